@@ -1,8 +1,24 @@
 package model
 
+import "time"
+
 type Child struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Metadata describes a stored secret. It is kept by the vault next to the secret, and never holds its value.
+type Metadata struct {
+	// Revision counts the writes of the secret, from 1 when it is stored. Conditional writes are checked against it.
+	Revision       int64             `json:"revision,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	CreatedBy      string            `json:"created_by,omitempty"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	UpdatedBy      string            `json:"updated_by,omitempty"`
+	LastAccessedAt *time.Time        `json:"last_accessed_at,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
 }
 
 type Tokenize struct {
@@ -37,6 +53,8 @@ type ChildResp struct {
 
 type All struct {
 	Tokens []*Tokenize `json:"tokens"`
+	// NextPageToken continues a paged listing, and is empty on its last page
+	NextPageToken string `json:"next_page_token,omitempty"`
 }
 
 type Resp interface {
@@ -47,3 +65,37 @@ type Response struct {
 	Code  int      `json:"code"`
 	Error []string `json:"error"`
 }
+
+type NamespaceRequest struct {
+	Name  string `json:"name"`
+	Quota int    `json:"quota"`
+}
+
+type NamespaceDeleted struct {
+	Name    string `json:"name"`
+	Deleted int    `json:"deleted"`
+}
+
+// Trashed describes a deleted secret kept in the trash
+type Trashed struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	// PurgeAt is when the secret is due to be purged for good
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// Purged reports the number of secrets a purge deleted for good
+type Purged struct {
+	Purged int `json:"purged"`
+}
+
+// RaftJoinRequest asks the node it is sent to, to join the raft cluster a node at Address belongs to
+type RaftJoinRequest struct {
+	Address string `json:"address"`
+}
+
+// RaftRemoveRequest asks a raft cluster to remove the node NodeID
+type RaftRemoveRequest struct {
+	NodeID string `json:"node_id"`
+}
@@ -0,0 +1,230 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/snapshot"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/joho/godotenv"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrRestoreKeyringConflict = errors.New("destination already holds tokens generated with a different keyring. restore with replace to replace them")
+	ErrRestoreTampered        = errors.New("tokens were changed outside the vault. review them, and restore with accept tampered to accept them")
+)
+
+// RestoreOptions tunes a Restore
+type RestoreOptions struct {
+	// Replace replaces every record of the destination store with those of the snapshot in a single batch, so the store
+	// is never left empty or half restored, and replaces its keyring unconditionally
+	Replace bool
+	// AcceptTampered restores the records even when the snapshot, or the destination store they are merged into, was
+	// changed outside the vault. They are resealed as they are.
+	AcceptTampered bool
+}
+
+// RestoreReport summarizes a Restore
+type RestoreReport struct {
+	Manifest    snapshot.Manifest `json:"manifest"`
+	Restored    int               `json:"restored"`
+	Overwritten int               `json:"overwritten"`
+	// Verified are the reports of verifying the keyspaces of the snapshot before they were restored. Keyspaces the
+	// snapshot holds unsealed, as those backed up before the vault kept MACs, are sealed as they are.
+	Verified []*VerifyReport `json:"verified"`
+}
+
+// Backup writes an encrypted snapshot of every record in the store and of the keyring to w. source describes the
+// store in the snapshot manifest.
+func (m *Manager) Backup(ctx context.Context, w io.Writer, keyer snapshot.Keyer, source string) (*snapshot.Manifest, error) {
+	log := m.log.Logger()
+	if len(m.namespace) > 0 {
+		return nil, ErrNamespaceScoped
+	}
+
+	records, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		log.Error().Msgf("error while reading records to back up: %s\n", err.Error())
+		return nil, fmt.Errorf("error while reading records to back up: %w", err)
+	}
+
+	snap := snapshot.New(source, records, nil, m.keyring())
+	if err = snapshot.Write(w, snap, keyer); err != nil {
+		log.Error().Msgf("error while writing snapshot: %s\n", err.Error())
+		return nil, err
+	}
+
+	log.Info().Msgf("backed up %d records", len(records))
+	return &snap.Manifest, nil
+}
+
+// Restore reads the encrypted snapshot in r and restores its records and keyring into the store of the manager,
+// whatever the backend type of the store the snapshot was taken from. The snapshot is verified first, and so is the
+// destination unless it is replaced, as the restored records are resealed: a restore fails with ErrRestoreTampered
+// rather than accept tokens changed outside the vault, unless opts accept them.
+func (m *Manager) Restore(ctx context.Context, r io.Reader, keyer snapshot.Keyer, opts RestoreOptions) (*RestoreReport, error) {
+	log := m.log.Logger()
+	if len(m.namespace) > 0 {
+		return nil, ErrNamespaceScoped
+	}
+
+	snap, err := snapshot.Read(r, keyer)
+	if err != nil {
+		log.Error().Msgf("error while reading snapshot: %s\n", err.Error())
+		return nil, err
+	}
+
+	// writes wait for the restore, so none is made with the keyring it replaces, or lost among the records it replaces
+	m.restoring.Lock()
+	defer m.restoring.Unlock()
+
+	if !opts.Replace && !reflect.DeepEqual(m.keyring(), snap.Keyring) {
+		if existing, _ := m.store.RetrieveAll(ctx); len(existing) > 0 {
+			return nil, ErrRestoreKeyringConflict
+		}
+	}
+
+	// stage records in memory, and let Migrate copy and verify them, or replace the records of the store with them
+	staged := store.NewSyncMap(ctx, m.log)
+	for _, records := range []map[string]string{snap.Records, snap.Metadata} {
+		for k, v := range records {
+			if err = staged.Store(ctx, k, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	verified, err := m.verifyRestore(ctx, staged, snap.Keyring, opts)
+	if err != nil {
+		log.Error().Msgf("error while verifying the records to restore: %s\n", err.Error())
+		return nil, err
+	}
+
+	var migrated *store.MigrateReport
+	if opts.Replace {
+		migrated, err = m.replaceRecords(ctx, staged)
+	} else {
+		migrated, err = store.Migrate(ctx, staged, m.store, store.MigrateOptions{Overwrite: true}, m.log)
+	}
+	if err != nil {
+		log.Error().Msgf("error while restoring records: %s\n", err.Error())
+		return nil, err
+	}
+
+	m.setKeyring(snap.Keyring)
+	if err = godotenv.Write(snap.Keyring, m.cipherLoc); err != nil {
+		log.Error().Msgf("error while writing restored keyring to %s: %s\n", m.cipherLoc, err.Error())
+		return nil, err
+	}
+
+	// the restored tokens were verified, and are adopted under the restored keyring
+	if err = m.Reseal(ctx); err != nil {
+		log.Error().Msgf("error while resealing restored records: %s\n", err.Error())
+		return nil, err
+	}
+
+	log.Info().Msgf("restored %d records", migrated.Records)
+	return &RestoreReport{
+		Manifest:    snap.Manifest,
+		Restored:    migrated.Copied,
+		Overwritten: migrated.Overwritten,
+		Verified:    verified,
+	}, nil
+}
+
+// verifyRestore verifies the records of the snapshot staged, under its keyring, and the records of the store of the
+// manager when the snapshot is merged into them. It fails with ErrRestoreTampered when either was changed outside the
+// vault, unless opts accept it, and returns the reports of the snapshot.
+func (m *Manager) verifyRestore(ctx context.Context, staged store.Store, keyring map[string]string, opts RestoreOptions) ([]*VerifyReport, error) {
+	// the snapshot is verified as a vault of its own, which mustn't share the locks, views or keyring of the manager
+	snap := &Manager{
+		store:     staged,
+		metrics:   newOpMetrics(),
+		views:     &namespaceViews{views: map[string]*store.Prefixed{}},
+		restoring: &sync.RWMutex{},
+		seals:     &sealLocks{locks: map[string]*sync.Mutex{}},
+		log:       m.log,
+	}
+	snap.setKeyring(keyring)
+	reports, err := snap.Verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tampered []string
+	for _, report := range reports {
+		// keyspaces never sealed hold no integrity record, and their tokens can't but be reported as added
+		unsealed := !report.Sealed && report.RootValid && report.Detected == nil
+		if report.Tampered && !unsealed {
+			tampered = append(tampered, fmt.Sprintf("snapshot namespace %q", report.Namespace))
+		}
+	}
+
+	if !opts.Replace {
+		existing, err := m.Verify(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, report := range existing {
+			if report.Tampered {
+				tampered = append(tampered, fmt.Sprintf("destination namespace %q", report.Namespace))
+			}
+		}
+	}
+
+	if len(tampered) == 0 {
+		return reports, nil
+	}
+	if !opts.AcceptTampered {
+		return nil, fmt.Errorf("%w: %s", ErrRestoreTampered, strings.Join(tampered, ", "))
+	}
+	m.log.Logger().Warn().Msgf("restoring records changed outside the vault, as accepted: %s", strings.Join(tampered, ", "))
+	return reports, nil
+}
+
+// replaceRecords replaces every record of the store with the records of staged, in a single batch, and verifies the
+// store holds them alone afterwards
+func (m *Manager) replaceRecords(ctx context.Context, staged store.Store) (*store.MigrateReport, error) {
+	records, err := staged.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading destination store: %w", err)
+	}
+
+	report := &store.MigrateReport{Records: len(records), SourceChecksum: store.Checksum(records)}
+	var ops []store.Op
+	for k, v := range existing {
+		if _, ok := records[k]; !ok {
+			// the batch checks the records it deletes are still the ones read
+			ops = append(ops, store.Op{Type: store.OpCheck, Key: k, Value: v}, store.Op{Type: store.OpDelete, Key: k})
+		}
+	}
+	for k, v := range records {
+		if _, ok := existing[k]; ok {
+			report.Overwritten++
+		} else {
+			report.Copied++
+		}
+		ops = append(ops, store.Op{Type: store.OpPatch, Key: k, Value: v})
+	}
+	if err = store.Batch(ctx, m.store, ops); err != nil {
+		return report, fmt.Errorf("error while replacing the records of the destination store: %w", err)
+	}
+
+	written, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		return report, fmt.Errorf("error while reading destination store: %w", err)
+	}
+	report.DestinationChecksum = store.Checksum(written)
+	if report.DestinationChecksum != report.SourceChecksum {
+		return report, fmt.Errorf("%w: checksum mismatch: source %s, destination %s", store.ErrMigrateVerification, report.SourceChecksum, report.DestinationChecksum)
+	}
+	report.Verified = true
+	return report, nil
+}
@@ -0,0 +1,199 @@
+package tokenize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/snapshot"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type BackupTestSuite struct {
+	suite.Suite
+	log *vlog.Logger
+}
+
+func (suite *BackupTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+}
+
+// manager creates a manager over a store of its own, with a keyring of its own
+func (suite *BackupTestSuite) manager(ctx context.Context) *Manager {
+	return NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+func (suite *BackupTestSuite) TestReplace() {
+	ctx := context.Background()
+	source := suite.manager(ctx)
+	tokens := map[string]string{}
+	for _, key := range []string{"app/db/password", "app/db/user"} {
+		token, err := source.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		tokens[key] = token
+	}
+	var buf bytes.Buffer
+	_, err := source.Backup(ctx, &buf, snapshot.Passphrase("correct horse"), "map")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// the destination holds a key the snapshot doesn't, and one it does, under another keyring
+	dest := suite.manager(ctx)
+	_, err = dest.Tokenize(ctx, "app/db/password", "Z9Y8X7W6V5U4T3S2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = dest.Tokenize(ctx, "app/cache/password", "Z9Y8X7W6V5U4T3S2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	_, err = dest.Restore(ctx, bytes.NewReader(buf.Bytes()), snapshot.Passphrase("correct horse"), RestoreOptions{})
+	suite.Require().ErrorIs(err, ErrRestoreKeyringConflict)
+
+	report, err := dest.Restore(ctx, bytes.NewReader(buf.Bytes()), snapshot.Passphrase("correct horse"), RestoreOptions{Replace: true})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Positive(report.Overwritten, "expected the records of app/db/password to be overwritten")
+
+	all, err := dest.GetAllTokens(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	restored := map[string]string{}
+	for _, parent := range all {
+		for _, child := range parent.Data {
+			restored[parent.ID+KeyDelimiter+child.Key] = child.Value
+		}
+	}
+	suite.Require().Equal(tokens, restored, "expected the destination to hold the secrets of the snapshot alone")
+	for key, token := range tokens {
+		ok, val, err := dest.Detokenize(ctx, key, token)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().True(ok, "expected the restored keyring to detokenize %s", key)
+		suite.Require().Equal("A1B2C3D4E5F6G7H8", val)
+	}
+
+	reports, err := dest.Verify(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	for _, report := range reports {
+		suite.Require().False(report.Tampered, "expected the restored records to verify")
+	}
+}
+
+func (suite *BackupTestSuite) TestVerifiedRestore() {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// tamper changes the store of the source outside the vault before it is backed up
+		tamper func(s *store.Map)
+		opts   RestoreOptions
+		err    error
+	}{
+		{"untampered snapshot", func(s *store.Map) {}, RestoreOptions{Replace: true}, nil},
+		{"snapshot with a token stored outside the vault", func(s *store.Map) {
+			suite.Require().NoError(s.Store(ctx, "app/db/host", "649sx8C30ubzd0cu"))
+		}, RestoreOptions{Replace: true}, ErrRestoreTampered},
+		{"snapshot with a tampered root", func(s *store.Map) {
+			_, err := s.Delete(ctx, integrityRootKey)
+			suite.Require().NoError(err)
+		}, RestoreOptions{Replace: true}, ErrRestoreTampered},
+		{"tampered snapshot accepted", func(s *store.Map) {
+			suite.Require().NoError(s.Store(ctx, "app/db/host", "649sx8C30ubzd0cu"))
+		}, RestoreOptions{Replace: true, AcceptTampered: true}, nil},
+		{"snapshot backed up before the vault kept MACs", func(s *store.Map) {
+			records, err := s.RetrieveAll(ctx)
+			suite.Require().NoError(err)
+			for key := range records {
+				if store.IsReserved(key) {
+					_, err := s.Delete(ctx, key)
+					suite.Require().NoError(err)
+				}
+			}
+		}, RestoreOptions{Replace: true}, nil},
+	}
+	for _, tt := range tests {
+		s := store.NewSyncMap(ctx, suite.log)
+		source := NewManager(ctx, suite.log, WithStore(s), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+		_, err := source.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		tt.tamper(s)
+		var buf bytes.Buffer
+		_, err = source.Backup(ctx, &buf, snapshot.Passphrase("correct horse"), "map")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+		dest := suite.manager(ctx)
+		report, err := dest.Restore(ctx, bytes.NewReader(buf.Bytes()), snapshot.Passphrase("correct horse"), tt.opts)
+		if tt.err != nil {
+			suite.Require().ErrorIsf(err, tt.err, "%s: expected the restore to fail\n", tt.name)
+			_, err = dest.store.Retrieve(ctx, "app/db/password")
+			suite.Require().ErrorIsf(err, store.ErrNotFound, "%s: expected nothing to be restored\n", tt.name)
+			continue
+		}
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		suite.Require().NotEmptyf(report.Verified, "%s: expected the snapshot to be verified\n", tt.name)
+		reports, err := dest.Verify(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Falsef(reports[0].Tampered, "%s: expected the restored records to be sealed\n", tt.name)
+	}
+
+	// records merged into a tampered destination would be resealed along with it
+	cipherLoc := filepath.Join(suite.T().TempDir(), ".cipher")
+	source := NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(cipherLoc))
+	_, err := source.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	var buf bytes.Buffer
+	_, err = source.Backup(ctx, &buf, snapshot.Passphrase("correct horse"), "map")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	dest := NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(cipherLoc))
+	suite.Require().NoError(dest.store.Store(ctx, "app/db/host", "649sx8C30ubzd0cu"))
+	_, err = dest.Restore(ctx, bytes.NewReader(buf.Bytes()), snapshot.Passphrase("correct horse"), RestoreOptions{})
+	suite.Require().ErrorIs(err, ErrRestoreTampered)
+}
+
+func (suite *BackupTestSuite) TestConcurrentRestore() {
+	ctx := context.Background()
+	source := suite.manager(ctx)
+	_, err := source.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	var buf bytes.Buffer
+	_, err = source.Backup(ctx, &buf, snapshot.Passphrase("correct horse"), "map")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// tokens are written under the keyring of the destination while the restore replaces it
+	dest := suite.manager(ctx)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+					dest.Tokenize(ctx, fmt.Sprintf("app/cache/key%d-%d", i, n), "Z9Y8X7W6V5U4T3S2")
+				}
+			}
+		}()
+	}
+	_, err = dest.Restore(ctx, bytes.NewReader(buf.Bytes()), snapshot.Passphrase("correct horse"), RestoreOptions{Replace: true})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	close(done)
+	wg.Wait()
+
+	// every token stored, before or after the restore, is one of the keyring in use
+	all, err := dest.GetAllTokens(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	for _, parent := range all {
+		for _, child := range parent.Data {
+			key := parent.ID + KeyDelimiter + child.Key
+			ok, _, err := dest.Detokenize(ctx, key, child.Value)
+			suite.Require().NoErrorf(err, "expected %s to detokenize, but got this %v\n", key, err)
+			suite.Require().True(ok)
+		}
+	}
+}
+
+// TestBackupSuite tests the backup and restore of the manager
+func TestBackupSuite(t *testing.T) {
+	suite.Run(t, new(BackupTestSuite))
+}
@@ -0,0 +1,334 @@
+package tokenize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"time"
+)
+
+// DefaultConflictRetries is how many times a write is rebuilt and applied again when a record it was built from is
+// changed by another writer before it is applied
+const DefaultConflictRetries = 3
+
+var (
+	ErrRevisionMismatch = errors.New("secret is not at the expected revision")
+)
+
+// BatchOptions tunes the multi-key writes of the manager. By default, a multi-key write is atomic: every key is
+// written, or none is.
+type BatchOptions struct {
+	// Partial writes every key it can instead, and reports the failures per key. The secret and the metadata of each
+	// key are still written together.
+	Partial bool
+	// IfRevision, if not nil, makes the patches and deletes of keys conditional on their secrets being at that
+	// revision. The write of a key at another revision fails with ErrRevisionMismatch. Secrets stored before revisions
+	// were kept are at revision 0.
+	IfRevision *int64
+}
+
+// KeyValue is a key of a multi-key write, with its value
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// BatchResult is the outcome of the write of one key of a multi-key write
+type BatchResult struct {
+	Key string
+	// Token is the token stored under Key, if any
+	Token string
+	// Revision is the revision of the secret written, if any
+	Revision int64
+	Err      error
+}
+
+// KeyError is the failure of a key of a multi-key write
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("error with key %s: %s", e.Key, e.Err.Error())
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// keyWrite holds the store ops writing a key of a multi-key write, or the error that kept them from being made. The
+// ops check that the records the write was built from are unchanged when they are applied.
+type keyWrite struct {
+	key      string
+	token    string
+	revision int64
+	ops      []store.Op
+	err      error
+}
+
+// TokenizeMany tokenizes the values of kvs and stores the tokens under their keys, with their metadata
+func (m *Manager) TokenizeMany(ctx context.Context, kvs []KeyValue, opts BatchOptions) ([]*BatchResult, error) {
+	builds := make([]func() *keyWrite, 0, len(kvs))
+	for _, kv := range kvs {
+		kv := kv
+		builds = append(builds, func() *keyWrite { return m.tokenizeWrite(ctx, kv.Key, kv.Value) })
+	}
+	return m.writeMany(ctx, builds, opts)
+}
+
+// PatchMany replaces the tokens stored under the keys of kvs with the tokens of their values
+func (m *Manager) PatchMany(ctx context.Context, kvs []KeyValue, opts BatchOptions) ([]*BatchResult, error) {
+	builds := make([]func() *keyWrite, 0, len(kvs))
+	for _, kv := range kvs {
+		kv := kv
+		builds = append(builds, func() *keyWrite { return m.patchWrite(ctx, kv.Key, kv.Value, opts.IfRevision) })
+	}
+	return m.writeMany(ctx, builds, opts)
+}
+
+// DeleteMany moves the tokens stored under keys to the trash, or deletes them for good if hard is set
+func (m *Manager) DeleteMany(ctx context.Context, keys []string, hard bool, opts BatchOptions) ([]*BatchResult, error) {
+	builds := make([]func() *keyWrite, 0, len(keys))
+	for _, key := range keys {
+		key := key
+		builds = append(builds, func() *keyWrite { return m.deleteWrite(ctx, key, hard, opts.IfRevision) })
+	}
+	return m.writeMany(ctx, builds, opts)
+}
+
+// writeMany builds the writes of the keys and applies them as a single store batch, or each as its own batch in
+// partial mode
+func (m *Manager) writeMany(ctx context.Context, builds []func() *keyWrite, opts BatchOptions) (_ []*BatchResult, err error) {
+	defer m.metrics.observe(OpBatch, time.Now(), &err)
+	log := m.log.Logger()
+
+	results := make([]*BatchResult, 0, len(builds))
+	if opts.Partial {
+		for _, build := range builds {
+			w, err := m.applyWrite(ctx, build)
+			result := &BatchResult{Key: w.key, Err: err}
+			if result.Err != nil {
+				log.Error().Msgf("error with key %s: %s\n", w.key, result.Err.Error())
+			} else {
+				result.Token, result.Revision = w.token, w.revision
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}
+
+	defer m.writing()()
+	for attempt := 0; ; attempt++ {
+		writes := make([]*keyWrite, 0, len(builds))
+		var ops []store.Op
+		// owners holds the index of the write of every op
+		var owners []int
+		for i, build := range builds {
+			w := build()
+			if w.err != nil {
+				return nil, &KeyError{Key: w.key, Err: w.err}
+			}
+			writes = append(writes, w)
+			ops = append(ops, w.ops...)
+			for range w.ops {
+				owners = append(owners, i)
+			}
+		}
+
+		err := m.batch(ctx, ops)
+		if errors.Is(err, store.ErrConflict) && attempt < DefaultConflictRetries {
+			log.Debug().Msgf("records of a batch of %d keys changed while it was built, retrying", len(writes))
+			continue
+		}
+		if err != nil {
+			log.Error().Msgf("error while writing a batch of %d keys, none was written: %s\n", len(writes), err.Error())
+			var be *store.BatchError
+			if errors.As(err, &be) && be.Index < len(owners) {
+				return nil, &KeyError{Key: writes[owners[be.Index]].key, Err: unwrapBatchError(err)}
+			}
+			return nil, err
+		}
+		for _, w := range writes {
+			results = append(results, &BatchResult{Key: w.key, Token: w.token, Revision: w.revision})
+		}
+		return results, nil
+	}
+}
+
+// applyWrite builds the write of a key, and applies it as a single store batch. It is rebuilt and applied again when
+// a record it was built from changed in the meantime.
+func (m *Manager) applyWrite(ctx context.Context, build func() *keyWrite) (*keyWrite, error) {
+	defer m.writing()()
+	for attempt := 0; ; attempt++ {
+		w := build()
+		if w.err != nil {
+			return w, w.err
+		}
+		err := m.batch(ctx, w.ops)
+		if errors.Is(err, store.ErrConflict) && attempt < DefaultConflictRetries {
+			m.log.Logger().Debug().Msgf("records of %s changed while its write was built, retrying", w.key)
+			continue
+		}
+		return w, unwrapBatchError(err)
+	}
+}
+
+// tokenizeWrite makes the ops storing the token of val under key, with new metadata
+func (m *Manager) tokenizeWrite(ctx context.Context, key, val string) *keyWrite {
+	w := &keyWrite{key: key}
+	if store.IsReserved(key) {
+		w.err = ErrKeyReserved
+		return w
+	}
+	token, err := Tokenize(val, m.keyring())
+	if err != nil {
+		m.log.Logger().Error().Msgf("error occurred while generating token: %s\n", err.Error())
+		w.err = err
+		return w
+	}
+	w.token = token.token
+	w.revision = 1
+
+	now := time.Now().UTC()
+	identity := m.identityFrom(ctx)
+	meta, err := m.metadataOp(key, &model.Metadata{Revision: w.revision, CreatedAt: now, CreatedBy: identity, UpdatedAt: now, UpdatedBy: identity})
+	if err != nil {
+		w.err = err
+		return w
+	}
+	w.ops = []store.Op{{Type: store.OpStore, Key: key, Value: w.token}, meta}
+	return w
+}
+
+// patchWrite makes the ops replacing the token stored under key with the token of val, and updating its metadata. The
+// key must hold a token already. If ifRevision is not nil, the secret must be at that revision.
+func (m *Manager) patchWrite(ctx context.Context, key, val string, ifRevision *int64) *keyWrite {
+	w := &keyWrite{key: key}
+	if store.IsReserved(key) {
+		w.err = ErrKeyReserved
+		return w
+	}
+	stored := m.storedKey(ctx, key)
+	current, err := m.store.Retrieve(ctx, stored)
+	if err != nil {
+		w.err = fmt.Errorf(ErrKeyDoesNotExists, key)
+		return w
+	}
+	token, err := Tokenize(val, m.keyring())
+	if err != nil {
+		m.log.Logger().Error().Msgf("error occurred while generating token: %s\n", err.Error())
+		w.err = err
+		return w
+	}
+	w.token = token.token
+
+	meta, raw, err := m.readMetadata(ctx, stored)
+	if err != nil || meta == nil {
+		meta = &model.Metadata{}
+	}
+	if err = checkRevision(key, meta, ifRevision); err != nil {
+		w.err = err
+		return w
+	}
+	meta.Revision++
+	meta.UpdatedAt = time.Now().UTC()
+	meta.UpdatedBy = m.identityFrom(ctx)
+	w.revision = meta.Revision
+	metaOp, err := m.metadataOp(stored, meta)
+	if err != nil {
+		w.err = err
+		return w
+	}
+	w.ops = []store.Op{
+		// the token patched and the metadata the revision is bumped from must still be there, as they were read
+		{Type: store.OpCheck, Key: stored, Value: current},
+		{Type: store.OpCheck, Key: metadataPrefix + stored, Value: raw},
+		{Type: store.OpPatch, Key: stored, Value: w.token},
+		metaOp,
+	}
+	return w
+}
+
+// deleteWrite makes the ops deleting the token stored under key with its metadata, keeping both in the trash unless
+// hard is set. If ifRevision is not nil, the secret must be at that revision.
+func (m *Manager) deleteWrite(ctx context.Context, key string, hard bool, ifRevision *int64) *keyWrite {
+	w := &keyWrite{key: key}
+	if store.IsReserved(key) {
+		w.err = ErrKeyReserved
+		return w
+	}
+	stored := m.storedKey(ctx, key)
+	token, err := m.store.Retrieve(ctx, stored)
+	if err != nil {
+		w.err = fmt.Errorf(ErrKeyDoesNotExists, key)
+		return w
+	}
+
+	meta, raw, err := m.readMetadata(ctx, stored)
+	if err != nil {
+		m.log.Logger().Error().Msgf("error while reading metadata of %s: %s\n", stored, err.Error())
+	}
+	if err = checkRevision(key, meta, ifRevision); err != nil {
+		w.err = err
+		return w
+	}
+
+	w.ops = []store.Op{
+		// the trash keeps the token and metadata read, so they must still be there
+		{Type: store.OpCheck, Key: stored, Value: token},
+		{Type: store.OpCheck, Key: metadataPrefix + stored, Value: raw},
+		{Type: store.OpDelete, Key: stored},
+		{Type: store.OpDelete, Key: metadataPrefix + stored},
+	}
+	if hard {
+		return w
+	}
+
+	record, err := json.Marshal(trashRecord{Token: token, DeletedAt: time.Now().UTC(), DeletedBy: m.identityFrom(ctx), Metadata: meta})
+	if err != nil {
+		w.err = err
+		return w
+	}
+	// an earlier deleted secret with the same key is replaced
+	w.ops = append([]store.Op{{Type: store.OpPatch, Key: trashPrefix + stored, Value: string(record)}}, w.ops...)
+	return w
+}
+
+// checkRevision checks that the secret stored under key, with meta as its metadata, is at ifRevision if it is not
+// nil. Secrets stored before revisions were kept are at revision 0.
+func checkRevision(key string, meta *model.Metadata, ifRevision *int64) error {
+	if ifRevision == nil {
+		return nil
+	}
+	var revision int64
+	if meta != nil {
+		revision = meta.Revision
+	}
+	if revision != *ifRevision {
+		return fmt.Errorf("%s is at revision %d, not %d: %w", key, revision, *ifRevision, ErrRevisionMismatch)
+	}
+	return nil
+}
+
+// metadataOp makes the op storing meta as the metadata record of the secret stored under key
+func (m *Manager) metadataOp(key string, meta *model.Metadata) (store.Op, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Type: store.OpPatch, Key: metadataPrefix + key, Value: string(b)}, nil
+}
+
+// unwrapBatchError returns the cause of the failure of a store batch, without the store op it failed on, which may be
+// a reserved record of the key. Failed rollbacks are returned whole.
+func unwrapBatchError(err error) error {
+	var be *store.BatchError
+	if errors.As(err, &be) && !errors.Is(err, store.ErrRollbackFailed) {
+		return be.Err
+	}
+	return err
+}
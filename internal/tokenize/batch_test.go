@@ -0,0 +1,165 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type BatchTestSuite struct {
+	suite.Suite
+	store   *store.Map
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *BatchTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.store = store.NewSyncMap(ctx, suite.log)
+	suite.manager = NewManager(ctx, suite.log, WithStore(suite.store), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+func (suite *BatchTestSuite) TestAtomicity() {
+	ctx := context.Background()
+	kvs := []KeyValue{
+		{"app/db/password", "A1B2C3D4E5F6G7H8"},
+		{store.ReservedPrefix + "db/user", "Z9Y8X7W6V5U4T3S2"},
+		{"app/cache/password", "Q1W2E3R4T5Y6U7I8"},
+	}
+	tests := []struct {
+		name    string
+		partial bool
+		// stored are the keys expected in the store afterwards
+		stored []string
+	}{
+		{"atomic batch with a failing key writes none", false, nil},
+		{"partial batch writes every key it can", true, []string{"app/cache/password", "app/db/password"}},
+	}
+	for _, tt := range tests {
+		suite.SetupTest()
+		results, err := suite.manager.TokenizeMany(ctx, kvs, BatchOptions{Partial: tt.partial})
+		if tt.partial {
+			suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+			suite.Require().Len(results, len(kvs))
+			for i, result := range results {
+				if i == 1 {
+					suite.Require().Truef(errors.Is(result.Err, ErrKeyReserved), "%s: expected the reserved key to fail, but got %v\n", tt.name, result.Err)
+					continue
+				}
+				suite.Require().NoErrorf(result.Err, "%s: expected no errors, but got this %v\n", tt.name, result.Err)
+				suite.Require().Equal(int64(1), result.Revision)
+			}
+		} else {
+			var ke *KeyError
+			suite.Require().Truef(errors.As(err, &ke), "%s: expected a key error, but got %v\n", tt.name, err)
+			suite.Require().Equal(kvs[1].Key, ke.Key)
+		}
+
+		all, err := suite.manager.GetAllTokens(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		var stored []string
+		for _, parent := range all {
+			for _, child := range parent.Data {
+				stored = append(stored, parent.ID+KeyDelimiter+child.Key)
+			}
+		}
+		suite.Require().Equalf(tt.stored, stored, "%s: expected these keys to be stored\n", tt.name)
+	}
+
+	// patches of missing keys fail, and don't create them
+	_, err := suite.manager.PatchMany(ctx, []KeyValue{{"app/db/missing", "649sx8C30ubzd0cu"}}, BatchOptions{})
+	suite.Require().Error(err, "expected the patch of a missing key to fail")
+	_, err = suite.store.Retrieve(ctx, "app/db/missing")
+	suite.Require().Truef(errors.Is(err, store.ErrNotFound), "expected the missing key not to be created, but got %v\n", err)
+}
+
+func (suite *BatchTestSuite) TestRevisions() {
+	ctx := context.Background()
+	_, err := suite.manager.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	// a secret stored before metadata was kept is at revision 0
+	suite.Require().NoError(suite.store.Store(ctx, "legacy/db/password", "A1B2C3D4E5F6G7H8"))
+
+	revision := func(r int64) *int64 { return &r }
+	tests := []struct {
+		name     string
+		key      string
+		write    func(key string) error
+		revision int64
+		err      error
+	}{
+		{"unconditional patch", "app/db/password", func(key string) error {
+			_, err := suite.manager.PatchTokenByID(ctx, key, "649sx8C30ubzd0cu")
+			return err
+		}, 2, nil},
+		{"conditional patch at the revision", "app/db/password", func(key string) error {
+			_, err := suite.manager.PatchMany(ctx, []KeyValue{{key, "TN4IFzbjuJfwuOIW"}}, BatchOptions{IfRevision: revision(2)})
+			return err
+		}, 3, nil},
+		{"conditional patch at another revision", "app/db/password", func(key string) error {
+			_, err := suite.manager.PatchMany(ctx, []KeyValue{{key, "a1otXUTJnt4gzOLL"}}, BatchOptions{IfRevision: revision(2)})
+			return err
+		}, 3, ErrRevisionMismatch},
+		{"conditional delete at another revision", "app/db/password", func(key string) error {
+			_, err := suite.manager.DeleteMany(ctx, []string{key}, false, BatchOptions{IfRevision: revision(1)})
+			return err
+		}, 3, ErrRevisionMismatch},
+		{"conditional patch of a legacy secret at revision 0", "legacy/db/password", func(key string) error {
+			_, err := suite.manager.PatchMany(ctx, []KeyValue{{key, "df8opIzQPrpRn9sM"}}, BatchOptions{IfRevision: revision(0)})
+			return err
+		}, 1, nil},
+	}
+	for _, tt := range tests {
+		err := tt.write(tt.key)
+		if tt.err != nil {
+			suite.Require().Truef(errors.Is(err, tt.err), "%s: expected %v, but got %v\n", tt.name, tt.err, err)
+		} else {
+			suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		}
+		meta, err := suite.manager.GetMetadata(ctx, tt.key)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equalf(tt.revision, meta.Revision, "%s: expected revision %d\n", tt.name, tt.revision)
+	}
+}
+
+func (suite *BatchTestSuite) TestConcurrentTokenize() {
+	ctx := context.Background()
+	// every tokenize of the same key validates it is absent, but only one may store it
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := suite.manager.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, ErrKeyAlreadyExists) && !errors.Is(err, store.ErrKeyExists):
+			suite.Failf("unexpected error", "expected the key to exist, but got %v\n", err)
+		}
+	}
+	suite.Require().Equal(1, stored, "expected a single tokenize to store the key")
+	meta, err := suite.manager.GetMetadata(ctx, "app/db/password")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(int64(1), meta.Revision)
+}
+
+// TestBatchSuite tests the batch writes of the manager
+func TestBatchSuite(t *testing.T) {
+	suite.Run(t, new(BatchTestSuite))
+}
@@ -0,0 +1,583 @@
+package tokenize
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSealRetries is how many times the seal of a write is rebuilt and applied again when another write was sealed
+// in the meantime
+const DefaultSealRetries = 10
+
+var (
+	// integrityPrefix starts the store keys of the records tampering with tokens is detected with
+	integrityPrefix = store.ReservedPrefix + "integrity/"
+	// integrityNodePrefix starts the keys of the nodes of the Merkle tree of the tokens, followed by their index
+	integrityNodePrefix = integrityPrefix + "node/"
+	// integrityRootKey is the key of the signed root of the tree
+	integrityRootKey = integrityPrefix + "root"
+	// integrityTamperKey is the key of the tampering detected by a write, kept until the keyspace is resealed
+	integrityTamperKey = integrityPrefix + "tampered"
+)
+
+var (
+	errIntegrityTampered = errors.New("integrity records were changed outside the vault")
+)
+
+// Tamper is the tampering a write of the vault detected in the integrity records of a keyspace. The write, and those
+// following it, are applied without being sealed, as the tree can't be updated without signing the tampered records
+// again. Verify reports them, and Reseal accepts them.
+type Tamper struct {
+	DetectedAt time.Time `json:"detected_at"`
+	Reason     string    `json:"reason"`
+}
+
+// integrityRoot is the signed root of the Merkle tree of the tokens of a keyspace. The leaves of the tree are the MACs
+// of the tokens, hung from one of 256 nodes by the first byte of the hash of their key. A node record holds the MACs of
+// its leaves by key, Nodes the hash of every node holding a leaf, and Digest the hash of Nodes, so a write rehashes
+// the nodes of the keys it writes and the root alone. Count is the number of leaves.
+type integrityRoot struct {
+	Digest    string            `json:"digest"`
+	Nodes     map[string]string `json:"nodes,omitempty"`
+	Count     int               `json:"count"`
+	SealedAt  time.Time         `json:"sealed_at"`
+	Signature string            `json:"signature"`
+}
+
+// VerifyReport is the outcome of checking the tokens of a keyspace against the MACs the vault keeps of them
+type VerifyReport struct {
+	// Namespace is the namespace checked, empty for the default one
+	Namespace string `json:"namespace,omitempty"`
+	// Sealed is false until the vault starts over the keyspace, writes to it, or it is resealed. The tokens of a
+	// keyspace that was never sealed are all reported as added.
+	Sealed   bool      `json:"sealed"`
+	SealedAt time.Time `json:"sealed_at,omitempty"`
+	// Checked is the number of tokens checked
+	Checked int `json:"checked"`
+	// Added are the keys of tokens without a MAC, stored outside the vault
+	Added []string `json:"added,omitempty"`
+	// Removed are the keys of MACs without a token, deleted outside the vault
+	Removed []string `json:"removed,omitempty"`
+	// Modified are the keys of tokens not matching their MAC, changed outside the vault
+	Modified []string `json:"modified,omitempty"`
+	// RootValid is false when the signed root doesn't match the nodes of the tree, as when a token is deleted with its
+	// MAC, or replaced with an older version of itself and its MAC. The keys involved can't be told then. Writes lost by
+	// a store applying batches op by op show the same way, see Manager.batch.
+	RootValid bool `json:"root_valid"`
+	// Detected is the tampering a write of the vault detected since the keyspace was last sealed, if any
+	Detected *Tamper `json:"detected,omitempty"`
+	// Tampered is set when the keyspace was changed outside the vault
+	Tampered bool `json:"tampered"`
+}
+
+// Verify checks every token against the MAC the vault keeps of it, and the MACs against their signed root. The root
+// manager checks the default keyspace and then every namespace, a namespaced manager its own namespace.
+func (m *Manager) Verify(ctx context.Context) ([]*VerifyReport, error) {
+	var reports []*VerifyReport
+	err := m.eachKeyspace(ctx, func(ks *Manager) error {
+		report, err := ks.verify(ctx)
+		if err != nil {
+			return err
+		}
+		report.Tampered = len(report.Added) > 0 || len(report.Removed) > 0 || len(report.Modified) > 0 || !report.RootValid ||
+			report.Detected != nil
+		reports = append(reports, report)
+		return nil
+	})
+	return reports, err
+}
+
+// Reseal accepts the tokens as they are stored: their MACs are computed again, and the root signed again. It adopts
+// tokens stored before the vault kept MACs, or changed outside of it and reviewed since, and clears the tampering
+// detected by writes. It covers the same
+// keyspaces as Verify.
+func (m *Manager) Reseal(ctx context.Context) error {
+	return m.eachKeyspace(ctx, func(ks *Manager) error {
+		return ks.reseal(ctx)
+	})
+}
+
+// sealUnsealed seals the keyspaces holding no integrity record at all, as those written before the vault kept them.
+// Their tokens are accepted as they are stored, as they would be by Reseal. A keyspace whose integrity records were
+// all deleted can't be told from one never sealed, and is sealed again as well.
+func (m *Manager) sealUnsealed(ctx context.Context) error {
+	return m.eachKeyspace(ctx, func(ks *Manager) error {
+		page, err := store.Scan(ctx, ks.store, store.ScanOptions{Prefix: integrityPrefix, Limit: 1})
+		if err != nil || len(page.Records) > 0 {
+			return err
+		}
+		ks.log.Logger().Info().Msgf("sealing the tokens of namespace %q, stored before the vault kept their MACs", ks.namespace)
+		return ks.reseal(ctx)
+	})
+}
+
+// eachKeyspace runs fn with m, and with a manager of every namespace if m is the root manager
+func (m *Manager) eachKeyspace(ctx context.Context, fn func(ks *Manager) error) error {
+	if err := fn(m); err != nil {
+		return err
+	}
+	if len(m.namespace) > 0 {
+		return nil
+	}
+	namespaces, err := m.ListNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		scoped, err := m.InNamespace(ctx, ns.Name)
+		if err != nil {
+			return err
+		}
+		if err = fn(scoped); err != nil {
+			return fmt.Errorf("namespace %s: %w", ns.Name, err)
+		}
+	}
+	return nil
+}
+
+// batch applies ops to the store as a single batch, sealing the tokens they write: their MACs, the nodes of the tree
+// holding them and the signed root are updated in the same batch. Every sealed write of a keyspace updates its root:
+// writes are serialized within the process, and the seal of a write is rebuilt when another process sealed one in the
+// meantime. That check is only as atomic as the batches of the store. Stores applying them op by op, like stores that
+// aren't Batchers, or sharded stores when a batch spans shards, can lose the writes of another process racing with
+// the check: its root is then left validly signed over nodes that no longer match it, which verify reports as a root
+// that isn't valid. Vaults written by several processes should keep such stores behind a single one.
+func (m *Manager) batch(ctx context.Context, ops []store.Op) error {
+	if len(tokenOps(ops)) == 0 {
+		return store.Batch(ctx, m.store, ops)
+	}
+	defer m.seals.lock(m.namespace)()
+	for attempt := 0; ; attempt++ {
+		seal, err := m.sealOps(ctx, ops)
+		if err != nil {
+			return err
+		}
+		err = store.Batch(ctx, m.store, append(ops[:len(ops):len(ops)], seal...))
+		// the seal starts with the check of the root it was built from
+		var be *store.BatchError
+		if errors.As(err, &be) && be.Index == len(ops) && errors.Is(err, store.ErrConflict) && attempt < DefaultSealRetries {
+			m.log.Logger().Debug().Msgf("integrity root changed while a write was sealed, retrying")
+			continue
+		}
+		return err
+	}
+}
+
+// sealOps makes the ops updating the MACs of the tokens ops write, the nodes holding them, and the signed root,
+// checking first that the root is still the one they were computed from. When the root or the nodes were tampered
+// with, the tampering is recorded instead, and the tokens are written without being sealed.
+func (m *Manager) sealOps(ctx context.Context, ops []store.Op) ([]store.Op, error) {
+	sealed := tokenOps(ops)
+	if len(sealed) == 0 {
+		return nil, nil
+	}
+	secret, err := m.integrityKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// leaves holds the MAC of every token written by node, as of the ops applied so far. Deleted tokens have none.
+	leaves := map[string]map[string]string{}
+	for _, op := range sealed {
+		idx := nodeOf(op.Key)
+		if leaves[idx] == nil {
+			leaves[idx] = map[string]string{}
+		}
+		leaves[idx][op.Key] = ""
+		if op.Type != store.OpDelete {
+			leaves[idx][op.Key] = hex.EncodeToString(tokenMAC(secret, op.Key, op.Value))
+		}
+	}
+
+	root, raw, err := m.readRoot(ctx, secret)
+	if errors.Is(err, errIntegrityTampered) {
+		return m.tamperOps(ctx, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seal := []store.Op{{Type: store.OpCheck, Key: integrityRootKey, Value: raw}}
+	for _, idx := range sortedNodes(leaves) {
+		node, err := m.readNode(ctx, idx)
+		if err == nil && nodeHash(node) != root.Nodes[idx] {
+			err = fmt.Errorf("%w: node %s doesn't match the root", errIntegrityTampered, idx)
+		}
+		if errors.Is(err, errIntegrityTampered) {
+			return m.tamperOps(ctx, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		existed := len(node) > 0
+		for key, mac := range leaves[idx] {
+			if _, ok := node[key]; ok {
+				root.Count--
+			}
+			delete(node, key)
+			if len(mac) > 0 {
+				node[key] = mac
+				root.Count++
+			}
+		}
+
+		if len(node) == 0 {
+			delete(root.Nodes, idx)
+			if existed {
+				seal = append(seal, store.Op{Type: store.OpDelete, Key: integrityNodePrefix + idx})
+			}
+			continue
+		}
+		b, err := json.Marshal(node)
+		if err != nil {
+			return nil, err
+		}
+		root.Nodes[idx] = nodeHash(node)
+		seal = append(seal, store.Op{Type: store.OpPatch, Key: integrityNodePrefix + idx, Value: string(b)})
+	}
+
+	rootOp, err := signRoot(secret, root)
+	if err != nil {
+		return nil, err
+	}
+	return append(seal, rootOp), nil
+}
+
+// reseal computes the MACs of every token of the keyspace again, rebuilds the tree from them, dropping any other
+// integrity record, and signs its root again, all in a single batch
+func (m *Manager) reseal(ctx context.Context) error {
+	secret, err := m.integrityKey()
+	if err != nil {
+		return err
+	}
+	defer m.seals.lock(m.namespace)()
+
+	for attempt := 0; ; attempt++ {
+		records, err := m.store.RetrieveAll(ctx)
+		if err != nil {
+			return err
+		}
+		nodes := map[string]map[string]string{}
+		for key, token := range records {
+			if store.IsReserved(key) {
+				continue
+			}
+			idx := nodeOf(key)
+			if nodes[idx] == nil {
+				nodes[idx] = map[string]string{}
+			}
+			nodes[idx][key] = hex.EncodeToString(tokenMAC(secret, key, token))
+		}
+
+		root := &integrityRoot{Nodes: map[string]string{}}
+		ops := []store.Op{{Type: store.OpCheck, Key: integrityRootKey, Value: records[integrityRootKey]}}
+		for _, key := range sortedKeys(records) {
+			idx, isNode := strings.CutPrefix(key, integrityNodePrefix)
+			if strings.HasPrefix(key, integrityPrefix) && key != integrityRootKey && (!isNode || nodes[idx] == nil) {
+				ops = append(ops, store.Op{Type: store.OpDelete, Key: key})
+			}
+		}
+		for _, idx := range sortedNodes(nodes) {
+			b, err := json.Marshal(nodes[idx])
+			if err != nil {
+				return err
+			}
+			root.Nodes[idx] = nodeHash(nodes[idx])
+			root.Count += len(nodes[idx])
+			ops = append(ops, store.Op{Type: store.OpPatch, Key: integrityNodePrefix + idx, Value: string(b)})
+		}
+		rootOp, err := signRoot(secret, root)
+		if err != nil {
+			return err
+		}
+
+		err = store.Batch(ctx, m.store, append(ops, rootOp))
+		if errors.Is(err, store.ErrConflict) && attempt < DefaultSealRetries {
+			continue
+		}
+		if err != nil {
+			return unwrapBatchError(err)
+		}
+		m.log.Logger().Info().Msgf("resealed %d tokens", root.Count)
+		return nil
+	}
+}
+
+// verify checks the tokens of the keyspace of the manager against their MACs, and the tree of the MACs against its
+// root
+func (m *Manager) verify(ctx context.Context) (*VerifyReport, error) {
+	secret, err := m.integrityKey()
+	if err != nil {
+		return nil, err
+	}
+	records, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := verifyRecords(secret, records)
+	report.Namespace = m.namespace
+	return report, nil
+}
+
+// verifyRecords checks the tokens of records against their MACs, and the tree of the MACs against its root, with the
+// integrity key secret
+func verifyRecords(secret []byte, records map[string]string) *VerifyReport {
+	report := &VerifyReport{}
+	// nodesValid is false when a node can't be read, or holds the leaf of a key hashing to another node
+	nodesValid := true
+	nodes := map[string]map[string]string{}
+	leaves := map[string]string{}
+	for key, val := range records {
+		idx, ok := strings.CutPrefix(key, integrityNodePrefix)
+		if !ok {
+			continue
+		}
+		var node map[string]string
+		if err := json.Unmarshal([]byte(val), &node); err != nil {
+			nodesValid = false
+			continue
+		}
+		nodes[idx] = node
+		for k, mac := range node {
+			leaves[k] = mac
+			nodesValid = nodesValid && nodeOf(k) == idx
+		}
+	}
+
+	for _, key := range sortedKeys(records) {
+		if store.IsReserved(key) {
+			continue
+		}
+		report.Checked++
+		mac, ok := leaves[key]
+		if !ok {
+			report.Added = append(report.Added, key)
+			continue
+		}
+		if !hmac.Equal([]byte(mac), []byte(hex.EncodeToString(tokenMAC(secret, key, records[key])))) {
+			report.Modified = append(report.Modified, key)
+		}
+	}
+	for _, key := range sortedKeys(leaves) {
+		if _, exists := records[key]; !exists || store.IsReserved(key) {
+			report.Removed = append(report.Removed, key)
+		}
+	}
+
+	if raw, ok := records[integrityTamperKey]; ok {
+		report.Detected = parseTamper(raw)
+	}
+
+	raw, ok := records[integrityRootKey]
+	if !ok {
+		// nodes without a root mean the root was deleted
+		report.RootValid = nodesValid && len(nodes) == 0
+		return report
+	}
+	var root integrityRoot
+	if err := json.Unmarshal([]byte(raw), &root); err != nil {
+		return report
+	}
+	report.Sealed, report.SealedAt = true, root.SealedAt
+	report.RootValid = nodesValid && validRoot(secret, &root) && root.Count == len(leaves) && len(root.Nodes) == len(nodes)
+	for idx, node := range nodes {
+		report.RootValid = report.RootValid && root.Nodes[idx] == nodeHash(node)
+	}
+	return report
+}
+
+// readRoot reads the root of the keyspace of the manager, and the raw record it was read from. A keyspace never sealed
+// has an empty root. A root that isn't valid isn't signed again.
+func (m *Manager) readRoot(ctx context.Context, secret []byte) (*integrityRoot, string, error) {
+	root := &integrityRoot{}
+	raw, err := m.store.Retrieve(ctx, integrityRootKey)
+	if errors.Is(err, store.ErrNotFound) {
+		root.Nodes = map[string]string{}
+		return root, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err = json.Unmarshal([]byte(raw), root); err != nil || !validRoot(secret, root) {
+		return nil, "", fmt.Errorf("%w: the signature of the root doesn't match", errIntegrityTampered)
+	}
+	if root.Nodes == nil {
+		root.Nodes = map[string]string{}
+	}
+	return root, raw, nil
+}
+
+// readNode reads the leaves of the node of the tree at idx, by key. Nodes without leaves aren't stored.
+func (m *Manager) readNode(ctx context.Context, idx string) (map[string]string, error) {
+	node := map[string]string{}
+	raw, err := m.store.Retrieve(ctx, integrityNodePrefix+idx)
+	if errors.Is(err, store.ErrNotFound) {
+		return node, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(raw), &node); err != nil {
+		return nil, fmt.Errorf("%w: node %s can't be read", errIntegrityTampered, idx)
+	}
+	return node, nil
+}
+
+// tamperOps makes the op recording the tampering detected, unless one was recorded since the keyspace was last sealed.
+// Tampered records aren't signed again, so writes go on without being sealed rather than failing.
+func (m *Manager) tamperOps(ctx context.Context, detected error) ([]store.Op, error) {
+	tamper, err := m.readTamper(ctx)
+	if err != nil || tamper != nil {
+		return nil, err
+	}
+	m.log.Logger().Error().Msgf("%s, writing without sealing until the vault is resealed", detected.Error())
+	b, err := json.Marshal(&Tamper{DetectedAt: time.Now().UTC(), Reason: detected.Error()})
+	if err != nil {
+		return nil, err
+	}
+	return []store.Op{{Type: store.OpPatch, Key: integrityTamperKey, Value: string(b)}}, nil
+}
+
+// readTamper reads the tampering recorded in the keyspace of the manager, nil if there is none
+func (m *Manager) readTamper(ctx context.Context) (*Tamper, error) {
+	raw, err := m.store.Retrieve(ctx, integrityTamperKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTamper(raw), nil
+}
+
+// parseTamper parses the tampering recorded as raw. A record that can't be read is tampering of its own.
+func parseTamper(raw string) *Tamper {
+	tamper := &Tamper{}
+	if err := json.Unmarshal([]byte(raw), tamper); err != nil {
+		return &Tamper{Reason: fmt.Sprintf("%s: the record of the tampering detected can't be read", errIntegrityTampered)}
+	}
+	return tamper
+}
+
+// sealLocks serializes the sealed writes of each keyspace made by the managers of a vault, so they don't race for
+// its root within the process
+type sealLocks struct {
+	locks map[string]*sync.Mutex
+	sync.Mutex
+}
+
+// lock locks the keyspace of namespace, and returns the func unlocking it
+func (sl *sealLocks) lock(namespace string) func() {
+	sl.Lock()
+	l, ok := sl.locks[namespace]
+	if !ok {
+		l = &sync.Mutex{}
+		sl.locks[namespace] = l
+	}
+	sl.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// tokenOps returns the ops writing tokens, which are sealed
+func tokenOps(ops []store.Op) []store.Op {
+	var sealed []store.Op
+	for _, op := range ops {
+		if !store.IsReserved(op.Key) && op.Type != store.OpCheck {
+			sealed = append(sealed, op)
+		}
+	}
+	return sealed
+}
+
+// nodeOf returns the index of the node of the tree the MAC of the token stored under key hangs from
+func nodeOf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:1])
+}
+
+// nodeHash returns the hash of the node holding leaves, or "" for a node without leaves
+func nodeHash(leaves map[string]string) string {
+	if len(leaves) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte("vault/integrity/node\x00"))
+	for _, key := range sortedKeys(leaves) {
+		fmt.Fprintf(h, "%s\x00%s\x00", key, leaves[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// treeDigest returns the hash of the nodes of a tree, by index
+func treeDigest(nodes map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte("vault/integrity/tree\x00"))
+	for _, idx := range sortedKeys(nodes) {
+		fmt.Fprintf(h, "%s\x00%s\x00", idx, nodes[idx])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sortedNodes returns the indexes of nodes, sorted
+func sortedNodes(nodes map[string]map[string]string) []string {
+	idxs := make([]string, 0, len(nodes))
+	for idx := range nodes {
+		idxs = append(idxs, idx)
+	}
+	sort.Strings(idxs)
+	return idxs
+}
+
+// integrityKey derives the key tokens are MACed and the root is signed with from the cipher of the manager, so each
+// namespace has its own
+func (m *Manager) integrityKey() ([]byte, error) {
+	keyring := m.keyring()
+	if len(keyring[EnvKeyAESCipher]) == 0 {
+		return nil, ErrCipherToken404AES
+	}
+	mac := hmac.New(sha256.New, []byte(keyring[EnvKeyAESCipher]+keyring[EnvKeyInitializationVector]))
+	mac.Write([]byte("vault/integrity"))
+	return mac.Sum(nil), nil
+}
+
+// tokenMAC returns the MAC of the token stored under key
+func tokenMAC(secret []byte, key, token string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "vault/integrity/leaf\x00%s\x00%s", key, token)
+	return mac.Sum(nil)
+}
+
+// rootSignature returns the signature of root, over everything it holds but the signature itself. The nodes are
+// covered by the digest.
+func rootSignature(secret []byte, root *integrityRoot) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "vault/integrity/root\x00%s\x00%d\x00%s", root.Digest, root.Count, root.SealedAt.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validRoot tells whether root is signed with secret, and its digest matches its nodes
+func validRoot(secret []byte, root *integrityRoot) bool {
+	return hmac.Equal([]byte(root.Signature), []byte(rootSignature(secret, root))) && root.Digest == treeDigest(root.Nodes)
+}
+
+// signRoot signs root as sealed now, and makes the op storing it
+func signRoot(secret []byte, root *integrityRoot) (store.Op, error) {
+	root.Digest = treeDigest(root.Nodes)
+	root.SealedAt = time.Now().UTC()
+	root.Signature = rootSignature(secret, root)
+	b, err := json.Marshal(root)
+	if err != nil {
+		return store.Op{}, err
+	}
+	return store.Op{Type: store.OpPatch, Key: integrityRootKey, Value: string(b)}, nil
+}
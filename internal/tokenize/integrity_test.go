@@ -0,0 +1,192 @@
+package tokenize
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+type IntegrityTestSuite struct {
+	suite.Suite
+	store   *store.Map
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *IntegrityTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.store = store.NewSyncMap(ctx, suite.log)
+	suite.manager = NewManager(ctx, suite.log, WithStore(suite.store), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+// tokenize tokenizes every key of keys
+func (suite *IntegrityTestSuite) tokenize(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		_, err := suite.manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+}
+
+// verify verifies the default keyspace of the vault
+func (suite *IntegrityTestSuite) verify(ctx context.Context) *VerifyReport {
+	reports, err := suite.manager.Verify(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(reports, 1)
+	return reports[0]
+}
+
+func (suite *IntegrityTestSuite) TestVerify() {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// tamper changes the store outside the vault, and returns the key it changed
+		tamper    func() string
+		added     bool
+		modified  bool
+		removed   bool
+		rootValid bool
+	}{
+		{"token stored outside the vault", func() string {
+			suite.Require().NoError(suite.store.Store(ctx, "app/db/host", "649sx8C30ubzd0cu"))
+			return "app/db/host"
+		}, true, false, false, true},
+		{"token patched outside the vault", func() string {
+			_, err := suite.store.Patch(ctx, "app/db/password", "649sx8C30ubzd0cu")
+			suite.Require().NoError(err)
+			return "app/db/password"
+		}, false, true, false, true},
+		{"token deleted outside the vault", func() string {
+			_, err := suite.store.Delete(ctx, "app/db/user")
+			suite.Require().NoError(err)
+			return "app/db/user"
+		}, false, false, true, true},
+		{"token deleted with its node", func() string {
+			_, err := suite.store.Delete(ctx, "app/db/user")
+			suite.Require().NoError(err)
+			_, err = suite.store.Delete(ctx, integrityNodePrefix+nodeOf("app/db/user"))
+			suite.Require().NoError(err)
+			return "app/db/user"
+		}, false, false, false, false},
+	}
+	for _, tt := range tests {
+		suite.SetupTest()
+		suite.tokenize(ctx, "app/db/password", "app/db/user", "app/cache/password")
+		report := suite.verify(ctx)
+		suite.Require().Truef(report.Sealed, "%s: expected the writes of the vault to seal it\n", tt.name)
+		suite.Require().Falsef(report.Tampered, "%s: expected the vault to verify before it is tampered with\n", tt.name)
+
+		key := tt.tamper()
+		report = suite.verify(ctx)
+		suite.Require().Truef(report.Tampered, "%s: expected the change to be detected\n", tt.name)
+		suite.Require().Equalf(tt.added, slices.Contains(report.Added, key), "%s: expected %s to be reported as added: %v\n", tt.name, key, tt.added)
+		suite.Require().Equalf(tt.modified, slices.Contains(report.Modified, key), "%s: expected %s to be reported as modified: %v\n", tt.name, key, tt.modified)
+		suite.Require().Equalf(tt.removed, slices.Contains(report.Removed, key), "%s: expected %s to be reported as removed: %v\n", tt.name, key, tt.removed)
+		suite.Require().Equalf(tt.rootValid, report.RootValid, "%s: expected the root to be valid: %v\n", tt.name, tt.rootValid)
+
+		// resealing adopts the change
+		suite.Require().NoError(suite.manager.Reseal(ctx))
+		suite.Require().Falsef(suite.verify(ctx).Tampered, "%s: expected the vault to verify once resealed\n", tt.name)
+	}
+}
+
+func (suite *IntegrityTestSuite) TestWritesAfterTampering() {
+	ctx := context.Background()
+	node := integrityNodePrefix + nodeOf("app/db/password")
+	tests := []struct {
+		name   string
+		key    string
+		tamper string
+	}{
+		{"root with a bad signature", integrityRootKey, `{"digest":"","count":0,"signature":"00"}`},
+		{"malformed root", integrityRootKey, "649sx8C30ubzd0cu"},
+		{"malformed node", node, "649sx8C30ubzd0cu"},
+		{"node not matching the root", node, `{"app/db/password":"00"}`},
+	}
+	for _, tt := range tests {
+		suite.SetupTest()
+		suite.tokenize(ctx, "app/db/password")
+		_, err := suite.store.Patch(ctx, tt.key, tt.tamper)
+		suite.Require().NoError(err)
+
+		// writes go on, without being sealed
+		token, err := suite.manager.Tokenize(ctx, "app/db/user", "Z9Y8X7W6V5U4T3S2")
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		_, err = suite.manager.PatchTokenByID(ctx, "app/db/password", "649sx8C30ubzd0cu")
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		ok, val, err := suite.manager.Detokenize(ctx, "app/db/user", token)
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		suite.Require().True(ok)
+		suite.Require().Equal("Z9Y8X7W6V5U4T3S2", val)
+
+		// the tampering is reported until the vault is resealed
+		report := suite.verify(ctx)
+		suite.Require().Truef(report.Tampered, "%s: expected the tampering to be reported\n", tt.name)
+		suite.Require().NotNilf(report.Detected, "%s: expected the tampering detected by the writes to be reported\n", tt.name)
+		stats, err := suite.manager.Stats(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().NotNilf(stats.Tampered, "%s: expected the stats to report the tampering\n", tt.name)
+
+		suite.Require().NoError(suite.manager.Reseal(ctx))
+		suite.tokenize(ctx, "app/cache/password")
+		report = suite.verify(ctx)
+		suite.Require().Falsef(report.Tampered, "%s: expected the vault to verify once resealed\n", tt.name)
+		suite.Require().Nil(report.Detected)
+		stats, err = suite.manager.Stats(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Nil(stats.Tampered)
+	}
+}
+
+func (suite *IntegrityTestSuite) TestSealOnStart() {
+	ctx := context.Background()
+	cipherLoc := filepath.Join(suite.T().TempDir(), ".cipher")
+	// tokens stored before the vault kept MACs
+	s := store.NewSyncMap(ctx, suite.log)
+	suite.Require().NoError(s.Store(ctx, "app/db/password", "A1B2C3D4E5F6G7H8"))
+	suite.Require().NoError(s.Store(ctx, "app/db/user", "Z9Y8X7W6V5U4T3S2"))
+
+	suite.manager = NewManager(ctx, suite.log, WithStore(s), WithCipherLoc(cipherLoc))
+	report := suite.verify(ctx)
+	suite.Require().True(report.Sealed, "expected the tokens to be sealed on start")
+	suite.Require().Equal(2, report.Checked)
+	suite.Require().False(report.Tampered, "expected the tokens stored before the upgrade to verify")
+
+	// sealed keyspaces aren't sealed again on start, which would accept the changes made outside the vault
+	suite.Require().NoError(s.Store(ctx, "app/db/host", "649sx8C30ubzd0cu"))
+	suite.manager = NewManager(ctx, suite.log, WithStore(s), WithCipherLoc(cipherLoc))
+	report = suite.verify(ctx)
+	suite.Require().True(report.Tampered, "expected the token stored outside the vault to be reported")
+	suite.Require().Equal([]string{"app/db/host"}, report.Added)
+}
+
+func (suite *IntegrityTestSuite) TestConcurrentWrites() {
+	ctx := context.Background()
+	// every write of the keyspace updates its root, and none may lose the seal of another
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := suite.manager.Tokenize(ctx, fmt.Sprintf("app/db/password%d", i), "A1B2C3D4E5F6G7H8")
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		}()
+	}
+	wg.Wait()
+
+	report := suite.verify(ctx)
+	suite.Require().Equal(20, report.Checked)
+	suite.Require().False(report.Tampered, "expected the concurrent writes to be sealed")
+}
+
+// TestIntegritySuite tests the detection of tokens changed outside the vault
+func TestIntegritySuite(t *testing.T) {
+	suite.Run(t, new(IntegrityTestSuite))
+}
@@ -0,0 +1,280 @@
+package tokenize
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SortID      = "id"
+	SortCreated = "created"
+	SortUpdated = "updated"
+	// SortDescending starts a sort to reverse it, as in -created
+	SortDescending = "-"
+)
+
+var (
+	ErrSortInvalid      = fmt.Errorf("sort must be one of %s, %s or %s, optionally starting with %s", SortID, SortCreated, SortUpdated, SortDescending)
+	ErrLimitInvalid     = errors.New("limit can't be negative")
+	ErrPageTokenInvalid = errors.New("invalid page token")
+)
+
+// ListOptions selects, sorts and pages the tokens returned by ListPage
+type ListOptions struct {
+	// Prefix keeps the tokens under this path prefix
+	Prefix string
+	// Match keeps the tokens whose key matches this glob, as in team/*/db/*
+	Match string
+	// Labels keeps the tokens carrying all these labels. An empty value matches any value of the label.
+	Labels map[string]string
+	// Sort orders the tokens by SortID, SortCreated or SortUpdated, starting with SortDescending to reverse the order.
+	// Tokens are sorted by key by default.
+	Sort string
+	// Limit caps the number of tokens of a page. 0 returns every token left.
+	Limit int
+	// PageToken continues the listing where the page it was returned with ended
+	PageToken string
+}
+
+// pageToken is where a page of a listing ended. It is handed out base64 encoded, and should be treated as opaque.
+type pageToken struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	// Time is only set for listings sorted by time
+	Time *time.Time `json:"t,omitempty"`
+}
+
+// listEntry is a token selected by a listing, with the metadata it was selected or sorted by
+type listEntry struct {
+	key, value string
+	meta       *model.Metadata
+}
+
+// ListPage returns a page of the tokens selected by opts, grouped by parent path, and the token of the next page.
+// Tokens sorted by key are filtered and paged by the store; sorting by time loads the metadata of every token selected.
+func (m *Manager) ListPage(ctx context.Context, opts ListOptions) (_ *model.All, err error) {
+	defer m.metrics.observe(OpList, time.Now(), &err)
+	log := m.log.Logger()
+
+	sortBy, desc, err := parseSort(opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit < 0 {
+		return nil, ErrLimitInvalid
+	}
+	after, err := decodePageToken(opts.PageToken, sortBy, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []listEntry
+	var next *pageToken
+	if sortBy == SortID {
+		entries, next, err = m.listByKey(ctx, opts, desc, after)
+	} else {
+		entries, next, err = m.listByTime(ctx, opts, sortBy, desc, after)
+	}
+	if err != nil {
+		log.Error().Msgf("error while listing tokens: %s\n", err.Error())
+		return nil, err
+	}
+
+	all := &model.All{Tokens: group(entries)}
+	if next != nil {
+		next.Sort = canonicalSort(sortBy, desc)
+		all.NextPageToken = encodePageToken(next)
+	}
+	log.Debug().Msgf("listed a page of %d tokens", len(entries))
+	return all, nil
+}
+
+// listByKey pages through the store in key order, until a page of tokens matching the labels of opts is filled
+func (m *Manager) listByKey(ctx context.Context, opts ListOptions, desc bool, after *pageToken) ([]listEntry, *pageToken, error) {
+	scan := store.ScanOptions{Prefix: opts.Prefix, Match: opts.Match, Reverse: desc, Limit: opts.Limit}
+	if after != nil {
+		scan.After = after.Key
+	}
+
+	var entries []listEntry
+	for {
+		page, err := store.Scan(ctx, m.store, scan)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, record := range page.Records {
+			entry, ok, err := m.listEntry(ctx, record, opts.Labels, false)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				continue
+			}
+			entries = append(entries, entry)
+			if opts.Limit > 0 && len(entries) == opts.Limit {
+				if i < len(page.Records)-1 || len(page.Next) > 0 {
+					return entries, &pageToken{Key: entry.key}, nil
+				}
+				return entries, nil, nil
+			}
+		}
+		if len(page.Next) == 0 {
+			return entries, nil, nil
+		}
+		scan.After = page.Next
+	}
+}
+
+// listByTime loads every token selected by opts with its metadata, and pages through them in time order
+func (m *Manager) listByTime(ctx context.Context, opts ListOptions, sortBy string, desc bool, after *pageToken) ([]listEntry, *pageToken, error) {
+	page, err := store.Scan(ctx, m.store, store.ScanOptions{Prefix: opts.Prefix, Match: opts.Match})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []listEntry
+	for _, record := range page.Records {
+		entry, ok, err := m.listEntry(ctx, record, opts.Labels, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	timeOf := func(entry listEntry) time.Time {
+		if entry.meta == nil {
+			return time.Time{}
+		}
+		if sortBy == SortCreated {
+			return entry.meta.CreatedAt
+		}
+		return entry.meta.UpdatedAt
+	}
+	// before reports whether the token at t and key comes before the one at u and other, breaking ties by key
+	before := func(t time.Time, key string, u time.Time, other string) bool {
+		if !t.Equal(u) {
+			return t.Before(u) != desc
+		}
+		return (key < other) != desc
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return before(timeOf(entries[i]), entries[i].key, timeOf(entries[j]), entries[j].key)
+	})
+
+	if after != nil {
+		var at time.Time
+		if after.Time != nil {
+			at = *after.Time
+		}
+		start := sort.Search(len(entries), func(i int) bool {
+			return before(at, after.Key, timeOf(entries[i]), entries[i].key)
+		})
+		entries = entries[start:]
+	}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := timeOf(entries[len(entries)-1])
+		return entries, &pageToken{Key: entries[len(entries)-1].key, Time: &last}, nil
+	}
+	return entries, nil, nil
+}
+
+// listEntry turns a record into a listing entry, and reports whether it is selected by labels. Metadata is only read
+// when needed to filter or sort.
+func (m *Manager) listEntry(ctx context.Context, record store.Record, labels map[string]string, withMeta bool) (listEntry, bool, error) {
+	entry := listEntry{key: record.Key, value: record.Value}
+	if store.IsReserved(record.Key) {
+		return entry, false, nil
+	}
+	if len(labels) == 0 && !withMeta {
+		return entry, true, nil
+	}
+	meta, err := m.metadata(ctx, record.Key)
+	if err != nil {
+		return entry, false, err
+	}
+	entry.meta = meta
+	for k, v := range labels {
+		if meta == nil {
+			return entry, false, nil
+		}
+		if label, ok := meta.Labels[k]; !ok || (len(v) > 0 && label != v) {
+			return entry, false, nil
+		}
+	}
+	return entry, true, nil
+}
+
+// group groups entries with the same parent path into a token. Tokens are in the order their first entry is, and
+// children in the order of their entries, even when the entries of a parent aren't consecutive, as a/b, a/b/c and a/d.
+func group(entries []listEntry) []*model.Tokenize {
+	tokens := []*model.Tokenize{}
+	parents := map[string]*model.Tokenize{}
+	for _, entry := range entries {
+		parent, child := SplitKey(entry.key)
+		token, ok := parents[parent]
+		if !ok {
+			token = &model.Tokenize{ID: parent}
+			parents[parent] = token
+			tokens = append(tokens, token)
+		}
+		token.Data = append(token.Data, model.Child{Key: child, Value: entry.value})
+	}
+	return tokens
+}
+
+// parseSort splits a sort into the field sorted by, and whether the order is reversed
+func parseSort(s string) (string, bool, error) {
+	field, desc := strings.CutPrefix(s, SortDescending)
+	switch field {
+	case "":
+		if desc {
+			return "", false, ErrSortInvalid
+		}
+		return SortID, false, nil
+	case SortID, SortCreated, SortUpdated:
+		return field, desc, nil
+	}
+	return "", false, ErrSortInvalid
+}
+
+func canonicalSort(sortBy string, desc bool) string {
+	if desc {
+		return SortDescending + sortBy
+	}
+	return sortBy
+}
+
+func encodePageToken(token *pageToken) string {
+	b, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageToken decodes s, and checks it continues a listing with the same sort. Empty page tokens decode to nil.
+func decodePageToken(s, sortBy string, desc bool) (*pageToken, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrPageTokenInvalid
+	}
+	var token pageToken
+	if err = json.Unmarshal(b, &token); err != nil || len(token.Key) == 0 {
+		return nil, ErrPageTokenInvalid
+	}
+	if token.Sort != canonicalSort(sortBy, desc) {
+		return nil, fmt.Errorf("%w: it continues a listing sorted by %s", ErrPageTokenInvalid, token.Sort)
+	}
+	return &token, nil
+}
@@ -0,0 +1,112 @@
+package tokenize
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+)
+
+type ListTestSuite struct {
+	suite.Suite
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *ListTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.manager = NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+// tokenize tokenizes every key of keys
+func (suite *ListTestSuite) tokenize(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		_, err := suite.manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+}
+
+func (suite *ListTestSuite) TestGroup() {
+	ctx := context.Background()
+	// the children of a are listed before and after those of a/b
+	suite.tokenize(ctx, "a/d", "a/b/c", "a/b", "team/app/db/password", "team/app/db/user")
+
+	all, err := suite.manager.GetAllTokens(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	var ids []string
+	children := map[string][]string{}
+	for _, parent := range all {
+		ids = append(ids, parent.ID)
+		for _, child := range parent.Data {
+			children[parent.ID] = append(children[parent.ID], child.Key)
+		}
+	}
+	suite.Require().Equal([]string{"a", "a/b", "team/app/db"}, ids, "expected every parent to be listed once, in order")
+	suite.Require().Equal(map[string][]string{
+		"a":           {"b", "d"},
+		"a/b":         {"c"},
+		"team/app/db": {"password", "user"},
+	}, children)
+}
+
+func (suite *ListTestSuite) TestPage() {
+	ctx := context.Background()
+	suite.tokenize(ctx, "app/db/password", "app/db/user", "app/cache/password", "billing/api/key")
+	_, err := suite.manager.UpdateMetadata(ctx, "app/db/user", MetadataUpdate{Labels: map[string]string{"env": "prod"}})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	tests := []struct {
+		opts ListOptions
+		keys []string
+	}{
+		{ListOptions{}, []string{"app/cache/password", "app/db/password", "app/db/user", "billing/api/key"}},
+		{ListOptions{Prefix: "app/db"}, []string{"app/db/password", "app/db/user"}},
+		{ListOptions{Match: "app/*/password"}, []string{"app/cache/password", "app/db/password"}},
+		{ListOptions{Labels: map[string]string{"env": "prod"}}, []string{"app/db/user"}},
+		{ListOptions{Sort: SortDescending + SortID, Limit: 1}, []string{"billing/api/key"}},
+	}
+	for _, tt := range tests {
+		page, err := suite.manager.ListPage(ctx, tt.opts)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equalf(tt.keys, keys(page.Tokens), "expected the keys listed with %+v\n", tt.opts)
+	}
+
+	// pages follow each other until the listing is done
+	var listed []string
+	opts := ListOptions{Limit: 3}
+	for pages := 0; ; pages++ {
+		suite.Require().Less(pages, 2, "expected 2 pages")
+		page, err := suite.manager.ListPage(ctx, opts)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		listed = append(listed, keys(page.Tokens)...)
+		if len(page.NextPageToken) == 0 {
+			break
+		}
+		opts.PageToken = page.NextPageToken
+	}
+	suite.Require().Equal(tests[0].keys, listed)
+
+	// page tokens continue listings with the sort they were made with
+	_, err = suite.manager.ListPage(ctx, ListOptions{Sort: SortDescending + SortID, PageToken: opts.PageToken})
+	suite.Require().ErrorIs(err, ErrPageTokenInvalid)
+}
+
+// keys returns the keys of the secrets of tokens, in order
+func keys(tokens []*model.Tokenize) []string {
+	var keys []string
+	for _, parent := range tokens {
+		for _, child := range parent.Data {
+			keys = append(keys, parent.ID+KeyDelimiter+child.Key)
+		}
+	}
+	return keys
+}
+
+// TestListSuite tests the listing of the tokens of the manager
+func TestListSuite(t *testing.T) {
+	suite.Run(t, new(ListTestSuite))
+}
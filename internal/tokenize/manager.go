@@ -11,6 +11,8 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -19,20 +21,47 @@ var (
 	ErrKeyAlreadyExists = errors.New("key already exists. not overriding")
 	ErrKeyDoesNotExists = "key %s does not exist"
 	ErrDuplicateKeys    = errors.New("key already exists in request. accepted only the first one")
+	ErrKeyReserved      = errors.New("key is reserved by the vault. keys can't start with " + store.ReservedPrefix)
 )
 
 var (
 	DefaultCipherLoc           = "./.cipher"
 	EnvKeyAESCipher            = "CIPHER"
 	EnvKeyInitializationVector = "IV"
-	KeyDelimiter               = "__"
+	// KeyDelimiter separates the segments of the path of a secret, as in team/app/db/password
+	KeyDelimiter = store.PathSeparator
+	// LegacyKeyDelimiter joined the id and key of a secret before paths were introduced. Secrets stored that way are
+	// still found under their path.
+	LegacyKeyDelimiter = "__"
 )
 
 type Manager struct {
-	store     store.Store
-	cipher    map[string]string
+	store store.Store
+	// cipher holds the keyring of the manager. A restore swaps it whole, so it is read with keyring, and never changed
+	// in place.
+	cipher    atomic.Pointer[map[string]string]
 	cipherLoc string
-	log       *vlog.Logger
+	// namespace is the name of the namespace the manager is scoped to, empty for the root manager
+	namespace string
+	// identity is who changes are recorded as made by, unless the context of a call carries one
+	identity string
+	// trashRetention is how long deleted tokens are kept in the trash before they are purged
+	trashRetention time.Duration
+	// accessResolution is how long the recorded access time of a secret is kept when it is read again. Negative
+	// resolutions don't record access times.
+	accessResolution time.Duration
+	// metrics counts the operations served by the manager, and the namespaced managers made from it
+	metrics *opMetrics
+	// views holds the store views of the namespaces, shared with the namespaced managers made from the manager
+	views *namespaceViews
+	// restoring is held by a restore while it replaces the records and the keyring of the vault, and by every write
+	// otherwise, so that no write is built with the keyring being replaced. It is shared with the namespaced managers
+	// made from the manager.
+	restoring *sync.RWMutex
+	// seals serializes the sealed writes of each keyspace, see batch. It is shared with the namespaced managers made
+	// from the manager.
+	seals *sealLocks
+	log   *vlog.Logger
 }
 
 // NewManager creates a new instance of Manager. It manages token operations (retrieval, storage, servicing) throughout the lifetime of the server.
@@ -41,14 +70,20 @@ func NewManager(ctx context.Context, logger *vlog.Logger, opts ...Options) *Mana
 	var manager = &Manager{}
 	manager.log = logger
 	manager.cipherLoc = DefaultCipherLoc
-	manager.cipher = map[string]string{}
-	if len(opts) == 0 {
+	manager.setKeyring(map[string]string{})
+	manager.trashRetention = DefaultTrashRetention
+	manager.accessResolution = DefaultAccessResolution
+	manager.metrics = newOpMetrics()
+	manager.views = &namespaceViews{views: map[string]*store.Prefixed{}}
+	manager.restoring = &sync.RWMutex{}
+	manager.seals = &sealLocks{locks: map[string]*sync.Mutex{}}
+	for i := 0; i < len(opts); i++ {
+		opts[i](manager)
+	}
+	if manager.store == nil {
 		manager.store = store.NewSyncMap(ctx, manager.log)
 	} else {
 		log.Debug().Msg("a separate store option was passed in")
-		for i := 0; i < len(opts); i++ {
-			opts[i](manager)
-		}
 	}
 
 	b, err := manager.store.Connect(ctx)
@@ -66,11 +101,19 @@ func NewManager(ctx context.Context, logger *vlog.Logger, opts ...Options) *Mana
 	}
 
 	// if cipher file already exists, emvMap is empty, so read from file
-	if len(manager.cipher) == 0 {
-		manager.cipher, err = godotenv.Read(manager.cipherLoc)
+	if len(manager.keyring()) == 0 {
+		keyring, err := godotenv.Read(manager.cipherLoc)
 		if err != nil {
 			manager.log.Logger().Error().Msgf("error encountered while reading cipher from file %s: %s\n", manager.cipherLoc, err.Error())
 		}
+		manager.setKeyring(keyring)
+	}
+
+	// tokens stored before the vault kept MACs are sealed as they are, so that they don't show as added
+	if len(manager.keyring()) > 0 {
+		if err = manager.sealUnsealed(ctx); err != nil {
+			manager.log.Logger().Error().Msgf("error encountered while sealing the tokens stored before MACs were kept: %s\n", err.Error())
+		}
 	}
 
 	return manager
@@ -78,35 +121,61 @@ func NewManager(ctx context.Context, logger *vlog.Logger, opts ...Options) *Mana
 
 // GenerateCipher generates a new AES cipher and Initialization Vector pais, and persists it to disk
 func (m *Manager) GenerateCipher() error {
-	// generate 32 digit key
-	m.cipher[EnvKeyAESCipher] = GenAlphaNumericString(32)
-	// generate 16 digit initialization vector
-	m.cipher[EnvKeyInitializationVector] = GenAlphaNumericString(16)
-	// write to file
-	return godotenv.Write(m.cipher, m.cipherLoc)
+	keyring := map[string]string{
+		// generate 32 digit key
+		EnvKeyAESCipher: GenAlphaNumericString(32),
+		// generate 16 digit initialization vector
+		EnvKeyInitializationVector: GenAlphaNumericString(16),
+	}
+	m.setKeyring(keyring)
+	// write to file, creating its directory if needed
+	if err := store.IsValidFile(m.cipherLoc, m.log.Logger()); err != nil {
+		return err
+	}
+	return godotenv.Write(keyring, m.cipherLoc)
+}
+
+// keyring returns the cipher and initialization vector of the manager
+func (m *Manager) keyring() map[string]string {
+	return *m.cipher.Load()
+}
+
+// setKeyring replaces the keyring of the manager with keyring, which mustn't be changed afterwards
+func (m *Manager) setKeyring(keyring map[string]string) {
+	m.cipher.Store(&keyring)
+}
+
+// writing blocks restores until the write it is called for is done, and returns the func ending it. Writes build
+// their tokens within it, so none is made with a keyring a restore replaces.
+func (m *Manager) writing() func() {
+	m.restoring.RLock()
+	return m.restoring.RUnlock
 }
 
-// GetTokenByID returns the token owned by a specific ID/Key
-func (m *Manager) GetTokenByID(ctx context.Context, id string) (*model.Tokenize, error) {
+// GetTokenByID returns the token stored under the key id. The parent path of the key is returned as the ID, and its
+// last segment as the child key.
+func (m *Manager) GetTokenByID(ctx context.Context, id string) (_ *model.Tokenize, err error) {
+	defer m.metrics.observe(OpGet, time.Now(), &err)
 	log := m.log.Logger()
-	var tokenStr string
 
-	if val, err := m.store.Retrieve(ctx, id); err != nil {
+	if store.IsReserved(id) {
+		return nil, fmt.Errorf(ErrKeyDoesNotExists, id)
+	}
+	key := m.storedKey(ctx, id)
+	tokenStr, err := m.store.Retrieve(ctx, key)
+	if err != nil {
 		return nil, fmt.Errorf(ErrKeyDoesNotExists, id)
-	} else {
-		tokenStr = fmt.Sprint(val)
 	}
-	log.Debug().Msg("successfully ranged over store data")
-
-	ss := strings.Split(id, KeyDelimiter)
 
+	parent, child := SplitKey(key)
 	log.Debug().Msg("found token in store")
 	return &model.Tokenize{
-		ID: ss[0],
+		ID: parent,
 		Data: []model.Child{
 			{
-				Key:   ss[1],
-				Value: tokenStr,
+				Key:      child,
+				Value:    tokenStr,
+				Metadata: m.touchAccessed(ctx, key, tokenStr),
 			},
 		},
 	}, nil
@@ -114,45 +183,17 @@ func (m *Manager) GetTokenByID(ctx context.Context, id string) (*model.Tokenize,
 
 // GetAllTokens returns all tokens currently in the store
 func (m *Manager) GetAllTokens(ctx context.Context) ([]*model.Tokenize, error) {
-	log := m.log.Logger()
-	allTokens := map[string]*model.Tokenize{}
+	return m.List(ctx, "")
+}
 
-	// pass a range func over the contents of the store and get the contents
-	allTokenMap, err := m.store.RetrieveAll(ctx)
+// List returns the tokens stored under the path prefix, or all tokens if prefix is empty. Tokens are grouped by their
+// parent path, and sorted by key.
+func (m *Manager) List(ctx context.Context, prefix string) ([]*model.Tokenize, error) {
+	all, err := m.ListPage(ctx, ListOptions{Prefix: prefix})
 	if err != nil {
-		log.Error().Msgf("error while retrieving all keys: %s\n", err.Error())
-	}
-
-	// parse all tokens into a slice of model.Tokenize
-	for k, v := range allTokenMap {
-		ss := strings.Split(k, KeyDelimiter)
-		if val, ok := allTokens[k]; ok {
-			if len(val.ID) == 0 {
-				log.Debug().Msgf("token with id %s is already stored. continuing.", val.ID)
-			}
-			val.ID = ss[0]
-			val.Data = append(val.Data, model.Child{
-				Key:   ss[1],
-				Value: v,
-			})
-			continue
-		}
-		allTokens[k] = &model.Tokenize{
-			ID: ss[0],
-		}
-		allTokens[k].Data = append(allTokens[k].Data, model.Child{
-			Key:   ss[1],
-			Value: v,
-		})
+		return nil, err
 	}
-
-	respTokens := []*model.Tokenize{}
-	for _, v := range allTokens {
-		respTokens = append(respTokens, v)
-	}
-
-	log.Debug().Msg("successfully parsed all tokens into a token array")
-	return respTokens, nil
+	return all.Tokens, nil
 }
 
 // ValidateResponse holds the error response from validation and the associated key.
@@ -182,9 +223,12 @@ func (m *Manager) ValidateKeys(ctx context.Context, token *model.Tokenize) ([]*V
 	for i := 0; i < len(token.Data); i++ {
 		childKey := token.Data[i].Key
 		combinedKeyName := GetCombinedKey(parentKey, childKey)
-		// check that key doesn't already exist
+		// check that key isn't reserved, and doesn't already exist
 		var err error
-		if err = keysIsPresent(ctx, combinedKeyName, tempMap, m.store); err != nil {
+		if store.IsReserved(combinedKeyName) {
+			verdict = false
+			valResp = append(valResp, &ValidateResponse{combinedKeyName, fmt.Errorf("error validating keys: %s\n", ErrKeyReserved.Error())})
+		} else if err = keysIsPresent(ctx, combinedKeyName, tempMap, m); err != nil {
 			verdict = false
 			valResp = append(valResp, &ValidateResponse{combinedKeyName, fmt.Errorf("error validating keys: %s\n", err.Error())})
 		}
@@ -192,11 +236,11 @@ func (m *Manager) ValidateKeys(ctx context.Context, token *model.Tokenize) ([]*V
 	return valResp, verdict
 }
 
-func keysIsPresent(ctx context.Context, key string, tempStore map[string]bool, store store.Store) error {
+func keysIsPresent(ctx context.Context, key string, tempStore map[string]bool, m *Manager) error {
 	if _, ok := tempStore[key]; ok {
 		return ErrDuplicateKeys
 	}
-	if _, err := store.Retrieve(ctx, key); err == nil {
+	if _, err := m.store.Retrieve(ctx, m.storedKey(ctx, key)); err == nil {
 		return ErrKeyAlreadyExists
 	}
 
@@ -204,29 +248,25 @@ func keysIsPresent(ctx context.Context, key string, tempStore map[string]bool, s
 	return nil
 }
 
-// Tokenize manages the tokenization, and stores generated tokens in an internal store, for easy retrieval
-func (m *Manager) Tokenize(ctx context.Context, key, val string) (string, error) {
-
-	// Tokenize
-	token, err := Tokenize(val, m.cipher)
-	if err != nil {
-		m.log.Logger().Error().Msgf("error occurred while generating token: %s\n", err.Error())
-		return "", err
-	}
-
+// Tokenize manages the tokenization, and stores generated tokens in an internal store, for easy retrieval. The token
+// and its metadata are stored together.
+func (m *Manager) Tokenize(ctx context.Context, key, val string) (_ string, err error) {
+	defer m.metrics.observe(OpTokenize, time.Now(), &err)
 	// proceed to store generated token
-	err = m.store.Store(ctx, key, token.token)
+	w, err := m.applyWrite(ctx, func() *keyWrite { return m.tokenizeWrite(ctx, key, val) })
 	if err != nil {
 		m.log.Logger().Error().Msgf("error occurred while storing token: %s\n", err.Error())
 		return "", err
 	}
-	return token.token, nil
+	return w.token, nil
 }
 
 // Detokenize retrieves the value represented by a particular token, identified by the particular key
-func (m *Manager) Detokenize(ctx context.Context, key, token string) (bool, string, error) {
+func (m *Manager) Detokenize(ctx context.Context, key, token string) (_ bool, _ string, err error) {
+	defer m.metrics.observe(OpDetokenize, time.Now(), &err)
 
 	// ensure that token matches what is in store
+	key = m.storedKey(ctx, key)
 	storedToken, err := m.store.Retrieve(ctx, key)
 	if err != nil {
 		m.log.Logger().Error().Msgf("error while confirming token key: %s\n", err.Error())
@@ -240,12 +280,13 @@ func (m *Manager) Detokenize(ctx context.Context, key, token string) (bool, stri
 	}
 
 	// Detokenize
-	decryptedStr, err := Detokenize(token, m.cipher)
+	decryptedStr, err := Detokenize(token, m.keyring())
 	if err != nil {
 		m.log.Logger().Error().Msgf("error occurred while decrypting token: %s\n", err.Error())
 		return false, "", err
 	}
 
+	m.touchAccessed(ctx, key, storedToken)
 	return true, decryptedStr, nil
 }
 
@@ -278,38 +319,61 @@ func GenAlphaNumericString(n int) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
-// DeleteTokenByID deletes the token from the store identified by ID
-func (m *Manager) DeleteTokenByID(ctx context.Context, id string) (bool, error) {
+// DeleteTokenByID moves the token identified by ID to the trash, where it can be undeleted until it is purged
+func (m *Manager) DeleteTokenByID(ctx context.Context, id string) (_ bool, err error) {
+	defer m.metrics.observe(OpDelete, time.Now(), &err)
 	log := m.log.Logger()
 
-	if b, err := m.store.Delete(ctx, id); err != nil || !b {
-		return false, fmt.Errorf(ErrKeyDoesNotExists, id)
+	if _, err := m.applyWrite(ctx, func() *keyWrite { return m.deleteWrite(ctx, id, false, nil) }); err != nil {
+		log.Error().Msgf("error while moving %s to the trash: %s\n", id, err.Error())
+		return false, err
 	}
 
-	log.Debug().Msg("successfully deleted ID from store")
-
-	log.Debug().Msg("found token in store")
+	log.Debug().Msg("successfully moved ID to the trash")
 	return true, nil
 }
 
-// PatchTokenByID updates a token in the store identified by ID
-func (m *Manager) PatchTokenByID(ctx context.Context, key, val string) (string, error) {
+// HardDeleteTokenByID deletes a token from the store for good, without keeping it in the trash
+func (m *Manager) HardDeleteTokenByID(ctx context.Context, id string) (_ bool, err error) {
+	defer m.metrics.observe(OpDelete, time.Now(), &err)
 	log := m.log.Logger()
 
-	// Tokenize
-	token, err := Tokenize(val, m.cipher)
-	if err != nil {
-		m.log.Logger().Error().Msgf("error occurred while generating token: %s\n", err.Error())
-		return "", err
+	if _, err := m.applyWrite(ctx, func() *keyWrite { return m.deleteWrite(ctx, id, true, nil) }); err != nil {
+		log.Error().Msgf("error while deleting %s: %s\n", id, err.Error())
+		return false, err
 	}
 
-	// patch token entry
-	if b, err := m.store.Patch(ctx, key, token.token); err != nil || !b {
-		return "", fmt.Errorf("error patching token: %s\n", err.Error())
+	log.Debug().Msg("successfully deleted ID from store")
+	return true, nil
+}
+
+// PatchTokenByID updates a token in the store identified by ID
+func (m *Manager) PatchTokenByID(ctx context.Context, key, val string) (_ string, err error) {
+	defer m.metrics.observe(OpPatch, time.Now(), &err)
+	log := m.log.Logger()
+	// patch token entry, with its metadata
+	w, err := m.applyWrite(ctx, func() *keyWrite { return m.patchWrite(ctx, key, val, nil) })
+	if err != nil {
+		return "", fmt.Errorf("error patching token: %w", err)
 	}
 
 	log.Debug().Msg("successfully patched ID from store")
-	return token.String(), nil
+	return w.token, nil
+}
+
+// Close closes the store of the manager, letting it persist what it holds in memory
+func (m *Manager) Close(ctx context.Context) error {
+	return m.store.Close(ctx)
+}
+
+// Watch streams the changes made to keys starting with prefix, until ctx is done. It returns store.ErrWatchUnsupported
+// if the store can't be watched.
+func (m *Manager) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	events, err := store.Watch(ctx, m.store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return store.WithoutReserved(ctx, events), nil
 }
 
 // IsErrKeyAlreadyExist enables easy checking of error
@@ -320,14 +384,46 @@ func IsErrKeyAlreadyExist(err error) bool {
 	return false
 }
 
-// GetCombinedKey creates a key string unique to every value in the request object. This key string is a concatenation of all the parent keys that constitute the request data
-func GetCombinedKey(s ...string) (cs string) {
-	for i := 0; i < len(s); i++ {
-		delimiter := ""
-		if i > 0 {
-			delimiter = KeyDelimiter
+// GetCombinedKey creates the path of a value in the request object. Every argument but the last is a parent path, whose
+// segments are separated by KeyDelimiter. The last is the key of the value, and is escaped into a single segment, so
+// keys holding KeyDelimiter stay unambiguous. Empty segments are left out.
+func GetCombinedKey(s ...string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return store.JoinPath(strings.Join(s[:len(s)-1], KeyDelimiter), s[len(s)-1])
+}
+
+// SplitKey splits the path of a stored secret into the ID of its parent and its key. Secrets stored with the legacy
+// id__key layout are split the way they were stored.
+func SplitKey(key string) (id, child string) {
+	if !strings.Contains(key, KeyDelimiter) {
+		if id, child, ok := strings.Cut(key, LegacyKeyDelimiter); ok {
+			return id, child
 		}
-		cs += delimiter + s[i]
 	}
-	return
+	return store.SplitPath(key)
+}
+
+// storedKey returns the key a secret is stored under. That is key itself, unless only the legacy id__key layout of key
+// exists.
+func (m *Manager) storedKey(ctx context.Context, key string) string {
+	return m.storedKeyIn(ctx, "", key)
+}
+
+// storedKeyIn is storedKey for secrets kept in the reserved area starting with prefix, like the trash
+func (m *Manager) storedKeyIn(ctx context.Context, prefix, key string) string {
+	i := strings.LastIndex(key, KeyDelimiter)
+	if i < 0 {
+		return key
+	}
+	if _, err := m.store.Retrieve(ctx, prefix+key); err == nil {
+		return key
+	}
+	legacy := key[:i] + LegacyKeyDelimiter + store.UnescapeSegment(key[i+1:])
+	if _, err := m.store.Retrieve(ctx, prefix+legacy); err == nil {
+		m.log.Logger().Debug().Msgf("found %s under its legacy key %s", key, legacy)
+		return legacy
+	}
+	return key
 }
@@ -0,0 +1,214 @@
+package tokenize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"time"
+)
+
+// DefaultAccessResolution is how long the recorded access time of a secret is kept by default when it is read again
+const DefaultAccessResolution = time.Minute
+
+var (
+	// metadataPrefix starts the store keys of the metadata records of secrets
+	metadataPrefix = store.ReservedPrefix + "meta/"
+)
+
+var (
+	ErrLabelKeyEmpty = errors.New("label key can't be empty")
+)
+
+// identityKey is the context key of the identity a request is made by
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying the identity changes are made by. It takes precedence over the
+// identity of the manager.
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityFrom returns the identity changes made with ctx are recorded under
+func (m *Manager) identityFrom(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityKey{}).(string); ok && len(identity) > 0 {
+		return identity
+	}
+	return m.identity
+}
+
+// MetadataUpdate holds the editable fields of the metadata of a secret. Nil and empty fields are left as they are.
+type MetadataUpdate struct {
+	Description *string
+	// Labels are added to the existing labels, replacing those with the same key
+	Labels map[string]string
+	// RemoveLabels are the keys of labels to remove
+	RemoveLabels []string
+}
+
+// GetMetadata returns the metadata of the secret stored under key. Secrets stored before metadata was kept have none,
+// and return nil.
+func (m *Manager) GetMetadata(ctx context.Context, key string) (*model.Metadata, error) {
+	if store.IsReserved(key) {
+		return nil, fmt.Errorf(ErrKeyDoesNotExists, key)
+	}
+	key = m.storedKey(ctx, key)
+	if _, err := m.store.Retrieve(ctx, key); err != nil {
+		return nil, fmt.Errorf(ErrKeyDoesNotExists, key)
+	}
+	return m.metadata(ctx, key)
+}
+
+// UpdateMetadata edits the description and labels of the secret stored under key, and returns its updated metadata
+func (m *Manager) UpdateMetadata(ctx context.Context, key string, update MetadataUpdate) (*model.Metadata, error) {
+	for k := range update.Labels {
+		if len(k) == 0 {
+			return nil, ErrLabelKeyEmpty
+		}
+	}
+	if store.IsReserved(key) {
+		return nil, fmt.Errorf(ErrKeyDoesNotExists, key)
+	}
+	key = m.storedKey(ctx, key)
+	if _, err := m.store.Retrieve(ctx, key); err != nil {
+		return nil, fmt.Errorf(ErrKeyDoesNotExists, key)
+	}
+
+	return m.updateMetadata(ctx, key, func(meta *model.Metadata) {
+		if update.Description != nil {
+			meta.Description = *update.Description
+		}
+		for k, v := range update.Labels {
+			if meta.Labels == nil {
+				meta.Labels = map[string]string{}
+			}
+			meta.Labels[k] = v
+		}
+		for _, k := range update.RemoveLabels {
+			delete(meta.Labels, k)
+		}
+		if len(meta.Labels) == 0 {
+			meta.Labels = nil
+		}
+		meta.UpdatedAt = time.Now().UTC()
+		meta.UpdatedBy = m.identityFrom(ctx)
+	})
+}
+
+// metadata reads the metadata record of the secret stored under key, or nil if it has none
+func (m *Manager) metadata(ctx context.Context, key string) (*model.Metadata, error) {
+	meta, _, err := m.readMetadata(ctx, key)
+	return meta, err
+}
+
+// readMetadata reads the metadata record of the secret stored under key, or nil if it has none. It also returns the
+// record as it is stored, for writes to check it is unchanged.
+func (m *Manager) readMetadata(ctx context.Context, key string) (*model.Metadata, string, error) {
+	var meta model.Metadata
+	raw, err := m.readRecord(ctx, metadataPrefix+key, &meta)
+	if err != nil || len(raw) == 0 {
+		return nil, raw, err
+	}
+	return &meta, raw, nil
+}
+
+// updateMetadata applies fn to the metadata of the secret stored under key, and stores it. The secret and its
+// metadata must be unchanged when it is stored, or fn is applied again to their new state.
+func (m *Manager) updateMetadata(ctx context.Context, key string, fn func(meta *model.Metadata)) (*model.Metadata, error) {
+	var meta *model.Metadata
+	w, err := m.applyWrite(ctx, func() *keyWrite {
+		w := &keyWrite{key: key}
+		token, err := m.store.Retrieve(ctx, key)
+		if err != nil {
+			w.err = fmt.Errorf(ErrKeyDoesNotExists, key)
+			return w
+		}
+		var raw string
+		meta, raw, err = m.readMetadata(ctx, key)
+		if err != nil {
+			w.err = err
+			return w
+		}
+		if meta == nil {
+			// secrets stored before metadata was kept get a record on their first update
+			meta = &model.Metadata{}
+		}
+		fn(meta)
+		metaOp, err := m.metadataOp(key, meta)
+		if err != nil {
+			w.err = err
+			return w
+		}
+		w.ops = []store.Op{
+			{Type: store.OpCheck, Key: key, Value: token},
+			{Type: store.OpCheck, Key: metadataPrefix + key, Value: raw},
+			metaOp,
+		}
+		return w
+	})
+	if err != nil {
+		m.log.Logger().Error().Msgf("error while storing metadata of %s: %s\n", w.key, err.Error())
+		return nil, err
+	}
+	return meta, nil
+}
+
+// readRecord decodes the json record stored under key into v, and returns it as it is stored, or "" if it doesn't
+// exist
+func (m *Manager) readRecord(ctx context.Context, key string, v any) (string, error) {
+	val, err := m.store.Retrieve(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal([]byte(val), v); err != nil {
+		return val, fmt.Errorf("error decoding record %s: %w", key, err)
+	}
+	return val, nil
+}
+
+// touchAccessed records that the secret stored under key, holding token, was just read, and returns its metadata. The
+// access time is only written once the recorded one is older than the access resolution of the manager, and the write
+// is best effort: it is tried once, and a read never fails or waits for it. Secrets read often then don't turn every
+// read into a write, and reads keep working on stores that can't be written to.
+func (m *Manager) touchAccessed(ctx context.Context, key, token string) *model.Metadata {
+	meta, raw, err := m.readMetadata(ctx, key)
+	if err != nil || m.accessResolution < 0 {
+		return meta
+	}
+	now := time.Now().UTC()
+	if meta != nil && meta.LastAccessedAt != nil && now.Sub(*meta.LastAccessedAt) < m.accessResolution {
+		return meta
+	}
+	// restores hold writes, and the read isn't held for them
+	if !m.restoring.TryRLock() {
+		return meta
+	}
+	defer m.restoring.RUnlock()
+
+	touched := &model.Metadata{}
+	if meta != nil {
+		cp := *meta
+		touched = &cp
+	}
+	// secrets stored before metadata was kept only get the access time
+	touched.LastAccessedAt = &now
+	metaOp, err := m.metadataOp(key, touched)
+	if err != nil {
+		return meta
+	}
+	err = m.batch(ctx, []store.Op{
+		{Type: store.OpCheck, Key: key, Value: token},
+		{Type: store.OpCheck, Key: metadataPrefix + key, Value: raw},
+		metaOp,
+	})
+	if err != nil {
+		m.log.Logger().Debug().Msgf("access time of %s not recorded: %s", key, err.Error())
+		return meta
+	}
+	return touched
+}
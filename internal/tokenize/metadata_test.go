@@ -0,0 +1,135 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errReadOnly = errors.New("store is read-only")
+
+// readOnlyStore refuses every write once readOnly is set
+type readOnlyStore struct {
+	*store.Map
+	readOnly bool
+}
+
+func (s *readOnlyStore) Batch(ctx context.Context, ops []store.Op) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	return s.Map.Batch(ctx, ops)
+}
+
+type MetadataTestSuite struct {
+	suite.Suite
+	log *vlog.Logger
+}
+
+func (suite *MetadataTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+}
+
+// manager creates a manager over s, with a keyring of its own
+func (suite *MetadataTestSuite) manager(ctx context.Context, s store.Store, opts ...Options) *Manager {
+	opts = append(opts, WithStore(s), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")), WithIdentity("vault-test"))
+	return NewManager(ctx, suite.log, opts...)
+}
+
+func (suite *MetadataTestSuite) TestMetadata() {
+	ctx := context.Background()
+	manager := suite.manager(ctx, store.NewSyncMap(ctx, suite.log))
+	key := "app/db/password"
+	_, err := manager.Tokenize(ContextWithIdentity(ctx, "alice"), key, "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	meta, err := manager.GetMetadata(ctx, key)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("alice", meta.CreatedBy)
+	suite.Require().False(meta.CreatedAt.IsZero(), "expected the creation time to be recorded")
+
+	description := "primary database"
+	tests := []struct {
+		name        string
+		write       func() error
+		revision    int64
+		description string
+		labels      map[string]string
+		updatedBy   string
+	}{
+		{"metadata edits keep the revision", func() error {
+			_, err := manager.UpdateMetadata(ctx, key, MetadataUpdate{Description: &description, Labels: map[string]string{"env": "prod", "team": "billing"}})
+			return err
+		}, 1, description, map[string]string{"env": "prod", "team": "billing"}, "vault-test"},
+		{"labels are removed by key", func() error {
+			_, err := manager.UpdateMetadata(ContextWithIdentity(ctx, "bob"), key, MetadataUpdate{RemoveLabels: []string{"team"}})
+			return err
+		}, 1, description, map[string]string{"env": "prod"}, "bob"},
+		{"patches bump the revision and keep the metadata", func() error {
+			_, err := manager.PatchTokenByID(ctx, key, "649sx8C30ubzd0cu")
+			return err
+		}, 2, description, map[string]string{"env": "prod"}, "vault-test"},
+	}
+	for _, tt := range tests {
+		suite.Require().NoErrorf(tt.write(), "%s: expected no errors\n", tt.name)
+		meta, err := manager.GetMetadata(ctx, key)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equalf(tt.revision, meta.Revision, "%s: expected revision %d\n", tt.name, tt.revision)
+		suite.Require().Equalf(tt.description, meta.Description, "%s: expected the description to be kept\n", tt.name)
+		suite.Require().Equalf(tt.labels, meta.Labels, "%s: expected these labels\n", tt.name)
+		suite.Require().Equalf(tt.updatedBy, meta.UpdatedBy, "%s: expected the update to be recorded\n", tt.name)
+		suite.Require().Equalf("alice", meta.CreatedBy, "%s: expected the creator to be kept\n", tt.name)
+	}
+
+	_, err = manager.UpdateMetadata(ctx, key, MetadataUpdate{Labels: map[string]string{"": "prod"}})
+	suite.Require().ErrorIs(err, ErrLabelKeyEmpty)
+}
+
+func (suite *MetadataTestSuite) TestAccessTime() {
+	ctx := context.Background()
+	key := "app/db/password"
+	tests := []struct {
+		name       string
+		resolution time.Duration
+		readOnly   bool
+		// recorded tells whether reads record an access time, and retouched whether a second read records it again
+		recorded  bool
+		retouched bool
+	}{
+		{"reads within the resolution record a single access", DefaultAccessResolution, false, true, false},
+		{"reads past the resolution record their access", time.Nanosecond, false, true, true},
+		{"negative resolutions record no access", -1, false, false, false},
+		{"reads of a read-only store succeed without recording their access", DefaultAccessResolution, true, false, false},
+	}
+	for _, tt := range tests {
+		s := &readOnlyStore{Map: store.NewSyncMap(ctx, suite.log)}
+		manager := suite.manager(ctx, s, WithAccessResolution(tt.resolution))
+		token, err := manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		s.readOnly = tt.readOnly
+
+		var accessed []*time.Time
+		for i := 0; i < 2; i++ {
+			ok, _, err := manager.Detokenize(ctx, key, token)
+			suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+			suite.Require().True(ok)
+			meta, err := manager.GetMetadata(ctx, key)
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			accessed = append(accessed, meta.LastAccessedAt)
+			time.Sleep(time.Millisecond)
+		}
+		suite.Require().Equalf(tt.recorded, accessed[0] != nil, "%s: expected the access to be recorded: %v\n", tt.name, tt.recorded)
+		if tt.recorded {
+			suite.Require().Equalf(tt.retouched, !accessed[0].Equal(*accessed[1]), "%s: expected the access to be recorded again: %v\n", tt.name, tt.retouched)
+		}
+	}
+}
+
+// TestMetadataSuite tests the metadata the manager keeps of secrets
+func TestMetadataSuite(t *testing.T) {
+	suite.Run(t, new(MetadataTestSuite))
+}
@@ -0,0 +1,309 @@
+package tokenize
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultNamespace names the keyspace of the vault itself. Selecting it, or no namespace, selects the root manager.
+	DefaultNamespace = "default"
+
+	// namespaceDataPrefix starts the store keys of the secrets of every namespace
+	namespaceDataPrefix = store.ReservedPrefix + "ns/"
+	// namespaceRecordPrefix starts the store keys of the records describing every namespace
+	namespaceRecordPrefix = store.ReservedPrefix + "namespaces/"
+)
+
+var (
+	ErrNamespaceInvalid  = errors.New("namespace name is invalid. it must be 1 to 63 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+	ErrNamespaceExists   = errors.New("namespace already exists")
+	ErrNamespaceNotFound = errors.New("namespace doesn't exist")
+	ErrNamespaceScoped   = errors.New("operation covers the whole vault, and can't be scoped to a namespace")
+	ErrQuotaInvalid      = errors.New("quota can't be negative")
+)
+
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Namespace describes an isolated keyspace of the vault
+type Namespace struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Quota caps the number of keys in the namespace. 0 means unlimited.
+	Quota int `json:"quota"`
+	// Keys is the number of keys currently in the namespace
+	Keys int `json:"keys"`
+}
+
+// namespaceRecord is what the store keeps about a namespace
+type namespaceRecord struct {
+	CreatedAt time.Time `json:"created_at"`
+	Quota     int       `json:"quota"`
+	// Salt is mixed into the derivation of the namespace cipher, so a namespace recreated under the same name
+	// doesn't get the keys of its predecessor
+	Salt string `json:"salt"`
+}
+
+// namespaceViews holds a single store view of the keys of every namespace, so the quota checks of all the writes to a
+// namespace are serialized with the writes they admit
+type namespaceViews struct {
+	views map[string]*store.Prefixed
+	sync.Mutex
+}
+
+// view returns the view of the keys of the namespace called name in inner, capped at quota keys
+func (v *namespaceViews) view(inner store.Store, name string, quota int, logger *vlog.Logger) *store.Prefixed {
+	v.Lock()
+	defer v.Unlock()
+	view, ok := v.views[name]
+	if !ok {
+		view = store.NewPrefixed(inner, namespaceDataPrefix+name+"/", quota, logger)
+		v.views[name] = view
+		return view
+	}
+	// the quota may have changed since the view was made
+	view.SetQuota(quota)
+	return view
+}
+
+// evict runs deleteFn with the views locked, and forgets the view of the namespace called name once it succeeded. No
+// view of the namespace is handed out while it is deleted, and the one made after, if it is created again, starts
+// over with the quota of the new namespace.
+func (v *namespaceViews) evict(name string, deleteFn func() error) error {
+	v.Lock()
+	defer v.Unlock()
+	if err := deleteFn(); err != nil {
+		return err
+	}
+	delete(v.views, name)
+	return nil
+}
+
+// InNamespace returns a manager scoped to the namespace called name. Its keys are stored under a prefix of their own,
+// and tokenized with a cipher derived from the root cipher for that namespace alone.
+func (m *Manager) InNamespace(ctx context.Context, name string) (*Manager, error) {
+	if len(name) == 0 || name == DefaultNamespace {
+		return m, nil
+	}
+	if len(m.namespace) > 0 {
+		return nil, ErrNamespaceScoped
+	}
+
+	record, err := m.namespaceRecord(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := deriveNamespaceCipher(m.keyring(), name, record.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := &Manager{
+		store:            m.views.view(m.store, name, record.Quota, m.log),
+		namespace:        name,
+		identity:         m.identity,
+		trashRetention:   m.trashRetention,
+		accessResolution: m.accessResolution,
+		metrics:          m.metrics,
+		views:            m.views,
+		restoring:        m.restoring,
+		seals:            m.seals,
+		log:              m.log,
+	}
+	scoped.setKeyring(cipher)
+	return scoped, nil
+}
+
+// CreateNamespace creates the namespace called name, capped at quota keys if quota is positive
+func (m *Manager) CreateNamespace(ctx context.Context, name string, quota int) (*Namespace, error) {
+	if err := m.checkNamespace(name, quota); err != nil {
+		return nil, err
+	}
+
+	if _, err := m.namespaceRecord(ctx, name); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceExists, name)
+	} else if !errors.Is(err, ErrNamespaceNotFound) {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	record := &namespaceRecord{CreatedAt: time.Now().UTC(), Quota: quota, Salt: hex.EncodeToString(salt)}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.store.Store(ctx, namespaceRecordPrefix+name, string(b)); err != nil {
+		m.log.Logger().Error().Msgf("error while storing namespace %s: %s\n", name, err.Error())
+		return nil, err
+	}
+
+	m.log.Logger().Info().Msgf("created namespace %s", name)
+	return &Namespace{Name: name, CreatedAt: record.CreatedAt, Quota: quota}, nil
+}
+
+// GetNamespace describes the namespace called name
+func (m *Manager) GetNamespace(ctx context.Context, name string) (*Namespace, error) {
+	if len(m.namespace) > 0 {
+		return nil, ErrNamespaceScoped
+	}
+	record, err := m.namespaceRecord(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.NewPrefixed(m.store, namespaceDataPrefix+name+"/", 0, m.log).Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Namespace{Name: name, CreatedAt: record.CreatedAt, Quota: record.Quota, Keys: keys}, nil
+}
+
+// ListNamespaces describes every namespace, sorted by name
+func (m *Manager) ListNamespaces(ctx context.Context) ([]*Namespace, error) {
+	if len(m.namespace) > 0 {
+		return nil, ErrNamespaceScoped
+	}
+	records, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []*Namespace{}
+	byName := map[string]*Namespace{}
+	for k, v := range records {
+		name, ok := strings.CutPrefix(k, namespaceRecordPrefix)
+		if !ok {
+			continue
+		}
+		var record namespaceRecord
+		if err = json.Unmarshal([]byte(v), &record); err != nil {
+			return nil, fmt.Errorf("error decoding namespace %s: %w", name, err)
+		}
+		ns := &Namespace{Name: name, CreatedAt: record.CreatedAt, Quota: record.Quota}
+		byName[name] = ns
+		namespaces = append(namespaces, ns)
+	}
+
+	// count the keys of every namespace in the same pass over the store
+	for k := range records {
+		if rest, ok := strings.CutPrefix(k, namespaceDataPrefix); ok {
+			if name, id, ok := strings.Cut(rest, "/"); ok && byName[name] != nil && !store.IsReserved(id) {
+				byName[name].Keys++
+			}
+		}
+	}
+
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces, nil
+}
+
+// SetNamespaceQuota caps the namespace called name at quota keys, or lifts its cap if quota is 0. Keys over a lowered
+// quota are kept, but no new key is accepted until the namespace is back under it.
+func (m *Manager) SetNamespaceQuota(ctx context.Context, name string, quota int) (*Namespace, error) {
+	if err := m.checkNamespace(name, quota); err != nil {
+		return nil, err
+	}
+	record, err := m.namespaceRecord(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	record.Quota = quota
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := m.store.Patch(ctx, namespaceRecordPrefix+name, string(b)); err != nil || !ok {
+		return nil, fmt.Errorf("error while updating namespace %s: %v", name, err)
+	}
+	return m.GetNamespace(ctx, name)
+}
+
+// DeleteNamespace deletes every key of the namespace called name, and then the namespace itself. It returns the
+// number of keys deleted.
+func (m *Manager) DeleteNamespace(ctx context.Context, name string) (int, error) {
+	ns, err := m.GetNamespace(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	err = m.views.evict(name, func() error {
+		if _, err := store.NewPrefixed(m.store, namespaceDataPrefix+name+"/", 0, m.log).Flush(ctx); err != nil {
+			return err
+		}
+		if ok, err := m.store.Delete(ctx, namespaceRecordPrefix+name); err != nil || !ok {
+			return fmt.Errorf("error while deleting namespace %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m.log.Logger().Info().Msgf("deleted namespace %s and its %d keys", name, ns.Keys)
+	return ns.Keys, nil
+}
+
+func (m *Manager) checkNamespace(name string, quota int) error {
+	if len(m.namespace) > 0 {
+		return ErrNamespaceScoped
+	}
+	if name == DefaultNamespace || !namespaceName.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrNamespaceInvalid, name)
+	}
+	if quota < 0 {
+		return ErrQuotaInvalid
+	}
+	return nil
+}
+
+func (m *Manager) namespaceRecord(ctx context.Context, name string) (*namespaceRecord, error) {
+	if !namespaceName.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrNamespaceInvalid, name)
+	}
+	val, err := m.store.Retrieve(ctx, namespaceRecordPrefix+name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record namespaceRecord
+	if err = json.Unmarshal([]byte(val), &record); err != nil {
+		return nil, fmt.Errorf("error decoding namespace %s: %w", name, err)
+	}
+	return &record, nil
+}
+
+// deriveNamespaceCipher derives the cipher and initialization vector of a namespace from the root cipher
+func deriveNamespaceCipher(root map[string]string, name, salt string) (map[string]string, error) {
+	if len(root[EnvKeyAESCipher]) == 0 {
+		return nil, ErrCipherToken404AES
+	}
+	if len(root[EnvKeyInitializationVector]) == 0 {
+		return nil, ErrCipherToken404IV
+	}
+	derive := func(label string, n int) string {
+		mac := hmac.New(sha256.New, []byte(root[EnvKeyAESCipher]+root[EnvKeyInitializationVector]))
+		fmt.Fprintf(mac, "vault/namespace/%s/%s/%s", label, name, salt)
+		// base64 keeps the derived bytes printable, as the cipher file holds them
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:n]
+	}
+	return map[string]string{
+		EnvKeyAESCipher:            derive("cipher", 32),
+		EnvKeyInitializationVector: derive("iv", 16),
+	}, nil
+}
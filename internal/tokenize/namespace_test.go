@@ -0,0 +1,164 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type NamespaceTestSuite struct {
+	suite.Suite
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *NamespaceTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.manager = NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+func (suite *NamespaceTestSuite) TestIsolation() {
+	ctx := context.Background()
+	for _, name := range []string{"team-a", "team-b"} {
+		_, err := suite.manager.CreateNamespace(ctx, name, 0)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+
+	tokens := map[string]string{}
+	for _, name := range []string{"team-a", "team-b"} {
+		scoped, err := suite.manager.InNamespace(ctx, name)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		tokens[name], err = scoped.Tokenize(ctx, "app/db/password", "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+	suite.Require().NotEqual(tokens["team-a"], tokens["team-b"], "expected each namespace to tokenize with a cipher of its own")
+
+	// the root manager sees none of the keys of the namespaces
+	all, err := suite.manager.GetAllTokens(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Empty(all)
+
+	// a namespace can't read the tokens of another
+	scoped, err := suite.manager.InNamespace(ctx, "team-b")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	ok, _, _ := scoped.Detokenize(ctx, "app/db/password", tokens["team-a"])
+	suite.Require().False(ok, "expected the token of another namespace to be refused")
+}
+
+func (suite *NamespaceTestSuite) TestQuota() {
+	ctx := context.Background()
+	_, err := suite.manager.CreateNamespace(ctx, "team-a", 2)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	scoped, err := suite.manager.InNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	for i := 0; i < 2; i++ {
+		_, err = scoped.Tokenize(ctx, fmt.Sprintf("app/key%d", i), "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+	_, err = scoped.Tokenize(ctx, "app/key2", "A1B2C3D4E5F6G7H8")
+	suite.Require().Truef(errors.Is(err, store.ErrQuotaExceeded), "expected the quota to be exceeded, but got %v\n", err)
+
+	// patches and metadata don't count against the quota
+	_, err = scoped.PatchTokenByID(ctx, "app/key0", "Z9Y8X7W6V5U4T3S2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// deletes make room, and raised quotas apply to the managers already made
+	_, err = scoped.HardDeleteTokenByID(ctx, "app/key0")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = scoped.Tokenize(ctx, "app/key2", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = suite.manager.SetNamespaceQuota(ctx, "team-a", 3)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = suite.manager.InNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = scoped.Tokenize(ctx, "app/key3", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	ns, err := suite.manager.GetNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(3, ns.Keys)
+}
+
+func (suite *NamespaceTestSuite) TestDeleteAndCreate() {
+	ctx := context.Background()
+	_, err := suite.manager.CreateNamespace(ctx, "team-a", 1)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	scoped, err := suite.manager.InNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = scoped.Tokenize(ctx, "app/key0", "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	deleted, err := suite.manager.DeleteNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(1, deleted)
+	_, err = suite.manager.InNamespace(ctx, "team-a")
+	suite.Require().Truef(errors.Is(err, ErrNamespaceNotFound), "expected the namespace to be gone, but got %v\n", err)
+
+	// the namespace created again under the same name gets a view of its own, with its own quota
+	_, err = suite.manager.CreateNamespace(ctx, "team-a", 2)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	recreated, err := suite.manager.InNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NotSame(scoped.store, recreated.store, "expected the view of the deleted namespace to be evicted")
+	for i := 0; i < 2; i++ {
+		_, err = recreated.Tokenize(ctx, fmt.Sprintf("app/key%d", i), "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+}
+
+func (suite *NamespaceTestSuite) TestConcurrentQuota() {
+	ctx := context.Background()
+	// a file store leaves the time for writes to interleave with the quota checks of others
+	dir := suite.T().TempDir()
+	file := store.NewFile(filepath.Join(dir, ".store"), suite.log)
+	suite.manager = NewManager(ctx, suite.log, WithStore(file), WithCipherLoc(filepath.Join(dir, ".cipher")))
+	defer suite.manager.Close(ctx)
+	quota := 5
+	_, err := suite.manager.CreateNamespace(ctx, "team-a", quota)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// every write goes through a manager of its own, as every request to the service does
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 40; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scoped, err := suite.manager.InNamespace(ctx, "team-a")
+			if err == nil {
+				_, err = scoped.Tokenize(ctx, fmt.Sprintf("app/key%d", i), "A1B2C3D4E5F6G7H8")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, store.ErrQuotaExceeded) && !errors.Is(err, store.ErrConflict):
+			suite.Failf("unexpected error", "expected the quota to be exceeded, but got %v\n", err)
+		}
+	}
+	ns, err := suite.manager.GetNamespace(ctx, "team-a")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(stored, ns.Keys, "expected every key stored to be counted")
+	suite.Require().LessOrEqual(ns.Keys, quota, "expected the quota to hold under concurrent writes")
+}
+
+// TestNamespaceSuite tests the namespaces of the manager
+func TestNamespaceSuite(t *testing.T) {
+	suite.Run(t, new(NamespaceTestSuite))
+}
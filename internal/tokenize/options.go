@@ -1,6 +1,9 @@
 package tokenize
 
-import "github.com/dark-enstein/vault/pkg/store"
+import (
+	"github.com/dark-enstein/vault/pkg/store"
+	"time"
+)
 
 type Options func(*Manager)
 
@@ -9,3 +12,39 @@ func WithStore(store store.Store) func(*Manager) {
 		manager.store = store
 	}
 }
+
+// WithCipherLoc sets the disk location the cipher is read from, and generated at if it doesn't exist yet
+func WithCipherLoc(loc string) func(*Manager) {
+	return func(manager *Manager) {
+		manager.cipherLoc = loc
+	}
+}
+
+// WithIdentity sets who changes made through the manager are recorded as made by, when a call doesn't carry an
+// identity of its own in its context
+func WithIdentity(identity string) func(*Manager) {
+	return func(manager *Manager) {
+		manager.identity = identity
+	}
+}
+
+// WithTrashRetention sets how long deleted tokens are kept in the trash before they are purged. Non-positive
+// retentions keep the default.
+func WithTrashRetention(retention time.Duration) func(*Manager) {
+	return func(manager *Manager) {
+		if retention > 0 {
+			manager.trashRetention = retention
+		}
+	}
+}
+
+// WithAccessResolution sets how long the recorded access time of a secret is kept when it is read again, so that
+// reads only write it once per resolution. Negative resolutions don't record access times at all, as suits read-only
+// stores and replicas, and zero keeps the default.
+func WithAccessResolution(resolution time.Duration) func(*Manager) {
+	return func(manager *Manager) {
+		if resolution != 0 {
+			manager.accessResolution = resolution
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tokenize
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/pkg/store"
+	"sync"
+	"time"
+)
+
+// Operations of a Manager whose calls are counted
+const (
+	OpGet        = "get"
+	OpList       = "list"
+	OpTokenize   = "tokenize"
+	OpDetokenize = "detokenize"
+	OpPatch      = "patch"
+	OpDelete     = "delete"
+	OpUndelete   = "undelete"
+	OpBatch      = "batch"
+	OpImport     = "import"
+	OpExport     = "export"
+)
+
+// OpStats counts the calls of an operation, those that failed, and how long they took
+type OpStats struct {
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+	// Total sums the latencies of the calls, Mean averages them, and Max is the longest
+	Total time.Duration `json:"total"`
+	Mean  time.Duration `json:"mean"`
+	Max   time.Duration `json:"max"`
+}
+
+// Stats describes the store of a manager, and the operations it served since it was created
+type Stats struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Since     time.Time         `json:"since"`
+	Store     *store.StoreStats `json:"store"`
+	// Operations holds the stats of every operation called at least once, by name
+	Operations map[string]OpStats `json:"operations"`
+	// Tampered is the tampering a write detected in the integrity records of the keyspace, until it is resealed
+	Tampered *Tamper `json:"tampered,omitempty"`
+}
+
+// opMetrics counts the operations of a manager, and of the namespaced managers made from it
+type opMetrics struct {
+	since time.Time
+	ops   map[string]*OpStats
+	sync.Mutex
+}
+
+func newOpMetrics() *opMetrics {
+	return &opMetrics{since: time.Now(), ops: map[string]*OpStats{}}
+}
+
+// observe counts a call of op started at start, failed if *errp isn't nil. It is deferred by the operations, with
+// the address of their named error result.
+func (om *opMetrics) observe(op string, start time.Time, errp *error) {
+	elapsed := time.Since(start)
+	om.Lock()
+	defer om.Unlock()
+	st, ok := om.ops[op]
+	if !ok {
+		st = &OpStats{}
+		om.ops[op] = st
+	}
+	st.Count++
+	if *errp != nil {
+		st.Errors++
+	}
+	st.Total += elapsed
+	if elapsed > st.Max {
+		st.Max = elapsed
+	}
+}
+
+// snapshot returns a copy of the stats of every operation
+func (om *opMetrics) snapshot() map[string]OpStats {
+	om.Lock()
+	defer om.Unlock()
+	ops := make(map[string]OpStats, len(om.ops))
+	for op, st := range om.ops {
+		cp := *st
+		cp.Mean = cp.Total / time.Duration(cp.Count)
+		ops[op] = cp
+	}
+	return ops
+}
+
+// Stats returns the stats of the store of the manager, and of the operations it served. Namespaced managers share
+// the operation counts of the manager they were made from, and describe the keys of their namespace alone.
+func (m *Manager) Stats(ctx context.Context) (*Stats, error) {
+	st, err := store.Stats(ctx, m.store)
+	if err != nil {
+		return nil, err
+	}
+	tamper, err := m.readTamper(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{Namespace: m.namespace, Since: m.metrics.since, Store: st, Operations: m.metrics.snapshot(), Tampered: tamper}, nil
+}
@@ -0,0 +1,63 @@
+package tokenize
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+)
+
+type StatsTestSuite struct {
+	suite.Suite
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *StatsTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.manager = NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+func (suite *StatsTestSuite) TestStats() {
+	ctx := context.Background()
+	tokens := map[string]string{}
+	for _, key := range []string{"app/db/password", "app/db/user", "app/cache/password"} {
+		token, err := suite.manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		tokens[key] = token
+	}
+	for key, token := range tokens {
+		_, _, err := suite.manager.Detokenize(ctx, key, token)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+	_, err := suite.manager.PatchTokenByID(ctx, "app/db/missing", "649sx8C30ubzd0cu")
+	suite.Require().Error(err)
+
+	stats, err := suite.manager.Stats(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(uint64(len(tokens)), stats.Operations[OpTokenize].Count)
+	suite.Require().Equal(uint64(len(tokens)), stats.Operations[OpDetokenize].Count)
+	suite.Require().Equal(uint64(1), stats.Operations[OpPatch].Errors)
+	suite.Require().Equal(store.DriverMap, stats.Store.Driver)
+	// the metadata and integrity records are counted with the tokens
+	suite.Require().Greater(stats.Store.Records, int64(len(tokens)))
+
+	// namespaced managers share the operation counts, and count the records of their namespace alone
+	_, err = suite.manager.CreateNamespace(ctx, "billing", 0)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	scoped, err := suite.manager.InNamespace(ctx, "billing")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	scopedStats, err := scoped.Stats(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("billing", scopedStats.Namespace)
+	suite.Require().Zero(scopedStats.Store.Records)
+	suite.Require().Equal(stats.Operations[OpTokenize].Count, scopedStats.Operations[OpTokenize].Count)
+}
+
+// TestStatsSuite tests the stats the manager keeps of its store and operations
+func TestStatsSuite(t *testing.T) {
+	suite.Run(t, new(StatsTestSuite))
+}
@@ -0,0 +1,199 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy decides what Import does with a key that already exists
+type ConflictPolicy string
+
+const (
+	// ConflictSkip keeps the existing token and skips the imported value
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite replaces the existing token with the imported value
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictFail aborts the import before anything is written
+	ConflictFail ConflictPolicy = "fail"
+)
+
+var (
+	ErrConflictPolicyInvalid = errors.New("conflict policy is invalid. options: skip, overwrite, fail")
+	ErrImportConflict        = errors.New("import conflicts with existing keys")
+	ErrImportIDEmpty         = errors.New("imported secret has an empty id")
+)
+
+// ParseConflictPolicy parses a conflict policy name
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(s)); p {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrConflictPolicyInvalid, s)
+	}
+}
+
+// ImportReport summarizes an Import
+type ImportReport struct {
+	Imported    int      `json:"imported"`
+	Overwritten int      `json:"overwritten"`
+	Skipped     int      `json:"skipped"`
+	Conflicts   []string `json:"conflicts,omitempty"`
+}
+
+// Import tokenizes and stores the plaintext values of tokens. Every key is validated before anything is written, and
+// keys that already exist, or that appear more than once in tokens, are handled according to policy.
+func (m *Manager) Import(ctx context.Context, tokens []*model.Tokenize, policy ConflictPolicy) (_ *ImportReport, err error) {
+	defer m.metrics.observe(OpImport, time.Now(), &err)
+	log := m.log.Logger()
+	report := &ImportReport{}
+
+	creates := map[string]string{}
+	overwrites := map[string]string{}
+	conflicts := map[string]bool{}
+	for _, token := range tokens {
+		if len(token.ID) == 0 {
+			return report, ErrImportIDEmpty
+		}
+
+		// duplicates within the import are tracked below, so only validate each key once against the store
+		resps, _ := m.Validate(ctx, uniqueKeys(token), false)
+		conflicting := make(map[string]bool, len(resps))
+		for _, resp := range resps {
+			conflicting[resp.Key] = true
+		}
+
+		for _, child := range token.Data {
+			key := GetCombinedKey(token.ID, child.Key)
+			_, created := creates[key]
+			_, overwritten := overwrites[key]
+			if !conflicting[key] && !created && !overwritten {
+				creates[key] = child.Value
+				continue
+			}
+
+			if !conflicts[key] {
+				conflicts[key] = true
+				report.Conflicts = append(report.Conflicts, key)
+			}
+			switch policy {
+			case ConflictSkip:
+				report.Skipped++
+			case ConflictOverwrite:
+				if created {
+					// a duplicate within the import, the last value wins
+					creates[key] = child.Value
+				} else {
+					overwrites[key] = child.Value
+				}
+			}
+		}
+	}
+
+	if policy == ConflictFail && len(report.Conflicts) > 0 {
+		log.Error().Msgf("import conflicts with %d existing keys\n", len(report.Conflicts))
+		return report, fmt.Errorf("%w: %s", ErrImportConflict, strings.Join(report.Conflicts, ", "))
+	}
+
+	if _, err := m.TokenizeBatch(ctx, creates); err != nil {
+		return report, err
+	}
+	report.Imported = len(creates)
+
+	for _, key := range sortedKeys(overwrites) {
+		if _, err := m.PatchTokenByID(ctx, key, overwrites[key]); err != nil {
+			return report, err
+		}
+		report.Overwritten++
+	}
+
+	log.Info().Msgf("imported %d secrets, overwrote %d, skipped %d", report.Imported, report.Overwritten, report.Skipped)
+	return report, nil
+}
+
+// TokenizeBatch tokenizes every value in records, and stores the tokens under their keys in a single batch: all of
+// them, or none if one fails. It returns the generated tokens by key.
+func (m *Manager) TokenizeBatch(ctx context.Context, records map[string]string) (map[string]string, error) {
+	kvs := make([]KeyValue, 0, len(records))
+	for _, key := range sortedKeys(records) {
+		kvs = append(kvs, KeyValue{Key: key, Value: records[key]})
+	}
+	results, err := m.TokenizeMany(ctx, kvs, BatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string, len(results))
+	for _, result := range results {
+		tokens[result.Key] = result.Token
+	}
+	return tokens, nil
+}
+
+// Export returns every secret in the store grouped by id, sorted by key. Values are tokens, or the detokenized
+// plaintext if plaintext is set.
+func (m *Manager) Export(ctx context.Context, plaintext bool) (_ []*model.Tokenize, err error) {
+	defer m.metrics.observe(OpExport, time.Now(), &err)
+	log := m.log.Logger()
+
+	records, err := m.store.RetrieveAll(ctx)
+	if err != nil {
+		log.Error().Msgf("error while retrieving all keys: %s\n", err.Error())
+		return nil, err
+	}
+
+	tokens := []*model.Tokenize{}
+	byID := map[string]*model.Tokenize{}
+	for _, key := range sortedKeys(records) {
+		if store.IsReserved(key) {
+			continue
+		}
+		val := records[key]
+		if plaintext {
+			if val, err = Detokenize(val, m.keyring()); err != nil {
+				log.Error().Msgf("error occurred while decrypting token for %s: %s\n", key, err.Error())
+				return nil, fmt.Errorf("error decrypting token for %s: %w", key, err)
+			}
+		}
+
+		id, child := SplitKey(key)
+		token, ok := byID[id]
+		if !ok {
+			token = &model.Tokenize{ID: id}
+			byID[id] = token
+			tokens = append(tokens, token)
+		}
+		token.Data = append(token.Data, model.Child{Key: child, Value: val})
+	}
+
+	log.Debug().Msgf("exported the secrets of %d ids", len(tokens))
+	return tokens, nil
+}
+
+// uniqueKeys returns a copy of token holding only the first occurrence of each key
+func uniqueKeys(token *model.Tokenize) *model.Tokenize {
+	seen := make(map[string]bool, len(token.Data))
+	unique := &model.Tokenize{ID: token.ID}
+	for _, child := range token.Data {
+		if !seen[child.Key] {
+			seen[child.Key] = true
+			unique.Data = append(unique.Data, child)
+		}
+	}
+	return unique
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
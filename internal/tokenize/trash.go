@@ -0,0 +1,212 @@
+package tokenize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted tokens are kept in the trash by default
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+var (
+	// trashPrefix starts the store keys of the trashed secrets
+	trashPrefix = store.ReservedPrefix + "trash/"
+)
+
+var (
+	ErrNotInTrash    = errors.New("not in the trash")
+	ErrTrashConflict = errors.New("a token with the same id exists. delete it first to undelete this one")
+)
+
+// trashRecord keeps a deleted secret with its metadata in the trash
+type trashRecord struct {
+	Token     string          `json:"token"`
+	DeletedAt time.Time       `json:"deleted_at"`
+	DeletedBy string          `json:"deleted_by,omitempty"`
+	Metadata  *model.Metadata `json:"metadata,omitempty"`
+}
+
+// PurgeOptions selects the trashed tokens Purge deletes for good. Without options, the tokens past their retention are.
+type PurgeOptions struct {
+	// ID purges a single token, whatever its age
+	ID string
+	// All empties the trash
+	All bool
+}
+
+// UndeleteTokenByID moves the token identified by ID back from the trash, with its metadata
+func (m *Manager) UndeleteTokenByID(ctx context.Context, id string) (err error) {
+	defer m.metrics.observe(OpUndelete, time.Now(), &err)
+	log := m.log.Logger()
+
+	if store.IsReserved(id) {
+		return ErrKeyReserved
+	}
+	defer m.writing()()
+	key := m.storedKeyIn(ctx, trashPrefix, id)
+	var record trashRecord
+	raw, err := m.readRecord(ctx, trashPrefix+key, &record)
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return fmt.Errorf("%s: %w", id, ErrNotInTrash)
+	}
+	if _, err = m.store.Retrieve(ctx, key); err == nil {
+		return fmt.Errorf("%s: %w", id, ErrTrashConflict)
+	}
+
+	// the token, its metadata and its trash record move together
+	ops := []store.Op{
+		{Type: store.OpCheck, Key: trashPrefix + key, Value: raw},
+		{Type: store.OpStore, Key: key, Value: record.Token},
+		{Type: store.OpDelete, Key: trashPrefix + key},
+	}
+	if record.Metadata != nil {
+		// an undeleted secret is a new revision, so writes conditional on the revision it was deleted at fail
+		record.Metadata.Revision++
+		metaOp, err := m.metadataOp(key, record.Metadata)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, metaOp)
+	}
+	if err = m.batch(ctx, ops); err != nil {
+		log.Error().Msgf("error while restoring %s from the trash: %s\n", key, err.Error())
+		if errors.Is(err, store.ErrKeyExists) {
+			return fmt.Errorf("%s: %w", id, ErrTrashConflict)
+		}
+		return unwrapBatchError(err)
+	}
+
+	log.Debug().Msgf("undeleted %s", key)
+	return nil
+}
+
+// ListTrash returns the tokens in the trash, sorted by key
+func (m *Manager) ListTrash(ctx context.Context) ([]*model.Trashed, error) {
+	entries, err := m.trashEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trashed := make([]*model.Trashed, 0, len(entries))
+	for _, entry := range entries {
+		trashed = append(trashed, entry.trashed)
+	}
+	return trashed, nil
+}
+
+// trashEntry is a token in the trash, with its trash record as it is stored
+type trashEntry struct {
+	trashed *model.Trashed
+	raw     string
+}
+
+// trashEntries returns the tokens in the trash, sorted by key
+func (m *Manager) trashEntries(ctx context.Context) ([]trashEntry, error) {
+	page, err := store.Scan(ctx, m.store, store.ScanOptions{Prefix: trashPrefix})
+	if err != nil {
+		m.log.Logger().Error().Msgf("error while listing the trash: %s\n", err.Error())
+		return nil, err
+	}
+
+	entries := make([]trashEntry, 0, len(page.Records))
+	for _, r := range page.Records {
+		var record trashRecord
+		if err = json.Unmarshal([]byte(r.Value), &record); err != nil {
+			return nil, fmt.Errorf("error decoding trashed token %s: %w", r.Key, err)
+		}
+		entries = append(entries, trashEntry{
+			trashed: &model.Trashed{
+				ID:        r.Key[len(trashPrefix):],
+				DeletedAt: record.DeletedAt,
+				DeletedBy: record.DeletedBy,
+				PurgeAt:   record.DeletedAt.Add(m.trashRetention),
+			},
+			raw: r.Value,
+		})
+	}
+	return entries, nil
+}
+
+// Purge deletes the trashed tokens selected by opts for good, and returns how many it deleted. Tokens undeleted, or
+// deleted again, while they are purged are left as they are.
+func (m *Manager) Purge(ctx context.Context, opts PurgeOptions) (int, error) {
+	log := m.log.Logger()
+	defer m.writing()()
+
+	if len(opts.ID) > 0 {
+		key := m.storedKeyIn(ctx, trashPrefix, opts.ID)
+		raw, err := m.store.Retrieve(ctx, trashPrefix+key)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", opts.ID, ErrNotInTrash)
+		}
+		if err = m.purge(ctx, key, raw); err != nil {
+			return 0, unwrapBatchError(err)
+		}
+		log.Debug().Msgf("purged %s from the trash", key)
+		return 1, nil
+	}
+
+	entries, err := m.trashEntries(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	purged := 0
+	for _, entry := range entries {
+		if !opts.All && entry.trashed.PurgeAt.After(now) {
+			continue
+		}
+		err = m.purge(ctx, entry.trashed.ID, entry.raw)
+		if errors.Is(err, store.ErrConflict) {
+			log.Debug().Msgf("%s changed in the trash while it was purged, leaving it", entry.trashed.ID)
+			continue
+		}
+		if err != nil {
+			return purged, fmt.Errorf("error while purging %s: %w", entry.trashed.ID, unwrapBatchError(err))
+		}
+		purged++
+	}
+	log.Debug().Msgf("purged %d tokens from the trash", purged)
+	return purged, nil
+}
+
+// purge deletes the trash record of the token stored under key for good, if it is still raw
+func (m *Manager) purge(ctx context.Context, key, raw string) error {
+	return m.batch(ctx, []store.Op{
+		{Type: store.OpCheck, Key: trashPrefix + key, Value: raw},
+		{Type: store.OpDelete, Key: trashPrefix + key},
+	})
+}
+
+// PurgeExpired purges the tokens past their retention from the trash. On the root manager, it purges the trash of
+// every namespace too.
+func (m *Manager) PurgeExpired(ctx context.Context) (int, error) {
+	purged, err := m.Purge(ctx, PurgeOptions{})
+	if err != nil || len(m.namespace) > 0 {
+		return purged, err
+	}
+
+	namespaces, err := m.ListNamespaces(ctx)
+	if err != nil {
+		return purged, err
+	}
+	for _, ns := range namespaces {
+		scoped, err := m.InNamespace(ctx, ns.Name)
+		if err != nil {
+			return purged, err
+		}
+		n, err := scoped.Purge(ctx, PurgeOptions{})
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("error while purging namespace %s: %w", ns.Name, err)
+		}
+	}
+	return purged, nil
+}
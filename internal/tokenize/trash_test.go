@@ -0,0 +1,126 @@
+package tokenize
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type TrashTestSuite struct {
+	suite.Suite
+	manager *Manager
+	log     *vlog.Logger
+}
+
+func (suite *TrashTestSuite) SetupTest() {
+	ctx := context.Background()
+	suite.log = vlog.New(true)
+	suite.manager = NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")))
+}
+
+func (suite *TrashTestSuite) TestUndelete() {
+	ctx := context.Background()
+	key := "app/db/password"
+	token, err := suite.manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	_, err = suite.manager.DeleteTokenByID(ctx, key)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, _, err = suite.manager.Detokenize(ctx, key, token)
+	suite.Require().Error(err, "expected the deleted token to be gone")
+	trashed, err := suite.manager.ListTrash(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(trashed, 1)
+	suite.Require().Equal(key, trashed[0].ID)
+
+	// the token comes back with its metadata, at a new revision
+	suite.Require().NoError(suite.manager.UndeleteTokenByID(ctx, key))
+	ok, val, err := suite.manager.Detokenize(ctx, key, token)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(ok, "expected the undeleted token to detokenize")
+	suite.Require().Equal("A1B2C3D4E5F6G7H8", val)
+	meta, err := suite.manager.GetMetadata(ctx, key)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(int64(2), meta.Revision)
+
+	tests := []struct {
+		name  string
+		setup func() error
+		err   error
+	}{
+		{"undelete of a token not in the trash", func() error { return nil }, ErrNotInTrash},
+		{"undelete over a token stored since", func() error {
+			if _, err := suite.manager.DeleteTokenByID(ctx, key); err != nil {
+				return err
+			}
+			_, err := suite.manager.Tokenize(ctx, key, "649sx8C30ubzd0cu")
+			return err
+		}, ErrTrashConflict},
+		{"undelete after a purge and a hard delete", func() error {
+			if _, err := suite.manager.Purge(ctx, PurgeOptions{All: true}); err != nil {
+				return err
+			}
+			_, err := suite.manager.HardDeleteTokenByID(ctx, key)
+			return err
+		}, ErrNotInTrash},
+	}
+	for _, tt := range tests {
+		suite.Require().NoErrorf(tt.setup(), "%s: expected no errors setting up\n", tt.name)
+		err = suite.manager.UndeleteTokenByID(ctx, key)
+		suite.Require().Truef(errors.Is(err, tt.err), "%s: expected %v, but got %v\n", tt.name, tt.err, err)
+	}
+}
+
+func (suite *TrashTestSuite) TestPurge() {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		retention time.Duration
+		opts      PurgeOptions
+		purged    int
+		left      []string
+	}{
+		{"tokens within their retention are kept", DefaultTrashRetention, PurgeOptions{}, 0, []string{"app/cache/password", "app/db/password"}},
+		{"tokens past their retention are purged", time.Nanosecond, PurgeOptions{}, 2, nil},
+		{"a single token is purged whatever its age", DefaultTrashRetention, PurgeOptions{ID: "app/db/password"}, 1, []string{"app/cache/password"}},
+		{"the whole trash is emptied", DefaultTrashRetention, PurgeOptions{All: true}, 2, nil},
+	}
+	for _, tt := range tests {
+		manager := NewManager(ctx, suite.log, WithStore(store.NewSyncMap(ctx, suite.log)), WithCipherLoc(filepath.Join(suite.T().TempDir(), ".cipher")), WithTrashRetention(tt.retention))
+		for _, key := range []string{"app/db/password", "app/cache/password"} {
+			_, err := manager.Tokenize(ctx, key, "A1B2C3D4E5F6G7H8")
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			_, err = manager.DeleteTokenByID(ctx, key)
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		}
+
+		purged, err := manager.Purge(ctx, tt.opts)
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", tt.name, err)
+		suite.Require().Equalf(tt.purged, purged, "%s: expected %d tokens purged\n", tt.name, tt.purged)
+		trashed, err := manager.ListTrash(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		var left []string
+		for _, t := range trashed {
+			left = append(left, t.ID)
+		}
+		suite.Require().Equalf(tt.left, left, "%s: expected these tokens left in the trash\n", tt.name)
+
+		// purges are writes of the vault, which verifies as it did before
+		reports, err := manager.Verify(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Falsef(reports[0].Tampered, "%s: expected the vault to verify after the purge\n", tt.name)
+	}
+
+	_, err := suite.manager.Purge(ctx, PurgeOptions{ID: "app/db/missing"})
+	suite.Require().ErrorIs(err, ErrNotInTrash)
+}
+
+// TestTrashSuite tests the trash of the manager
+func TestTrashSuite(t *testing.T) {
+	suite.Run(t, new(TrashTestSuite))
+}
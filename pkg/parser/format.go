@@ -0,0 +1,225 @@
+package parser
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/joho/godotenv"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Format is an interchange format secrets are imported from and exported to
+type Format string
+
+const (
+	// FormatJSON is a json array of model.Tokenize objects
+	FormatJSON Format = "json"
+	// FormatCSV is a csv file with an id,key,value header
+	FormatCSV Format = "csv"
+	// FormatDotenv is a .env file, with each variable named <id>__<key>, and the path separators of ids replaced
+	// with __ too, as in team__app__db__password
+	FormatDotenv Format = "dotenv"
+
+	// DotenvDelimiter joins the path segments of the id and the key of a secret into a dotenv variable name
+	DotenvDelimiter = "__"
+
+	// pathSeparator separates the segments of the path of an id
+	pathSeparator = "/"
+)
+
+var (
+	ErrFormatInvalid = errors.New("format is invalid. options: json, csv, dotenv")
+	ErrCSVHeader     = errors.New("csv header must be id,key,value")
+)
+
+var csvHeader = []string{"id", "key", "value"}
+
+// ParseFormat parses a format name
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatJSON, FormatCSV, FormatDotenv:
+		return f, nil
+	case "env":
+		return FormatDotenv, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrFormatInvalid, s)
+	}
+}
+
+// FormatFromPath infers the format of a file from its name, defaulting to json
+func FormatFromPath(path string) Format {
+	base := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasSuffix(base, ".csv"):
+		return FormatCSV
+	case base == ".env" || strings.HasSuffix(base, ".env"):
+		return FormatDotenv
+	default:
+		return FormatJSON
+	}
+}
+
+// Decode reads the secrets in r, encoded in format f
+func Decode(r io.Reader, f Format) ([]*model.Tokenize, error) {
+	switch f {
+	case FormatJSON:
+		return decodeJSON(r)
+	case FormatCSV:
+		return decodeCSV(r)
+	case FormatDotenv:
+		return decodeDotenv(r)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFormatInvalid, f)
+	}
+}
+
+// Encode writes tokens to w, encoded in format f
+func Encode(w io.Writer, f Format, tokens []*model.Tokenize) error {
+	switch f {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tokens)
+	case FormatCSV:
+		return encodeCSV(w, tokens)
+	case FormatDotenv:
+		return encodeDotenv(w, tokens)
+	default:
+		return fmt.Errorf("%w: %s", ErrFormatInvalid, f)
+	}
+}
+
+// decodeJSON accepts a single model.Tokenize object, an array of them, or the model.All shape served on /all
+func decodeJSON(r io.Reader) ([]*model.Tokenize, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := strings.TrimSpace(string(content))
+	if strings.HasPrefix(trimmed, "[") {
+		var tokens []*model.Tokenize
+		if err = json.Unmarshal(content, &tokens); err != nil {
+			return nil, fmt.Errorf("error decoding json: %w", err)
+		}
+		return tokens, nil
+	}
+
+	var obj struct {
+		model.Tokenize
+		Tokens []*model.Tokenize `json:"tokens"`
+	}
+	if err = json.Unmarshal(content, &obj); err != nil {
+		return nil, fmt.Errorf("error decoding json: %w", err)
+	}
+	if obj.Tokens != nil {
+		return obj.Tokens, nil
+	}
+	return []*model.Tokenize{&obj.Tokenize}, nil
+}
+
+func decodeCSV(r io.Reader) ([]*model.Tokenize, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding csv: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	for i := range csvHeader {
+		if strings.ToLower(strings.TrimSpace(rows[0][i])) != csvHeader[i] {
+			return nil, ErrCSVHeader
+		}
+	}
+
+	g := newGrouper()
+	for _, row := range rows[1:] {
+		g.add(row[0], row[1], row[2])
+	}
+	return g.tokens, nil
+}
+
+func encodeCSV(w io.Writer, tokens []*model.Tokenize) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, token := range tokens {
+		for _, child := range token.Data {
+			cw.Write([]string{token.ID, child.Key, child.Value})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func decodeDotenv(r io.Reader) ([]*model.Tokenize, error) {
+	env, err := godotenv.Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding dotenv: %w", err)
+	}
+
+	// godotenv parses into a map, so sort the variables to keep the order stable
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	g := newGrouper()
+	for _, name := range names {
+		// the last segment is the key, unless the name is a bare id
+		id, key := name, ""
+		if i := strings.LastIndex(name, DotenvDelimiter); i >= 0 {
+			id = strings.ReplaceAll(name[:i], DotenvDelimiter, pathSeparator)
+			key = name[i+len(DotenvDelimiter):]
+		}
+		g.add(id, key, env[name])
+	}
+	return g.tokens, nil
+}
+
+func encodeDotenv(w io.Writer, tokens []*model.Tokenize) error {
+	env := map[string]string{}
+	for _, token := range tokens {
+		for _, child := range token.Data {
+			name := strings.ReplaceAll(token.ID, pathSeparator, DotenvDelimiter)
+			if len(name) == 0 {
+				name = child.Key
+			} else if len(child.Key) > 0 {
+				name += DotenvDelimiter + child.Key
+			}
+			env[name] = child.Value
+		}
+	}
+	content, err := godotenv.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, content+"\n")
+	return err
+}
+
+// grouper collects id, key, value rows into tokens, one per id, in the order ids are first seen
+type grouper struct {
+	tokens []*model.Tokenize
+	byID   map[string]*model.Tokenize
+}
+
+func newGrouper() *grouper {
+	return &grouper{byID: map[string]*model.Tokenize{}}
+}
+
+func (g *grouper) add(id, key, value string) {
+	token, ok := g.byID[id]
+	if !ok {
+		token = &model.Tokenize{ID: id}
+		g.byID[id] = token
+		g.tokens = append(g.tokens, token)
+	}
+	token.Data = append(token.Data, model.Child{Key: key, Value: value})
+}
@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+)
+
+type FormatTestSuite struct {
+	suite.Suite
+	tokens []*model.Tokenize
+}
+
+func (suite *FormatTestSuite) SetupTest() {
+	suite.tokens = []*model.Tokenize{
+		{ID: "customer123", Data: []model.Child{{Key: "card", Value: "4111 1111, 1111 1111"}, {Key: "ssn", Value: "123-45-6789"}}},
+		{ID: "dbpassword", Data: []model.Child{{Key: "", Value: "p@ss\"word"}}},
+		{ID: "team/app/db", Data: []model.Child{{Key: "password", Value: "hunter2"}}},
+	}
+}
+
+func (suite *FormatTestSuite) TestRoundTrip() {
+	for _, f := range []Format{FormatJSON, FormatCSV, FormatDotenv} {
+		var buf bytes.Buffer
+		err := Encode(&buf, f, suite.tokens)
+		suite.Require().NoErrorf(err, "expected no errors encoding %s, but got this %v\n", f, err)
+
+		tokens, err := Decode(&buf, f)
+		suite.Require().NoErrorf(err, "expected no errors decoding %s, but got this %v\n", f, err)
+		suite.Require().Equalf(suite.tokens, tokens, "expected %s round trip to preserve secrets", f)
+	}
+}
+
+func (suite *FormatTestSuite) TestDecodeJSONShapes() {
+	single := `{"id":"customer123","data":[{"key":"ssn","value":"123-45-6789"}]}`
+	tokens, err := Decode(strings.NewReader(single), FormatJSON)
+	suite.Require().NoError(err)
+	suite.Require().Len(tokens, 1)
+	suite.Require().Equal("customer123", tokens[0].ID)
+
+	all := `{"tokens":[` + single + `]}`
+	tokens, err = Decode(strings.NewReader(all), FormatJSON)
+	suite.Require().NoError(err)
+	suite.Require().Len(tokens, 1)
+	suite.Require().Equal("123-45-6789", tokens[0].Data[0].Value)
+}
+
+func (suite *FormatTestSuite) TestDecodeCSVHeader() {
+	_, err := Decode(strings.NewReader("name,secret,value\na,b,c\n"), FormatCSV)
+	suite.Require().Truef(errors.Is(err, ErrCSVHeader), "expected csv header error, but got %v\n", err)
+}
+
+func (suite *FormatTestSuite) TestFormat() {
+	suite.Require().Equal(FormatCSV, FormatFromPath("secrets.CSV"))
+	suite.Require().Equal(FormatDotenv, FormatFromPath("/app/.env"))
+	suite.Require().Equal(FormatDotenv, FormatFromPath("prod.env"))
+	suite.Require().Equal(FormatJSON, FormatFromPath("-"))
+
+	f, err := ParseFormat("env")
+	suite.Require().NoError(err)
+	suite.Require().Equal(FormatDotenv, f)
+	_, err = ParseFormat("yaml")
+	suite.Require().Truef(errors.Is(err, ErrFormatInvalid), "expected format error, but got %v\n", err)
+}
+
+func (suite *FormatTestSuite) TearDownTest() {}
+
+// TestFormatSuite tests encoding and decoding secrets in the interchange formats
+func TestFormatSuite(t *testing.T) {
+	suite.Run(t, new(FormatTestSuite))
+}
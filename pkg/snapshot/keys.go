@@ -0,0 +1,225 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	ModePassphrase = "passphrase"
+	ModeRecipient  = "x25519"
+
+	// DefaultIterations is the PBKDF2 iteration count used to stretch backup passphrases
+	DefaultIterations = 600000
+	// MaxIterations caps the PBKDF2 iteration count a snapshot header may ask for. The header is only authenticated
+	// with the key derived from it, so the count is checked before any work is done.
+	MaxIterations = 10 * DefaultIterations
+	keySize       = 32
+	saltSize      = 16
+)
+
+var (
+	ErrPassphraseEmpty = errors.New("backup passphrase is empty")
+	ErrIterations      = fmt.Errorf("snapshot iteration count must be between 1 and %d", MaxIterations)
+	ErrModeMismatch    = errors.New("snapshot was sealed with a different kind of key")
+	ErrWrongIdentity   = errors.New("snapshot was sealed for a different recipient")
+	ErrSealOnly        = errors.New("a recipient key can only seal snapshots, use its identity to open them")
+	ErrOpenOnly        = errors.New("an identity can only open snapshots, use its recipient key to seal them")
+)
+
+var labelRecipient = []byte("vault/snapshot/x25519")
+
+// Keyer derives the key a snapshot payload is sealed under
+type Keyer interface {
+	// seal derives a fresh key, recording in h whatever is needed to derive it again
+	seal(h *Header) ([]byte, error)
+	// open derives the key recorded in h
+	open(h *Header) ([]byte, error)
+}
+
+// Passphrase seals and opens snapshots with a key stretched from a passphrase
+type Passphrase string
+
+func (p Passphrase) seal(h *Header) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, ErrPassphraseEmpty
+	}
+	h.Mode = ModePassphrase
+	h.Iterations = DefaultIterations
+	h.Salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, h.Salt); err != nil {
+		return nil, err
+	}
+	return pbkdf2([]byte(p), h.Salt, h.Iterations, keySize), nil
+}
+
+func (p Passphrase) open(h *Header) ([]byte, error) {
+	if h.Mode != ModePassphrase {
+		return nil, fmt.Errorf("%w: %s", ErrModeMismatch, h.Mode)
+	}
+	if len(p) == 0 {
+		return nil, ErrPassphraseEmpty
+	}
+	if h.Iterations < 1 || h.Iterations > MaxIterations {
+		return nil, fmt.Errorf("%w: %d", ErrIterations, h.Iterations)
+	}
+	return pbkdf2([]byte(p), h.Salt, h.Iterations, keySize), nil
+}
+
+// Recipient seals snapshots to the holder of the matching Identity
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// Identity opens snapshots sealed to its Recipient
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new identity
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentity parses a base64 encoded identity
+func ParseIdentity(s string) (*Identity, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("identity invalid: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("identity invalid: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// LoadIdentity reads a base64 encoded identity from the file at loc
+func LoadIdentity(loc string) (*Identity, error) {
+	content, err := os.ReadFile(loc)
+	if err != nil {
+		return nil, err
+	}
+	return ParseIdentity(string(content))
+}
+
+// ParseRecipient parses a base64 encoded recipient key
+func ParseRecipient(s string) (*Recipient, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("recipient invalid: %w", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("recipient invalid: %w", err)
+	}
+	return &Recipient{key: key}, nil
+}
+
+// Recipient returns the recipient key matching the identity
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{key: i.key.PublicKey()}
+}
+
+func (i *Identity) String() string {
+	return base64.StdEncoding.EncodeToString(i.key.Bytes())
+}
+
+func (r *Recipient) String() string {
+	return base64.StdEncoding.EncodeToString(r.key.Bytes())
+}
+
+func (r *Recipient) seal(h *Header) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return nil, err
+	}
+	h.Mode = ModeRecipient
+	h.EphemeralKey = ephemeral.PublicKey().Bytes()
+	h.Recipient = r.key.Bytes()
+	return recipientKey(shared, h.EphemeralKey, h.Recipient), nil
+}
+
+func (r *Recipient) open(h *Header) ([]byte, error) {
+	return nil, ErrSealOnly
+}
+
+func (i *Identity) seal(h *Header) ([]byte, error) {
+	return nil, ErrOpenOnly
+}
+
+func (i *Identity) open(h *Header) ([]byte, error) {
+	if h.Mode != ModeRecipient {
+		return nil, fmt.Errorf("%w: %s", ErrModeMismatch, h.Mode)
+	}
+	recipient := i.key.PublicKey().Bytes()
+	if !bytes.Equal(recipient, h.Recipient) {
+		return nil, ErrWrongIdentity
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(h.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotSnapshot, err)
+	}
+	shared, err := i.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	return recipientKey(shared, h.EphemeralKey, recipient), nil
+}
+
+// recipientKey derives the payload key from an X25519 shared secret, binding both public keys
+func recipientKey(shared, ephemeral, recipient []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(labelRecipient)
+	mac.Write(ephemeral)
+	mac.Write(recipient)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 implements PBKDF2 with HMAC-SHA256 as described in RFC 8018
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
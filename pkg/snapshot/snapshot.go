@@ -0,0 +1,215 @@
+// Package snapshot reads and writes encrypted vault snapshots. A snapshot holds every store record, the metadata kept
+// alongside them and the keyring needed to detokenize them, sealed under a backup passphrase or a recipient key.
+//
+// On disk a snapshot is a magic line, a JSON header carrying the manifest and the key derivation parameters, and the
+// AES-GCM sealed payload. The header is not encrypted so that a snapshot can be inspected without its key, but it is
+// authenticated together with the payload.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"io"
+	"time"
+)
+
+const (
+	// Magic is the first line of every snapshot
+	Magic = "VAULT-SNAPSHOT"
+	// Version is the current snapshot format version
+	Version = 1
+	// Extension is the conventional file extension of a snapshot
+	Extension = ".vbk"
+)
+
+var (
+	ErrNotSnapshot        = errors.New("not a vault snapshot")
+	ErrVersionUnsupported = errors.New("snapshot version unsupported")
+	ErrDecrypt            = errors.New("snapshot could not be decrypted: wrong key or corrupted snapshot")
+	ErrChecksum           = errors.New("snapshot checksum mismatch")
+)
+
+// Manifest describes the content of a snapshot
+type Manifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	// Source describes the store the snapshot was taken from
+	Source  string `json:"source,omitempty"`
+	Records int    `json:"records"`
+	// RecordsChecksum is the store.Checksum of the records
+	RecordsChecksum string `json:"records_checksum"`
+	// PayloadChecksum is the hex encoded SHA-256 digest of the plaintext payload
+	PayloadChecksum string `json:"payload_checksum"`
+}
+
+// Header is the plaintext, authenticated part of a snapshot
+type Header struct {
+	Version  int      `json:"version"`
+	Manifest Manifest `json:"manifest"`
+	// Mode names the Keyer the payload is sealed with, and the fields below hold its parameters
+	Mode         string `json:"mode"`
+	Salt         []byte `json:"salt,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"`
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	Recipient    []byte `json:"recipient,omitempty"`
+	Nonce        []byte `json:"nonce"`
+}
+
+// Snapshot is the decrypted content of a snapshot
+type Snapshot struct {
+	Manifest Manifest `json:"-"`
+	// Records are the store records, keyed exactly as they are in the store
+	Records map[string]string `json:"records"`
+	// Metadata are the records the vault keeps alongside the tokens
+	Metadata map[string]string `json:"metadata"`
+	// Keyring is the cipher map the tokens were generated with
+	Keyring map[string]string `json:"keyring"`
+}
+
+// New creates a snapshot of records, metadata and keyring taken from source
+func New(source string, records, metadata, keyring map[string]string) *Snapshot {
+	return &Snapshot{
+		Manifest: Manifest{
+			CreatedAt: time.Now().UTC(),
+			Source:    source,
+		},
+		Records:  records,
+		Metadata: metadata,
+		Keyring:  keyring,
+	}
+}
+
+// Write seals snap with keyer and writes it to w
+func Write(w io.Writer, snap *Snapshot, keyer Keyer) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(payload)
+	header := &Header{
+		Version:  Version,
+		Manifest: snap.Manifest,
+	}
+	header.Manifest.Records = len(snap.Records)
+	header.Manifest.RecordsChecksum = store.Checksum(snap.Records)
+	header.Manifest.PayloadChecksum = hex.EncodeToString(digest[:])
+
+	key, err := keyer.seal(header)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	header.Nonce = make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, header.Nonce); err != nil {
+		return err
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, header.Nonce, payload, headerBytes)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, Magic)
+	bw.Write(headerBytes)
+	bw.WriteByte('\n')
+	bw.Write(sealed)
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	snap.Manifest = header.Manifest
+	return nil
+}
+
+// ReadHeader reads the header of the snapshot in r without decrypting it
+func ReadHeader(r io.Reader) (*Header, error) {
+	header, _, _, err := read(r)
+	return header, err
+}
+
+// Read opens the snapshot in r with keyer, verifying its integrity
+func Read(r io.Reader, keyer Keyer) (*Snapshot, error) {
+	header, headerBytes, sealed, err := read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keyer.open(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := aead.Open(nil, header.Nonce, sealed, headerBytes)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	digest := sha256.Sum256(payload)
+	if hex.EncodeToString(digest[:]) != header.Manifest.PayloadChecksum {
+		return nil, fmt.Errorf("%w: payload", ErrChecksum)
+	}
+
+	snap := &Snapshot{}
+	if err = json.Unmarshal(payload, snap); err != nil {
+		return nil, err
+	}
+	snap.Manifest = header.Manifest
+
+	if len(snap.Records) != header.Manifest.Records || store.Checksum(snap.Records) != header.Manifest.RecordsChecksum {
+		return nil, fmt.Errorf("%w: records", ErrChecksum)
+	}
+	return snap, nil
+}
+
+// read splits a snapshot into its header and sealed payload
+func read(r io.Reader) (*Header, []byte, []byte, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.ReadString('\n')
+	if err != nil || magic != Magic+"\n" {
+		return nil, nil, nil, ErrNotSnapshot
+	}
+
+	headerBytes, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: truncated header", ErrNotSnapshot)
+	}
+	headerBytes = bytes.TrimSuffix(headerBytes, []byte("\n"))
+
+	header := &Header{}
+	if err = json.Unmarshal(headerBytes, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrNotSnapshot, err)
+	}
+	if header.Version != Version {
+		return nil, nil, nil, fmt.Errorf("%w: %d", ErrVersionUnsupported, header.Version)
+	}
+
+	sealed, err := io.ReadAll(br)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return header, headerBytes, sealed, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
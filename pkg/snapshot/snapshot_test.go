@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type SnapshotTestSuite struct {
+	suite.Suite
+	records map[string]string
+	keyring map[string]string
+}
+
+func (suite *SnapshotTestSuite) SetupTest() {
+	suite.records = map[string]string{
+		"customer123__ssn":  "A1B2C3D4E5F6G7H8",
+		"customer123__card": "Z9Y8X7W6V5U4T3S2",
+	}
+	suite.keyring = map[string]string{
+		"CIPHER": "abcdefghijklmnopqrstuvwxyzABCDEF",
+		"IV":     "abcdefghijklmnop",
+	}
+}
+
+func (suite *SnapshotTestSuite) TestPassphraseRoundTrip() {
+	var buf bytes.Buffer
+	snap := New("gob", suite.records, nil, suite.keyring)
+	err := Write(&buf, snap, Passphrase("correct horse"))
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(len(suite.records), snap.Manifest.Records, "expected manifest to be filled in")
+	suite.Require().NotContains(buf.String(), "A1B2C3D4E5F6G7H8", "expected records to be encrypted")
+	suite.Require().NotContains(buf.String(), suite.keyring["CIPHER"], "expected keyring to be encrypted")
+
+	header, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(len(suite.records), header.Manifest.Records)
+	suite.Require().Equal("gob", header.Manifest.Source)
+
+	read, err := Read(bytes.NewReader(buf.Bytes()), Passphrase("correct horse"))
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.records, read.Records)
+	suite.Require().Equal(suite.keyring, read.Keyring)
+
+	_, err = Read(bytes.NewReader(buf.Bytes()), Passphrase("wrong horse"))
+	suite.Require().Truef(errors.Is(err, ErrDecrypt), "expected decryption error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestRecipientRoundTrip() {
+	identity, err := GenerateIdentity()
+	suite.Require().NoError(err)
+	recipient, err := ParseRecipient(identity.Recipient().String())
+	suite.Require().NoError(err)
+
+	var buf bytes.Buffer
+	suite.Require().NoError(Write(&buf, New("redis", suite.records, nil, suite.keyring), recipient))
+
+	_, err = Read(bytes.NewReader(buf.Bytes()), recipient)
+	suite.Require().Truef(errors.Is(err, ErrSealOnly), "expected seal only error, but got %v\n", err)
+
+	parsed, err := ParseIdentity(identity.String())
+	suite.Require().NoError(err)
+	snap, err := Read(bytes.NewReader(buf.Bytes()), parsed)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.records, snap.Records)
+
+	other, err := GenerateIdentity()
+	suite.Require().NoError(err)
+	_, err = Read(bytes.NewReader(buf.Bytes()), other)
+	suite.Require().Truef(errors.Is(err, ErrWrongIdentity), "expected wrong identity error, but got %v\n", err)
+
+	_, err = Read(bytes.NewReader(buf.Bytes()), Passphrase("correct horse"))
+	suite.Require().Truef(errors.Is(err, ErrModeMismatch), "expected mode mismatch error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestTamperedHeader() {
+	var buf bytes.Buffer
+	suite.Require().NoError(Write(&buf, New("gob", suite.records, nil, suite.keyring), Passphrase("correct horse")))
+
+	tampered := bytes.Replace(buf.Bytes(), []byte(`"source":"gob"`), []byte(`"source":"map"`), 1)
+	_, err := Read(bytes.NewReader(tampered), Passphrase("correct horse"))
+	suite.Require().Truef(errors.Is(err, ErrDecrypt), "expected decryption error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestIterations() {
+	var buf bytes.Buffer
+	suite.Require().NoError(Write(&buf, New("gob", suite.records, nil, suite.keyring), Passphrase("correct horse")))
+
+	// counts out of bounds are refused before the key is derived, as the header isn't authenticated until then
+	for _, iterations := range []string{`"iterations":2000000000`, `"iterations":-1`} {
+		tampered := bytes.Replace(buf.Bytes(), []byte(`"iterations":600000`), []byte(iterations), 1)
+		_, err := Read(bytes.NewReader(tampered), Passphrase("correct horse"))
+		suite.Require().Truef(errors.Is(err, ErrIterations), "expected iterations error, but got %v\n", err)
+	}
+}
+
+func (suite *SnapshotTestSuite) TestNotSnapshot() {
+	_, err := Read(bytes.NewReader([]byte("a__b=c\n")), Passphrase("correct horse"))
+	suite.Require().Truef(errors.Is(err, ErrNotSnapshot), "expected not a snapshot error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestPBKDF2() {
+	// test vector from RFC 7914, section 11
+	dk := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	suite.Require().Equal("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(dk))
+}
+
+func (suite *SnapshotTestSuite) TearDownTest() {}
+
+// TestSnapshotSuite tests sealing and opening snapshots
+func TestSnapshotSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotTestSuite))
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// OpType is the kind of write an Op makes
+type OpType string
+
+const (
+	// OpStore creates a key, and fails the batch if it already exists
+	OpStore OpType = "store"
+	// OpPatch sets the value of a key, creating it if it is missing
+	OpPatch OpType = "patch"
+	// OpDelete deletes a key, if it exists
+	OpDelete OpType = "delete"
+	// OpCheck writes nothing, and fails the batch with ErrConflict unless the key holds Value, or is missing if Value
+	// is empty. It makes the writes of the batch conditional on values read before it.
+	OpCheck OpType = "check"
+)
+
+var (
+	ErrKeyExists      = errors.New("key already exists")
+	ErrConflict       = errors.New("key was changed concurrently")
+	ErrOpInvalid      = errors.New("batch operation is invalid")
+	ErrRollbackFailed = errors.New("rolling back the batch failed, it is partially applied")
+)
+
+// Op is a write of a batch
+type Op struct {
+	Type  OpType
+	Key   string
+	Value string
+}
+
+// BatchError is returned by Batch when an op of the batch fails. None of the batch is applied then.
+type BatchError struct {
+	// Index is the position of the failed op in the batch
+	Index int
+	Op    Op
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op.Type, e.Op.Key, e.Err.Error())
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batcher is implemented by stores that apply a batch of writes atomically: either every op is applied, or none is
+type Batcher interface {
+	// Batch applies ops in order, as a single write
+	Batch(ctx context.Context, ops []Op) error
+}
+
+// Batch applies ops to s in order, all of them or none. Stores that aren't Batchers get the ops applied one by one,
+// and those already applied are rolled back when one fails. That is only as atomic as the rollback: readers may see
+// the batch half applied meanwhile, and a failed rollback is returned as ErrRollbackFailed.
+func Batch(ctx context.Context, s Store, ops []Op) error {
+	if err := validateOps(ops); err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if b, ok := s.(Batcher); ok {
+		return b.Batch(ctx, ops)
+	}
+	return batchEach(ctx, s, ops)
+}
+
+// batchEach applies ops to s one by one, restoring the keys written so far when one fails
+func batchEach(ctx context.Context, s Store, ops []Op) error {
+	// undo holds the writes restoring the keys written so far, in the order they were written
+	var undo []func() error
+	for i, op := range ops {
+		prev, err := s.Retrieve(ctx, op.Key)
+		existed := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return rollback(undo, &BatchError{Index: i, Op: op, Err: err})
+		}
+		if op.Type == OpCheck {
+			if !matches(op, prev, existed) {
+				return rollback(undo, &BatchError{Index: i, Op: op, Err: ErrConflict})
+			}
+			continue
+		}
+		if err = applyOp(ctx, s, op, existed); err != nil {
+			return rollback(undo, &BatchError{Index: i, Op: op, Err: err})
+		}
+
+		op := op
+		undo = append(undo, func() error {
+			switch {
+			case !existed:
+				_, err := s.Delete(ctx, op.Key)
+				return err
+			case op.Type == OpDelete:
+				return s.Store(ctx, op.Key, prev)
+			default:
+				_, err := s.Patch(ctx, op.Key, prev)
+				return err
+			}
+		})
+	}
+	return nil
+}
+
+// applyOp applies a single op to s. existed tells whether its key exists.
+func applyOp(ctx context.Context, s Store, op Op, existed bool) error {
+	switch op.Type {
+	case OpStore:
+		if existed {
+			return ErrKeyExists
+		}
+		return s.Store(ctx, op.Key, op.Value)
+	case OpPatch:
+		// not every backend creates missing keys on Patch
+		if !existed {
+			return s.Store(ctx, op.Key, op.Value)
+		}
+		if b, err := s.Patch(ctx, op.Key, op.Value); err != nil || !b {
+			return fmt.Errorf("error patching: %v", err)
+		}
+	case OpDelete:
+		if !existed {
+			return nil
+		}
+		if b, err := s.Delete(ctx, op.Key); err != nil || !b {
+			return fmt.Errorf("error deleting: %v", err)
+		}
+	}
+	return nil
+}
+
+// rollback runs undo in reverse, and returns failed, joined with ErrRollbackFailed if a key couldn't be restored
+func rollback(undo []func() error, failed *BatchError) error {
+	var errs []error
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(failed, fmt.Errorf("%w: %w", ErrRollbackFailed, errors.Join(errs...)))
+	}
+	return failed
+}
+
+// validateOps checks the types of ops
+func validateOps(ops []Op) error {
+	for i, op := range ops {
+		switch op.Type {
+		case OpStore, OpPatch, OpDelete, OpCheck:
+		default:
+			return &BatchError{Index: i, Op: op, Err: fmt.Errorf("%w: unknown type %q", ErrOpInvalid, op.Type)}
+		}
+	}
+	return nil
+}
+
+// checkOps checks that ops can be applied in order to a store holding the values current reports, before any is. It
+// tracks the keys the batch itself writes.
+func checkOps(ops []Op, current func(key string) (string, bool)) error {
+	type state struct {
+		val     string
+		existed bool
+	}
+	written := map[string]state{}
+	for i, op := range ops {
+		st, ok := written[op.Key]
+		if !ok {
+			st.val, st.existed = current(op.Key)
+		}
+		switch {
+		case op.Type == OpStore && st.existed:
+			return &BatchError{Index: i, Op: op, Err: ErrKeyExists}
+		case op.Type == OpCheck:
+			if !matches(op, st.val, st.existed) {
+				return &BatchError{Index: i, Op: op, Err: ErrConflict}
+			}
+			continue
+		}
+		written[op.Key] = state{val: op.Value, existed: op.Type != OpDelete}
+	}
+	return nil
+}
+
+// matches tells whether a key holding val, if it exists, passes the check op
+func matches(op Op, val string, existed bool) bool {
+	if len(op.Value) == 0 {
+		return !existed
+	}
+	return existed && val == op.Value
+}
+
+// writes returns ops without their checks
+func writes(ops []Op) []Op {
+	w := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Type != OpCheck {
+			w = append(w, op)
+		}
+	}
+	return w
+}
+
+// applyRecords applies ops in order to records, the content of a store read whole. Nothing is applied if an op fails.
+func applyRecords(records map[string]string, ops []Op) error {
+	if err := checkOps(ops, func(key string) (string, bool) {
+		val, ok := records[key]
+		return val, ok
+	}); err != nil {
+		return err
+	}
+	for _, op := range writes(ops) {
+		if op.Type == OpDelete {
+			delete(records, op.Key)
+			continue
+		}
+		records[op.Key] = op.Value
+	}
+	return nil
+}
+
+// opKeys returns the keys written by ops
+func opKeys(ops []Op) []string {
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
+
+// mapOps returns a copy of ops with their keys and values mapped by fn
+func mapOps(ops []Op, fn func(op Op) Op) []Op {
+	mapped := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		mapped = append(mapped, fn(op))
+	}
+	return mapped
+}
+
+// unmapBatchError points a BatchError returned for mapped ops back at the op of ops it was mapped from
+func unmapBatchError(err error, ops []Op) error {
+	var be *BatchError
+	if errors.As(err, &be) && be.Index >= 0 && be.Index < len(ops) {
+		be.Op = ops[be.Index]
+	}
+	return err
+}
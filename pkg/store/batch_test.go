@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+)
+
+var errWriteFailed = errors.New("write failed")
+
+// unbatched is a map whose writes fail on one key. Its Batch field hides the batches of the map, so writes are
+// applied one by one.
+type unbatched struct {
+	*Map
+	Batch   struct{}
+	failing string
+}
+
+func (u unbatched) Store(ctx context.Context, id string, token any) error {
+	if id == u.failing {
+		return errWriteFailed
+	}
+	return u.Map.Store(ctx, id, token)
+}
+
+type BatchTestSuite struct {
+	suite.Suite
+	log *vlog.Logger
+	dir string
+}
+
+func (suite *BatchTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.dir = suite.T().TempDir()
+}
+
+// stores returns every backend applying batches atomically, named
+func (suite *BatchTestSuite) stores() map[string]Store {
+	ctx := context.Background()
+	g, err := NewGob(ctx, filepath.Join(suite.dir, ".gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	f := NewFile(filepath.Join(suite.dir, ".store"), suite.log)
+	_, err = f.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	key, err := GenerateStoreKey()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	e, err := NewEncrypted(NewSyncMap(ctx, suite.log), key, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	c, err := NewCached(e, CacheConfig{}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	d, err := NewDir(DirConfig{Root: filepath.Join(suite.dir, "secrets")}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = d.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	db, err := NewSQL(SQLConfig{Dialect: DriverSQLite, DSN: filepath.Join(suite.dir, "vault.db")}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = db.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	return map[string]Store{
+		"map":     NewSyncMap(ctx, suite.log),
+		"dir":     d,
+		"sqlite":  db,
+		"gob":     g,
+		"file":    f,
+		"stacked": NewPrefixed(c, "ns/payments/", 0, suite.log),
+	}
+}
+
+func (suite *BatchTestSuite) TestAtomic() {
+	ctx := context.Background()
+	for name, s := range suite.stores() {
+		suite.Require().NoError(s.Store(ctx, "customer123/dob", "token0"), name)
+
+		err := Batch(ctx, s, []Op{
+			{Type: OpStore, Key: "customer123/ssn", Value: "token1"},
+			{Type: OpPatch, Key: "customer123/dob", Value: "token2"},
+			{Type: OpPatch, Key: "customer123/zip", Value: "token3"},
+		})
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", name, err)
+		all, err := s.RetrieveAll(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(map[string]string{"customer123/ssn": "token1", "customer123/dob": "token2", "customer123/zip": "token3"}, all, name)
+
+		// the third op fails, so neither the first nor the second is applied
+		err = Batch(ctx, s, []Op{
+			{Type: OpDelete, Key: "customer123/zip"},
+			{Type: OpStore, Key: "customer456/ssn", Value: "token4"},
+			{Type: OpStore, Key: "customer123/ssn", Value: "token5"},
+		})
+		var be *BatchError
+		suite.Require().Truef(errors.As(err, &be), "%s: expected a batch error, but got %v\n", name, err)
+		suite.Require().Equal(2, be.Index, name)
+		suite.Require().Equal("customer123/ssn", be.Op.Key, "%s: expected the failed op as it was passed in", name)
+		suite.Require().ErrorIs(err, ErrKeyExists, name)
+		after, err := s.RetrieveAll(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(all, after, "%s: expected a failed batch to leave the store as it was", name)
+
+		// ops apply in order, so a key deleted by the batch can be created again
+		err = Batch(ctx, s, []Op{
+			{Type: OpDelete, Key: "customer123/ssn"},
+			{Type: OpStore, Key: "customer123/ssn", Value: "token6"},
+		})
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", name, err)
+		val, err := s.Retrieve(ctx, "customer123/ssn")
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal("token6", val, name)
+		suite.Require().NoError(s.Close(ctx))
+	}
+}
+
+func (suite *BatchTestSuite) TestCheck() {
+	ctx := context.Background()
+	stores := suite.stores()
+	stores["unbatched"] = unbatched{Map: NewSyncMap(ctx, suite.log)}
+	for name, s := range stores {
+		suite.Require().NoError(s.Store(ctx, "customer123/ssn", "token1"), name)
+
+		// a check of the value read lets the write through
+		err := Batch(ctx, s, []Op{
+			{Type: OpCheck, Key: "customer123/ssn", Value: "token1"},
+			{Type: OpCheck, Key: "customer123/dob"},
+			{Type: OpPatch, Key: "customer123/ssn", Value: "token2"},
+			{Type: OpStore, Key: "customer123/dob", Value: "token3"},
+		})
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", name, err)
+
+		// the value was changed since, so the check fails the batch
+		err = Batch(ctx, s, []Op{
+			{Type: OpDelete, Key: "customer123/dob"},
+			{Type: OpCheck, Key: "customer123/ssn", Value: "token1"},
+			{Type: OpPatch, Key: "customer123/ssn", Value: "token4"},
+		})
+		suite.Require().ErrorIs(err, ErrConflict, name)
+		var be *BatchError
+		suite.Require().True(errors.As(err, &be), name)
+		suite.Require().Equal(1, be.Index, name)
+		all, err := s.RetrieveAll(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(map[string]string{"customer123/ssn": "token2", "customer123/dob": "token3"}, all, name)
+
+		// checks see the writes of the batch before them
+		err = Batch(ctx, s, []Op{
+			{Type: OpPatch, Key: "customer123/ssn", Value: "token5"},
+			{Type: OpDelete, Key: "customer123/dob"},
+			{Type: OpCheck, Key: "customer123/ssn", Value: "token5"},
+			{Type: OpCheck, Key: "customer123/dob"},
+		})
+		suite.Require().NoErrorf(err, "%s: expected no errors, but got this %v\n", name, err)
+		suite.Require().NoError(s.Close(ctx))
+	}
+}
+
+func (suite *BatchTestSuite) TestRollback() {
+	ctx := context.Background()
+	s := unbatched{Map: NewSyncMap(ctx, suite.log), failing: "customer123/zip"}
+	suite.Require().NoError(s.Map.Store(ctx, "customer123/dob", "token0"))
+	suite.Require().NoError(s.Map.Store(ctx, "customer123/ssn", "token1"))
+
+	err := Batch(ctx, s, []Op{
+		{Type: OpPatch, Key: "customer123/dob", Value: "token2"},
+		{Type: OpDelete, Key: "customer123/ssn"},
+		{Type: OpStore, Key: "customer456/ssn", Value: "token3"},
+		{Type: OpStore, Key: "customer123/zip", Value: "token4"},
+	})
+	suite.Require().ErrorIs(err, errWriteFailed)
+	all, _ := s.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"customer123/dob": "token0", "customer123/ssn": "token1"}, all, "expected the ops applied before the failure rolled back")
+
+	err = Batch(ctx, s, []Op{{Type: "upsert", Key: "customer123/dob"}})
+	suite.Require().ErrorIs(err, ErrOpInvalid)
+}
+
+func (suite *BatchTestSuite) TestQuota() {
+	ctx := context.Background()
+	p := NewPrefixed(NewSyncMap(ctx, suite.log), "ns/payments/", 3, suite.log)
+	suite.Require().NoError(p.Store(ctx, "customer123/ssn", "token1"))
+
+	err := Batch(ctx, p, []Op{
+		{Type: OpStore, Key: "customer123/dob", Value: "token2"},
+		{Type: OpStore, Key: "customer123/zip", Value: "token3"},
+		{Type: OpStore, Key: "customer123/pin", Value: "token4"},
+	})
+	suite.Require().ErrorIs(err, ErrQuotaExceeded, "expected a batch that doesn't fit to be refused whole")
+	n, _ := p.Count(ctx)
+	suite.Require().Equal(1, n)
+
+	// deleting a key makes room for another
+	err = Batch(ctx, p, []Op{
+		{Type: OpDelete, Key: "customer123/ssn"},
+		{Type: OpStore, Key: "customer123/dob", Value: "token2"},
+		{Type: OpStore, Key: "customer123/zip", Value: "token3"},
+		{Type: OpStore, Key: "customer123/pin", Value: "token4"},
+	})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+}
+
+func (suite *BatchTestSuite) TestReplicatedSharded() {
+	ctx := context.Background()
+	primary, secondary := NewSyncMap(ctx, suite.log), NewSyncMap(ctx, suite.log)
+	r, err := NewReplicated(primary, []Store{secondary}, ReplicatedConfig{Mode: ReplicaSync}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(secondary.Store(ctx, "customer123/ssn", "stale"))
+	suite.Require().NoError(Batch(ctx, r, []Op{{Type: OpStore, Key: "customer123/ssn", Value: "token1"}}))
+	val, _ := secondary.Retrieve(ctx, "customer123/ssn")
+	suite.Require().Equal("token1", val, "expected a batch mirrored over a drifting secondary")
+
+	var shards []Shard
+	for _, name := range []string{"a", "b", "c"} {
+		shards = append(shards, Shard{Name: name, Store: NewSyncMap(ctx, suite.log)})
+	}
+	s, err := NewSharded(shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(s.Store(ctx, "customer009/ssn", "token0"))
+	var ops []Op
+	for _, id := range []string{"customer001/ssn", "customer002/ssn", "customer003/ssn", "customer004/ssn", "customer009/ssn"} {
+		ops = append(ops, Op{Type: OpStore, Key: id, Value: "token"})
+	}
+	err = Batch(ctx, s, ops)
+	suite.Require().ErrorIs(err, ErrKeyExists)
+	all, _ := s.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"customer009/ssn": "token0"}, all, "expected a batch across shards rolled back")
+}
+
+// TestBatchSuite tests applying batches of writes atomically
+func TestBatchSuite(t *testing.T) {
+	suite.Run(t, new(BatchTestSuite))
+}
@@ -0,0 +1,371 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachePolicy decides how writes through a Cached store affect its cache
+type CachePolicy string
+
+const (
+	// CacheWriteThrough updates the cache with every successful write
+	CacheWriteThrough CachePolicy = "write-through"
+	// CacheWriteAround invalidates the cached entry on every write, so the next read goes to the underlying store
+	CacheWriteAround CachePolicy = "write-around"
+)
+
+const (
+	DefaultCacheSize = 1024
+	DefaultCacheTTL  = 5 * time.Minute
+)
+
+var (
+	ErrCachePolicyInvalid = errors.New("cache policy is invalid")
+)
+
+// CacheConfig holds the tunables of a Cached store
+type CacheConfig struct {
+	// Size is the maximum number of entries kept in the cache; the least recently used entry is evicted first
+	Size int
+	// TTL is how long an entry is served from the cache. Zero means entries never expire.
+	TTL time.Duration
+	// Policy is the write policy. Defaults to CacheWriteThrough.
+	Policy CachePolicy
+	// NegativeTTL is how long a missing key is remembered. Zero disables negative caching.
+	NegativeTTL time.Duration
+}
+
+// CacheStats is a snapshot of the counters of a Cached store
+type CacheStats struct {
+	Hits         uint64 `json:"hits"`
+	Misses       uint64 `json:"misses"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Evictions    uint64 `json:"evictions"`
+	Entries      int    `json:"entries"`
+}
+
+// HitRate returns the fraction of reads served from the cache, including negative hits
+func (cs CacheStats) HitRate() float64 {
+	total := cs.Hits + cs.NegativeHits + cs.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Hits+cs.NegativeHits) / float64(total)
+}
+
+// MissRate returns the fraction of reads that went to the underlying store
+func (cs CacheStats) MissRate() float64 {
+	total := cs.Hits + cs.NegativeHits + cs.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Misses) / float64(total)
+}
+
+type cacheEntry struct {
+	id      string
+	value   string
+	missing bool
+	expires time.Time
+}
+
+// Cached decorates a Store with a bounded, read-through LRU cache
+type Cached struct {
+	inner        Store
+	config       CacheConfig
+	entries      map[string]*list.Element
+	lru          *list.List
+	onInvalidate []func(id string)
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+	evictions    atomic.Uint64
+	// generation counts the writes and invalidations of the cache. A read that misses fills the cache only if it is
+	// unchanged since the read started, so a value read before a write isn't cached after it.
+	generation uint64
+	logger     *vlog.Logger
+	sync.Mutex
+}
+
+// NewCached wraps inner with a read-through cache configured by config
+func NewCached(inner Store, config CacheConfig, logger *vlog.Logger) (*Cached, error) {
+	if config.Size <= 0 {
+		config.Size = DefaultCacheSize
+	}
+	switch config.Policy {
+	case "":
+		config.Policy = CacheWriteThrough
+	case CacheWriteThrough, CacheWriteAround:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrCachePolicyInvalid, config.Policy)
+	}
+
+	return &Cached{
+		inner:   inner,
+		config:  config,
+		entries: make(map[string]*list.Element, config.Size),
+		lru:     list.New(),
+		logger:  logger,
+	}, nil
+}
+
+// Inner returns the wrapped store
+func (c *Cached) Inner() Store {
+	return c.inner
+}
+
+func (c *Cached) Connect(ctx context.Context) (bool, error) {
+	return c.inner.Connect(ctx)
+}
+
+// Store persists the key value pair in the underlying store, then applies the write policy
+func (c *Cached) Store(ctx context.Context, id string, token any) error {
+	if err := c.inner.Store(ctx, id, token); err != nil {
+		return err
+	}
+	c.written(id, token)
+	return nil
+}
+
+// Retrieve serves id from the cache if present and fresh, otherwise reads it from the underlying store and caches it
+func (c *Cached) Retrieve(ctx context.Context, id string) (string, error) {
+	log := c.logger.Logger()
+
+	if entry, ok := c.lookup(id); ok {
+		if entry.missing {
+			c.negativeHits.Add(1)
+			log.Debug().Msgf("cache: negative hit for key %s", id)
+			return "", fmt.Errorf("cached: key %s: %w", id, ErrNotFound)
+		}
+		c.hits.Add(1)
+		log.Debug().Msgf("cache: hit for key %s", id)
+		return entry.value, nil
+	}
+
+	c.misses.Add(1)
+	log.Debug().Msgf("cache: miss for key %s", id)
+	generation := c.currentGeneration()
+	val, err := c.inner.Retrieve(ctx, id)
+	if err != nil {
+		if c.config.NegativeTTL > 0 && errors.Is(err, ErrNotFound) {
+			c.fill(&cacheEntry{id: id, missing: true, expires: time.Now().Add(c.config.NegativeTTL)}, generation)
+		}
+		return "", err
+	}
+
+	c.fill(&cacheEntry{id: id, value: val, expires: c.expiry()}, generation)
+	return val, nil
+}
+
+// RetrieveAll always reads from the underlying store
+func (c *Cached) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	return c.inner.RetrieveAll(ctx)
+}
+
+// Scan always reads from the underlying store
+func (c *Cached) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	return Scan(ctx, c.inner, opts)
+}
+
+func (c *Cached) Delete(ctx context.Context, id string) (bool, error) {
+	b, err := c.inner.Delete(ctx, id)
+	c.Invalidate(id)
+	return b, err
+}
+
+func (c *Cached) Patch(ctx context.Context, id string, token any) (bool, error) {
+	b, err := c.inner.Patch(ctx, id, token)
+	if err != nil || !b {
+		c.Invalidate(id)
+		return b, err
+	}
+	c.written(id, token)
+	return b, nil
+}
+
+// Batch applies ops to the underlying store as a single batch, then applies the write policy to every key written
+func (c *Cached) Batch(ctx context.Context, ops []Op) error {
+	if err := Batch(ctx, c.inner, ops); err != nil {
+		// a failed rollback may leave any key of the batch changed, and a failed check means a key was changed by
+		// another writer
+		for _, op := range ops {
+			c.Invalidate(op.Key)
+		}
+		return err
+	}
+	for _, op := range writes(ops) {
+		if op.Type == OpDelete {
+			c.Invalidate(op.Key)
+			continue
+		}
+		c.written(op.Key, op.Value)
+	}
+	return nil
+}
+
+func (c *Cached) Flush(ctx context.Context) (bool, error) {
+	b, err := c.inner.Flush(ctx)
+	c.InvalidateAll()
+	return b, err
+}
+
+func (c *Cached) Close(ctx context.Context) error {
+	c.InvalidateAll()
+	return c.inner.Close(ctx)
+}
+
+// Invalidate drops id from the cache, and notifies every hook registered with OnInvalidate. It should be called when
+// the underlying store is changed by another writer.
+func (c *Cached) Invalidate(id string) {
+	c.Lock()
+	c.generation++
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+	hooks := c.onInvalidate
+	c.Unlock()
+
+	for i := 0; i < len(hooks); i++ {
+		hooks[i](id)
+	}
+}
+
+// InvalidateAll empties the cache
+func (c *Cached) InvalidateAll() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.entries = make(map[string]*list.Element, c.config.Size)
+	c.lru.Init()
+}
+
+// OnInvalidate registers fn to be called with the id of every entry invalidated from the cache
+func (c *Cached) OnInvalidate(fn func(id string)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onInvalidate = append(c.onInvalidate, fn)
+}
+
+// Stats returns the statistics of the underlying store, with the cache counters
+func (c *Cached) Stats(ctx context.Context) (*StoreStats, error) {
+	st, err := Stats(ctx, c.inner)
+	if err != nil {
+		return nil, err
+	}
+	cs := c.CacheStats()
+	st.Cache = &cs
+	return st, nil
+}
+
+// CacheStats returns a snapshot of the cache counters
+func (c *Cached) CacheStats() CacheStats {
+	c.Lock()
+	entries := c.lru.Len()
+	c.Unlock()
+	return CacheStats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Evictions:    c.evictions.Load(),
+		Entries:      entries,
+	}
+}
+
+// written applies the write policy after a successful write of token to id
+func (c *Cached) written(id string, token any) {
+	tokenStr, ok := token.(string)
+	if c.config.Policy == CacheWriteAround || !ok {
+		c.Invalidate(id)
+		return
+	}
+	c.put(&cacheEntry{id: id, value: tokenStr, expires: c.expiry()})
+}
+
+// lookup returns the cached entry for id, dropping it if it has expired
+func (c *Cached) lookup(id string) (*cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry, true
+}
+
+// currentGeneration returns the generation of the cache, for a read to fill it with later
+func (c *Cached) currentGeneration() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// fill caches the entry read by a read that started at generation, unless the cache was written to since
+func (c *Cached) fill(entry *cacheEntry, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.generation != generation {
+		c.logger.Logger().Debug().Msgf("cache: not caching key %s, written while it was read", entry.id)
+		return
+	}
+	c.insert(entry)
+}
+
+// put caches the entry written by a write
+func (c *Cached) put(entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.insert(entry)
+}
+
+// insert inserts or replaces an entry, evicting the least recently used entries beyond the configured size. The lock
+// must be held.
+func (c *Cached) insert(entry *cacheEntry) {
+	if el, ok := c.entries[entry.id]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.id] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).id)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cached) expiry() time.Time {
+	if c.config.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.config.TTL)
+}
+
+// Watch streams the changes made to keys starting with prefix in the inner store. Changed keys are invalidated from
+// the cache as they are seen, so the cache stays coherent with other writers for as long as the watch runs.
+func (c *Cached) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	inner, err := Watch(ctx, c.inner, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return forward(ctx, inner, func(event Event) (Event, bool) {
+		c.Invalidate(event.Key)
+		return event, true
+	}), nil
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type CachedTestSuite struct {
+	suite.Suite
+	tableStoreRetrieve map[string]string
+	log                *vlog.Logger
+}
+
+// countingStore counts the reads that reach the underlying store, and runs afterRetrieve, if set, once a read is done
+type countingStore struct {
+	*Map
+	retrieves     int
+	afterRetrieve func()
+}
+
+func (cs *countingStore) Retrieve(ctx context.Context, id string) (string, error) {
+	cs.retrieves++
+	val, err := cs.Map.Retrieve(ctx, id)
+	if cs.afterRetrieve != nil {
+		cs.afterRetrieve()
+	}
+	return val, err
+}
+
+func (suite *CachedTestSuite) SetupTest() {
+	suite.tableStoreRetrieve = varTableStoreMapRetrieve
+	suite.log = vlog.New(true)
+}
+
+func (suite *CachedTestSuite) TestReadThrough() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 16, TTL: time.Minute, Policy: CacheWriteAround})
+	for k, v := range suite.tableStoreRetrieve {
+		suite.Require().NoError(cached.Store(ctx, k, v))
+	}
+
+	for i := 0; i < 3; i++ {
+		for k, v := range suite.tableStoreRetrieve {
+			val, err := cached.Retrieve(ctx, k)
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			suite.Require().Equal(v, val)
+		}
+	}
+
+	stats := cached.CacheStats()
+	suite.Require().Equal(len(suite.tableStoreRetrieve), inner.retrieves, "expected one underlying read per key")
+	suite.Require().Equal(uint64(len(suite.tableStoreRetrieve)), stats.Misses)
+	suite.Require().Equal(uint64(2*len(suite.tableStoreRetrieve)), stats.Hits)
+	suite.Require().InDelta(2.0/3.0, stats.HitRate(), 0.001)
+}
+
+func (suite *CachedTestSuite) TestWriteThrough() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 16, Policy: CacheWriteThrough})
+	suite.Require().NoError(cached.Store(ctx, "id1", "token1"))
+	_, err := cached.Patch(ctx, "id1", "token2")
+	suite.Require().NoError(err)
+
+	val, err := cached.Retrieve(ctx, "id1")
+	suite.Require().NoError(err)
+	suite.Require().Equal("token2", val)
+	suite.Require().Equal(0, inner.retrieves, "expected write-through to serve the read from the cache")
+}
+
+func (suite *CachedTestSuite) TestEviction() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 2})
+	suite.Require().NoError(cached.Store(ctx, "id1", "token1"))
+	suite.Require().NoError(cached.Store(ctx, "id2", "token2"))
+	suite.Require().NoError(cached.Store(ctx, "id3", "token3"))
+
+	// id1 was the least recently used, so it has been evicted
+	_, err := cached.Retrieve(ctx, "id1")
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, inner.retrieves)
+	suite.Require().Equal(2, cached.CacheStats().Entries)
+	suite.Require().Equal(uint64(2), cached.CacheStats().Evictions)
+}
+
+func (suite *CachedTestSuite) TestTTL() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 2, TTL: 10 * time.Millisecond})
+	suite.Require().NoError(cached.Store(ctx, "id1", "token1"))
+	time.Sleep(20 * time.Millisecond)
+	_, err := cached.Retrieve(ctx, "id1")
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, inner.retrieves, "expected expired entry to be read from the underlying store")
+}
+
+func (suite *CachedTestSuite) TestNegativeCaching() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 2, NegativeTTL: time.Minute})
+	for i := 0; i < 3; i++ {
+		_, err := cached.Retrieve(ctx, "missing")
+		suite.Require().Truef(errors.Is(err, ErrNotFound), "expected not found error, but got %v\n", err)
+	}
+	suite.Require().Equal(1, inner.retrieves)
+	suite.Require().Equal(uint64(2), cached.CacheStats().NegativeHits)
+
+	// storing the key must clear the negative entry
+	suite.Require().NoError(cached.Store(ctx, "missing", "token"))
+	val, err := cached.Retrieve(ctx, "missing")
+	suite.Require().NoError(err)
+	suite.Require().Equal("token", val)
+}
+
+func (suite *CachedTestSuite) TestInvalidate() {
+	ctx := context.Background()
+	inner, cached := suite.cached(ctx, CacheConfig{Size: 4})
+	var invalidated []string
+	cached.OnInvalidate(func(id string) {
+		invalidated = append(invalidated, id)
+	})
+	suite.Require().NoError(cached.Store(ctx, "id1", "token1"))
+
+	// another writer changes the underlying store
+	_, err := inner.Patch(ctx, "id1", "token2")
+	suite.Require().NoError(err)
+	cached.Invalidate("id1")
+
+	val, err := cached.Retrieve(ctx, "id1")
+	suite.Require().NoError(err)
+	suite.Require().Equal("token2", val)
+	suite.Require().Equal([]string{"id1"}, invalidated)
+
+	_, err = cached.Delete(ctx, "id1")
+	suite.Require().NoError(err)
+	_, err = cached.Retrieve(ctx, "id1")
+	suite.Require().Error(err)
+}
+
+func (suite *CachedTestSuite) TestWriteDuringFill() {
+	ctx := context.Background()
+	for _, policy := range []CachePolicy{CacheWriteAround, CacheWriteThrough} {
+		inner, cached := suite.cached(ctx, CacheConfig{Size: 4, Policy: policy, NegativeTTL: time.Minute})
+		suite.Require().NoError(inner.Store(ctx, "id1", "token1"))
+
+		// the key is patched after a read of its old value, and another stored after a read missed it, before the reads
+		// fill the cache
+		inner.afterRetrieve = func() {
+			inner.afterRetrieve = nil
+			_, err := cached.Patch(ctx, "id1", "token2")
+			suite.Require().NoError(err)
+		}
+		_, err := cached.Retrieve(ctx, "id1")
+		suite.Require().NoError(err)
+		val, err := cached.Retrieve(ctx, "id1")
+		suite.Require().NoError(err)
+		suite.Require().Equalf("token2", val, "expected the value read before the patch not to be cached with %s", policy)
+
+		inner.afterRetrieve = func() {
+			inner.afterRetrieve = nil
+			suite.Require().NoError(cached.Store(ctx, "id2", "token"))
+		}
+		_, err = cached.Retrieve(ctx, "id2")
+		suite.Require().Error(err)
+		val, err = cached.Retrieve(ctx, "id2")
+		suite.Require().NoErrorf(err, "expected the miss read before the store not to be cached with %s", policy)
+		suite.Require().Equal("token", val)
+	}
+}
+
+func (suite *CachedTestSuite) TestInvalidPolicy() {
+	_, err := NewCached(NewSyncMap(context.Background(), suite.log), CacheConfig{Policy: "write-back"}, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrCachePolicyInvalid), "expected invalid policy error, but got %v\n", err)
+}
+
+func (suite *CachedTestSuite) TearDownTest() {}
+
+// TestCachedSuite tests the Cached suite
+func TestCachedSuite(t *testing.T) {
+	suite.Run(t, new(CachedTestSuite))
+}
+
+func (suite *CachedTestSuite) cached(ctx context.Context, config CacheConfig) (*countingStore, *Cached) {
+	inner := &countingStore{Map: NewSyncMap(ctx, suite.log)}
+	cached, err := NewCached(inner, config, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := cached.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	return inner, cached
+}
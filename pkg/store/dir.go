@@ -0,0 +1,528 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DirFileExt ends the name of every file of a dir store holding a token. Directories never end with it, so a key
+	// and the keys under it, like team/app and team/app/db, don't collide.
+	DirFileExt = ".tok"
+	// DefaultDirGitAuthor is the author of the commits of a dir store, unless set
+	DefaultDirGitAuthor = "vault <vault@localhost>"
+
+	dirFileMode = 0600
+	dirMode     = 0700
+	// dirTempPrefix starts the temporary files of writes in progress. Encoded names never start with a dot.
+	dirTempPrefix = ".tmp-"
+)
+
+var (
+	ErrGitUnavailable = errors.New("git is unavailable")
+)
+
+// DirConfig holds the tunables of a Dir store
+type DirConfig struct {
+	// Root is the directory holding the files of the store, created on Connect if missing
+	Root string
+	// Truncate starts the store empty, deleting the files under Root
+	Truncate bool
+	// Git commits every change of the store to a git repository at Root, initialized on Connect if missing
+	Git bool
+	// GitAuthor is the author of the commits, as in "name <email>". Defaults to DefaultDirGitAuthor.
+	GitAuthor string
+}
+
+// Dir is a store keeping every key in a file of its own under a root directory, holding its token. Slashes in keys
+// make subdirectories, and the other characters that aren't safe in file names are escaped, so team/app/db/password
+// is kept in team/app/db/password.tok. With git enabled, every write is committed, so the history of a key is its git
+// log.
+//
+// Writes are atomic per file, and batches are rolled back if they fail midway, but other processes may see a batch
+// half applied meanwhile.
+type Dir struct {
+	config DirConfig
+	logger *vlog.Logger
+	mu     sync.RWMutex
+}
+
+func init() {
+	Register(DriverDir, func(ctx context.Context, cfg Config) (Store, error) {
+		config := DirConfig{Root: cfg.Loc, Truncate: cfg.Truncate, GitAuthor: cfg.Options.Get(ParamGitAuthor)}
+		if git := cfg.Options.Get(ParamGit); len(git) > 0 {
+			var err error
+			if config.Git, err = strconv.ParseBool(git); err != nil {
+				return nil, fmt.Errorf("%w: %s must be true or false", ErrURLInvalid, ParamGit)
+			}
+		}
+		return NewDir(config, cfg.Logger)
+	})
+}
+
+// NewDir creates a dir store configured by config. Nothing is created on disk until Connect.
+func NewDir(config DirConfig, logger *vlog.Logger) (*Dir, error) {
+	if len(config.Root) == 0 {
+		return nil, fmt.Errorf("%s: %w", DriverDir, ErrLocEmpty)
+	}
+	if len(config.GitAuthor) == 0 {
+		config.GitAuthor = DefaultDirGitAuthor
+	}
+	return &Dir{config: config, logger: logger}, nil
+}
+
+// Connect creates the root directory, and the git repository if enabled
+func (d *Dir) Connect(ctx context.Context) (bool, error) {
+	log := d.logger.Logger()
+	if err := os.MkdirAll(d.config.Root, dirMode); err != nil {
+		log.Error().Msgf("error while creating dir store %s: %s\n", d.config.Root, err.Error())
+		return false, err
+	}
+
+	if d.config.Git {
+		if _, err := exec.LookPath("git"); err != nil {
+			return false, fmt.Errorf("%w: %s", ErrGitUnavailable, err)
+		}
+		if _, err := os.Stat(filepath.Join(d.config.Root, ".git")); os.IsNotExist(err) {
+			log.Info().Msgf("initializing git repository in %s", d.config.Root)
+			if err = d.git(ctx, "init", "-q"); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if d.config.Truncate {
+		if _, err := d.Flush(ctx); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Close is a no-op: every write is on disk when it returns
+func (d *Dir) Close(ctx context.Context) error {
+	return nil
+}
+
+// Store persists a new key-value entry in a new file
+func (d *Dir) Store(ctx context.Context, id string, token any) error {
+	log := d.logger.Logger()
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok, err := d.read(id); err != nil {
+		return err
+	} else if ok {
+		log.Error().Msgf("key already exists in store, skipping")
+		return fmt.Errorf("key %s: %w", id, ErrKeyExists)
+	}
+	if err := d.write(id, tokenStr); err != nil {
+		return err
+	}
+	d.commit(ctx, "store "+id)
+	return nil
+}
+
+// Retrieve reads the token of id from its file
+func (d *Dir) Retrieve(ctx context.Context, id string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	val, ok, err := d.read(id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		d.logger.Logger().Debug().Msgf("token with id %s doesn't exist", id)
+		return "", fmt.Errorf("token with id %s: %w", id, ErrNotFound)
+	}
+	return val, nil
+}
+
+// RetrieveAll reads every file of the store
+func (d *Dir) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	records := map[string]string{}
+	err := d.walk(func(key, path string) error {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		records[key] = decodeDirValue(content)
+		return nil
+	})
+	return records, err
+}
+
+// Scan returns a page of the keys of the store, read from the names of its files
+func (d *Dir) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	all, err := d.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(all, opts), nil
+}
+
+// Delete removes the file of id, and the directories it leaves empty
+func (d *Dir) Delete(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	existed, err := d.remove(id)
+	if err != nil {
+		d.logger.Logger().Error().Msgf("error while deleting key with id %s: %s\n", id, err.Error())
+		return false, err
+	}
+	if existed {
+		d.commit(ctx, "delete "+id)
+	}
+	return true, nil
+}
+
+// Patch replaces the token of id, creating its file if it is missing
+func (d *Dir) Patch(ctx context.Context, id string, token any) (bool, error) {
+	log := d.logger.Logger()
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return false, fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.write(id, tokenStr); err != nil {
+		return false, err
+	}
+	d.commit(ctx, "patch "+id)
+	return true, nil
+}
+
+// Batch checks ops against the files of the store, then applies them in order, as a single commit. The files written
+// so far are restored if a write fails.
+func (d *Dir) Batch(ctx context.Context, ops []Op) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var readErr error
+	if err := checkOps(ops, func(key string) (string, bool) {
+		val, ok, err := d.read(key)
+		if err != nil && readErr == nil {
+			readErr = err
+		}
+		return val, ok
+	}); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	var undo []func() error
+	keys := map[string]bool{}
+	for i, op := range ops {
+		if op.Type == OpCheck {
+			continue
+		}
+		prev, existed, err := d.read(op.Key)
+		if err == nil {
+			if op.Type == OpDelete {
+				_, err = d.remove(op.Key)
+			} else {
+				err = d.write(op.Key, op.Value)
+			}
+		}
+		if err != nil {
+			return rollback(undo, &BatchError{Index: i, Op: op, Err: err})
+		}
+		keys[op.Key] = true
+
+		op := op
+		undo = append(undo, func() error {
+			if !existed {
+				_, err := d.remove(op.Key)
+				return err
+			}
+			return d.write(op.Key, prev)
+		})
+	}
+
+	if len(keys) > 0 {
+		d.commit(ctx, batchCommitMessage(keys))
+	}
+	return nil
+}
+
+// Stats counts the files of the store, and sums their sizes
+func (d *Dir) Stats(ctx context.Context) (*StoreStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	st := &StoreStats{Driver: DriverDir}
+	err := d.walk(func(key, path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		st.Records++
+		st.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Flush deletes every file of the store, keeping the root directory and its git repository
+func (d *Dir) Flush(ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries, err := os.ReadDir(d.config.Root)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(d.config.Root, entry.Name())); err != nil {
+			return false, err
+		}
+	}
+	d.commit(ctx, "flush")
+	return true, nil
+}
+
+// Path returns the file holding the token of key
+func (d *Dir) Path(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = encodeDirSegment(segment)
+	}
+	return filepath.Join(d.config.Root, filepath.Join(segments...)+DirFileExt)
+}
+
+// read returns the token in the file of key, and whether it exists
+func (d *Dir) read(key string) (string, bool, error) {
+	content, err := os.ReadFile(d.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return decodeDirValue(content), true, nil
+}
+
+// write replaces the file of key with one holding val, through a rename so readers see either file whole
+func (d *Dir) write(key, val string) error {
+	path := d.Path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, dirTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(val + "\n"); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), dirFileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		d.logger.Logger().Error().Msgf("error while writing key with id %s to %s: %s\n", key, path, err.Error())
+	}
+	return err
+}
+
+// remove deletes the file of key, and the directories it leaves empty. It tells whether the file existed.
+func (d *Dir) remove(key string) (bool, error) {
+	path := d.Path(key)
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	root := filepath.Clean(d.config.Root)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails on the first directory that isn't empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return true, nil
+}
+
+// walk calls fn with the key and path of every file of the store holding a token, in the order of their names
+func (d *Dir) walk(fn func(key, path string) error) error {
+	return filepath.WalkDir(d.config.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == d.config.Root {
+			return nil
+		}
+		// skips .git and the temporary files of writes in progress
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), DirFileExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.config.Root, strings.TrimSuffix(path, DirFileExt))
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for i, segment := range segments {
+			if segments[i], err = decodeDirSegment(segment); err != nil {
+				d.logger.Logger().Debug().Msgf("skipping %s: %s", path, err.Error())
+				return nil
+			}
+		}
+		return fn(strings.Join(segments, "/"), path)
+	})
+}
+
+// commit commits every change under the root to its git repository, if enabled. A failed commit is logged, and its
+// changes are included in the next one.
+func (d *Dir) commit(ctx context.Context, msg string) {
+	if !d.config.Git {
+		return
+	}
+	log := d.logger.Logger()
+	if err := d.git(ctx, "add", "-A", "."); err != nil {
+		log.Error().Msgf("error while staging changes of dir store %s: %s\n", d.config.Root, err.Error())
+		return
+	}
+	// nothing staged, as when a patch writes the token already there
+	if d.git(ctx, "diff", "--cached", "--quiet") == nil {
+		return
+	}
+	if err := d.git(ctx, "commit", "-q", "--no-verify", "--author", d.config.GitAuthor, "-m", msg); err != nil {
+		log.Error().Msgf("error while committing changes of dir store %s: %s\n", d.config.Root, err.Error())
+	}
+}
+
+// git runs git with args in the root directory. Commits are made as the author of the config when git has no identity
+// configured.
+func (d *Dir) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = d.config.Root
+	name, email := splitGitAuthor(d.config.GitAuthor)
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_NAME="+name, "GIT_COMMITTER_EMAIL="+email)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// splitGitAuthor splits "name <email>" into its name and email
+func splitGitAuthor(author string) (string, string) {
+	name, email, ok := strings.Cut(author, "<")
+	if !ok {
+		return strings.TrimSpace(author), ""
+	}
+	return strings.TrimSpace(name), strings.TrimSuffix(strings.TrimSpace(email), ">")
+}
+
+// batchCommitMessage describes a batch writing keys
+func batchCommitMessage(keys map[string]bool) string {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return fmt.Sprintf("batch of %d keys\n\n%s", len(sorted), strings.Join(sorted, "\n"))
+}
+
+// decodeDirValue returns the token in the content of a file, without the newline it is written with
+func decodeDirValue(content []byte) string {
+	return strings.TrimSuffix(string(content), "\n")
+}
+
+// isDirSafe tells whether c is kept as it is in file names. Upper case letters are escaped too, so keys differing in
+// case don't collide on case-insensitive file systems.
+func isDirSafe(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.'
+}
+
+// encodeDirSegment escapes a segment of a key into a file name, as %XX. An empty segment is kept as a lone %. A
+// leading dot is escaped, so names are never hidden, . or .., and so is the dot of a trailing DirFileExt, so
+// directories never end with it.
+func encodeDirSegment(segment string) string {
+	if len(segment) == 0 {
+		return "%"
+	}
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		escape := !isDirSafe(c) || (c == '.' && i == 0) ||
+			(c == '.' && i == len(segment)-len(DirFileExt) && strings.HasSuffix(segment, DirFileExt))
+		if escape {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decodeDirSegment reverses encodeDirSegment
+func decodeDirSegment(name string) (string, error) {
+	if name == "%" {
+		return "", nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("truncated escape in %q", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type DirTestSuite struct {
+	suite.Suite
+	root string
+	log  *vlog.Logger
+}
+
+func (suite *DirTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.root = filepath.Join(suite.T().TempDir(), "secrets")
+}
+
+// connected returns a connected dir store at the suite root
+func (suite *DirTestSuite) connected(config DirConfig) *Dir {
+	config.Root = suite.root
+	d, err := NewDir(config, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := d.Connect(context.Background())
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	return d
+}
+
+func (suite *DirTestSuite) TestStore() {
+	ctx := context.Background()
+	d := suite.connected(DirConfig{})
+
+	suite.Require().NoError(d.Store(ctx, "team/app/db/password", "token1"))
+	suite.Require().NoError(d.Store(ctx, "team/app", "token2"))
+	err := d.Store(ctx, "team/app", "token3")
+	suite.Require().Truef(errors.Is(err, ErrKeyExists), "expected a key exists error, but got %v\n", err)
+
+	content, err := os.ReadFile(filepath.Join(suite.root, "team", "app", "db", "password"+DirFileExt))
+	suite.Require().NoErrorf(err, "expected a file per key, but got this %v\n", err)
+	suite.Require().Equal("token1\n", string(content))
+
+	b, err := d.Patch(ctx, "team/app", "token4")
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	val, err := d.Retrieve(ctx, "team/app")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token4", val)
+
+	b, err = d.Delete(ctx, "team/app/db/password")
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = d.Retrieve(ctx, "team/app/db/password")
+	suite.Require().Truef(errors.Is(err, ErrNotFound), "expected a not found error, but got %v\n", err)
+	_, err = os.Stat(filepath.Join(suite.root, "team", "app"))
+	suite.Require().Truef(os.IsNotExist(err), "expected the emptied directories removed, but got %v\n", err)
+
+	all, err := d.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"team/app": "token4"}, all)
+
+	b, err = d.Flush(ctx)
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	all, _ = d.RetrieveAll(ctx)
+	suite.Require().Empty(all)
+}
+
+func (suite *DirTestSuite) TestEncoding() {
+	ctx := context.Background()
+	d := suite.connected(DirConfig{})
+
+	keys := []string{"../../etc/passwd", ".git/config", "a//b", "/leading", "trailing/", "Upper", "upper",
+		"x.tok", "x.tok/y", "x", "sp ace/ünïcode", "%41", ".", ".."}
+	for _, key := range keys {
+		suite.Require().NoErrorf(d.Store(ctx, key, "token:"+key), "expected %q stored", key)
+		rel, err := filepath.Rel(suite.root, d.Path(key))
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Falsef(strings.HasPrefix(rel, ".."), "expected %q kept under the root, but got %s", key, rel)
+	}
+
+	all, err := d.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(all, len(keys), "expected every key in a file of its own")
+	for _, key := range keys {
+		suite.Require().Equal("token:"+key, all[key], key)
+	}
+	_, err = os.Stat(filepath.Join(suite.root, ".git"))
+	suite.Require().Truef(os.IsNotExist(err), "expected no file hidden in the root, but got %v\n", err)
+}
+
+func (suite *DirTestSuite) TestGit() {
+	if _, err := exec.LookPath("git"); err != nil {
+		suite.T().Skip("git is unavailable")
+	}
+	ctx := context.Background()
+	d := suite.connected(DirConfig{Git: true, GitAuthor: "platform <platform@example.com>"})
+
+	suite.Require().NoError(d.Store(ctx, "team/app/db/password", "token1"))
+	_, err := d.Patch(ctx, "team/app/db/password", "token2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	// an unchanged token makes no commit
+	_, err = d.Patch(ctx, "team/app/db/password", "token2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(Batch(ctx, d, []Op{
+		{Type: OpDelete, Key: "team/app/db/password"},
+		{Type: OpStore, Key: "team/app/db/user", Value: "token3"},
+	}))
+
+	out, err := exec.Command("git", "-C", suite.root, "log", "--format=%an|%s").Output()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal([]string{
+		"platform|batch of 2 keys",
+		"platform|patch team/app/db/password",
+		"platform|store team/app/db/password",
+	}, strings.Split(strings.TrimSpace(string(out)), "\n"))
+
+	// the history keeps tokens, never plaintext
+	out, err = exec.Command("git", "-C", suite.root, "show", "HEAD~1:team/app/db/password"+DirFileExt).Output()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token2\n", string(out))
+
+	// reconnecting keeps the repository
+	d = suite.connected(DirConfig{Git: true})
+	all, _ := d.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"team/app/db/user": "token3"}, all)
+}
+
+func (suite *DirTestSuite) TestOpenURL() {
+	ctx := context.Background()
+	s, err := OpenURL(ctx, "dir://"+suite.root+"?git=false", suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().IsType(&Dir{}, s)
+
+	_, err = OpenURL(ctx, "dir://"+suite.root+"?git=maybe", suite.log)
+	suite.Require().Truef(errors.Is(err, ErrURLInvalid), "expected an invalid url error, but got %v\n", err)
+	_, err = Open(ctx, DriverDir, Config{Logger: suite.log})
+	suite.Require().Truef(errors.Is(err, ErrLocEmpty), "expected an empty location error, but got %v\n", err)
+}
+
+// TestDirSuite tests the store keeping a file per key, and its git history
+func TestDirSuite(t *testing.T) {
+	suite.Run(t, new(DirTestSuite))
+}
@@ -0,0 +1,421 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// StoreKeySize is the size in bytes of the master key used by Encrypted
+	StoreKeySize = 32
+	// DefaultStoreKeyLoc is the default disk location of the store encryption key
+	DefaultStoreKeyLoc = "./.store.key"
+	// encryptedKeysMarker is kept in the clear in the inner store once none of its keys is in the legacy encoding, so
+	// Connect doesn't look for them again
+	encryptedKeysMarker = ReservedPrefix + "encrypted/keys"
+)
+
+var (
+	// idEncoding encodes encrypted keys in lowercase letters and digits, which every store holds as they are: a file
+	// store as variable names, and a directory store on case-insensitive file systems too
+	idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+	// legacyIDEncoding encoded the encrypted keys of stores written by earlier versions
+	legacyIDEncoding = base64.RawURLEncoding
+)
+
+// idDecoder decodes encrypted keys
+type idDecoder interface {
+	DecodeString(s string) ([]byte, error)
+}
+
+var (
+	// ErrStoreCorrupted is returned when a record read from the underlying store fails authentication
+	ErrStoreCorrupted  = errors.New("store corrupted: record failed authentication")
+	ErrStoreKeyInvalid = fmt.Errorf("store key must be %d bytes", StoreKeySize)
+)
+
+// labels used to derive the sub keys from the master store key
+var (
+	labelRecordKey = []byte("vault/store/record")
+	labelIDKey     = []byte("vault/store/id")
+)
+
+// Encrypted wraps a Store, encrypting keys and values before they reach the underlying store and authenticating every
+// record when it is read back. Keys are encrypted deterministically so that lookups by id keep working, while values
+// are sealed with a fresh nonce and bound to the encrypted key they are stored under, so swapping tokens between
+// records on disk is detected just like editing them.
+type Encrypted struct {
+	inner  Store
+	aead   cipher.AEAD
+	idMAC  []byte
+	logger *vlog.Logger
+}
+
+// NewEncrypted wraps inner with authenticated encryption under key, which must be StoreKeySize bytes long
+func NewEncrypted(inner Store, key []byte, logger *vlog.Logger) (*Encrypted, error) {
+	if len(key) != StoreKeySize {
+		return nil, ErrStoreKeyInvalid
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, labelRecordKey))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypted{
+		inner:  inner,
+		aead:   aead,
+		idMAC:  deriveKey(key, labelIDKey),
+		logger: logger,
+	}, nil
+}
+
+// Inner returns the wrapped store
+func (e *Encrypted) Inner() Store {
+	return e.inner
+}
+
+// Connect connects the inner store, and re-encodes the keys it holds in the legacy encoding
+func (e *Encrypted) Connect(ctx context.Context) (bool, error) {
+	b, err := e.inner.Connect(ctx)
+	if !b || err != nil {
+		return b, err
+	}
+	if err = e.upgradeKeys(ctx); err != nil {
+		e.logger.Logger().Error().Msgf("error while re-encoding the keys of the encrypted store: %s\n", err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+// upgradeKeys moves the records of the inner store kept under keys in the legacy encoding to the keys sealID makes
+// now, in a single batch, unless encryptedKeysMarker says there are none. Keys that fail authentication are left for
+// reads to report.
+func (e *Encrypted) upgradeKeys(ctx context.Context) error {
+	if _, err := e.inner.Retrieve(ctx, encryptedKeysMarker); err == nil {
+		return nil
+	}
+	all, err := e.inner.RetrieveAll(ctx)
+	if err != nil {
+		return err
+	}
+	// an empty store is checked again on the next Connect, which is as cheap
+	if len(all) == 0 {
+		return nil
+	}
+
+	var ops []Op
+	for legacyID, val := range all {
+		if legacyID == encryptedKeysMarker {
+			continue
+		}
+		if _, err := e.openIDAs(idEncoding, legacyID); err == nil {
+			continue
+		}
+		id, err := e.openIDAs(legacyIDEncoding, legacyID)
+		if err != nil {
+			continue
+		}
+		token, err := e.openValue(legacyID, val)
+		if err != nil {
+			continue
+		}
+		encID := e.sealID(id)
+		ops = append(ops,
+			Op{Type: OpCheck, Key: legacyID, Value: val},
+			Op{Type: OpDelete, Key: legacyID},
+			Op{Type: OpStore, Key: encID, Value: e.sealValue(encID, token)},
+		)
+	}
+	if len(ops) > 0 {
+		e.logger.Logger().Info().Msgf("re-encoding %d keys of the encrypted store", len(ops)/3)
+	}
+	ops = append(ops, Op{Type: OpPatch, Key: encryptedKeysMarker, Value: "base32"})
+	return Batch(ctx, e.inner, ops)
+}
+
+// Store encrypts the key value pair and persists it in the underlying store
+func (e *Encrypted) Store(ctx context.Context, id string, token any) error {
+	log := e.logger.Logger()
+
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	encID := e.sealID(id)
+	return e.inner.Store(ctx, encID, e.sealValue(encID, tokenStr))
+}
+
+// Retrieve retrieves and authenticates the token identified by id
+func (e *Encrypted) Retrieve(ctx context.Context, id string) (string, error) {
+	encID := e.sealID(id)
+	val, err := e.inner.Retrieve(ctx, encID)
+	if err != nil {
+		return "", err
+	}
+
+	return e.openValue(encID, val)
+}
+
+// RetrieveAll decrypts every record in the underlying store. It refuses to return anything if a single record fails
+// authentication.
+func (e *Encrypted) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	log := e.logger.Logger()
+
+	all, err := e.inner.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string, len(all))
+	for encID, val := range all {
+		if encID == encryptedKeysMarker {
+			continue
+		}
+		id, err := e.openID(encID)
+		if err != nil {
+			log.Error().Msgf("error while decrypting record key: %s\n", err.Error())
+			return nil, err
+		}
+		if m[id], err = e.openValue(encID, val); err != nil {
+			log.Error().Msgf("error while decrypting record %s: %s\n", id, err.Error())
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (e *Encrypted) Delete(ctx context.Context, id string) (bool, error) {
+	return e.inner.Delete(ctx, e.sealID(id))
+}
+
+// Patch encrypts the new token and replaces the record identified by id
+func (e *Encrypted) Patch(ctx context.Context, id string, token any) (bool, error) {
+	log := e.logger.Logger()
+
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return false, fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	encID := e.sealID(id)
+	return e.inner.Patch(ctx, encID, e.sealValue(encID, tokenStr))
+}
+
+// Batch encrypts the keys and values of ops, and applies them to the inner store as a single batch. Values are sealed
+// under random nonces, so checks are compared in the clear here, then passed on as checks of the sealed values they
+// matched, which the inner store makes sure are still there when the batch is applied.
+func (e *Encrypted) Batch(ctx context.Context, ops []Op) error {
+	type value struct {
+		plain, sealed string
+		existed       bool
+	}
+	// written holds the values the batch gives the keys it writes, by encrypted key
+	written := map[string]value{}
+
+	sealed := make([]Op, 0, len(ops))
+	for i, op := range ops {
+		encID := e.sealID(op.Key)
+		switch op.Type {
+		case OpDelete:
+			written[encID] = value{}
+			sealed = append(sealed, Op{Type: op.Type, Key: encID})
+		case OpCheck:
+			v, ok := written[encID]
+			if !ok {
+				raw, err := e.inner.Retrieve(ctx, encID)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					return &BatchError{Index: i, Op: op, Err: err}
+				}
+				v = value{sealed: raw, existed: err == nil}
+				if v.existed {
+					if v.plain, err = e.openValue(encID, raw); err != nil {
+						return &BatchError{Index: i, Op: op, Err: err}
+					}
+				}
+			}
+			if !matches(op, v.plain, v.existed) {
+				return &BatchError{Index: i, Op: op, Err: ErrConflict}
+			}
+			sealed = append(sealed, Op{Type: op.Type, Key: encID, Value: v.sealed})
+		default:
+			v := value{plain: op.Value, sealed: e.sealValue(encID, op.Value), existed: true}
+			written[encID] = v
+			sealed = append(sealed, Op{Type: op.Type, Key: encID, Value: v.sealed})
+		}
+	}
+	return unmapBatchError(Batch(ctx, e.inner, sealed), ops)
+}
+
+func (e *Encrypted) Flush(ctx context.Context) (bool, error) {
+	return e.inner.Flush(ctx)
+}
+
+// Stats returns the statistics of the underlying store, which holds a record for each encrypted one
+func (e *Encrypted) Stats(ctx context.Context) (*StoreStats, error) {
+	return Stats(ctx, e.inner)
+}
+
+func (e *Encrypted) Close(ctx context.Context) error {
+	return e.inner.Close(ctx)
+}
+
+// sealID deterministically encrypts id. The nonce is derived from a MAC over the id, so the same id always maps to the
+// same stored key, and openID can check that the decrypted id reproduces the nonce.
+func (e *Encrypted) sealID(id string) string {
+	nonce := e.idNonce(id)
+	sealed := e.aead.Seal(nonce, nonce, []byte(id), labelIDKey)
+	return idEncoding.EncodeToString(sealed)
+}
+
+// openID decrypts a key produced by sealID, or by earlier versions in the legacy encoding
+func (e *Encrypted) openID(encID string) (string, error) {
+	id, err := e.openIDAs(idEncoding, encID)
+	if err != nil {
+		if legacy, legacyErr := e.openIDAs(legacyIDEncoding, encID); legacyErr == nil {
+			return legacy, nil
+		}
+	}
+	return id, err
+}
+
+// openIDAs decrypts a key encoded with enc
+func (e *Encrypted) openIDAs(enc idDecoder, encID string) (string, error) {
+	raw, err := enc.DecodeString(encID)
+	if err != nil || len(raw) < e.aead.NonceSize() {
+		return "", fmt.Errorf("%w: malformed key %q", ErrStoreCorrupted, encID)
+	}
+
+	nonce, sealed := raw[:e.aead.NonceSize()], raw[e.aead.NonceSize():]
+	id, err := e.aead.Open(nil, nonce, sealed, labelIDKey)
+	if err != nil || !hmac.Equal(nonce, e.idNonce(string(id))) {
+		return "", fmt.Errorf("%w: key %q", ErrStoreCorrupted, encID)
+	}
+	return string(id), nil
+}
+
+// sealValue encrypts token under a random nonce, authenticating the encrypted key it is stored under
+func (e *Encrypted) sealValue(encID, token string) string {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(fmt.Sprintf("error reading random nonce: %s", err.Error()))
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(token), []byte(encID))
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// openValue decrypts a value produced by sealValue, failing with ErrStoreCorrupted if it was modified or moved
+func (e *Encrypted) openValue(encID, val string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(val)
+	if err != nil || len(raw) < e.aead.NonceSize() {
+		return "", fmt.Errorf("%w: malformed value for key %q", ErrStoreCorrupted, encID)
+	}
+
+	nonce, sealed := raw[:e.aead.NonceSize()], raw[e.aead.NonceSize():]
+	token, err := e.aead.Open(nil, nonce, sealed, []byte(encID))
+	if err != nil {
+		return "", fmt.Errorf("%w: value for key %q", ErrStoreCorrupted, encID)
+	}
+	return string(token), nil
+}
+
+func (e *Encrypted) idNonce(id string) []byte {
+	mac := hmac.New(sha256.New, e.idMAC)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:e.aead.NonceSize()]
+}
+
+// deriveKey derives a purpose specific sub key from the master key
+func deriveKey(master, label []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(label)
+	return mac.Sum(nil)
+}
+
+// GenerateStoreKey returns a new random master key for Encrypted
+func GenerateStoreKey() ([]byte, error) {
+	key := make([]byte, StoreKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadStoreKey reads the store key persisted at loc, generating and persisting a new one if none exists yet
+func LoadStoreKey(loc string, logger *vlog.Logger) ([]byte, error) {
+	log := logger.Logger()
+
+	content, err := os.ReadFile(loc)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != StoreKeySize {
+			log.Error().Msgf("store key at %s is invalid\n", loc)
+			return nil, fmt.Errorf("store key at %s is invalid: %w", loc, ErrStoreKeyInvalid)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Debug().Msgf("store key %s not found, generating it", loc)
+	if err = IsValidFile(loc, log); err != nil {
+		return nil, err
+	}
+
+	key, err := GenerateStoreKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(loc, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		log.Error().Msgf("error while writing store key to %s: %s\n", loc, err.Error())
+		return nil, err
+	}
+	return key, nil
+}
+
+// Watch streams the changes made to keys starting with prefix in the inner store, with their keys decrypted. Encrypted
+// keys can't be matched by prefix, so the inner store is watched whole and filtered here.
+func (e *Encrypted) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	inner, err := Watch(ctx, e.inner, "")
+	if err != nil {
+		return nil, err
+	}
+	return forward(ctx, inner, func(event Event) (Event, bool) {
+		if event.Key == encryptedKeysMarker {
+			return event, false
+		}
+		id, err := e.openID(event.Key)
+		if err != nil {
+			e.logger.Logger().Error().Msgf("dropping change event: %s\n", err.Error())
+			return event, false
+		}
+		event.Key = id
+		return event, strings.HasPrefix(id, prefix)
+	}), nil
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type EncryptedTestSuite struct {
+	suite.Suite
+	tableStoreRetrieve map[string]string
+	tableStorePatch    map[string]string
+	key                []byte
+	log                *vlog.Logger
+}
+
+var (
+	varTableStoreEncryptedRetrieve = map[string]string{
+		"customer123__ssn":   "A1B2C3D4E5F6G7H8",
+		"customer123__card":  "Z9Y8X7W6V5U4T3S2",
+		"customer456__ssn":   "Q1W2E3R4T5Y6U7I8",
+		"customer456__phone": "O9P0A1S2D3F4G5H6",
+	}
+
+	varTableEncryptedPatch = map[string]string{
+		"customer123__ssn":   "649sx8C30ubzd0cu",
+		"customer123__card":  "TN4IFzbjuJfwuOIW",
+		"customer456__ssn":   "a1otXUTJnt4gzOLL",
+		"customer456__phone": "df8opIzQPrpRn9sM",
+	}
+)
+
+func (suite *EncryptedTestSuite) SetupTest() {
+	var err error
+	suite.tableStoreRetrieve = varTableStoreEncryptedRetrieve
+	suite.tableStorePatch = varTableEncryptedPatch
+	suite.log = vlog.New(true)
+	suite.key, err = GenerateStoreKey()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+}
+
+func (suite *EncryptedTestSuite) TestStoreAndRetrieve() {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	enc := suite.connect(ctx, inner)
+	i := 1
+	for k, v := range suite.tableStoreRetrieve {
+		fmt.Printf(Order, i)
+		err := enc.Store(ctx, k, v)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		val, err := enc.Retrieve(ctx, k)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equalf(v, val, "expected %s, but got %s\n", v, val)
+		i++
+	}
+
+	// nothing readable should reach the underlying store
+	raw, err := inner.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(len(suite.tableStoreRetrieve), len(raw))
+	for k, v := range raw {
+		suite.Require().NotContains(k, "customer", "expected key to be encrypted, but got %s\n", k)
+		for _, plain := range suite.tableStoreRetrieve {
+			suite.Require().NotContains(v, plain, "expected value to be encrypted, but got %s\n", v)
+		}
+	}
+
+	all, err := enc.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.tableStoreRetrieve, all)
+	suite.Require().NoError(enc.Close(ctx))
+}
+
+func (suite *EncryptedTestSuite) TestPatchAndDelete() {
+	ctx := context.Background()
+	enc := suite.connect(ctx, NewSyncMap(ctx, suite.log))
+	for k, v := range suite.tableStoreRetrieve {
+		suite.Require().NoError(enc.Store(ctx, k, v))
+		b, err := enc.Patch(ctx, k, suite.tableStorePatch[k])
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().True(b, "expected true, got false")
+		val, err := enc.Retrieve(ctx, k)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(suite.tableStorePatch[k], val)
+		b, err = enc.Delete(ctx, k)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().True(b, "expected true, got false")
+		_, err = enc.Retrieve(ctx, k)
+		suite.Require().Error(err, "expected id to not exist")
+	}
+}
+
+func (suite *EncryptedTestSuite) TestTamperedValue() {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	enc := suite.connect(ctx, inner)
+	suite.Require().NoError(enc.Store(ctx, "customer123__ssn", "A1B2C3D4E5F6G7H8"))
+
+	raw, err := inner.RetrieveAll(ctx)
+	suite.Require().NoError(err)
+	for k, v := range raw {
+		// flip one character of the sealed value
+		flipped := []byte(v)
+		flipped[len(flipped)/2] ^= 0x01
+		_, err = inner.Patch(ctx, k, string(flipped))
+		suite.Require().NoError(err)
+	}
+
+	_, err = enc.Retrieve(ctx, "customer123__ssn")
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected corruption error, but got %v\n", err)
+	_, err = enc.RetrieveAll(ctx)
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected corruption error, but got %v\n", err)
+}
+
+func (suite *EncryptedTestSuite) TestSwappedValues() {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	enc := suite.connect(ctx, inner)
+	suite.Require().NoError(enc.Store(ctx, "customer123__ssn", "A1B2C3D4E5F6G7H8"))
+	suite.Require().NoError(enc.Store(ctx, "customer456__ssn", "Q1W2E3R4T5Y6U7I8"))
+
+	raw, err := inner.RetrieveAll(ctx)
+	suite.Require().NoError(err)
+	var keys, values []string
+	for k, v := range raw {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	_, err = inner.Patch(ctx, keys[0], values[1])
+	suite.Require().NoError(err)
+	_, err = inner.Patch(ctx, keys[1], values[0])
+	suite.Require().NoError(err)
+
+	_, err = enc.Retrieve(ctx, "customer123__ssn")
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected corruption error, but got %v\n", err)
+}
+
+func (suite *EncryptedTestSuite) TestGobRoundTrip() {
+	ctx := context.Background()
+	loc := filepath.Join(suite.T().TempDir(), "encrypted.gob")
+	gob, err := NewGob(ctx, loc, suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	enc := suite.connect(ctx, gob)
+	for k, v := range suite.tableStoreRetrieve {
+		suite.Require().NoError(enc.Store(ctx, k, v))
+	}
+	suite.Require().NoError(enc.Close(ctx))
+
+	content, err := os.ReadFile(loc)
+	suite.Require().NoError(err)
+	suite.Require().False(strings.Contains(string(content), "customer"), "expected key names to be encrypted on disk")
+
+	gob, err = NewGob(ctx, loc, suite.log, false)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	enc = suite.connect(ctx, gob)
+	all, err := enc.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.tableStoreRetrieve, all)
+	suite.Require().NoError(enc.Close(ctx))
+}
+
+func (suite *EncryptedTestSuite) TestFileRoundTrip() {
+	ctx := context.Background()
+	loc := filepath.Join(suite.T().TempDir(), ".store")
+	file := NewFile(loc, suite.log)
+	enc := suite.connect(ctx, file)
+	for k, v := range suite.tableStoreRetrieve {
+		suite.Require().NoErrorf(enc.Store(ctx, k, v), "expected no errors storing %s\n", k)
+	}
+	suite.Require().NoError(enc.Close(ctx))
+
+	content, err := os.ReadFile(loc)
+	suite.Require().NoError(err)
+	suite.Require().False(strings.Contains(string(content), "customer"), "expected key names to be encrypted on disk")
+
+	enc = suite.connect(ctx, NewFile(loc, suite.log))
+	defer enc.Close(ctx)
+	for k, v := range suite.tableStoreRetrieve {
+		val, err := enc.Retrieve(ctx, k)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(v, val)
+	}
+	all, err := enc.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.tableStoreRetrieve, all)
+}
+
+func (suite *EncryptedTestSuite) TestLegacyKeys() {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	enc, err := NewEncrypted(inner, suite.key, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// records written by earlier versions, with their keys in the legacy encoding
+	for k, v := range suite.tableStoreRetrieve {
+		raw, err := idEncoding.DecodeString(enc.sealID(k))
+		suite.Require().NoError(err)
+		legacyID := legacyIDEncoding.EncodeToString(raw)
+		suite.Require().NoError(inner.Store(ctx, legacyID, enc.sealValue(legacyID, v)))
+	}
+
+	enc = suite.connect(ctx, inner)
+	for k, v := range suite.tableStoreRetrieve {
+		val, err := enc.Retrieve(ctx, k)
+		suite.Require().NoErrorf(err, "expected the key of %s to be re-encoded, but got this %v\n", k, err)
+		suite.Require().Equal(v, val)
+	}
+	raw, err := inner.RetrieveAll(ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(raw, len(suite.tableStoreRetrieve)+1, "expected the legacy keys to be replaced, and the store marked")
+	suite.Require().Contains(raw, encryptedKeysMarker)
+	all, err := enc.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.tableStoreRetrieve, all)
+}
+
+func (suite *EncryptedTestSuite) TestWrongKey() {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	enc := suite.connect(ctx, inner)
+	suite.Require().NoError(enc.Store(ctx, "customer123__ssn", "A1B2C3D4E5F6G7H8"))
+
+	other, err := GenerateStoreKey()
+	suite.Require().NoError(err)
+	wrong, err := NewEncrypted(inner, other, suite.log)
+	suite.Require().NoError(err)
+	_, err = wrong.RetrieveAll(ctx)
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected corruption error, but got %v\n", err)
+}
+
+func (suite *EncryptedTestSuite) TestLoadStoreKey() {
+	loc := filepath.Join(suite.T().TempDir(), "keys", ".store.key")
+	key, err := LoadStoreKey(loc, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(key, StoreKeySize)
+
+	again, err := LoadStoreKey(loc, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(key, again)
+}
+
+func (suite *EncryptedTestSuite) TearDownTest() {}
+
+// TestEncryptedSuite tests the Encrypted suite
+func TestEncryptedSuite(t *testing.T) {
+	suite.Run(t, new(EncryptedTestSuite))
+}
+
+func (suite *EncryptedTestSuite) connect(ctx context.Context, inner Store) *Encrypted {
+	enc, err := NewEncrypted(inner, suite.key, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := enc.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	return enc
+}
@@ -3,12 +3,15 @@ package store
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
 	"io"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -17,6 +20,9 @@ type File struct {
 	fd       *os.File
 	channels *FileChannels
 	logger   *vlog.Logger
+	// writes serializes the writes to the file from the read of its records through the write of the new ones, so
+	// none is lost to a concurrent write
+	writes sync.Mutex
 	sync.Mutex
 }
 
@@ -24,6 +30,15 @@ type FileChannels struct {
 	ops chan func(is string) error
 }
 
+func init() {
+	Register(DriverFile, func(ctx context.Context, cfg Config) (Store, error) {
+		if len(cfg.Loc) == 0 {
+			return nil, fmt.Errorf("%s: %w", DriverFile, ErrLocEmpty)
+		}
+		return NewFile(cfg.Loc, cfg.Logger), nil
+	})
+}
+
 // NewFile creates a new filestore at loc
 func NewFile(loc string, logger *vlog.Logger) *File {
 	return &File{
@@ -43,8 +58,14 @@ func (f *File) Connect(ctx context.Context) (bool, error) {
 		return false, err
 	}
 
-	// create file database
-	f.fd, err = os.Create(loc)
+	// files written in an older format are upgraded before they are opened
+	if err = upgradeFormat(FormatFile, loc, f.logger); err != nil {
+		log.Error().Msgf("error while upgrading file store %s: %s\n", loc, err.Error())
+		return false, err
+	}
+
+	// open file database, creating it if it doesn't exist yet. existing records are kept.
+	f.fd, err = os.OpenFile(loc, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		log.Info().Msgf("error while creating file at location %s: %s\n", loc, err.Error())
 		return false, err
@@ -60,6 +81,8 @@ func (f *File) Close(ctx context.Context) error {
 // Store persists a new key-value entry in the file store
 func (f *File) Store(ctx context.Context, id string, token any) error {
 	log := f.logger.Logger()
+	f.writes.Lock()
+	defer f.writes.Unlock()
 	var err error
 
 	// read current contents of the file
@@ -73,7 +96,7 @@ func (f *File) Store(ctx context.Context, id string, token any) error {
 
 	// harvest currently stored values if file store is not empty
 	if len(content) > 0 {
-		storeMap, err = godotenv.UnmarshalBytes(content)
+		storeMap, err = unmarshalFile(content)
 	}
 
 	var tokenStr string
@@ -88,7 +111,7 @@ func (f *File) Store(ctx context.Context, id string, token any) error {
 	// check if ID already exists
 	if _, ok := storeMap[id]; ok {
 		log.Error().Msgf("key already exists in store, skipping")
-		return fmt.Errorf("key already exists in store, skipping")
+		return fmt.Errorf("key %s: %w", id, ErrKeyExists)
 	}
 
 	// add the new ID
@@ -140,10 +163,10 @@ func (f *File) Retrieve(ctx context.Context, id string) (string, error) {
 	// if file is empty return empty
 	if len(content) == 0 {
 		log.Debug().Msgf("token with id %s doesn't exist", id)
-		return "", fmt.Errorf("token with id %s doesn't exist", id)
+		return "", fmt.Errorf("token with id %s: %w", id, ErrNotFound)
 	}
 
-	storeMap, err = godotenv.UnmarshalBytes(content)
+	storeMap, err = unmarshalFile(content)
 	// check err
 	if err != nil {
 		log.Debug().Msg("error while unmarshalling file store bytes")
@@ -155,7 +178,7 @@ func (f *File) Retrieve(ctx context.Context, id string) (string, error) {
 	// check if ID already exists
 	if tokenStr, ok = storeMap[id]; !ok {
 		log.Debug().Msgf("token with id %s doesn't exist", id)
-		return "", fmt.Errorf("token with id %s doesn't exist", id)
+		return "", fmt.Errorf("token with id %s: %w", id, ErrNotFound)
 	}
 
 	return tokenStr, nil
@@ -177,10 +200,10 @@ func (f *File) RetrieveAll(ctx context.Context) (map[string]string, error) {
 	// if file is empty return empty
 	if len(content) == 0 {
 		log.Debug().Msg("file store empty")
-		return nil, errors.New("file store empty")
+		return storeMap, nil
 	}
 
-	storeMap, err = godotenv.UnmarshalBytes(content)
+	storeMap, err = unmarshalFile(content)
 	// check err
 	if err != nil {
 		log.Debug().Msg("error while unmarshalling file store bytes")
@@ -193,6 +216,8 @@ func (f *File) RetrieveAll(ctx context.Context) (map[string]string, error) {
 // Delete removes a token from the file store
 func (f *File) Delete(ctx context.Context, id string) (bool, error) {
 	log := f.logger.Logger()
+	f.writes.Lock()
+	defer f.writes.Unlock()
 
 	// read current contents of the file
 	content, err := f.read()
@@ -209,7 +234,7 @@ func (f *File) Delete(ctx context.Context, id string) (bool, error) {
 		return true, errors.New("file store empty")
 	}
 
-	storeMap, err = godotenv.UnmarshalBytes(content)
+	storeMap, err = unmarshalFile(content)
 	// check err
 	if err != nil {
 		log.Debug().Msg("error while unmarshalling file store bytes")
@@ -233,6 +258,8 @@ func (f *File) Delete(ctx context.Context, id string) (bool, error) {
 // Patch only updates a token in the file store, identified by id
 func (f *File) Patch(ctx context.Context, id string, token any) (bool, error) {
 	log := f.logger.Logger()
+	f.writes.Lock()
+	defer f.writes.Unlock()
 
 	// read current contents of the file
 	content, err := f.read()
@@ -249,7 +276,7 @@ func (f *File) Patch(ctx context.Context, id string, token any) (bool, error) {
 		return true, errors.New("file store empty")
 	}
 
-	storeMap, err = godotenv.UnmarshalBytes(content)
+	storeMap, err = unmarshalFile(content)
 	// check err
 	if err != nil {
 		log.Debug().Msg("error while unmarshalling file store bytes")
@@ -284,12 +311,41 @@ func (f *File) Patch(ctx context.Context, id string, token any) (bool, error) {
 	return true, nil
 }
 
-// Flush cleans al the data from a file store
+// Batch applies ops atomically to the records of the file store, and writes them back in a single write
+func (f *File) Batch(ctx context.Context, ops []Op) error {
+	log := f.logger.Logger()
+	f.writes.Lock()
+	defer f.writes.Unlock()
+
+	storeMap, err := f.RetrieveAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the batch is checked before it is applied, so a failing op leaves the file as it was
+	if err = applyRecords(storeMap, ops); err != nil {
+		return err
+	}
+
+	if err = f.Write(storeMap); err != nil {
+		log.Error().Msgf("error while writing map to file store")
+		return fmt.Errorf("error while writing map to file store")
+	}
+	return nil
+}
+
+// Flush cleans al the data from a file store, keeping its header
 func (f *File) Flush(ctx context.Context) (bool, error) {
-	err := f.fd.Truncate(0)
+	f.writes.Lock()
+	defer f.writes.Unlock()
+	header := formatHeader(FormatFile, CurrentFormat(FormatFile))
+	err := f.fd.Truncate(int64(len(header)))
 	if err != nil {
 		return false, err
 	}
+	if _, err = f.fd.WriteAt(header, 0); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -297,10 +353,87 @@ func (f *File) Loop() {
 
 }
 
-// Write persists the map to disk using godotenv.Write
+// Write persists the map to disk in dotenv format, under the header of the current format. Keys godotenv can't hold
+// as variable names are escaped.
 func (f *File) Write(m map[string]string) error {
+	escaped := make(map[string]string, len(m))
+	for k, v := range m {
+		escaped[escapeFileKey(k)] = v
+	}
+	content, err := godotenv.Marshal(escaped)
+	if err != nil {
+		return err
+	}
 	f.Lock()
-	err := godotenv.Write(m, f.loc)
-	f.Unlock()
-	return err
+	defer f.Unlock()
+	fd, err := os.Create(f.loc)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err = fd.Write(append(formatHeader(FormatFile, CurrentFormat(FormatFile)), content+"\n"...)); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// fileKeyEscape starts the names of escaped keys in the file store
+const fileKeyEscape = ".."
+
+// fileKeyName matches the keys godotenv holds as variable names as they are
+var fileKeyName = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// escapeFileKey escapes key into a variable name godotenv accepts, e.g. keys holding '/' or '-'. Keys that are
+// already valid names are kept as they are, so existing files read the same.
+func escapeFileKey(key string) string {
+	if fileKeyName.MatchString(key) && !strings.HasPrefix(key, fileKeyEscape) {
+		return key
+	}
+	return fileKeyEscape + hex.EncodeToString([]byte(key))
+}
+
+// unescapeFileKey reverses escapeFileKey
+func unescapeFileKey(name string) string {
+	encoded, ok := strings.CutPrefix(name, fileKeyEscape)
+	if !ok {
+		return name
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return name
+	}
+	return string(key)
+}
+
+// unmarshalFile parses the contents of a file store, unescaping its keys
+func unmarshalFile(content []byte) (map[string]string, error) {
+	body, err := readFormat(FormatFile, content)
+	if err != nil {
+		return nil, err
+	}
+	escaped, err := godotenv.UnmarshalBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]string, len(escaped))
+	for k, v := range escaped {
+		records[unescapeFileKey(k)] = v
+	}
+	return records, nil
+}
+
+// Stats counts the records of the file store, and sizes its file
+func (f *File) Stats(ctx context.Context) (*StoreStats, error) {
+	records, err := f.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fileStats(DriverFile, f.loc, len(records))
+}
+
+// Watch streams the changes made to keys starting with prefix in the file store, by this or any other process
+func (f *File) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchFile(ctx, f.loc, prefix, func() (map[string]string, error) {
+		return readFileRecords(f.loc, unmarshalFile)
+	}, f.logger)
 }
@@ -2,10 +2,12 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -208,6 +210,114 @@ func (suite *FileTestSuite) TestPatch() {
 	_ = file.Close(ctx)
 }
 
+func (suite *FileTestSuite) TestEscapedKeys() {
+	loc := filepath.Join(suite.T().TempDir(), "test_file.db")
+	ctx := context.Background()
+	file := NewFile(loc, suite.log)
+	_, err := file.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer file.Close(ctx)
+
+	// keys godotenv doesn't accept as variable names, and a plain key that looks escaped
+	records := map[string]string{
+		"_vault/namespaces/team-a": `{"quota":2}`,
+		"customer-123__ssn":        "A1B2C3D4E5F6G7H8",
+		"..6869":                   "Z9Y8X7W6V5U4T3S2",
+		"ijbnijdelkfiue1":          "Q1W2E3R4T5Y6U7I8",
+	}
+	for k, v := range records {
+		suite.Require().NoErrorf(file.Store(ctx, k, v), "expected no errors storing %s\n", k)
+	}
+
+	all, err := file.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(records, all)
+}
+
+func (suite *FileTestSuite) TestConcurrentBatches() {
+	loc := filepath.Join(suite.T().TempDir(), "test_file.db")
+	ctx := context.Background()
+	file := NewFile(loc, suite.log)
+	_, err := file.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer file.Close(ctx)
+
+	records, err := batchConcurrently(ctx, file, 100)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	all, err := file.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(records, all, "expected no batch to be lost")
+}
+
+func (suite *FileTestSuite) TestConcurrentConflicts() {
+	loc := filepath.Join(suite.T().TempDir(), "test_file.db")
+	ctx := context.Background()
+	file := NewFile(loc, suite.log)
+	_, err := file.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer file.Close(ctx)
+
+	stored, conflicts := createConcurrently(ctx, file, "ijbnijdelkfiue1", 100)
+	suite.Require().Equal(1, stored, "expected a single create of the key to succeed")
+	suite.Require().Equal(99, conflicts, "expected the other creates to conflict")
+}
+
+// batchConcurrently stores n records in s, each in a batch of its own running alongside the others, and returns them
+func batchConcurrently(ctx context.Context, s Store, n int) (map[string]string, error) {
+	records := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		records[fmt.Sprintf("ijbnijdelkfiue%d", i)] = fmt.Sprintf("A1B2C3D4E5F6G7H%d", i)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for k, v := range records {
+		k, v := k, v
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Batch(ctx, s, []Op{{Type: OpStore, Key: k, Value: v}})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// createConcurrently creates key in s n times alongside each other, each in a batch checking that the key is missing,
+// and counts the creates that succeeded and the ones that conflicted
+func createConcurrently(ctx context.Context, s Store, key string, n int) (stored, conflicts int) {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Batch(ctx, s, []Op{
+				{Type: OpCheck, Key: key},
+				{Type: OpStore, Key: key, Value: fmt.Sprintf("A1B2C3D4E5F6G7H%d", i)},
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case errors.Is(err, ErrConflict):
+			conflicts++
+		}
+	}
+	return stored, conflicts
+}
+
 func (suite *FileTestSuite) TearDownTest() {
 	_ = context.Background()
 	log := suite.log.Logger()
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Kinds of versioned store files
+const (
+	FormatFile = "file"
+	FormatGob  = "gob"
+)
+
+const (
+	// FormatLegacy is the version of store files written before they had a header
+	FormatLegacy = 1
+	// formatMagic starts the header line of a store file. It reads as a comment to dotenv parsers.
+	formatMagic = "#vault "
+)
+
+var (
+	ErrFormatNewer   = errors.New("store file was written by a newer version of vault")
+	ErrFormatInvalid = errors.New("store file header is invalid")
+	ErrFormatUnknown = errors.New("store file kind is unknown")
+)
+
+// formatUpgrade rewrites the body of a store file, what follows its header, from one format version to the next
+type formatUpgrade func(body []byte) ([]byte, error)
+
+// formatUpgrades holds the upgrade steps of each kind of store file, in order: the step at index i upgrades a file
+// from version i+1 to version i+2. The current version of a kind is the one its last step upgrades to, so a new
+// format is introduced by appending the step upgrading to it.
+var formatUpgrades = map[string][]formatUpgrade{
+	FormatFile: {
+		// 2 adds the header, the records are kept as they are
+		keepFormat,
+	},
+	FormatGob: {
+		// 2 adds the header, the encoded map is kept as it is
+		keepFormat,
+	},
+}
+
+// keepFormat is the upgrade step of formats only changing the header
+func keepFormat(body []byte) ([]byte, error) {
+	return body, nil
+}
+
+// FormatInfo describes the format of a store file
+type FormatInfo struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// Version is the format the file is written in. Files older than Current are upgraded when the store opens them.
+	Version int   `json:"version"`
+	Current int   `json:"current"`
+	Size    int64 `json:"size"`
+	// Backups are the copies of the file kept before each upgrade
+	Backups []string `json:"backups,omitempty"`
+}
+
+// CurrentFormat returns the format version files of kind are written in
+func CurrentFormat(kind string) int {
+	return len(formatUpgrades[kind]) + FormatLegacy
+}
+
+// ReadFormat describes the format of the store file of kind at loc, without upgrading it. A missing file is
+// reported at the current version, as it would be written.
+func ReadFormat(kind, loc string) (*FormatInfo, error) {
+	if _, ok := formatUpgrades[kind]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFormatUnknown, kind)
+	}
+	info := &FormatInfo{Kind: kind, Path: loc, Version: CurrentFormat(kind), Current: CurrentFormat(kind)}
+	content, err := os.ReadFile(loc)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Size = int64(len(content))
+	if len(content) > 0 {
+		if info.Version, _, err = parseFormat(kind, content); err != nil {
+			return nil, err
+		}
+	}
+	if info.Backups, err = filepath.Glob(loc + ".v*.bak"); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// formatHeader returns the header line of store files of kind at version
+func formatHeader(kind string, version int) []byte {
+	return []byte(fmt.Sprintf("%s%s v%d\n", formatMagic, kind, version))
+}
+
+// parseFormat splits the content of a store file of kind into its format version and its body. Content without a
+// header is of the legacy version.
+func parseFormat(kind string, content []byte) (int, []byte, error) {
+	prefix := []byte(formatMagic + kind + " v")
+	if !bytes.HasPrefix(content, prefix) {
+		return FormatLegacy, content, nil
+	}
+	line, body, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %q", ErrFormatInvalid, line)
+	}
+	version, err := strconv.Atoi(string(line[len(prefix):]))
+	if err != nil || version <= FormatLegacy {
+		return 0, nil, fmt.Errorf("%w: %q", ErrFormatInvalid, line)
+	}
+	return version, body, nil
+}
+
+// readFormat returns the body of the content of a store file of kind, failing if it was written in a format newer
+// than this vault reads
+func readFormat(kind string, content []byte) ([]byte, error) {
+	version, body, err := parseFormat(kind, content)
+	if err != nil {
+		return nil, err
+	}
+	if current := CurrentFormat(kind); version > current {
+		return nil, fmt.Errorf("%w: version %d, this vault reads up to version %d", ErrFormatNewer, version, current)
+	}
+	return body, nil
+}
+
+// upgradeFormat upgrades the store file of kind at loc to the current format, running the upgrade steps from its
+// version in order. The file is first copied to <loc>.v<version>.bak, and replaced once every step succeeded, so a
+// failed upgrade leaves it as it was. Missing and empty files are given the header of the current format.
+func upgradeFormat(kind, loc string, logger *vlog.Logger) error {
+	log := logger.Logger()
+	current := CurrentFormat(kind)
+
+	content, err := os.ReadFile(loc)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(content) == 0 {
+		return os.WriteFile(loc, formatHeader(kind, current), 0644)
+	}
+
+	version, body, err := parseFormat(kind, content)
+	if err != nil {
+		return fmt.Errorf("error while reading the format of %s: %w", loc, err)
+	}
+	if version > current {
+		return fmt.Errorf("%w: %s is at version %d, this vault reads up to version %d", ErrFormatNewer, loc, version, current)
+	}
+	if version == current {
+		return nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", loc, version)
+	if err = os.WriteFile(backup, content, 0600); err != nil {
+		return fmt.Errorf("error while backing up %s before upgrading it: %w", loc, err)
+	}
+	for v := version; v < current; v++ {
+		if body, err = formatUpgrades[kind][v-FormatLegacy](body); err != nil {
+			return fmt.Errorf("error while upgrading %s from format version %d to %d: %w", loc, v, v+1, err)
+		}
+	}
+
+	tmp := loc + ".upgrade"
+	if err = os.WriteFile(tmp, append(formatHeader(kind, current), body...), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, loc); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Info().Msgf("upgraded %s store %s from format version %d to %d, keeping a copy of it at %s", kind, loc, version, current, backup)
+	return nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type FormatTestSuite struct {
+	suite.Suite
+	dir string
+	log *vlog.Logger
+}
+
+func (suite *FormatTestSuite) SetupTest() {
+	suite.log = vlog.New(false)
+	suite.dir = suite.T().TempDir()
+}
+
+func (suite *FormatTestSuite) TestUpgradeFile() {
+	ctx := context.Background()
+	loc := filepath.Join(suite.dir, ".store")
+	legacy := []byte("customer123=\"token1\"\n")
+	suite.Require().NoError(os.WriteFile(loc, legacy, 0644))
+
+	info, err := ReadFormat(FormatFile, loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(FormatLegacy, info.Version, "expected a file without header at the legacy version")
+
+	f := NewFile(loc, suite.log)
+	_, err = f.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer f.Close(ctx)
+	val, err := f.Retrieve(ctx, "customer123")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token1", val)
+
+	// the old file is kept next to the upgraded one
+	backup, err := os.ReadFile(loc + ".v1.bak")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(legacy, backup)
+	info, err = ReadFormat(FormatFile, loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(CurrentFormat(FormatFile), info.Version)
+	suite.Require().Equal([]string{loc + ".v1.bak"}, info.Backups)
+
+	// writes and flushes keep the header
+	suite.Require().NoError(f.Store(ctx, "customer123/ssn", "token2"))
+	_, err = f.Flush(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	content, err := os.ReadFile(loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(formatHeader(FormatFile, CurrentFormat(FormatFile)), content)
+}
+
+func (suite *FormatTestSuite) TestUpgradeGob() {
+	ctx := context.Background()
+	loc := filepath.Join(suite.dir, ".gob")
+	var legacy bytes.Buffer
+	suite.Require().NoError(gob.NewEncoder(&legacy).Encode(map[string]string{"customer123": "token1"}))
+	suite.Require().NoError(os.WriteFile(loc, legacy.Bytes(), 0644))
+
+	g, err := NewGob(ctx, loc, suite.log, false)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer g.Close(ctx)
+	val, err := g.Retrieve(ctx, "customer123")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token1", val)
+	suite.Require().NoError(g.Store(ctx, "customer123/ssn", "token2"))
+
+	backup, err := os.ReadFile(loc + ".v1.bak")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(legacy.Bytes(), backup)
+	records, err := readFileRecords(loc, decodeGob)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123": "token1", "customer123/ssn": "token2"}, records)
+}
+
+func (suite *FormatTestSuite) TestNewer() {
+	loc := filepath.Join(suite.dir, ".store")
+	newer := append(formatHeader(FormatFile, CurrentFormat(FormatFile)+1), "customer123=\"token1\"\n"...)
+	suite.Require().NoError(os.WriteFile(loc, newer, 0644))
+
+	// files from a newer vault are left alone
+	_, err := NewFile(loc, suite.log).Connect(context.Background())
+	suite.Require().Truef(errors.Is(err, ErrFormatNewer), "expected a format newer error, but got %v\n", err)
+	content, err := os.ReadFile(loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(newer, content)
+
+	suite.Require().NoError(os.WriteFile(loc, []byte("#vault file vX\n"), 0644))
+	_, err = ReadFormat(FormatFile, loc)
+	suite.Require().Truef(errors.Is(err, ErrFormatInvalid), "expected a format invalid error, but got %v\n", err)
+}
+
+// TestFormatSuite tests the versioning and upgrades of store files
+func TestFormatSuite(t *testing.T) {
+	suite.Run(t, new(FormatTestSuite))
+}
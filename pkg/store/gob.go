@@ -1,12 +1,14 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"encoding/gob"
 	"fmt"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/rs/zerolog/log"
 	"io"
+	"math"
 	"os"
 	"sync"
 )
@@ -19,9 +21,21 @@ type Gob struct {
 	basin  *Map
 	fd     *os.File
 	logger *vlog.Logger
+	// ops serializes the operations on basin, from the refresh of the map through the write of the file, so no write is
+	// lost to a concurrent one and no refresh drops a write not yet persisted
+	ops sync.Mutex
 	sync.RWMutex
 }
 
+func init() {
+	Register(DriverGob, func(ctx context.Context, cfg Config) (Store, error) {
+		if len(cfg.Loc) == 0 {
+			return nil, fmt.Errorf("%s: %w", DriverGob, ErrLocEmpty)
+		}
+		return NewGob(ctx, cfg.Loc, cfg.Logger, cfg.Truncate)
+	})
+}
+
 func NewGob(ctx context.Context, loc string, logger *vlog.Logger, trunc bool) (*Gob, error) {
 	// switch trunc to using functonal options
 	log := logger.Logger()
@@ -33,22 +47,29 @@ func NewGob(ctx context.Context, loc string, logger *vlog.Logger, trunc bool) (*
 		return nil, err
 	}
 
-	// open file
-	fd, err := os.OpenFile(loc, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
-	if err != nil {
-		log.Info().Msgf("error while creating file at location %s: %s\n", loc, err.Error())
-		return nil, err
-	}
-
 	if trunc {
-		// truncate the file to zero
-		err := fd.Truncate(0)
+		// start over from an empty store in the current format
+		err = os.WriteFile(loc, formatHeader(FormatGob, CurrentFormat(FormatGob)), 0755)
 		if err != nil {
 			log.Info().Msgf("could not truncate existing gob store %s: %s\n", loc, err.Error())
 			return nil, err
 		}
+	} else {
+		// files written in an older format are upgraded before they are opened
+		err = upgradeFormat(FormatGob, loc, logger)
+		if err != nil {
+			log.Error().Msgf("error while upgrading gob store %s: %s\n", loc, err.Error())
+			return nil, err
+		}
+	}
+
+	// open file
+	fd, err := os.OpenFile(loc, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		log.Info().Msgf("error while creating file at location %s: %s\n", loc, err.Error())
+		return nil, err
 	}
-	return &Gob{loc, NewSyncMap(ctx, logger), fd, logger, sync.RWMutex{}}, nil
+	return &Gob{loc: loc, basin: NewSyncMap(ctx, logger), fd: fd, logger: logger}, nil
 }
 
 func (g *Gob) Connect(ctx context.Context) (bool, error) {
@@ -56,6 +77,8 @@ func (g *Gob) Connect(ctx context.Context) (bool, error) {
 }
 
 func (g *Gob) Store(ctx context.Context, id string, token any) error {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 
 	// TODO: Revisit this it's best to refresh before persisting new data; just in case there has been a latest update first refresh in-memory map, or the in-memory map has been cleared below
@@ -95,6 +118,8 @@ func (g *Gob) Store(ctx context.Context, id string, token any) error {
 }
 
 func (g *Gob) Patch(ctx context.Context, id string, token any) (bool, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 
 	// first refresh in-memory map
@@ -125,7 +150,37 @@ func (g *Gob) Patch(ctx context.Context, id string, token any) (bool, error) {
 	return true, nil
 }
 
+// Batch applies ops atomically to the refreshed in-memory map, and persists them all in a single write
+func (g *Gob) Batch(ctx context.Context, ops []Op) error {
+	g.ops.Lock()
+	defer g.ops.Unlock()
+	log := g.logger.Logger()
+
+	err := g.MapRefresh(ctx)
+	if err != nil {
+		log.Error().Msgf("error while refresh gob persistent storage: error: %s\n", err.Error())
+		return err
+	}
+
+	// the batch is checked before it is applied, so a failing op leaves the map as it was
+	if err = g.basin.Batch(ctx, ops); err != nil {
+		return err
+	}
+
+	i, err := g.persist(ctx, true)
+	if err != nil {
+		log.Debug().Msgf("error while persisting a batch of %d operations: %s\n", len(ops), err.Error())
+		return err
+	}
+	if i == 0 {
+		return fmt.Errorf("wrote 0 bytes to gob persistent storage")
+	}
+	return nil
+}
+
 func (g *Gob) Retrieve(ctx context.Context, id string) (string, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 	// first refresh in-memory map
 	err := g.MapRefresh(ctx)
@@ -138,7 +193,7 @@ func (g *Gob) Retrieve(ctx context.Context, id string) (string, error) {
 	value, err := g.basin.Retrieve(ctx, id)
 	if err != nil {
 		log.Debug().Msgf("error while retrieving value with id: %s: %s\n", id, err.Error())
-		return "", fmt.Errorf("error while retrieving value with id: %s: %s\n", id, err.Error())
+		return "", fmt.Errorf("error while retrieving value with id: %s: %w", id, err)
 	}
 
 	return value, nil
@@ -146,6 +201,8 @@ func (g *Gob) Retrieve(ctx context.Context, id string) (string, error) {
 
 // RetrieveAll
 func (g *Gob) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 
 	// first refresh in-memory map
@@ -165,7 +222,29 @@ func (g *Gob) RetrieveAll(ctx context.Context) (map[string]string, error) {
 	return m, err
 }
 
+// Stats counts the records of the gob store, and sizes its file
+func (g *Gob) Stats(ctx context.Context) (*StoreStats, error) {
+	records, err := g.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fileStats(DriverGob, g.loc, len(records))
+}
+
+// Scan returns the page of records selected by opts, from the refreshed in-memory map
+func (g *Gob) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
+	if err := g.MapRefresh(ctx); err != nil {
+		g.logger.Logger().Error().Msgf("error while refresh gob persistent storage: error: %s\n", err.Error())
+		return nil, err
+	}
+	return g.basin.Scan(ctx, opts)
+}
+
 func (g *Gob) Delete(ctx context.Context, id string) (bool, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 
 	// first refresh in-memory map
@@ -254,25 +333,18 @@ func (g *Gob) MapRefresh(ctx context.Context) error {
 	g.RLock()
 	defer g.RUnlock()
 
-	//fBytes := []byte{}
-	//g.fd.Read(fBytes)
-	//
-	//fBuffer := bytes.Buffer{}
-	//_, err := fBuffer.Read(fBytes)
-	//if err != nil {
-	//	return err
-	//}
-
-	// set up gob decoder with file descriptor to gob persistent store
-	dec := gob.NewDecoder(g.fd)
-
-	// encode map and write to io.Writer
-	err := dec.Decode(&m)
-	if err == io.EOF {
-		log.Warn().Msgf("decoding file returned with EOF: file empty: %s\n", err.Error())
-	} else if err != nil {
+	// read the whole persistent store, so changes made by other processes are seen too. reading at an offset leaves
+	// the file descriptor to concurrent readers.
+	content, err := io.ReadAll(io.NewSectionReader(g.fd, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+
+	// decode map from the body of the file
+	m, err = decodeGob(content)
+	if err != nil {
 		log.Error().Msgf("error while decoding into map from gob persistent storage: error: %s\n", err.Error())
-		return fmt.Errorf("error while encoddecodinging into map from gob persistent storage: error: %s\n", err.Error())
+		return fmt.Errorf("error while decoding into map from gob persistent storage: %w", err)
 	}
 
 	// only perform a clean refresh when m map is not empty
@@ -286,10 +358,7 @@ func (g *Gob) MapRefresh(ctx context.Context) error {
 		}
 
 		// unfurl map into sync map
-		syncM := g.basin.Map()
-		for k, v := range m {
-			syncM.Store(k, v)
-		}
+		g.basin.load(m)
 	}
 
 	return nil
@@ -315,8 +384,15 @@ func (g *Gob) MapDump(ctx context.Context) error {
 	// print things about to be stored, for debugging purposes
 	fmt.Println("about to persist:", m)
 
+	// every dump starts with the header of the current format
+	_, err := g.fd.Write(formatHeader(FormatGob, CurrentFormat(FormatGob)))
+	if err != nil {
+		log.Error().Msgf("error while writing gob persistent storage header: error: %s\n", err.Error())
+		return err
+	}
+
 	// encode map and write to io.Writer || fd
-	err := dec.Encode(m)
+	err = dec.Encode(m)
 	if err != nil {
 		log.Error().Msgf("error while encoding into map into gob persistent storage: error: %s\n", err.Error())
 		return err
@@ -343,6 +419,8 @@ func (g *Gob) fileRefresh() error {
 // Flush empties the internal sync.Map and the persistent gob store // TODO: why? What is the use case for this?
 // TODO: Flush should rather persist the current state of the in-memory map into disk, and then empty the in-memory map. It isn't idiomatic for flush to clear the persistent store too.
 func (g *Gob) Flush(ctx context.Context) (bool, error) {
+	g.ops.Lock()
+	defer g.ops.Unlock()
 	log := g.logger.Logger()
 
 	// first empty sync map
@@ -353,12 +431,34 @@ func (g *Gob) Flush(ctx context.Context) (bool, error) {
 		return b, err
 	}
 
-	// delete persistent gob store last
+	// delete persistent gob store last, keeping its header
 	err = g.trunc(0)
 	log.Debug().Msgf("flushing gob persistent store")
 	if err != nil {
 		log.Error().Msgf("error occurred while flushing persistent gob store: %s\n", err.Error())
 		return false, err
 	}
+	if _, err = g.fd.Write(formatHeader(FormatGob, CurrentFormat(FormatGob))); err != nil {
+		log.Error().Msgf("error occurred while flushing persistent gob store: %s\n", err.Error())
+		return false, err
+	}
 	return true, nil
 }
+
+// Watch streams the changes made to keys starting with prefix in the gob store, by this or any other process
+func (g *Gob) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchFile(ctx, g.loc, prefix, func() (map[string]string, error) {
+		return readFileRecords(g.loc, decodeGob)
+	}, g.logger)
+}
+
+// decodeGob decodes the map held in the content of a gob store. A store holding no map yet decodes as empty.
+func decodeGob(content []byte) (map[string]string, error) {
+	var m = map[string]string{}
+	body, err := readFormat(FormatGob, content)
+	if err != nil || len(body) == 0 {
+		return m, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(body)).Decode(&m)
+	return m, err
+}
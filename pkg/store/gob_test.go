@@ -360,6 +360,30 @@ func (suite *GobTestSuite) TestPatch() {
 	}
 }
 
+func (suite *GobTestSuite) TestConcurrentBatches() {
+	ctx := context.Background()
+	gob, err := NewGob(ctx, filepath.Join(suite.T().TempDir(), "test.gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer gob.Close(ctx)
+
+	records, err := batchConcurrently(ctx, gob, 400)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	all, err := gob.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(records, all, "expected no batch to be lost")
+}
+
+func (suite *GobTestSuite) TestConcurrentConflicts() {
+	ctx := context.Background()
+	gob, err := NewGob(ctx, filepath.Join(suite.T().TempDir(), "test.gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer gob.Close(ctx)
+
+	stored, conflicts := createConcurrently(ctx, gob, "ijbnijdelkfiue1", 100)
+	suite.Require().Equal(1, stored, "expected a single create of the key to succeed")
+	suite.Require().Equal(99, conflicts, "expected the other creates to conflict")
+}
+
 func (suite *GobTestSuite) TearDownSuite() {
 	for i := 0; i < len(suite.tableConnect); i++ {
 		err := os.RemoveAll(suite.tableConnect[i].loc)
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyIndex keeps the keys of a store in order, so ranges of keys can be scanned without visiting every key. Writes
+// replace the slice of keys rather than changing it, so scans can range over it without holding the lock.
+type keyIndex struct {
+	keys []string
+	sync.RWMutex
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{}
+}
+
+// add inserts key into the index, if it isn't there yet
+func (ix *keyIndex) add(key string) {
+	ix.Lock()
+	defer ix.Unlock()
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		return
+	}
+	keys := make([]string, 0, len(ix.keys)+1)
+	keys = append(append(append(keys, ix.keys[:i]...), key), ix.keys[i:]...)
+	ix.keys = keys
+}
+
+// remove deletes key from the index, if it is there
+func (ix *keyIndex) remove(key string) {
+	ix.Lock()
+	defer ix.Unlock()
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		keys := make([]string, 0, len(ix.keys)-1)
+		ix.keys = append(append(keys, ix.keys[:i]...), ix.keys[i+1:]...)
+	}
+}
+
+// reset replaces the content of the index with keys
+func (ix *keyIndex) reset(keys []string) {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	ix.Lock()
+	defer ix.Unlock()
+	ix.keys = sorted
+}
+
+// scan calls fn with the keys starting with prefix, in order, until fn returns false. Scans start after the key
+// after, or before it when reverse.
+func (ix *keyIndex) scan(prefix, after string, reverse bool, fn func(key string) bool) {
+	ix.RLock()
+	keys := ix.keys
+	ix.RUnlock()
+
+	// the range of keys starting with prefix
+	lo := sort.SearchStrings(keys, prefix)
+	hi := lo + sort.Search(len(keys)-lo, func(i int) bool {
+		return !strings.HasPrefix(keys[lo+i], prefix)
+	})
+
+	if !reverse {
+		if len(after) > 0 {
+			lo = max(lo, sort.Search(len(keys), func(i int) bool { return keys[i] > after }))
+		}
+		for i := lo; i < hi; i++ {
+			if !fn(keys[i]) {
+				return
+			}
+		}
+		return
+	}
+
+	if len(after) > 0 {
+		hi = min(hi, sort.SearchStrings(keys, after))
+	}
+	for i := hi - 1; i >= lo; i-- {
+		if !fn(keys[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"sort"
+)
+
+var (
+	ErrMigrateVerification = errors.New("migration verification failed")
+)
+
+// MigrateOptions tunes a Migrate run
+type MigrateOptions struct {
+	// DryRun reads and checksums the source without writing anything to the destination
+	DryRun bool
+	// Overwrite patches records that already exist in the destination instead of aborting
+	Overwrite bool
+}
+
+// MigrateReport summarizes a Migrate run
+type MigrateReport struct {
+	Records             int    `json:"records"`
+	Copied              int    `json:"copied"`
+	Overwritten         int    `json:"overwritten"`
+	SourceChecksum      string `json:"source_checksum"`
+	DestinationChecksum string `json:"destination_checksum"`
+	DryRun              bool   `json:"dry_run"`
+	Verified            bool   `json:"verified"`
+}
+
+// Migrate copies every record of from into to, preserving keys verbatim, and then verifies the destination by
+// comparing the record count and checksum of the migrated keys with the source.
+func Migrate(ctx context.Context, from, to Store, opts MigrateOptions, logger *vlog.Logger) (*MigrateReport, error) {
+	log := logger.Logger()
+	report := &MigrateReport{DryRun: opts.DryRun}
+
+	records, err := from.RetrieveAll(ctx)
+	if err != nil {
+		log.Error().Msgf("error while reading source store: %s\n", err.Error())
+		return report, fmt.Errorf("error while reading source store: %w", err)
+	}
+	report.Records = len(records)
+	report.SourceChecksum = Checksum(records)
+	log.Debug().Msgf("read %d records from source store with checksum %s", report.Records, report.SourceChecksum)
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	// nothing to copy or verify
+	if report.Records == 0 {
+		report.DestinationChecksum = report.SourceChecksum
+		report.Verified = true
+		return report, nil
+	}
+
+	for _, id := range sortedKeys(records) {
+		err = to.Store(ctx, id, records[id])
+		if err == nil {
+			report.Copied++
+			continue
+		}
+		if !opts.Overwrite {
+			log.Error().Msgf("error while writing record %s to destination store: %s\n", id, err.Error())
+			return report, fmt.Errorf("error while writing record %s to destination store: %w", id, err)
+		}
+		if b, err := to.Patch(ctx, id, records[id]); err != nil || !b {
+			log.Error().Msgf("error while overwriting record %s in destination store: %v\n", id, err)
+			return report, fmt.Errorf("error while overwriting record %s in destination store: %v", id, err)
+		}
+		report.Overwritten++
+	}
+
+	// verify what landed in the destination
+	written, err := to.RetrieveAll(ctx)
+	if err != nil {
+		log.Error().Msgf("error while reading destination store: %s\n", err.Error())
+		return report, fmt.Errorf("error while reading destination store: %w", err)
+	}
+
+	migrated := make(map[string]string, len(records))
+	for id := range records {
+		if val, ok := written[id]; ok {
+			migrated[id] = val
+		}
+	}
+	report.DestinationChecksum = Checksum(migrated)
+
+	if len(migrated) != len(records) {
+		return report, fmt.Errorf("%w: expected %d records in destination, found %d", ErrMigrateVerification, len(records), len(migrated))
+	}
+	if report.DestinationChecksum != report.SourceChecksum {
+		return report, fmt.Errorf("%w: checksum mismatch: source %s, destination %s", ErrMigrateVerification, report.SourceChecksum, report.DestinationChecksum)
+	}
+	report.Verified = true
+
+	log.Info().Msgf("migrated %d records", report.Records)
+	return report, nil
+}
+
+// Checksum returns a hex encoded SHA-256 digest over the records, independent of map iteration order
+func Checksum(records map[string]string) string {
+	h := sha256.New()
+	for _, id := range sortedKeys(records) {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(id), id, len(records[id]), records[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
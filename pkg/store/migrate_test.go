@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+	records map[string]string
+	log     *vlog.Logger
+}
+
+func (suite *MigrateTestSuite) SetupTest() {
+	suite.records = varTableStoreGobRetrieve
+	suite.log = vlog.New(true)
+}
+
+func (suite *MigrateTestSuite) TestMigrate() {
+	ctx := context.Background()
+	from := suite.source(ctx)
+	to, err := NewGob(ctx, filepath.Join(suite.T().TempDir(), "migrated.gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(report.Verified, "expected migration to be verified")
+	suite.Require().Equal(len(suite.records), report.Records)
+	suite.Require().Equal(len(suite.records), report.Copied)
+	suite.Require().Equal(Checksum(suite.records), report.DestinationChecksum)
+
+	all, err := to.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(suite.records, all)
+}
+
+func (suite *MigrateTestSuite) TestDryRun() {
+	ctx := context.Background()
+	from := suite.source(ctx)
+	to := NewSyncMap(ctx, suite.log)
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{DryRun: true}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(len(suite.records), report.Records)
+	suite.Require().Equal(0, report.Copied)
+	suite.Require().False(report.Verified)
+
+	all, err := to.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Empty(all, "expected dry run to leave the destination untouched")
+}
+
+func (suite *MigrateTestSuite) TestConflict() {
+	ctx := context.Background()
+	from := suite.source(ctx)
+	to := NewSyncMap(ctx, suite.log)
+	suite.Require().NoError(to.Store(ctx, "ijbnijdelkfiue1", "stale"))
+
+	_, err := Migrate(ctx, from, to, MigrateOptions{}, suite.log)
+	suite.Require().Error(err, "expected existing destination record to abort the migration")
+
+	report, err := Migrate(ctx, from, to, MigrateOptions{Overwrite: true}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(report.Verified, "expected migration to be verified")
+	suite.Require().Equal(len(suite.records), report.Overwritten+report.Copied)
+}
+
+func (suite *MigrateTestSuite) TestChecksum() {
+	a := map[string]string{"ab": "c", "d": "e"}
+	b := map[string]string{"a": "bc", "d": "e"}
+	suite.Require().Equal(Checksum(a), Checksum(map[string]string{"d": "e", "ab": "c"}))
+	suite.Require().NotEqual(Checksum(a), Checksum(b), "expected checksum to separate keys from values")
+}
+
+func (suite *MigrateTestSuite) TearDownTest() {}
+
+// TestMigrateSuite tests migrating records between stores
+func TestMigrateSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
+
+func (suite *MigrateTestSuite) source(ctx context.Context) Store {
+	from := NewSyncMap(ctx, suite.log)
+	for k, v := range suite.records {
+		suite.Require().NoError(from.Store(ctx, k, v))
+	}
+	return from
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"strings"
+)
+
+// PathSeparator separates the segments of a key, as in team/app/db/password
+const PathSeparator = "/"
+
+var (
+	segmentEscaper   = strings.NewReplacer("%", "%25", PathSeparator, "%2F")
+	segmentUnescaper = strings.NewReplacer("%25", "%", "%2F", PathSeparator)
+)
+
+// EscapeSegment escapes name so it can be used as a single segment of a key, whatever separators it holds
+func EscapeSegment(name string) string {
+	return segmentEscaper.Replace(name)
+}
+
+// UnescapeSegment reverses EscapeSegment
+func UnescapeSegment(segment string) string {
+	return segmentUnescaper.Replace(segment)
+}
+
+// CleanPath drops the empty segments of path, so team//app/ and team/app name the same parent
+func CleanPath(path string) string {
+	segments := strings.Split(path, PathSeparator)
+	clean := segments[:0]
+	for _, segment := range segments {
+		if len(segment) > 0 {
+			clean = append(clean, segment)
+		}
+	}
+	return strings.Join(clean, PathSeparator)
+}
+
+// JoinPath creates the key of name under the parent path. name is escaped into a single segment, and left out if empty.
+func JoinPath(parent, name string) string {
+	parent = CleanPath(parent)
+	if len(name) == 0 {
+		return parent
+	}
+	if len(parent) == 0 {
+		return EscapeSegment(name)
+	}
+	return parent + PathSeparator + EscapeSegment(name)
+}
+
+// SplitPath splits key into its parent path and its unescaped name. Keys without a separator have an empty parent.
+func SplitPath(key string) (parent, name string) {
+	i := strings.LastIndex(key, PathSeparator)
+	if i < 0 {
+		return "", UnescapeSegment(key)
+	}
+	return key[:i], UnescapeSegment(key[i+1:])
+}
+
+// HasPathPrefix reports whether key is prefix itself, or lies under it. Only whole segments match, so team/app
+// doesn't match team/application.
+func HasPathPrefix(key, prefix string) bool {
+	prefix = CleanPath(prefix)
+	if len(prefix) == 0 {
+		return true
+	}
+	return key == prefix || strings.HasPrefix(key, prefix+PathSeparator)
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type PathTestSuite struct {
+	suite.Suite
+}
+
+func (suite *PathTestSuite) TestJoinAndSplit() {
+	table := []struct {
+		parent, name, key string
+	}{
+		{"team/app/db", "password", "team/app/db/password"},
+		{"team//app/", "password", "team/app/password"},
+		{"", "password", "password"},
+		{"team/app", "tls/cert", "team/app/tls%2Fcert"},
+		{"team/app", "100%", "team/app/100%25"},
+		{"team/app", "100%2F", "team/app/100%252F"},
+		{"customer123", "first__name", "customer123/first__name"},
+	}
+	for _, tt := range table {
+		key := JoinPath(tt.parent, tt.name)
+		suite.Require().Equalf(tt.key, key, "expected %s, but got %s\n", tt.key, key)
+		parent, name := SplitPath(key)
+		suite.Require().Equal(CleanPath(tt.parent), parent)
+		suite.Require().Equalf(tt.name, name, "expected %s to round trip, but got %s\n", tt.name, name)
+	}
+
+	suite.Require().Equal("team/app", JoinPath("team/app/", ""), "expected an empty name to be left out")
+}
+
+func (suite *PathTestSuite) TestHasPathPrefix() {
+	suite.Require().True(HasPathPrefix("team/app/db/password", "team/app/"))
+	suite.Require().True(HasPathPrefix("team/app/db/password", "team/app"))
+	suite.Require().True(HasPathPrefix("team/app", "team/app/"))
+	suite.Require().True(HasPathPrefix("team/app", ""))
+	suite.Require().False(HasPathPrefix("team/application/key", "team/app"))
+	suite.Require().False(HasPathPrefix("other/app/key", "team/app"))
+}
+
+// TestPathSuite tests building and splitting slash-separated keys
+func TestPathSuite(t *testing.T) {
+	suite.Run(t, new(PathTestSuite))
+}
@@ -0,0 +1,554 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PluginProtocolVersion is the version of the plugin protocol. Plugins speaking another version are refused at the
+	// handshake.
+	PluginProtocolVersion = 1
+
+	// PluginCookieEnv and PluginCookie are set in the environment of plugins, so they can tell they were launched by
+	// the vault
+	PluginCookieEnv = "VAULT_PLUGIN_COOKIE"
+	PluginCookie    = "d5c4a0f6-vault-store-plugin"
+	// PluginSocketEnv is set to the path of the unix socket a plugin should listen on, instead of serving over stdio
+	PluginSocketEnv = "VAULT_PLUGIN_SOCKET"
+
+	DefaultPluginCallTimeout    = 30 * time.Second
+	DefaultPluginHealthInterval = 10 * time.Second
+	DefaultPluginStartTimeout   = 10 * time.Second
+)
+
+// The methods of the plugin protocol. All but PluginHandshake and PluginHealth map to the Store method of the same name.
+const (
+	PluginHandshake   = "handshake"
+	PluginHealth      = "health"
+	PluginConnect     = "connect"
+	PluginStore       = "store"
+	PluginRetrieve    = "retrieve"
+	PluginRetrieveAll = "retrieve_all"
+	PluginDelete      = "delete"
+	PluginPatch       = "patch"
+	PluginFlush       = "flush"
+	PluginClose       = "close"
+
+	// PluginCodeNotFound marks the error of a response as ErrNotFound
+	PluginCodeNotFound = "not_found"
+)
+
+var (
+	ErrPluginUnavailable = errors.New("store plugin is unavailable")
+	ErrPluginProtocol    = errors.New("store plugin protocol mismatch")
+	ErrPluginClosed      = errors.New("store plugin is closed")
+)
+
+// PluginRequest is a call from the vault to a plugin. Requests and responses are exchanged as newline delimited json,
+// and matched by ID, so a plugin may answer them in any order.
+type PluginRequest struct {
+	ID      uint64 `json:"id"`
+	Method  string `json:"method"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// PluginResponse is the answer of a plugin to the PluginRequest with the same ID
+type PluginResponse struct {
+	ID      uint64            `json:"id"`
+	OK      bool              `json:"ok,omitempty"`
+	Value   string            `json:"value,omitempty"`
+	Records map[string]string `json:"records,omitempty"`
+	Version int               `json:"version,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Code    string            `json:"code,omitempty"`
+}
+
+// PluginConfig holds the tunables of a Plugin store
+type PluginConfig struct {
+	// Path is the plugin executable
+	Path string
+	// Args are passed to the plugin executable
+	Args []string
+	// Socket talks to the plugin over a unix socket instead of its stdin and stdout
+	Socket bool
+	// CallTimeout bounds every call to the plugin. Defaults to DefaultPluginCallTimeout.
+	CallTimeout time.Duration
+	// HealthInterval is how often a connected plugin is health checked, and restarted if it fails. Defaults to
+	// DefaultPluginHealthInterval.
+	HealthInterval time.Duration
+	// StartTimeout bounds the launch and handshake of the plugin. Defaults to DefaultPluginStartTimeout.
+	StartTimeout time.Duration
+}
+
+// Plugin is a store backed by an external executable, which serves the store methods over the plugin protocol. The
+// executable is launched on Connect, and launched again whenever it exits or fails a health check. See the storeplugin
+// package to write one.
+type Plugin struct {
+	config   PluginConfig
+	logger   *vlog.Logger
+	mu       sync.Mutex
+	proc     *pluginProcess
+	restarts int
+	// connected reconnects a restarted plugin
+	connected bool
+	closed    bool
+	stop      chan struct{}
+}
+
+func init() {
+	Register(DriverPlugin, func(ctx context.Context, cfg Config) (Store, error) {
+		config := PluginConfig{Path: cfg.Loc, Args: cfg.Options[ParamArg]}
+		if socket := cfg.Options.Get(ParamSocket); len(socket) > 0 {
+			var err error
+			if config.Socket, err = strconv.ParseBool(socket); err != nil {
+				return nil, fmt.Errorf("%w: %s must be true or false", ErrURLInvalid, ParamSocket)
+			}
+		}
+		return NewPlugin(config, cfg.Logger)
+	})
+}
+
+// NewPlugin creates a store backed by the plugin executable configured by config. Nothing is launched until Connect.
+func NewPlugin(config PluginConfig, logger *vlog.Logger) (*Plugin, error) {
+	if len(config.Path) == 0 {
+		return nil, fmt.Errorf("plugin: %w", ErrLocEmpty)
+	}
+	if config.CallTimeout <= 0 {
+		config.CallTimeout = DefaultPluginCallTimeout
+	}
+	if config.HealthInterval <= 0 {
+		config.HealthInterval = DefaultPluginHealthInterval
+	}
+	if config.StartTimeout <= 0 {
+		config.StartTimeout = DefaultPluginStartTimeout
+	}
+	return &Plugin{config: config, logger: logger, stop: make(chan struct{})}, nil
+}
+
+// Connect launches the plugin, and health checks it in the background until Close
+func (p *Plugin) Connect(ctx context.Context) (bool, error) {
+	resp, err := p.call(ctx, PluginRequest{Method: PluginConnect})
+	if err != nil {
+		return false, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		p.connected = true
+		go p.healthLoop()
+	}
+	return resp.OK, nil
+}
+
+func (p *Plugin) Store(ctx context.Context, id string, token any) error {
+	b, tokenStr := InterfaceIsString(token)
+	if !b {
+		return fmt.Errorf(ErrTokenTypeNotString)
+	}
+	_, err := p.call(ctx, PluginRequest{Method: PluginStore, Key: id, Value: tokenStr})
+	return err
+}
+
+func (p *Plugin) Retrieve(ctx context.Context, id string) (string, error) {
+	resp, err := p.call(ctx, PluginRequest{Method: PluginRetrieve, Key: id})
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+func (p *Plugin) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	resp, err := p.call(ctx, PluginRequest{Method: PluginRetrieveAll})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Records == nil {
+		resp.Records = map[string]string{}
+	}
+	return resp.Records, nil
+}
+
+func (p *Plugin) Delete(ctx context.Context, id string) (bool, error) {
+	resp, err := p.call(ctx, PluginRequest{Method: PluginDelete, Key: id})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+func (p *Plugin) Patch(ctx context.Context, id string, token any) (bool, error) {
+	b, tokenStr := InterfaceIsString(token)
+	if !b {
+		return false, fmt.Errorf(ErrTokenTypeNotString)
+	}
+	resp, err := p.call(ctx, PluginRequest{Method: PluginPatch, Key: id, Value: tokenStr})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+func (p *Plugin) Flush(ctx context.Context) (bool, error) {
+	resp, err := p.call(ctx, PluginRequest{Method: PluginFlush})
+	if err != nil {
+		return false, err
+	}
+	return resp.OK, nil
+}
+
+// Close closes the store of the plugin, and stops the plugin
+func (p *Plugin) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	proc := p.proc
+	p.closed = true
+	close(p.stop)
+	p.mu.Unlock()
+
+	if proc == nil || !proc.alive() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.CallTimeout)
+	defer cancel()
+	_, err := proc.call(ctx, PluginRequest{Method: PluginClose})
+	proc.shutdown(ctx)
+	return err
+}
+
+// Health checks that the plugin answers, launching it if it isn't running
+func (p *Plugin) Health(ctx context.Context) error {
+	_, err := p.call(ctx, PluginRequest{Method: PluginHealth})
+	return err
+}
+
+// Restarts returns how many times the plugin was launched again after it exited or failed a health check
+func (p *Plugin) Restarts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts
+}
+
+// call sends req to the running plugin, launching it first if needed, and turns an error response into an error
+func (p *Plugin) call(ctx context.Context, req PluginRequest) (*PluginResponse, error) {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.CallTimeout)
+	defer cancel()
+	resp, err := proc.call(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrPluginUnavailable, req.Method, err)
+	}
+	if len(resp.Error) > 0 {
+		if resp.Code == PluginCodeNotFound {
+			return nil, fmt.Errorf("%s: %w", resp.Error, ErrNotFound)
+		}
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// process returns the running plugin process, launching the plugin if it never ran or exited
+func (p *Plugin) process(ctx context.Context) (*pluginProcess, error) {
+	log := p.logger.Logger()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPluginClosed
+	}
+	if p.proc != nil && p.proc.alive() {
+		return p.proc, nil
+	}
+	if p.proc != nil {
+		p.restarts++
+		log.Warn().Msgf("store plugin %s stopped: %v. restarting it", p.config.Path, p.proc.failure())
+	}
+
+	proc, err := p.launch(ctx)
+	if err != nil {
+		log.Error().Msgf("error while launching store plugin %s: %s\n", p.config.Path, err.Error())
+		return nil, fmt.Errorf("%w: %v", ErrPluginUnavailable, err)
+	}
+	p.proc = proc
+	if p.connected {
+		// a restarted plugin starts disconnected
+		cctx, cancel := context.WithTimeout(ctx, p.config.CallTimeout)
+		defer cancel()
+		if _, err = proc.call(cctx, PluginRequest{Method: PluginConnect}); err != nil {
+			return nil, fmt.Errorf("%w: reconnecting: %v", ErrPluginUnavailable, err)
+		}
+	}
+	return proc, nil
+}
+
+// launch starts the plugin executable, and shakes hands with it
+func (p *Plugin) launch(ctx context.Context) (*pluginProcess, error) {
+	log := p.logger.Logger()
+	ctx, cancel := context.WithTimeout(ctx, p.config.StartTimeout)
+	defer cancel()
+
+	cmd := exec.Command(p.config.Path, p.config.Args...)
+	cmd.Env = append(os.Environ(), PluginCookieEnv+"="+PluginCookie)
+	cmd.Stderr = &pluginLog{logger: p.logger, name: filepath.Base(p.config.Path)}
+
+	var proc *pluginProcess
+	if p.config.Socket {
+		dir, err := os.MkdirTemp("", "vault-plugin-")
+		if err != nil {
+			return nil, err
+		}
+		sock := filepath.Join(dir, "plugin.sock")
+		cmd.Env = append(cmd.Env, PluginSocketEnv+"="+sock)
+		if err = cmd.Start(); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		conn, err := dialPlugin(ctx, sock)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		proc = newPluginProcess(cmd, conn, conn, func() { conn.Close(); os.RemoveAll(dir) })
+	} else {
+		w, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		proc = newPluginProcess(cmd, r, w, func() { w.Close() })
+	}
+
+	resp, err := proc.call(ctx, PluginRequest{Method: PluginHandshake, Version: PluginProtocolVersion})
+	if err == nil && len(resp.Error) > 0 {
+		err = fmt.Errorf("%w: %s", ErrPluginProtocol, resp.Error)
+	} else if err == nil && resp.Version != PluginProtocolVersion {
+		err = fmt.Errorf("%w: plugin speaks version %d, expected %d", ErrPluginProtocol, resp.Version, PluginProtocolVersion)
+	}
+	if err != nil {
+		proc.kill()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	log.Debug().Msgf("launched store plugin %s, pid %d", p.config.Path, cmd.Process.Pid)
+	return proc, nil
+}
+
+// healthLoop health checks the plugin every health interval until Close, and restarts it when it fails
+func (p *Plugin) healthLoop() {
+	log := p.logger.Logger()
+	ticker := time.NewTicker(p.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			proc := p.proc
+			p.mu.Unlock()
+			if proc != nil && proc.alive() {
+				ctx, cancel := context.WithTimeout(context.Background(), p.config.CallTimeout)
+				_, err := proc.call(ctx, PluginRequest{Method: PluginHealth})
+				cancel()
+				if err == nil {
+					continue
+				}
+				log.Error().Msgf("store plugin %s failed its health check: %s\n", p.config.Path, err.Error())
+				proc.fail(fmt.Errorf("health check failed: %w", err))
+				proc.kill()
+			}
+			// relaunch it now, rather than on the next call
+			if err := p.Health(context.Background()); err != nil && !errors.Is(err, ErrPluginClosed) {
+				log.Error().Msgf("store plugin %s is unhealthy: %s\n", p.config.Path, err.Error())
+			}
+		}
+	}
+}
+
+// dialPlugin connects to the unix socket of a plugin, waiting for it to listen
+func dialPlugin(ctx context.Context, sock string) (net.Conn, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "unix", sock)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("plugin never listened on %s: %w", sock, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// pluginProcess is a running plugin, and the calls waiting for its answers
+type pluginProcess struct {
+	cmd     *exec.Cmd
+	enc     *json.Encoder
+	wmu     sync.Mutex
+	release func()
+	nextID  atomic.Uint64
+	mu      sync.Mutex
+	pending map[uint64]chan *PluginResponse
+	err     error
+	done    chan struct{}
+	exited  chan struct{}
+}
+
+func newPluginProcess(cmd *exec.Cmd, r io.Reader, w io.Writer, release func()) *pluginProcess {
+	var once sync.Once
+	proc := &pluginProcess{
+		cmd:     cmd,
+		enc:     json.NewEncoder(w),
+		release: func() { once.Do(release) },
+		pending: map[uint64]chan *PluginResponse{},
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		proc.read(r)
+		// the pipes must be drained before waiting
+		err := cmd.Wait()
+		proc.fail(fmt.Errorf("plugin exited: %v", err))
+		proc.release()
+		close(proc.exited)
+	}()
+	return proc
+}
+
+// read dispatches the responses of the plugin to the calls waiting for them, until the plugin stops answering
+func (pp *pluginProcess) read(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var resp PluginResponse
+		if err := dec.Decode(&resp); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("plugin closed its output")
+			}
+			pp.fail(err)
+			return
+		}
+		pp.mu.Lock()
+		ch, ok := pp.pending[resp.ID]
+		delete(pp.pending, resp.ID)
+		pp.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+}
+
+func (pp *pluginProcess) call(ctx context.Context, req PluginRequest) (*PluginResponse, error) {
+	req.ID = pp.nextID.Add(1)
+	ch := make(chan *PluginResponse, 1)
+	pp.mu.Lock()
+	if pp.err != nil {
+		pp.mu.Unlock()
+		return nil, pp.err
+	}
+	pp.pending[req.ID] = ch
+	pp.mu.Unlock()
+
+	pp.wmu.Lock()
+	err := pp.enc.Encode(req)
+	pp.wmu.Unlock()
+	if err != nil {
+		pp.fail(err)
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-pp.done:
+		return nil, pp.failure()
+	case <-ctx.Done():
+		pp.mu.Lock()
+		delete(pp.pending, req.ID)
+		pp.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// fail marks the process as failed with err, failing every pending call. Only the first failure is kept.
+func (pp *pluginProcess) fail(err error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.err != nil {
+		return
+	}
+	pp.err = err
+	close(pp.done)
+}
+
+func (pp *pluginProcess) failure() error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.err
+}
+
+func (pp *pluginProcess) alive() bool {
+	select {
+	case <-pp.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (pp *pluginProcess) kill() {
+	pp.cmd.Process.Kill()
+}
+
+// shutdown closes the input of the plugin so it can exit on its own, and kills it if it hasn't by the end of ctx
+func (pp *pluginProcess) shutdown(ctx context.Context) {
+	pp.fail(ErrPluginClosed)
+	pp.release()
+	select {
+	case <-pp.exited:
+	case <-ctx.Done():
+		pp.kill()
+		<-pp.exited
+	}
+}
+
+// pluginLog logs what a plugin writes to its stderr
+type pluginLog struct {
+	logger *vlog.Logger
+	name   string
+}
+
+func (pl *pluginLog) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		pl.logger.Logger().Debug().Msgf("[%s] %s", pl.name, line)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"strings"
+	"sync"
+)
+
+// ReservedPrefix starts every key the vault keeps for its own bookkeeping. Such keys are never listed as secrets.
+const ReservedPrefix = "_vault/"
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// IsReserved reports whether key is kept by the vault for its own bookkeeping
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// WithoutReserved forwards the events of in, leaving out those of reserved keys
+func WithoutReserved(ctx context.Context, in <-chan Event) <-chan Event {
+	return forward(ctx, in, func(event Event) (Event, bool) {
+		return event, !IsReserved(event.Key)
+	})
+}
+
+// Prefixed is a view of the keys of a store that start with a prefix. Keys are passed in and returned without the
+// prefix, so the view behaves like a store of its own.
+type Prefixed struct {
+	inner  Store
+	prefix string
+	quota  int
+	logger *vlog.Logger
+	// Mutex serializes the quota checks of the writes through this view with the writes they admit. Writes through
+	// other views of the same keys aren't serialized with them, so a quota is only enforced if the view is shared.
+	sync.Mutex
+}
+
+// NewPrefixed creates a view of the keys of inner starting with prefix. A positive quota caps the number of keys in
+// the view.
+func NewPrefixed(inner Store, prefix string, quota int, logger *vlog.Logger) *Prefixed {
+	return &Prefixed{inner: inner, prefix: prefix, quota: quota, logger: logger}
+}
+
+// Inner returns the wrapped store
+func (p *Prefixed) Inner() Store {
+	return p.inner
+}
+
+// Prefix returns the prefix of the keys in the view
+func (p *Prefixed) Prefix() string {
+	return p.prefix
+}
+
+// SetQuota caps the number of keys in the view at quota if it is positive, or lifts the cap
+func (p *Prefixed) SetQuota(quota int) {
+	p.Lock()
+	defer p.Unlock()
+	p.quota = quota
+}
+
+func (p *Prefixed) Connect(ctx context.Context) (bool, error) {
+	return p.inner.Connect(ctx)
+}
+
+func (p *Prefixed) Store(ctx context.Context, id string, token any) error {
+	p.Lock()
+	defer p.Unlock()
+	if err := p.admit(ctx, id); err != nil {
+		return err
+	}
+	return p.inner.Store(ctx, p.prefix+id, token)
+}
+
+func (p *Prefixed) Retrieve(ctx context.Context, id string) (string, error) {
+	return p.inner.Retrieve(ctx, p.prefix+id)
+}
+
+func (p *Prefixed) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	all, err := p.inner.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := map[string]string{}
+	for k, v := range all {
+		if id, ok := strings.CutPrefix(k, p.prefix); ok {
+			records[id] = v
+		}
+	}
+	return records, nil
+}
+
+func (p *Prefixed) Delete(ctx context.Context, id string) (bool, error) {
+	return p.inner.Delete(ctx, p.prefix+id)
+}
+
+// Patch replaces the value of id. Backends that create missing keys on Patch count against the quota too.
+func (p *Prefixed) Patch(ctx context.Context, id string, token any) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	if _, err := p.inner.Retrieve(ctx, p.prefix+id); err != nil {
+		if err = p.admit(ctx, id); err != nil {
+			return false, err
+		}
+	}
+	return p.inner.Patch(ctx, p.prefix+id, token)
+}
+
+// Batch applies ops to the keys of the view as a single batch of the inner store. The keys the batch creates count
+// against the quota together, so a batch that doesn't fit is refused whole.
+func (p *Prefixed) Batch(ctx context.Context, ops []Op) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.quota > 0 {
+		// the keys the batch deletes make room for those it creates
+		created := 0
+		exists := map[string]bool{}
+		for _, op := range writes(ops) {
+			existed, ok := exists[op.Key]
+			if !ok {
+				_, err := p.inner.Retrieve(ctx, p.prefix+op.Key)
+				existed = err == nil
+			}
+			if !existed && op.Type != OpDelete && !IsReserved(op.Key) {
+				created++
+			}
+			if existed && op.Type == OpDelete && !IsReserved(op.Key) {
+				created--
+			}
+			exists[op.Key] = op.Type != OpDelete
+		}
+		if err := p.admitN(ctx, created); err != nil {
+			return err
+		}
+	}
+
+	prefixed := mapOps(ops, func(op Op) Op {
+		op.Key = p.prefix + op.Key
+		return op
+	})
+	return unmapBatchError(Batch(ctx, p.inner, prefixed), ops)
+}
+
+// Flush deletes every key in the view, leaving the rest of the inner store untouched
+func (p *Prefixed) Flush(ctx context.Context) (bool, error) {
+	records, err := p.RetrieveAll(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range sortedKeys(records) {
+		if b, err := p.inner.Delete(ctx, p.prefix+id); err != nil || !b {
+			return false, fmt.Errorf("error while deleting %s: %v", p.prefix+id, err)
+		}
+	}
+	return true, nil
+}
+
+// Close leaves the inner store open. It is shared with other views, and closed by its owner.
+func (p *Prefixed) Close(ctx context.Context) error {
+	return nil
+}
+
+// admit checks that the view has room for one more key. Reserved keys don't count against the quota.
+func (p *Prefixed) admit(ctx context.Context, id string) error {
+	if IsReserved(id) {
+		return nil
+	}
+	return p.admitN(ctx, 1)
+}
+
+// admitN checks that the view has room for n more keys
+func (p *Prefixed) admitN(ctx context.Context, created int) error {
+	if p.quota <= 0 || created <= 0 {
+		return nil
+	}
+	n, err := p.Count(ctx)
+	if err != nil {
+		return err
+	}
+	if n+created > p.quota {
+		p.logger.Logger().Error().Msgf("quota of %d keys under %s reached\n", p.quota, p.prefix)
+		return fmt.Errorf("%w: %d of %d keys used", ErrQuotaExceeded, n, p.quota)
+	}
+	return nil
+}
+
+// Count returns the number of keys in the view, leaving out reserved keys. Only the keys of the view are scanned.
+func (p *Prefixed) Count(ctx context.Context) (int, error) {
+	page, err := p.Scan(ctx, ScanOptions{})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, record := range page.Records {
+		if !IsReserved(record.Key) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Scan returns the page of records of the view selected by opts, scanning the inner store within the prefix
+func (p *Prefixed) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	inner := ScanOptions{
+		Prefix:  CleanPath(p.prefix + CleanPath(opts.Prefix)),
+		Reverse: opts.Reverse,
+		Limit:   opts.Limit,
+	}
+	if len(opts.Match) > 0 {
+		inner.Match = globEscape(p.prefix) + opts.Match
+	}
+	if len(opts.After) > 0 {
+		inner.After = p.prefix + opts.After
+	}
+	page, err := Scan(ctx, p.inner, inner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range page.Records {
+		page.Records[i].Key = strings.TrimPrefix(page.Records[i].Key, p.prefix)
+	}
+	page.Next = strings.TrimPrefix(page.Next, p.prefix)
+	return page, nil
+}
+
+// Watch streams the changes made to keys of the view starting with prefix
+func (p *Prefixed) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	inner, err := Watch(ctx, p.inner, p.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	return forward(ctx, inner, func(event Event) (Event, bool) {
+		event.Key = strings.TrimPrefix(event.Key, p.prefix)
+		return event, true
+	}), nil
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type PrefixedTestSuite struct {
+	suite.Suite
+	inner *Map
+	log   *vlog.Logger
+}
+
+func (suite *PrefixedTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.inner = NewSyncMap(context.Background(), suite.log)
+}
+
+func (suite *PrefixedTestSuite) TestIsolation() {
+	ctx := context.Background()
+	teamA := NewPrefixed(suite.inner, "_vault/ns/a/", 0, suite.log)
+	teamB := NewPrefixed(suite.inner, "_vault/ns/b/", 0, suite.log)
+	suite.Require().NoError(suite.inner.Store(ctx, "customer123__ssn", "root"))
+	suite.Require().NoError(teamA.Store(ctx, "customer123__ssn", "tokenA"))
+	suite.Require().NoError(teamB.Store(ctx, "customer123__ssn", "tokenB"))
+
+	val, err := teamA.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("tokenA", val)
+
+	all, err := teamB.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123__ssn": "tokenB"}, all, "expected keys without the prefix")
+
+	// flushing a view leaves the rest of the store untouched
+	_, err = teamA.Flush(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	all, err = suite.inner.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123__ssn": "root", "_vault/ns/b/customer123__ssn": "tokenB"}, all)
+}
+
+func (suite *PrefixedTestSuite) TestQuota() {
+	ctx := context.Background()
+	view := NewPrefixed(suite.inner, "_vault/ns/a/", 2, suite.log)
+	suite.Require().NoError(view.Store(ctx, "customer123__ssn", "token1"))
+	suite.Require().NoError(view.Store(ctx, "customer123__dob", "token2"))
+
+	err := view.Store(ctx, "customer123__zip", "token3")
+	suite.Require().Truef(errors.Is(err, ErrQuotaExceeded), "expected quota error, but got %v\n", err)
+	_, err = view.Patch(ctx, "customer123__zip", "token3")
+	suite.Require().Truef(errors.Is(err, ErrQuotaExceeded), "expected patching a new key to count against the quota, but got %v\n", err)
+
+	// existing keys can still be patched at the quota
+	_, err = view.Patch(ctx, "customer123__ssn", "token4")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	n, err := view.Count(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(2, n)
+}
+
+func (suite *PrefixedTestSuite) TestReserved() {
+	suite.Require().True(IsReserved("_vault/ns/a/customer123__ssn"))
+	suite.Require().False(IsReserved("customer123__ssn"))
+}
+
+func (suite *PrefixedTestSuite) TearDownTest() {}
+
+// TestPrefixedSuite tests prefixed views of a store
+func TestPrefixedSuite(t *testing.T) {
+	suite.Run(t, new(PrefixedTestSuite))
+}
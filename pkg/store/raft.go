@@ -0,0 +1,915 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRaftAddr         = "127.0.0.1:8201"
+	DefaultRaftDir          = "./.raft"
+	DefaultRaftApplyTimeout = 5 * time.Second
+	// raftSnapshotsRetained is how many snapshots are kept in the raft directory
+	raftSnapshotsRetained = 2
+	// raftMaxPool is how many connections are pooled to each other node
+	raftMaxPool = 3
+	// raftRetryInterval is how often a request waiting for a leader is made again
+	raftRetryInterval = 50 * time.Millisecond
+	// raftSnapshotsDir is the directory the snapshot store of a node keeps its snapshots in, one directory each
+	raftSnapshotsDir = "snapshots"
+	// raftLogFile keeps the raft log and its term and vote, in the raft directory
+	raftLogFile = "raft.db"
+	// raftAppliedKey holds the index of the last log entry applied to the store of a node, so a restarted node
+	// doesn't apply the entries it holds again
+	raftAppliedKey = ReservedPrefix + "raft/applied"
+)
+
+// the first byte of a connection to a node tells what it carries
+const (
+	raftConnRPC byte = iota + 1
+	raftConnForward
+)
+
+var (
+	ErrRaftNodeIDEmpty   = errors.New("raft node id is empty")
+	ErrRaftNoLeader      = errors.New("raft cluster has no leader")
+	ErrRaftNotConnected  = errors.New("raft store is not connected")
+	ErrRaftStoreNotEmpty = errors.New("the store of a node joining a raft cluster must be empty. bootstrap the cluster on the node holding the records")
+	ErrRaftRequest       = errors.New("raft request is invalid")
+	// errRaftUnreachable fails the requests that couldn't be sent to a node
+	errRaftUnreachable = errors.New("raft node is unreachable")
+)
+
+// raftErrors are the errors a forwarded request carries back to the node it was forwarded from, by name
+var raftErrors = map[string]error{
+	"key_exists":      ErrKeyExists,
+	"not_found":       ErrNotFound,
+	"conflict":        ErrConflict,
+	"op_invalid":      ErrOpInvalid,
+	"rollback_failed": ErrRollbackFailed,
+	"no_leader":       ErrRaftNoLeader,
+	"not_leader":      raft.ErrNotLeader,
+}
+
+// RaftConfig configures the node of a Raft store
+type RaftConfig struct {
+	// NodeID names the node in the cluster. It must be unique, and stay the same across restarts.
+	NodeID string
+	// Addr is the address the node listens on for the other nodes, and is advertised to them, so must be reachable by
+	// them, as in 10.0.0.1:8201. A port of 0 picks a free port. Defaults to DefaultRaftAddr.
+	Addr string
+	// Dir keeps the raft log and the snapshots of the node. Defaults to DefaultRaftDir.
+	Dir string
+	// Bootstrap starts a cluster of this node alone, if it has no raft state yet. A single node of a new cluster is
+	// bootstrapped, and the records its store holds are replicated to the nodes joining it.
+	Bootstrap bool
+	// HeartbeatTimeout is how long a follower goes without hearing from the leader before it calls an election.
+	// Defaults to that of hashicorp/raft.
+	HeartbeatTimeout time.Duration
+	// ElectionTimeout is how long a candidate waits for the votes of an election. Defaults to that of hashicorp/raft.
+	ElectionTimeout time.Duration
+	// SnapshotThreshold is how many log entries are applied between snapshots, after which the log is compacted.
+	// Defaults to that of hashicorp/raft.
+	SnapshotThreshold uint64
+	// ApplyTimeout bounds how long a write waits to be committed by the cluster. Defaults to DefaultRaftApplyTimeout.
+	ApplyTimeout time.Duration
+}
+
+// RaftPeer describes a node of a Raft cluster
+type RaftPeer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// RaftStatus describes a node of a Raft cluster, and the cluster as known to it
+type RaftStatus struct {
+	NodeID        string     `json:"node_id"`
+	Address       string     `json:"address"`
+	State         string     `json:"state"`
+	LeaderID      string     `json:"leader_id"`
+	LeaderAddress string     `json:"leader_address"`
+	Peers         []RaftPeer `json:"peers"`
+}
+
+// Raft replicates a store across the nodes of a cluster with the Raft consensus protocol. Every node keeps its records
+// in a store of its own, which the writes committed to the replicated log are applied to in order. Writes made on a
+// follower are forwarded to the leader, and return once the cluster committed them, so they survive the loss of a
+// minority of the nodes. Reads are served by the store of the node, so a follower may briefly answer with a token the
+// leader already changed.
+type Raft struct {
+	inner  Store
+	config RaftConfig
+	logger *vlog.Logger
+	// mu guards the connection of the node
+	mu        sync.Mutex
+	raft      *raft.Raft
+	logs      *raftboltdb.BoltStore
+	snapshots *raft.FileSnapshotStore
+	transport *raft.NetworkTransport
+}
+
+// NewRaft creates the node of a Raft cluster replicating inner. The node joins the cluster on Connect.
+func NewRaft(inner Store, config RaftConfig, logger *vlog.Logger) (*Raft, error) {
+	if len(config.NodeID) == 0 {
+		return nil, ErrRaftNodeIDEmpty
+	}
+	if len(config.Addr) == 0 {
+		config.Addr = DefaultRaftAddr
+	}
+	if len(config.Dir) == 0 {
+		config.Dir = DefaultRaftDir
+	}
+	if config.ApplyTimeout <= 0 {
+		config.ApplyTimeout = DefaultRaftApplyTimeout
+	}
+	return &Raft{inner: inner, config: config, logger: logger}, nil
+}
+
+// Inner returns the store of the node
+func (r *Raft) Inner() Store {
+	return r.inner
+}
+
+// Connect connects the store of the node, opens its raft log, and starts it. A node with no raft state yet
+// bootstraps a cluster if configured to, and otherwise waits to be joined to one.
+func (r *Raft) Connect(ctx context.Context) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.raft != nil {
+		return true, nil
+	}
+	log := r.logger.Logger()
+
+	if b, err := r.inner.Connect(ctx); err != nil || !b {
+		return false, fmt.Errorf("error while connecting the store of raft node %s: %v", r.config.NodeID, err)
+	}
+	if err := os.MkdirAll(r.config.Dir, 0700); err != nil {
+		return false, fmt.Errorf("error while creating raft directory: %w", err)
+	}
+	hlog := raftLogger(r.logger)
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(r.config.Dir, raftLogFile))
+	if err != nil {
+		return false, fmt.Errorf("error while opening raft log: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(r.config.Dir, raftSnapshotsRetained, hlog)
+	if err != nil {
+		logs.Close()
+		return false, fmt.Errorf("error while opening raft snapshots: %w", err)
+	}
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		logs.Close()
+		return false, fmt.Errorf("error while reading raft state: %w", err)
+	}
+	fsm, err := newRaftFSM(ctx, r.inner)
+	if err != nil {
+		logs.Close()
+		return false, err
+	}
+	// the records of a node joining a cluster would never be replicated, so would drift from the others
+	var records map[string]string
+	if !existing {
+		if records, err = r.inner.RetrieveAll(ctx); err != nil {
+			logs.Close()
+			return false, fmt.Errorf("error while reading the store of raft node %s: %w", r.config.NodeID, err)
+		}
+		if !r.config.Bootstrap && len(records) > 0 {
+			logs.Close()
+			return false, ErrRaftStoreNotEmpty
+		}
+	}
+
+	listener, err := net.Listen("tcp", r.config.Addr)
+	if err != nil {
+		logs.Close()
+		return false, fmt.Errorf("error while listening for raft nodes: %w", err)
+	}
+	stream := newRaftStream(listener, r.serveForward, r.logger)
+	transport := raft.NewNetworkTransportWithLogger(stream, raftMaxPool, r.config.ApplyTimeout, hlog)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(r.config.NodeID)
+	conf.Logger = hlog
+	if r.config.HeartbeatTimeout > 0 {
+		conf.HeartbeatTimeout = r.config.HeartbeatTimeout
+		conf.LeaderLeaseTimeout = r.config.HeartbeatTimeout / 2
+	}
+	if r.config.ElectionTimeout > 0 {
+		conf.ElectionTimeout = r.config.ElectionTimeout
+	}
+	if r.config.SnapshotThreshold > 0 {
+		conf.SnapshotThreshold = r.config.SnapshotThreshold
+	}
+	node, err := raft.NewRaft(conf, fsm, logs, logs, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return false, fmt.Errorf("error while starting raft node %s: %w", r.config.NodeID, err)
+	}
+	r.raft, r.logs, r.snapshots, r.transport = node, logs, snapshots, transport
+
+	if existing || !r.config.Bootstrap {
+		log.Info().Msgf("raft node %s started on %s", r.config.NodeID, transport.LocalAddr())
+		return true, nil
+	}
+	err = node.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: conf.LocalID, Address: transport.LocalAddr()},
+	}}).Error()
+	if err != nil {
+		return false, fmt.Errorf("error while bootstrapping raft cluster: %w", err)
+	}
+	log.Info().Msgf("raft node %s bootstrapped a cluster on %s", r.config.NodeID, transport.LocalAddr())
+	if len(records) == 0 {
+		return true, nil
+	}
+
+	// commit the records the store already holds to the log, so they are replicated to the nodes joining
+	if err = r.awaitLeader(ctx); err != nil {
+		return false, err
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ops := make([]Op, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, Op{Type: OpPatch, Key: key, Value: records[key]})
+	}
+	if err = r.applyLocal(ctx, raftCommand{Ops: ops}); err != nil {
+		return false, fmt.Errorf("error while replicating the records of the store: %w", err)
+	}
+	log.Info().Msgf("replicated the %d records the store held", len(ops))
+	return true, nil
+}
+
+func (r *Raft) Store(ctx context.Context, id string, token any) error {
+	b, tokenStr := InterfaceIsString(token)
+	if !b {
+		r.logger.Logger().Error().Msgf(ErrTokenTypeNotString)
+		return fmt.Errorf(ErrTokenTypeNotString)
+	}
+	return r.write(ctx, Op{Type: OpStore, Key: id, Value: tokenStr})
+}
+
+func (r *Raft) Retrieve(ctx context.Context, id string) (string, error) {
+	return r.inner.Retrieve(ctx, id)
+}
+
+func (r *Raft) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	return r.inner.RetrieveAll(ctx)
+}
+
+// Scan scans the store of the node
+func (r *Raft) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	return Scan(ctx, r.inner, opts)
+}
+
+func (r *Raft) Delete(ctx context.Context, id string) (bool, error) {
+	if err := r.write(ctx, Op{Type: OpDelete, Key: id}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Patch sets the token of a key, creating the key if it doesn't exist
+func (r *Raft) Patch(ctx context.Context, id string, token any) (bool, error) {
+	b, tokenStr := InterfaceIsString(token)
+	if !b {
+		r.logger.Logger().Error().Msgf(ErrTokenTypeNotString)
+		return false, fmt.Errorf(ErrTokenTypeNotString)
+	}
+	if err := r.write(ctx, Op{Type: OpPatch, Key: id, Value: tokenStr}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Batch commits ops as a single log entry, which every node applies to its store as a single batch
+func (r *Raft) Batch(ctx context.Context, ops []Op) error {
+	return r.apply(ctx, raftCommand{Ops: ops})
+}
+
+func (r *Raft) Flush(ctx context.Context) (bool, error) {
+	if err := r.apply(ctx, raftCommand{Flush: true}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Stats returns the statistics of the store of the node. The raft log was last compacted when the node last took a
+// snapshot of its store.
+func (r *Raft) Stats(ctx context.Context) (*StoreStats, error) {
+	st, err := Stats(ctx, r.inner)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	snapshots := r.snapshots
+	r.mu.Unlock()
+	if snapshots == nil {
+		return st, nil
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return nil, fmt.Errorf("error while listing raft snapshots: %w", err)
+	}
+	// snapshots are listed from the newest
+	if len(metas) > 0 {
+		info, err := os.Stat(filepath.Join(r.config.Dir, raftSnapshotsDir, metas[0].ID))
+		if err != nil {
+			return nil, err
+		}
+		taken := info.ModTime()
+		st.LastCompaction = &taken
+	}
+	return st, nil
+}
+
+// Watch streams the changes made to the store of the node, which include those replicated from the others
+func (r *Raft) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, r.inner, prefix)
+}
+
+// Close stops the node, handing the leadership over to another node first if it leads, then closes its store
+func (r *Raft) Close(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.raft == nil {
+		return r.inner.Close(ctx)
+	}
+	log := r.logger.Logger()
+
+	if r.raft.State() == raft.Leader && len(r.voters()) > 1 {
+		if err := r.raft.LeadershipTransfer().Error(); err != nil {
+			log.Debug().Msgf("error while transferring raft leadership: %v", err)
+		}
+	}
+	var errs []error
+	if err := r.raft.Shutdown().Error(); err != nil {
+		errs = append(errs, fmt.Errorf("error while stopping raft node: %w", err))
+	}
+	if err := r.transport.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("error while closing raft transport: %w", err))
+	}
+	if err := r.logs.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("error while closing raft log: %w", err))
+	}
+	if err := r.inner.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	r.raft = nil
+	return errors.Join(errs...)
+}
+
+// ID returns the id of the node
+func (r *Raft) ID() string {
+	return r.config.NodeID
+}
+
+// Addr returns the address the node is reached at by the others, once connected
+func (r *Raft) Addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.transport == nil {
+		return r.config.Addr
+	}
+	return string(r.transport.LocalAddr())
+}
+
+// State returns the role of the node in the cluster: Leader, Follower, Candidate, or Shutdown
+func (r *Raft) State() string {
+	node, err := r.node()
+	if err != nil {
+		return raft.Shutdown.String()
+	}
+	return node.State().String()
+}
+
+// Leader returns the id and address of the leader of the cluster, empty if there is none
+func (r *Raft) Leader() (string, string) {
+	node, err := r.node()
+	if err != nil {
+		return "", ""
+	}
+	addr, id := node.LeaderWithID()
+	return string(id), string(addr)
+}
+
+// Peers lists the nodes of the cluster, as known to this node
+func (r *Raft) Peers(ctx context.Context) ([]RaftPeer, error) {
+	node, err := r.node()
+	if err != nil {
+		return nil, err
+	}
+	future := node.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("error while reading raft configuration: %w", err)
+	}
+	_, leader := node.LeaderWithID()
+	var peers []RaftPeer
+	for _, server := range future.Configuration().Servers {
+		peers = append(peers, RaftPeer{ID: string(server.ID), Address: string(server.Address),
+			Voter: server.Suffrage == raft.Voter, Leader: server.ID == leader})
+	}
+	return peers, nil
+}
+
+// Status describes the node, and the cluster as known to it
+func (r *Raft) Status(ctx context.Context) (*RaftStatus, error) {
+	peers, err := r.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	leaderID, leaderAddr := r.Leader()
+	return &RaftStatus{NodeID: r.config.NodeID, Address: r.Addr(), State: r.State(), LeaderID: leaderID,
+		LeaderAddress: leaderAddr, Peers: peers}, nil
+}
+
+// Join asks the cluster a node at addr belongs to, to add this node as a voter. The request is forwarded to the leader
+// if addr isn't the leader's.
+func (r *Raft) Join(ctx context.Context, addr string) error {
+	if _, err := r.node(); err != nil {
+		return err
+	}
+	return r.send(ctx, addr, raftRequest{Join: &RaftPeer{ID: r.config.NodeID, Address: r.Addr()}})
+}
+
+// Remove removes the node id from the cluster. The request is forwarded to the leader if this node isn't the leader.
+func (r *Raft) Remove(ctx context.Context, id string) error {
+	return r.handle(ctx, raftRequest{Remove: id})
+}
+
+// node returns the raft node, or ErrRaftNotConnected
+func (r *Raft) node() (*raft.Raft, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.raft == nil {
+		return nil, ErrRaftNotConnected
+	}
+	return r.raft, nil
+}
+
+// voters returns the ids of the voters of the cluster
+func (r *Raft) voters() []raft.ServerID {
+	future := r.raft.GetConfiguration()
+	if future.Error() != nil {
+		return nil
+	}
+	var ids []raft.ServerID
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage == raft.Voter {
+			ids = append(ids, server.ID)
+		}
+	}
+	return ids
+}
+
+// awaitLeader waits for the node to be elected leader of the cluster it bootstrapped
+func (r *Raft) awaitLeader(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.ApplyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for r.raft.State() != raft.Leader {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: node %s wasn't elected: %v", ErrRaftNoLeader, r.config.NodeID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// write commits a single op, and returns its error unwrapped from the BatchError
+func (r *Raft) write(ctx context.Context, op Op) error {
+	err := r.apply(ctx, raftCommand{Ops: []Op{op}})
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Err
+	}
+	return err
+}
+
+// apply commits cmd to the log, on the leader
+func (r *Raft) apply(ctx context.Context, cmd raftCommand) error {
+	if err := validateOps(cmd.Ops); err != nil {
+		return err
+	}
+	return r.handle(ctx, raftRequest{Command: &cmd})
+}
+
+// handle serves req on the leader: here if this node leads, and otherwise by forwarding it. While the cluster elects a
+// leader, req waits for one.
+func (r *Raft) handle(ctx context.Context, req raftRequest) error {
+	node, err := r.node()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(r.timeout(ctx))
+	for {
+		err = r.handleOnce(ctx, node, req)
+		// a request that didn't reach the leader wasn't applied, so can be made again
+		if !errors.Is(err, ErrRaftNoLeader) && !errors.Is(err, raft.ErrNotLeader) && !errors.Is(err, errRaftUnreachable) {
+			return err
+		}
+		if req.Forwarded || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+func (r *Raft) handleOnce(ctx context.Context, node *raft.Raft, req raftRequest) error {
+	if node.State() == raft.Leader {
+		return r.serve(ctx, req)
+	}
+	if req.Forwarded {
+		return raft.ErrNotLeader
+	}
+	addr, _ := node.LeaderWithID()
+	if len(addr) == 0 {
+		return ErrRaftNoLeader
+	}
+	req.Forwarded = true
+	return r.send(ctx, string(addr), req)
+}
+
+// serve serves req on this node, which leads the cluster
+func (r *Raft) serve(ctx context.Context, req raftRequest) error {
+	timeout := r.timeout(ctx)
+	switch {
+	case req.Command != nil:
+		return r.applyLocal(ctx, *req.Command)
+	case req.Join != nil:
+		r.logger.Logger().Info().Msgf("adding raft node %s at %s", req.Join.ID, req.Join.Address)
+		return r.raft.AddVoter(raft.ServerID(req.Join.ID), raft.ServerAddress(req.Join.Address), 0, timeout).Error()
+	case len(req.Remove) > 0:
+		r.logger.Logger().Info().Msgf("removing raft node %s", req.Remove)
+		return r.raft.RemoveServer(raft.ServerID(req.Remove), 0, timeout).Error()
+	}
+	return ErrRaftRequest
+}
+
+// applyLocal commits cmd to the log of this node, which leads the cluster, and returns the error it was applied with
+func (r *Raft) applyLocal(ctx context.Context, cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := r.raft.Apply(data, r.timeout(ctx))
+	if err := future.Error(); err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// timeout returns how long a request made with ctx may wait for the cluster
+func (r *Raft) timeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		// hashicorp/raft waits forever on a timeout of 0
+		return max(time.Until(deadline), time.Millisecond)
+	}
+	return r.config.ApplyTimeout
+}
+
+// send sends req to the node at addr, and returns the error it was served with
+func (r *Raft) send(ctx context.Context, addr string, req raftRequest) error {
+	timeout := r.timeout(ctx)
+	conn, err := dialRaft(addr, raftConnForward, timeout)
+	if err != nil {
+		return fmt.Errorf("%w at %s: %w", errRaftUnreachable, addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("error while forwarding to raft node at %s: %w", addr, err)
+	}
+	var resp raftResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("error while reading from raft node at %s: %w", addr, err)
+	}
+	return resp.err()
+}
+
+// serveForward serves a request forwarded by another node over conn
+func (r *Raft) serveForward(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.config.ApplyTimeout))
+	var req raftRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		r.logger.Logger().Error().Msgf("error while reading a forwarded raft request: %v", err)
+		return
+	}
+	err := r.handle(context.Background(), req)
+	if err := json.NewEncoder(conn).Encode(newRaftResponse(err)); err != nil {
+		r.logger.Logger().Error().Msgf("error while answering a forwarded raft request: %v", err)
+	}
+}
+
+// raftCommand is a write committed to the log
+type raftCommand struct {
+	Ops   []Op `json:"ops,omitempty"`
+	Flush bool `json:"flush,omitempty"`
+}
+
+// raftRequest is a request served by the leader, which nodes forward to it. Join and Remove change the members of the
+// cluster.
+type raftRequest struct {
+	Command *raftCommand `json:"command,omitempty"`
+	Join    *RaftPeer    `json:"join,omitempty"`
+	Remove  string       `json:"remove,omitempty"`
+	// Forwarded is set on requests forwarded to the leader, which aren't forwarded again
+	Forwarded bool `json:"forwarded,omitempty"`
+}
+
+// raftResponse answers a raftRequest, with the error it failed with if it did
+type raftResponse struct {
+	Error *raftError `json:"error,omitempty"`
+}
+
+// raftError is an error carried back to the node a request was forwarded from
+type raftError struct {
+	Message string `json:"message"`
+	// Kind names the error of raftErrors it wraps, if any
+	Kind string `json:"kind,omitempty"`
+	// Op and Index are set when the error is a BatchError
+	Op    *Op `json:"op,omitempty"`
+	Index int `json:"index,omitempty"`
+}
+
+func (e *raftError) Error() string {
+	return e.Message
+}
+
+func (e *raftError) Unwrap() error {
+	return raftErrors[e.Kind]
+}
+
+func newRaftResponse(err error) raftResponse {
+	if err == nil {
+		return raftResponse{}
+	}
+	e := &raftError{Message: err.Error()}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		e.Op, e.Index, e.Message = &batchErr.Op, batchErr.Index, batchErr.Err.Error()
+	}
+	for kind, sentinel := range raftErrors {
+		if errors.Is(err, sentinel) {
+			e.Kind = kind
+		}
+	}
+	return raftResponse{Error: e}
+}
+
+func (resp raftResponse) err() error {
+	if resp.Error == nil {
+		return nil
+	}
+	if resp.Error.Op != nil {
+		return &BatchError{Index: resp.Error.Index, Op: *resp.Error.Op, Err: resp.Error}
+	}
+	return resp.Error
+}
+
+// raftFSM applies the committed log entries to the store of a node
+type raftFSM struct {
+	inner Store
+	// applied is the index of the last entry applied to the store
+	applied uint64
+}
+
+func newRaftFSM(ctx context.Context, inner Store) (*raftFSM, error) {
+	f := &raftFSM{inner: inner}
+	val, err := inner.Retrieve(ctx, raftAppliedKey)
+	if errors.Is(err, ErrNotFound) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the last applied raft index: %w", err)
+	}
+	if f.applied, err = strconv.ParseUint(val, 10, 64); err != nil {
+		return nil, fmt.Errorf("error while reading the last applied raft index: %w", err)
+	}
+	return f, nil
+}
+
+// Apply applies a committed entry to the store, and returns the error it failed with. The index of the entry is
+// recorded in the same batch, so entries are applied once to a store that persists across restarts.
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	if entry.Index <= f.applied {
+		return nil
+	}
+	ctx := context.Background()
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return fmt.Errorf("%w: %w", ErrRaftRequest, err)
+	}
+	mark := Op{Type: OpPatch, Key: raftAppliedKey, Value: strconv.FormatUint(entry.Index, 10)}
+
+	var err error
+	if cmd.Flush {
+		_, err = f.inner.Flush(ctx)
+	} else if err = Batch(ctx, f.inner, append(cmd.Ops, mark)); err == nil {
+		f.applied = entry.Index
+		return nil
+	}
+	// the entry failed alike on every node, so it is applied nonetheless
+	if markErr := Batch(ctx, f.inner, []Op{mark}); markErr != nil {
+		return errors.Join(err, markErr)
+	}
+	f.applied = entry.Index
+	return err
+}
+
+// Snapshot captures the records of the store. Entries aren't applied until it returns.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	records, err := f.inner.RetrieveAll(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot(records), nil
+}
+
+// Restore replaces the records of the store with those of a snapshot
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	ctx := context.Background()
+	var records raftSnapshot
+	if err := json.NewDecoder(snapshot).Decode(&records); err != nil {
+		return fmt.Errorf("error while reading raft snapshot: %w", err)
+	}
+	if _, err := f.inner.Flush(ctx); err != nil {
+		return fmt.Errorf("error while restoring raft snapshot: %w", err)
+	}
+	ops := make([]Op, 0, len(records))
+	for key, val := range records {
+		ops = append(ops, Op{Type: OpStore, Key: key, Value: val})
+	}
+	if err := Batch(ctx, f.inner, ops); err != nil {
+		return fmt.Errorf("error while restoring raft snapshot: %w", err)
+	}
+	f.applied = 0
+	if val, ok := records[raftAppliedKey]; ok {
+		f.applied, _ = strconv.ParseUint(val, 10, 64)
+	}
+	return nil
+}
+
+// raftSnapshot holds the records of a store as of a snapshot
+type raftSnapshot map[string]string
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// raftStream carries both the raft rpcs between nodes and the requests they forward to the leader over a listener.
+// The first byte of a connection tells them apart.
+type raftStream struct {
+	net.Listener
+	rpcs    chan net.Conn
+	forward func(conn net.Conn)
+	logger  *vlog.Logger
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newRaftStream(listener net.Listener, forward func(conn net.Conn), logger *vlog.Logger) *raftStream {
+	s := &raftStream{Listener: listener, rpcs: make(chan net.Conn), forward: forward, logger: logger, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+// serve routes the connections accepted until the listener is closed
+func (s *raftStream) serve() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				s.logger.Logger().Error().Msgf("error while accepting raft connections: %v", err)
+			}
+			return
+		}
+		go s.route(conn)
+	}
+}
+
+func (s *raftStream) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(DefaultRaftApplyTimeout))
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(conn, kind); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	switch kind[0] {
+	case raftConnRPC:
+		select {
+		case s.rpcs <- conn:
+		case <-s.done:
+			conn.Close()
+		}
+	case raftConnForward:
+		s.forward(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection carrying raft rpcs
+func (s *raftStream) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.rpcs:
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *raftStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return s.Listener.Close()
+}
+
+// Dial opens a connection carrying raft rpcs to the node at addr
+func (s *raftStream) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialRaft(string(addr), raftConnRPC, timeout)
+}
+
+// dialRaft opens a connection of the given kind to the node at addr
+func dialRaft(addr string, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// raftLogger logs the messages of hashicorp/raft to logger, at their level
+func raftLogger(logger *vlog.Logger) hclog.Logger {
+	level := hclog.Info
+	if zerolog.GlobalLevel() <= zerolog.DebugLevel {
+		level = hclog.Debug
+	}
+	return hclog.New(&hclog.LoggerOptions{Name: "raft", Level: level, Output: raftLogWriter{logger}, DisableTime: true})
+}
+
+// raftLogWriter writes the lines of an hclog logger, as in [INFO]  raft: message, to a zerolog logger
+type raftLogWriter struct {
+	logger *vlog.Logger
+}
+
+func (w raftLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	level := zerolog.InfoLevel
+	if strings.HasPrefix(line, "[") {
+		if name, rest, ok := strings.Cut(line[1:], "]"); ok {
+			if parsed, err := zerolog.ParseLevel(strings.ToLower(name)); err == nil {
+				level, line = parsed, strings.TrimSpace(rest)
+			}
+		}
+	}
+	w.logger.Logger().WithLevel(level).Msg(line)
+	return len(p), nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// kept is a map store outliving its Close, as stores persisting their records do. It counts the batches applied to it.
+type kept struct {
+	*Map
+	batches atomic.Int32
+}
+
+func (k *kept) Batch(ctx context.Context, ops []Op) error {
+	k.batches.Add(1)
+	return k.Map.Batch(ctx, ops)
+}
+
+func (k *kept) Close(ctx context.Context) error {
+	return nil
+}
+
+type RaftTestSuite struct {
+	suite.Suite
+	dir   string
+	log   *vlog.Logger
+	nodes []*Raft
+}
+
+func (suite *RaftTestSuite) SetupTest() {
+	suite.log = vlog.New(false)
+	suite.dir = suite.T().TempDir()
+	suite.nodes = nil
+}
+
+func (suite *RaftTestSuite) TearDownTest() {
+	for _, node := range suite.nodes {
+		node.Close(context.Background())
+	}
+}
+
+// node starts a node on a free localhost port, with a map store holding records
+func (suite *RaftTestSuite) node(id string, bootstrap bool, records map[string]string) *Raft {
+	ctx := context.Background()
+	inner := NewSyncMap(ctx, suite.log)
+	for key, val := range records {
+		suite.Require().NoError(inner.Store(ctx, key, val))
+	}
+	return suite.start(id, bootstrap, inner)
+}
+
+// start starts a node over inner, keeping its raft state in a directory named after it
+func (suite *RaftTestSuite) start(id string, bootstrap bool, inner Store) *Raft {
+	r, err := NewRaft(inner, RaftConfig{NodeID: id, Addr: "127.0.0.1:0", Dir: filepath.Join(suite.dir, id), Bootstrap: bootstrap,
+		HeartbeatTimeout: 100 * time.Millisecond, ElectionTimeout: 100 * time.Millisecond}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := r.Connect(context.Background())
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	suite.nodes = append(suite.nodes, r)
+	return r
+}
+
+// cluster starts a cluster of n nodes, the first of which is bootstrapped over records
+func (suite *RaftTestSuite) cluster(n int, records map[string]string) []*Raft {
+	ctx := context.Background()
+	nodes := []*Raft{suite.node("node1", true, records)}
+	for i := 2; i <= n; i++ {
+		node := suite.node(fmt.Sprintf("node%d", i), false, nil)
+		// joining through a follower is forwarded to the leader
+		suite.Require().NoError(node.Join(ctx, nodes[len(nodes)-1].Addr()))
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// replicated waits for every node to hold want
+func (suite *RaftTestSuite) replicated(nodes []*Raft, want map[string]string) {
+	for _, node := range nodes {
+		node := node
+		suite.Require().Eventuallyf(func() bool {
+			all, err := node.RetrieveAll(context.Background())
+			delete(all, raftAppliedKey)
+			return err == nil && fmt.Sprint(all) == fmt.Sprint(want)
+		}, 5*time.Second, 10*time.Millisecond, "expected %v replicated to %s", want, node.ID())
+	}
+}
+
+// leader waits for one of nodes to lead the cluster, and returns it
+func (suite *RaftTestSuite) leader(nodes []*Raft) *Raft {
+	var leader *Raft
+	suite.Require().Eventually(func() bool {
+		for _, node := range nodes {
+			if node.State() == "Leader" {
+				leader = node
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "expected a leader elected")
+	return leader
+}
+
+func (suite *RaftTestSuite) TestCluster() {
+	ctx := context.Background()
+	nodes := suite.cluster(3, map[string]string{"customer123/name": "token0"})
+	suite.replicated(nodes, map[string]string{"customer123/name": "token0"})
+
+	// writes made on followers are forwarded to the leader
+	suite.Require().Equal("Follower", nodes[2].State())
+	suite.Require().NoError(nodes[2].Store(ctx, "customer123/ssn", "token1"))
+	_, err := nodes[1].Patch(ctx, "customer123/name", "token2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.replicated(nodes, map[string]string{"customer123/name": "token2", "customer123/ssn": "token1"})
+
+	// and come back with the errors they failed with on the leader
+	err = nodes[2].Store(ctx, "customer123/ssn", "token3")
+	suite.Require().Truef(errors.Is(err, ErrKeyExists), "expected a key exists error, but got %v\n", err)
+	err = nodes[1].Batch(ctx, []Op{
+		{Type: OpDelete, Key: "customer123/name"},
+		{Type: OpCheck, Key: "customer123/ssn", Value: "token0"},
+	})
+	var batchErr *BatchError
+	suite.Require().Truef(errors.As(err, &batchErr), "expected a batch error, but got %v\n", err)
+	suite.Require().Equal(1, batchErr.Index)
+	suite.Require().Truef(errors.Is(err, ErrConflict), "expected a conflict error, but got %v\n", err)
+
+	_, err = nodes[1].Delete(ctx, "customer123/name")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.replicated(nodes, map[string]string{"customer123/ssn": "token1"})
+
+	peers, err := nodes[2].Peers(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(peers, 3)
+	suite.Require().Equal(RaftPeer{ID: "node1", Address: nodes[0].Addr(), Voter: true, Leader: true}, peers[0])
+}
+
+func (suite *RaftTestSuite) TestFailover() {
+	ctx := context.Background()
+	nodes := suite.cluster(3, nil)
+	suite.Require().NoError(nodes[1].Store(ctx, "customer123/ssn", "token1"))
+
+	// the leader hands over when it stops, and the others keep a majority
+	suite.Require().NoError(nodes[0].Close(ctx))
+	leader := suite.leader(nodes[1:])
+	suite.Require().NoError(nodes[2].Store(ctx, "customer123/dob", "token2"))
+	suite.replicated(nodes[1:], map[string]string{"customer123/ssn": "token1", "customer123/dob": "token2"})
+
+	suite.Require().NoError(nodes[2].Remove(ctx, "node1"))
+	peers, err := leader.Peers(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(peers, 2, "expected the stopped node removed")
+}
+
+func (suite *RaftTestSuite) TestRestart() {
+	ctx := context.Background()
+	node := suite.node("node1", true, nil)
+	suite.leader([]*Raft{node})
+	suite.Require().NoError(node.Store(ctx, "customer123/ssn", "token1"))
+	suite.Require().NoError(node.raft.Snapshot().Error())
+	suite.Require().NoError(node.Store(ctx, "customer123/dob", "token2"))
+	suite.Require().NoError(node.Close(ctx))
+
+	// a store that doesn't persist is restored from the snapshot, and the entries logged after it
+	node = suite.start("node1", true, NewSyncMap(ctx, suite.log))
+	suite.replicated([]*Raft{node}, map[string]string{"customer123/ssn": "token1", "customer123/dob": "token2"})
+	suite.Require().NoError(node.Close(ctx))
+
+	// a store that does keeps the entries it applied, which aren't applied again
+	inner := &kept{Map: NewSyncMap(ctx, suite.log)}
+	node = suite.start("node2", true, inner)
+	suite.leader([]*Raft{node})
+	suite.Require().NoError(node.Store(ctx, "customer123/ssn", "token1"))
+	suite.Require().NoError(node.Close(ctx))
+	node = suite.start("node2", true, inner)
+	suite.leader([]*Raft{node})
+	suite.Require().NoError(node.Store(ctx, "customer123/dob", "token2"))
+	suite.replicated([]*Raft{node}, map[string]string{"customer123/ssn": "token1", "customer123/dob": "token2"})
+	suite.Require().Equal(int32(2), inner.batches.Load(), "expected every entry applied once")
+}
+
+func (suite *RaftTestSuite) TestJoinNotEmpty() {
+	r, err := NewRaft(NewSyncMap(context.Background(), suite.log), RaftConfig{NodeID: "node2", Addr: "127.0.0.1:0",
+		Dir: filepath.Join(suite.dir, "node2")}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(r.inner.Store(context.Background(), "customer123/ssn", "token1"))
+	_, err = r.Connect(context.Background())
+	suite.Require().Truef(errors.Is(err, ErrRaftStoreNotEmpty), "expected a store not empty error, but got %v\n", err)
+
+	_, err = NewRaft(NewSyncMap(context.Background(), suite.log), RaftConfig{}, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrRaftNodeIDEmpty), "expected a node id empty error, but got %v\n", err)
+}
+
+// TestRaftSuite tests clusters of Raft stores on localhost
+func TestRaftSuite(t *testing.T) {
+	suite.Run(t, new(RaftTestSuite))
+}
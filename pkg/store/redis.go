@@ -2,11 +2,16 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Const
@@ -14,6 +19,8 @@ const (
 	RedisStatusOkay              = "OK"
 	DefaultRedisConnectionString = "redis://localhost:6379"
 	DefaultTTL                   = 0
+	// DefaultRedisBatchRetries is how many times a batch is retried when another client changes its keys meanwhile
+	DefaultRedisBatchRetries = 8
 )
 
 var (
@@ -33,6 +40,19 @@ type Redis struct {
 // Options implements funcitonal options for passing in Redis configuration options
 type Options func(*Redis) error
 
+func init() {
+	Register(DriverRedis, func(ctx context.Context, cfg Config) (Store, error) {
+		conn := cfg.Loc
+		if cfg.URL != nil {
+			conn = cfg.URL.String()
+		}
+		if len(conn) == 0 {
+			conn = DefaultRedisConnectionString
+		}
+		return NewRedis(conn, cfg.Logger)
+	})
+}
+
 // NewRedis creates a new instance of Redis, for managing CRUD operations to the configured redis client
 func NewRedis(connectionString string, logger *vlog.Logger) (*Redis, error) {
 	log := logger.Logger()
@@ -79,39 +99,9 @@ func (r *Redis) Connect(ctx context.Context) (bool, error) {
 	//	log.Info().Msgf("no options provided moving ahead with default Redis connection config: %s", DefaultRedisConnectionString)
 	//}
 
-	// if connection isn't already created or I cannot ping the server successfully, then I'll create the connection using the default config.
+	// if connection isn't already created, create it from the options parsed out of the connection string
 	if r.conn == nil {
-		r.conn = redis.NewClient(&redis.Options{
-			Network:               "",
-			Addr:                  "localhost:6379",
-			ClientName:            "",
-			Dialer:                nil,
-			OnConnect:             nil,
-			Protocol:              0,
-			Username:              "",
-			Password:              "",
-			CredentialsProvider:   nil,
-			DB:                    0,
-			MaxRetries:            0,
-			MinRetryBackoff:       0,
-			MaxRetryBackoff:       0,
-			DialTimeout:           0,
-			ReadTimeout:           0,
-			WriteTimeout:          0,
-			ContextTimeoutEnabled: false,
-			PoolFIFO:              false,
-			PoolSize:              0,
-			PoolTimeout:           0,
-			MinIdleConns:          0,
-			MaxIdleConns:          0,
-			MaxActiveConns:        0,
-			ConnMaxIdleTime:       0,
-			ConnMaxLifetime:       0,
-			TLSConfig:             nil,
-			Limiter:               nil,
-			DisableIndentity:      false,
-			IdentitySuffix:        "",
-		})
+		r.conn = redis.NewClient(r.rOpts)
 	}
 	log.Debug().Msgf("created the client: %#v\n", *r.conn)
 
@@ -141,8 +131,8 @@ func (r *Redis) Client() *redis.Client {
 	return r.conn
 }
 
-// Store stores a key/value pair in the database.
-func (r *Redis) Store(ctx context.Context, id string, token any) (err error) {
+// Store stores a key/value pair in the database. It fails with ErrKeyExists if the key already exists.
+func (r *Redis) Store(ctx context.Context, id string, token any) error {
 	log := r.logger.Logger()
 
 	// ensure that token type is string
@@ -153,21 +143,15 @@ func (r *Redis) Store(ctx context.Context, id string, token any) (err error) {
 		return fmt.Errorf(ErrTokenTypeNotString)
 	}
 
-	// check if key already exists
-	if r.IsExists(ctx, tokenStr) {
-		log.Error().Msgf("key already exists")
-		return err
-	}
-
-	// check if key already exists
-	status, err := r.Client().Set(ctx, id, tokenStr, DefaultTTL).Result()
+	// SETNX only sets the key if it doesn't exist yet, so concurrent stores of the same key can't both succeed
+	set, err := r.Client().SetNX(ctx, id, tokenStr, DefaultTTL).Result()
 	if err != nil {
 		log.Error().Msgf(ErrWithOperation, err.Error())
 		return err
 	}
-	if status != RedisStatusOkay {
-		log.Debug().Msgf("did not receive an \"OK\" response from redis, received %s", RedisStatusOkay)
-		return fmt.Errorf("did not receive an \"OK\" response from redis, received %s", RedisStatusOkay)
+	if !set {
+		log.Error().Msgf("key %s already exists", id)
+		return fmt.Errorf("key %s: %w", id, ErrKeyExists)
 	}
 	log.Debug().Msg(OperationSuccessful)
 	return nil
@@ -185,6 +169,10 @@ func (r *Redis) IsExists(ctx context.Context, key string) bool {
 // Retrieve retrieves a key/value pair from the database.
 func (r *Redis) Retrieve(ctx context.Context, id string) (string, error) {
 	val, err := r.Client().Get(ctx, id).Result()
+	if errors.Is(err, redis.Nil) {
+		log.Debug().Msgf("key %s doesn't exist", id)
+		return val, fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
 	if err != nil {
 		log.Error().Msgf(ErrWithOperation, err.Error())
 		return val, err
@@ -200,9 +188,13 @@ func (r *Redis) RetrieveAll(ctx context.Context) (map[string]string, error) {
 	l := len(keys.Val())
 	// allocate map of size l
 	kv := make(map[string]string, l)
+	if err := keys.Err(); err != nil {
+		log.Error().Msgf(ErrWithOperation, err.Error())
+		return nil, err
+	}
 	if l < 1 {
-		log.Error().Msgf("length of retrieved keys is less than zero. it is: %d", l)
-		return kv, fmt.Errorf("length of retrieved keys is less than zero. it is: %d", l)
+		log.Debug().Msg("redis store empty")
+		return kv, nil
 	}
 
 	for i := 0; i < l; i++ {
@@ -213,6 +205,62 @@ func (r *Redis) RetrieveAll(ctx context.Context) (map[string]string, error) {
 	return kv, nil
 }
 
+// Scan returns the page of records selected by opts. Redis filters the keys with SCAN MATCH, and only the values of
+// the page are read.
+func (r *Redis) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	log := r.logger.Logger()
+
+	// redis globs let '*' cross separators, so they select a superset of the keys selected by opts
+	pattern := globEscape(opts.literalPrefix()) + "*"
+	if len(opts.Match) > 0 {
+		pattern = opts.Match
+	}
+
+	seen := map[string]bool{}
+	var keys []string
+	iter := r.conn.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		// SCAN may return a key more than once
+		key := iter.Val()
+		if !seen[key] && opts.resumes(key) && opts.selects(key) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Error().Msgf(ErrWithOperation, err.Error())
+		return nil, err
+	}
+	sort.Strings(keys)
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	next := ""
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		next = keys[len(keys)-1]
+	}
+	page := &ScanPage{Next: next}
+	if len(keys) == 0 {
+		return page, nil
+	}
+
+	vals, err := r.conn.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Error().Msgf(ErrWithOperation, err.Error())
+		return nil, err
+	}
+	for i, val := range vals {
+		// deleted since the scan
+		if val == nil {
+			continue
+		}
+		page.Records = append(page.Records, Record{Key: keys[i], Value: fmt.Sprint(val)})
+	}
+	return page, nil
+}
+
 // Delete deletes a key/value pair identified by key
 func (r *Redis) Delete(ctx context.Context, id string) (bool, error) {
 	log := r.logger.Logger()
@@ -255,6 +303,65 @@ func (r *Redis) Patch(ctx context.Context, id string, token any) (bool, error) {
 	return true, nil
 }
 
+// Batch applies ops atomically in a MULTI/EXEC transaction. The keys of the batch are WATCHed while they are
+// checked against the ops, checks included, and the transaction is retried if another client changes one of them before it runs.
+func (r *Redis) Batch(ctx context.Context, ops []Op) error {
+	log := r.logger.Logger()
+
+	seen := map[string]bool{}
+	var keys []string
+	for _, key := range opKeys(ops) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	txf := func(tx *redis.Tx) error {
+		values := make(map[string]string, len(keys))
+		for _, key := range keys {
+			val, err := tx.Get(ctx, key).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			values[key] = val
+		}
+		if err := checkOps(ops, func(key string) (string, bool) {
+			val, ok := values[key]
+			return val, ok
+		}); err != nil {
+			return err
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, op := range writes(ops) {
+				if op.Type == OpDelete {
+					pipe.Del(ctx, op.Key)
+					continue
+				}
+				pipe.Set(ctx, op.Key, op.Value, DefaultTTL)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < DefaultRedisBatchRetries; i++ {
+		err := r.Client().Watch(ctx, txf, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			if err != nil {
+				log.Error().Msgf(ErrWithOperation, err.Error())
+			}
+			return err
+		}
+		log.Debug().Msgf("keys of a batch changed while it was checked, retrying")
+	}
+	return fmt.Errorf("batch gave up after %d retries: %w", DefaultRedisBatchRetries, redis.TxFailedErr)
+}
+
 // Flush clears the content of the current redis DB
 func (r *Redis) Flush(ctx context.Context) (bool, error) {
 	err := r.Client().FlushDB(ctx)
@@ -270,3 +377,120 @@ func (r *Redis) Flush(ctx context.Context) (bool, error) {
 func (r *Redis) Close(ctx context.Context) error {
 	return r.Client().Close()
 }
+
+// Stats counts the keys of the redis DB, and describes the server and the connection pool of the client. Redis
+// only reports the memory of the whole server, and was last compacted when it last saved its dataset to disk.
+func (r *Redis) Stats(ctx context.Context) (*StoreStats, error) {
+	size, err := r.Client().DBSize(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+	info, err := r.Client().Info(ctx, "memory", "persistence").Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := parseRedisInfo(info)
+	bytes, _ := strconv.ParseInt(fields["used_memory"], 10, 64)
+
+	pool := r.Client().PoolStats()
+	return &StoreStats{
+		Driver:         DriverRedis,
+		Records:        size,
+		Bytes:          bytes,
+		LastCompaction: unixTime(fields["rdb_last_save_time"]),
+		Pool: &PoolStats{
+			MaxOpen:  r.Client().Options().PoolSize,
+			Open:     int(pool.TotalConns),
+			Idle:     int(pool.IdleConns),
+			InUse:    int(pool.TotalConns - pool.IdleConns),
+			Hits:     uint64(pool.Hits),
+			Misses:   uint64(pool.Misses),
+			Timeouts: uint64(pool.Timeouts),
+		},
+	}, nil
+}
+
+// keyspaceEvents enables keyspace notifications for generic, string, expired and evicted events
+const keyspaceEvents = "Kg$xe"
+
+// Watch streams the changes made to keys starting with prefix in the redis DB, using keyspace notifications. Redis
+// doesn't tell creates and updates apart, so the keys that exist when Watch is called are tracked to do so.
+func (r *Redis) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	log := r.logger.Logger()
+
+	// managed redis deployments often refuse CONFIG SET. notifications may already be enabled there.
+	if err := r.Client().ConfigSet(ctx, "notify-keyspace-events", keyspaceEvents).Err(); err != nil {
+		log.Warn().Msgf("could not enable keyspace notifications, make sure notify-keyspace-events includes %s: %s\n", keyspaceEvents, err.Error())
+	}
+
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", r.rOpts.DB)
+	pubsub := r.Client().PSubscribe(ctx, channelPrefix+globEscape(prefix)+"*")
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("error subscribing to keyspace notifications: %w", err)
+	}
+
+	// subscribe before listing, so no change made in between is missed
+	known := map[string]bool{}
+	iter := r.Client().Scan(ctx, 0, globEscape(prefix)+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		known[iter.Val()] = true
+	}
+	if err := iter.Err(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	events := make(chan Event, DefaultWatchBuffer)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				key := strings.TrimPrefix(msg.Channel, channelPrefix)
+				var t EventType
+				switch msg.Payload {
+				case "set", "rename_to":
+					t = EventCreate
+					if known[key] {
+						t = EventUpdate
+					}
+					known[key] = true
+				case "del", "expired", "evicted", "rename_from":
+					t = EventDelete
+					delete(known, key)
+				default:
+					continue
+				}
+				select {
+				case events <- Event{Type: t, Key: key, Time: time.Now().UTC()}:
+				default:
+					log.Error().Msgf("redis watcher fell behind, disconnecting it")
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// globEscape escapes the glob special characters of s for use in a redis pattern, or a path.Match pattern
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
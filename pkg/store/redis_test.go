@@ -114,6 +114,8 @@ func (suite *RedisTestSuite) TestStoreAndRetrieve() {
 		suite.Assert().True(b, "expected true but got false")
 		err = redis.Store(ctx, k, v)
 		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		err = redis.Store(ctx, k, v)
+		suite.Require().ErrorIs(err, ErrKeyExists)
 		time.Sleep(2)
 		val, err := redis.Retrieve(ctx, k)
 		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
@@ -211,6 +213,62 @@ func (suite *RedisTestSuite) TestPatch() {
 	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
 }
 
+func (suite *RedisTestSuite) TestBatch() {
+	ctx := context.Background()
+	redis, err := NewRedis(suite.redisConnectionString, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := redis.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	defer redis.Close(ctx)
+	defer suite.flush(ctx, redis)
+
+	err = redis.Batch(ctx, []Op{
+		{Type: OpStore, Key: "ijbnijdelkfiue1", Value: "A1B2C3D4E5F6G7H8"},
+		{Type: OpStore, Key: "ijbnijdelkfiue2", Value: "Z9Y8X7W6V5U4T3S2"},
+	})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	// the second op fails the transaction, so the first isn't applied either
+	err = redis.Batch(ctx, []Op{
+		{Type: OpDelete, Key: "ijbnijdelkfiue1"},
+		{Type: OpStore, Key: "ijbnijdelkfiue2", Value: "Q1W2E3R4T5Y6U7I8"},
+	})
+	suite.Require().ErrorIs(err, ErrKeyExists)
+	valMap, err := redis.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"ijbnijdelkfiue1": "A1B2C3D4E5F6G7H8", "ijbnijdelkfiue2": "Z9Y8X7W6V5U4T3S2"}, valMap)
+
+	// the value checked was changed, so the patch isn't applied
+	err = redis.Batch(ctx, []Op{
+		{Type: OpCheck, Key: "ijbnijdelkfiue1", Value: "O9P0A1S2D3F4G5H6"},
+		{Type: OpPatch, Key: "ijbnijdelkfiue1", Value: "Q1W2E3R4T5Y6U7I8"},
+	})
+	suite.Require().ErrorIs(err, ErrConflict)
+}
+
+func (suite *RedisTestSuite) TestStats() {
+	ctx := context.Background()
+	redis, err := NewRedis(suite.redisConnectionString, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := redis.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	defer redis.Close(ctx)
+	defer suite.flush(ctx, redis)
+
+	for k, v := range suite.tableStoreRetrieve {
+		suite.Require().NoError(redis.Store(ctx, k, v))
+	}
+	st, err := Stats(ctx, redis)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(DriverRedis, st.Driver)
+	suite.Require().Equal(int64(len(suite.tableStoreRetrieve)), st.Records)
+	suite.Require().Positive(st.Bytes, "expected the memory used by the server")
+	suite.Require().NotNil(st.Pool, "expected the stats of the connection pool")
+	suite.Require().Positive(st.Pool.Open, "expected an open connection")
+}
+
 func (suite *RedisTestSuite) TearDownTest() {}
 
 // TestRedisSuite tests the Redis suite
@@ -0,0 +1,400 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"sync"
+	"sync/atomic"
+)
+
+// ReplicaMode decides whether writes wait for the secondaries of a Replicated store
+type ReplicaMode string
+
+const (
+	// ReplicaSync mirrors every write to the secondaries before returning
+	ReplicaSync ReplicaMode = "sync"
+	// ReplicaAsync mirrors writes to the secondaries in the background, in the order they were made
+	ReplicaAsync ReplicaMode = "async"
+)
+
+const (
+	DefaultReplicaQueueSize = 1024
+)
+
+var (
+	ErrReplicaModeInvalid  = errors.New("replica mode is invalid")
+	ErrReadOrderInvalid    = errors.New("read order is invalid")
+	ErrReplicasUnavailable = errors.New("no replica is available")
+)
+
+// ReplicatedConfig holds the tunables of a Replicated store
+type ReplicatedConfig struct {
+	// Mode is the replication mode. Defaults to ReplicaAsync.
+	Mode ReplicaMode
+	// ReadOrder is the order replicas are read from, by index: 0 is the primary, 1 the first secondary, and so on. A
+	// read goes to the next replica only when one fails. Defaults to the primary, then the secondaries in order.
+	ReadOrder []int
+	// QueueSize is how many writes can wait to be mirrored to each secondary in async mode. Writes that don't fit are
+	// dropped and left for Reconcile. Defaults to DefaultReplicaQueueSize.
+	QueueSize int
+}
+
+// ReplicaStats is a snapshot of the counters of a Replicated store
+type ReplicaStats struct {
+	// Mirrored counts the writes mirrored to secondaries
+	Mirrored uint64 `json:"mirrored"`
+	// Failed counts the writes that couldn't be mirrored, which leave the secondaries drifting until Reconcile
+	Failed uint64 `json:"failed"`
+	// Failovers counts the reads served by another replica because one failed
+	Failovers uint64 `json:"failovers"`
+}
+
+// ReconcileOptions tunes a Reconcile run
+type ReconcileOptions struct {
+	// DryRun reports the drift without repairing it
+	DryRun bool
+}
+
+// ReconcileReport summarizes the drift Reconcile found in a secondary, compared with the primary
+type ReconcileReport struct {
+	Replica int `json:"replica"`
+	// Missing counts the records of the primary the secondary lacked
+	Missing int `json:"missing"`
+	// Stale counts the records the secondary held with another value
+	Stale int `json:"stale"`
+	// Extra counts the records of the secondary the primary doesn't have
+	Extra    int  `json:"extra"`
+	Repaired bool `json:"repaired"`
+}
+
+// Replicated writes to a primary store and mirrors the writes to secondaries, synchronously or in the background.
+// Reads go to the replicas in a configurable order, failing over to the next one when a replica fails, so the
+// secondaries keep serving while the primary is down.
+type Replicated struct {
+	replicas []Store
+	config   ReplicatedConfig
+	logger   *vlog.Logger
+	// queues feed the mirror of each secondary in async mode
+	queues    []chan mirrorOp
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	mirrored  atomic.Uint64
+	failed    atomic.Uint64
+	failovers atomic.Uint64
+}
+
+// mirrorOp is a write to mirror to a secondary
+type mirrorOp func(ctx context.Context, s Store) error
+
+// NewReplicated creates a store writing to primary and mirroring to secondaries
+func NewReplicated(primary Store, secondaries []Store, config ReplicatedConfig, logger *vlog.Logger) (*Replicated, error) {
+	replicas := append([]Store{primary}, secondaries...)
+	if len(config.Mode) == 0 {
+		config.Mode = ReplicaAsync
+	}
+	if config.Mode != ReplicaSync && config.Mode != ReplicaAsync {
+		return nil, fmt.Errorf("%w: %q, expected %s or %s", ErrReplicaModeInvalid, config.Mode, ReplicaSync, ReplicaAsync)
+	}
+	if len(config.ReadOrder) == 0 {
+		for i := range replicas {
+			config.ReadOrder = append(config.ReadOrder, i)
+		}
+	}
+	for _, i := range config.ReadOrder {
+		if i < 0 || i >= len(replicas) {
+			return nil, fmt.Errorf("%w: no replica %d, there are %d", ErrReadOrderInvalid, i, len(replicas))
+		}
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultReplicaQueueSize
+	}
+
+	r := &Replicated{replicas: replicas, config: config, logger: logger}
+	if config.Mode == ReplicaAsync {
+		for i := range secondaries {
+			queue := make(chan mirrorOp, config.QueueSize)
+			r.queues = append(r.queues, queue)
+			r.wg.Add(1)
+			go r.mirrorLoop(i+1, queue)
+		}
+	}
+	return r, nil
+}
+
+// Connect connects every replica, and succeeds as long as one of them does, so reads can fail over
+func (r *Replicated) Connect(ctx context.Context) (bool, error) {
+	log := r.logger.Logger()
+	connected := false
+	var errs []error
+	for i, s := range r.replicas {
+		b, err := s.Connect(ctx)
+		if err != nil || !b {
+			log.Error().Msgf("error while connecting to replica %d: %v\n", i, err)
+			errs = append(errs, fmt.Errorf("replica %d: %v", i, err))
+			continue
+		}
+		connected = true
+	}
+	if !connected {
+		return false, fmt.Errorf("%w: %w", ErrReplicasUnavailable, errors.Join(errs...))
+	}
+	return true, nil
+}
+
+func (r *Replicated) Store(ctx context.Context, id string, token any) error {
+	if err := r.replicas[0].Store(ctx, id, token); err != nil {
+		return err
+	}
+	// a drifting secondary may already hold the key
+	r.mirror(ctx, func(ctx context.Context, s Store) error {
+		_, err := s.Patch(ctx, id, token)
+		return err
+	})
+	return nil
+}
+
+func (r *Replicated) Retrieve(ctx context.Context, id string) (string, error) {
+	var val string
+	err := r.read(ctx, func(s Store) error {
+		var err error
+		val, err = s.Retrieve(ctx, id)
+		return err
+	})
+	return val, err
+}
+
+func (r *Replicated) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	var all map[string]string
+	err := r.read(ctx, func(s Store) error {
+		var err error
+		all, err = s.RetrieveAll(ctx)
+		return err
+	})
+	return all, err
+}
+
+// Scan scans the first replica of the read order that answers
+func (r *Replicated) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	var page *ScanPage
+	err := r.read(ctx, func(s Store) error {
+		var err error
+		page, err = Scan(ctx, s, opts)
+		return err
+	})
+	return page, err
+}
+
+func (r *Replicated) Delete(ctx context.Context, id string) (bool, error) {
+	b, err := r.replicas[0].Delete(ctx, id)
+	if err != nil {
+		return b, err
+	}
+	r.mirror(ctx, func(ctx context.Context, s Store) error {
+		_, err := s.Delete(ctx, id)
+		return err
+	})
+	return b, nil
+}
+
+func (r *Replicated) Patch(ctx context.Context, id string, token any) (bool, error) {
+	b, err := r.replicas[0].Patch(ctx, id, token)
+	if err != nil {
+		return b, err
+	}
+	r.mirror(ctx, func(ctx context.Context, s Store) error {
+		_, err := s.Patch(ctx, id, token)
+		return err
+	})
+	return b, nil
+}
+
+// Batch applies ops to the primary as a single batch, then mirrors the batch to the secondaries
+func (r *Replicated) Batch(ctx context.Context, ops []Op) error {
+	if err := Batch(ctx, r.replicas[0], ops); err != nil {
+		return err
+	}
+	// a drifting secondary may already hold the keys the batch creates, or other values than those the primary was
+	// checked against
+	mirrored := mapOps(writes(ops), func(op Op) Op {
+		if op.Type == OpStore {
+			op.Type = OpPatch
+		}
+		return op
+	})
+	r.mirror(ctx, func(ctx context.Context, s Store) error {
+		return Batch(ctx, s, mirrored)
+	})
+	return nil
+}
+
+func (r *Replicated) Flush(ctx context.Context) (bool, error) {
+	b, err := r.replicas[0].Flush(ctx)
+	if err != nil {
+		return b, err
+	}
+	r.mirror(ctx, func(ctx context.Context, s Store) error {
+		_, err := s.Flush(ctx)
+		return err
+	})
+	return b, nil
+}
+
+// Watch streams the changes made to the primary
+func (r *Replicated) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, r.replicas[0], prefix)
+}
+
+// Close waits for the writes still queued to be mirrored, and closes every replica
+func (r *Replicated) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		for _, queue := range r.queues {
+			close(queue)
+		}
+	})
+	r.wg.Wait()
+
+	var errs []error
+	for i, s := range r.replicas {
+		if err := s.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the statistics of the primary, with the replication counters
+func (r *Replicated) Stats(ctx context.Context) (*StoreStats, error) {
+	st, err := Stats(ctx, r.replicas[0])
+	if err != nil {
+		return nil, err
+	}
+	rs := r.ReplicaStats()
+	st.Replication = &rs
+	return st, nil
+}
+
+// ReplicaStats returns a snapshot of the replication counters
+func (r *Replicated) ReplicaStats() ReplicaStats {
+	return ReplicaStats{Mirrored: r.mirrored.Load(), Failed: r.failed.Load(), Failovers: r.failovers.Load()}
+}
+
+// Reconcile repairs the drift of every secondary, making it hold exactly the records of the primary. It returns a
+// report per secondary.
+func (r *Replicated) Reconcile(ctx context.Context, opts ReconcileOptions) ([]*ReconcileReport, error) {
+	log := r.logger.Logger()
+
+	records, err := r.replicas[0].RetrieveAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the primary: %w", err)
+	}
+
+	var reports []*ReconcileReport
+	for i, s := range r.replicas[1:] {
+		report := &ReconcileReport{Replica: i + 1}
+		reports = append(reports, report)
+		held, err := s.RetrieveAll(ctx)
+		if err != nil {
+			return reports, fmt.Errorf("error while reading replica %d: %w", report.Replica, err)
+		}
+
+		var repairs []mirrorOp
+		for _, id := range sortedKeys(records) {
+			val, ok := held[id]
+			if ok && val == records[id] {
+				continue
+			}
+			if ok {
+				report.Stale++
+			} else {
+				report.Missing++
+			}
+			id, token := id, records[id]
+			repairs = append(repairs, func(ctx context.Context, s Store) error {
+				_, err := s.Patch(ctx, id, token)
+				return err
+			})
+		}
+		for _, id := range sortedKeys(held) {
+			if _, ok := records[id]; ok {
+				continue
+			}
+			report.Extra++
+			id := id
+			repairs = append(repairs, func(ctx context.Context, s Store) error {
+				_, err := s.Delete(ctx, id)
+				return err
+			})
+		}
+
+		if opts.DryRun {
+			continue
+		}
+		for _, repair := range repairs {
+			if err = repair(ctx, s); err != nil {
+				return reports, fmt.Errorf("error while repairing replica %d: %w", report.Replica, err)
+			}
+		}
+		report.Repaired = true
+		log.Info().Msgf("reconciled replica %d: %d missing, %d stale and %d extra records", report.Replica, report.Missing, report.Stale, report.Extra)
+	}
+	return reports, nil
+}
+
+// read calls fn on the replicas in read order, until one doesn't fail. A missing key is an answer, not a failure.
+func (r *Replicated) read(ctx context.Context, fn func(s Store) error) error {
+	log := r.logger.Logger()
+	var errs []error
+	for n, i := range r.config.ReadOrder {
+		err := fn(r.replicas[i])
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return err
+		}
+		log.Error().Msgf("error while reading from replica %d: %s\n", i, err.Error())
+		errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+		if n < len(r.config.ReadOrder)-1 {
+			r.failovers.Add(1)
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrReplicasUnavailable, errors.Join(errs...))
+}
+
+// mirror applies op to every secondary, now in sync mode, or through their queues in async mode
+func (r *Replicated) mirror(ctx context.Context, op mirrorOp) {
+	log := r.logger.Logger()
+	if r.config.Mode == ReplicaSync {
+		for i, s := range r.replicas[1:] {
+			r.apply(ctx, i+1, s, op)
+		}
+		return
+	}
+	for i, queue := range r.queues {
+		select {
+		case queue <- op:
+		default:
+			r.failed.Add(1)
+			log.Error().Msgf("mirror queue of replica %d is full, dropping a write. run a reconcile to repair it", i+1)
+		}
+	}
+}
+
+// mirrorLoop mirrors the queued writes to the secondary at index i, until its queue is closed
+func (r *Replicated) mirrorLoop(i int, queue chan mirrorOp) {
+	defer r.wg.Done()
+	for op := range queue {
+		// queued writes outlive the request that made them
+		r.apply(context.Background(), i, r.replicas[i], op)
+	}
+}
+
+// apply mirrors op to the secondary at index i. Failures are counted and logged, but don't fail the write, which
+// already succeeded on the primary.
+func (r *Replicated) apply(ctx context.Context, i int, s Store, op mirrorOp) {
+	if err := op(ctx, s); err != nil {
+		r.failed.Add(1)
+		r.logger.Logger().Error().Msgf("error while mirroring a write to replica %d: %s\n", i, err.Error())
+		return
+	}
+	r.mirrored.Add(1)
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("replica is down")
+
+// down is a store whose reads fail, as when its server is unreachable
+type down struct {
+	*Map
+}
+
+func (d down) Retrieve(ctx context.Context, id string) (string, error) {
+	return "", errDown
+}
+
+func (d down) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	return nil, errDown
+}
+
+type ReplicatedTestSuite struct {
+	suite.Suite
+	primary   *Map
+	secondary *Map
+	log       *vlog.Logger
+}
+
+func (suite *ReplicatedTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.primary = NewSyncMap(context.Background(), suite.log)
+	suite.secondary = NewSyncMap(context.Background(), suite.log)
+}
+
+func (suite *ReplicatedTestSuite) TestSync() {
+	ctx := context.Background()
+	r, err := NewReplicated(suite.primary, []Store{suite.secondary}, ReplicatedConfig{Mode: ReplicaSync}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	suite.Require().NoError(r.Store(ctx, "customer123__ssn", "token1"))
+	suite.Require().NoError(r.Store(ctx, "customer123__dob", "token2"))
+	_, err = r.Patch(ctx, "customer123__ssn", "token3")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = r.Delete(ctx, "customer123__dob")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	all, err := suite.secondary.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123__ssn": "token3"}, all, "expected every write mirrored before returning")
+	suite.Require().Equal(uint64(4), r.ReplicaStats().Mirrored)
+}
+
+func (suite *ReplicatedTestSuite) TestAsync() {
+	ctx := context.Background()
+	r, err := NewReplicated(suite.primary, []Store{suite.secondary}, ReplicatedConfig{}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	for _, id := range []string{"customer123__ssn", "customer123__dob", "customer123__zip"} {
+		suite.Require().NoError(r.Store(ctx, id, "token"))
+	}
+	suite.Require().Eventually(func() bool { return r.ReplicaStats().Mirrored == 3 }, time.Second, time.Millisecond)
+	val, err := suite.secondary.Retrieve(ctx, "customer123__zip")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token", val)
+}
+
+func (suite *ReplicatedTestSuite) TestFailover() {
+	ctx := context.Background()
+	r, err := NewReplicated(down{suite.primary}, []Store{suite.secondary}, ReplicatedConfig{Mode: ReplicaSync}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(r.Store(ctx, "customer123__ssn", "token1"))
+
+	val, err := r.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected reads to fail over to the secondary, but got this %v\n", err)
+	suite.Require().Equal("token1", val)
+	suite.Require().Equal(uint64(1), r.ReplicaStats().Failovers)
+
+	// a missing key is an answer, and isn't looked up elsewhere
+	r, err = NewReplicated(suite.secondary, []Store{down{suite.primary}}, ReplicatedConfig{Mode: ReplicaSync}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = r.Retrieve(ctx, "customer123__dob")
+	suite.Require().Truef(errors.Is(err, ErrNotFound), "expected a not found error, but got %v\n", err)
+	suite.Require().Zero(r.ReplicaStats().Failovers)
+
+	// every replica down
+	r, err = NewReplicated(down{suite.primary}, []Store{down{suite.secondary}}, ReplicatedConfig{Mode: ReplicaSync}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = r.RetrieveAll(ctx)
+	suite.Require().Truef(errors.Is(err, ErrReplicasUnavailable), "expected no replica to be available, but got %v\n", err)
+}
+
+func (suite *ReplicatedTestSuite) TestReadOrder() {
+	ctx := context.Background()
+	suite.Require().NoError(suite.primary.Store(ctx, "customer123__ssn", "primary"))
+	suite.Require().NoError(suite.secondary.Store(ctx, "customer123__ssn", "secondary"))
+
+	r, err := NewReplicated(suite.primary, []Store{suite.secondary}, ReplicatedConfig{ReadOrder: []int{1, 0}}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	val, err := r.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("secondary", val, "expected the secondary to be read first")
+
+	_, err = NewReplicated(suite.primary, []Store{suite.secondary}, ReplicatedConfig{ReadOrder: []int{2}}, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrReadOrderInvalid), "expected an invalid read order error, but got %v\n", err)
+	_, err = NewReplicated(suite.primary, nil, ReplicatedConfig{Mode: "eventually"}, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrReplicaModeInvalid), "expected an invalid mode error, but got %v\n", err)
+}
+
+func (suite *ReplicatedTestSuite) TestReconcile() {
+	ctx := context.Background()
+	suite.Require().NoError(suite.primary.Store(ctx, "customer123__ssn", "token1"))
+	suite.Require().NoError(suite.primary.Store(ctx, "customer123__dob", "token2"))
+	suite.Require().NoError(suite.secondary.Store(ctx, "customer123__dob", "stale"))
+	suite.Require().NoError(suite.secondary.Store(ctx, "customer123__zip", "extra"))
+
+	r, err := NewReplicated(suite.primary, []Store{suite.secondary}, ReplicatedConfig{}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	reports, err := r.Reconcile(ctx, ReconcileOptions{DryRun: true})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal([]*ReconcileReport{{Replica: 1, Missing: 1, Stale: 1, Extra: 1}}, reports)
+	all, _ := suite.secondary.RetrieveAll(ctx)
+	suite.Require().Len(all, 2, "expected a dry run to leave the secondary untouched")
+
+	reports, err = r.Reconcile(ctx, ReconcileOptions{})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(reports[0].Repaired)
+	all, _ = suite.secondary.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"customer123__ssn": "token1", "customer123__dob": "token2"}, all)
+}
+
+// TestReplicatedSuite tests mirroring writes to secondaries, failing reads over and reconciling replicas
+func TestReplicatedSuite(t *testing.T) {
+	suite.Run(t, new(ReplicatedTestSuite))
+}
@@ -0,0 +1,575 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultS3Region = "us-east-1"
+	// DefaultS3Concurrency is how many objects are read at once when a listing is loaded
+	DefaultS3Concurrency = 8
+	DefaultS3Timeout     = 30 * time.Second
+
+	// The environment variables an S3 store reads the settings missing from its config from, as the AWS tools do
+	EnvS3AccessKeyID     = "AWS_ACCESS_KEY_ID"
+	EnvS3SecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	EnvS3SessionToken    = "AWS_SESSION_TOKEN"
+	EnvS3Region          = "AWS_REGION"
+	EnvS3DefaultRegion   = "AWS_DEFAULT_REGION"
+	EnvS3Endpoint        = "AWS_ENDPOINT_URL"
+
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3Service    = "s3"
+	s3DateFormat = "20060102T150405Z"
+	// s3EmptyHash is the sha256 of an empty payload
+	s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	ErrS3Request = errors.New("s3 request failed")
+)
+
+// S3Config holds the tunables of an S3 store. Settings left empty are read from the environment, as the AWS tools do.
+type S3Config struct {
+	Bucket string
+	// Prefix starts the object key of every record, so several vaults can share a bucket. A trailing slash is added if
+	// missing.
+	Prefix string
+	// Endpoint is the url of the S3 api, as in http://localhost:9000 for a local MinIO. Defaults to AWS_ENDPOINT_URL,
+	// or the AWS endpoint of Region.
+	Endpoint string
+	// Region signs the requests. Defaults to AWS_REGION, AWS_DEFAULT_REGION, or DefaultS3Region.
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses the bucket in the path of the url rather than its host, as most S3-compatible servers expect
+	PathStyle bool
+	// Truncate starts the store empty, deleting every object under Prefix
+	Truncate bool
+	// Client sends the requests. Defaults to a client timing out after DefaultS3Timeout.
+	Client *http.Client
+}
+
+// S3 is a store keeping every record as an object of an S3-compatible bucket, under the key prefix of its config.
+// Requests are signed with AWS Signature Version 4. Store is a conditional write, so a key is never created twice,
+// even by concurrent vaults sharing the bucket.
+//
+// S3 has no transactions: batches are applied object by object, and rolled back if one fails.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	logger   *vlog.Logger
+	// now dates the signatures
+	now func() time.Time
+}
+
+// s3Key is the credentials requests are signed with
+type s3Key struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+func init() {
+	Register(DriverS3, func(ctx context.Context, cfg Config) (Store, error) {
+		config, err := parseS3Config(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3(config, cfg.Logger)
+	})
+}
+
+// parseS3Config parses an s3 url, as in s3://access_key:secret_key@bucket/prefix?region=eu-west-1. Credentials missing
+// from the url are read from the environment.
+func parseS3Config(cfg Config) (S3Config, error) {
+	config := S3Config{Truncate: cfg.Truncate, Endpoint: cfg.Options.Get(ParamEndpoint), Region: cfg.Options.Get(ParamRegion)}
+	if cfg.URL != nil {
+		config.Bucket = cfg.URL.Host
+		config.Prefix = strings.TrimPrefix(cfg.URL.Path, "/")
+		if cfg.URL.User != nil {
+			config.AccessKeyID = cfg.URL.User.Username()
+			config.SecretAccessKey, _ = cfg.URL.User.Password()
+		}
+	} else {
+		config.Bucket, config.Prefix, _ = strings.Cut(cfg.Loc, "/")
+	}
+	if raw := cfg.Options.Get(ParamPathStyle); len(raw) > 0 {
+		var err error
+		if config.PathStyle, err = strconv.ParseBool(raw); err != nil {
+			return config, fmt.Errorf("%w: %s must be true or false", ErrURLInvalid, ParamPathStyle)
+		}
+	}
+	return config, nil
+}
+
+// NewS3 creates an S3 store configured by config. Nothing is sent until Connect.
+func NewS3(config S3Config, logger *vlog.Logger) (*S3, error) {
+	if len(config.Bucket) == 0 {
+		return nil, fmt.Errorf("%s: bucket: %w", DriverS3, ErrLocEmpty)
+	}
+	if len(config.Prefix) > 0 && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+	config.Region = firstNonEmpty(config.Region, os.Getenv(EnvS3Region), os.Getenv(EnvS3DefaultRegion), DefaultS3Region)
+	config.Endpoint = firstNonEmpty(config.Endpoint, os.Getenv(EnvS3Endpoint), "https://s3."+config.Region+".amazonaws.com")
+	if len(config.AccessKeyID) == 0 {
+		config.AccessKeyID = os.Getenv(EnvS3AccessKeyID)
+		config.SecretAccessKey = os.Getenv(EnvS3SecretAccessKey)
+		config.SessionToken = os.Getenv(EnvS3SessionToken)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("%w: %s endpoint %q", ErrURLInvalid, DriverS3, config.Endpoint)
+	}
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultS3Timeout}
+	}
+	return &S3{config: config, endpoint: endpoint, client: client, logger: logger, now: time.Now}, nil
+}
+
+// Connect checks that the bucket exists and the credentials can reach it
+func (s *S3) Connect(ctx context.Context) (bool, error) {
+	log := s.logger.Logger()
+	resp, err := s.do(ctx, http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		log.Error().Msgf("error while connecting to bucket %s: %s\n", s.config.Bucket, err.Error())
+		return false, err
+	}
+	resp.Body.Close()
+
+	if s.config.Truncate {
+		if _, err = s.Flush(ctx); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Close releases the idle connections to the endpoint
+func (s *S3) Close(ctx context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Store writes the object of a new key. The write is conditional on no object existing under the key.
+func (s *S3) Store(ctx context.Context, id string, token any) error {
+	log := s.logger.Logger()
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.config.Prefix+id, nil, http.Header{"If-None-Match": {"*"}}, []byte(tokenStr))
+	if err != nil {
+		log.Error().Msgf("error while storing key with id %s: %s\n", id, err.Error())
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Retrieve reads the object of id
+func (s *S3) Retrieve(ctx context.Context, id string) (string, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.config.Prefix+id, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// RetrieveAll lists the objects under the prefix, and reads them
+func (s *S3) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	var keys []string
+	if err := s.list(ctx, "", "", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	records, err := s.read(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]string, len(records))
+	for _, r := range records {
+		all[r.Key] = r.Value
+	}
+	return all, nil
+}
+
+// Scan lists the objects selected by opts, and reads the page of them. Listings are in key order, so a forward scan
+// stops listing once its page is full.
+func (s *S3) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	var after string
+	if !opts.Reverse {
+		after = opts.After
+	}
+	var keys []string
+	if err := s.list(ctx, opts.literalPrefix(), after, func(key string) bool {
+		if opts.resumes(key) && opts.selects(key) {
+			keys = append(keys, key)
+		}
+		return opts.Reverse || opts.Limit <= 0 || len(keys) <= opts.Limit
+	}); err != nil {
+		return nil, err
+	}
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	next := ""
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		next = keys[len(keys)-1]
+	}
+	records, err := s.read(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &ScanPage{Records: records, Next: next}, nil
+}
+
+// Delete deletes the object of id. Deleting a missing object succeeds.
+func (s *S3) Delete(ctx context.Context, id string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodDelete, s.config.Prefix+id, nil, nil, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		s.logger.Logger().Error().Msgf("error while deleting key with id %s: %s\n", id, err.Error())
+		return false, err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return true, nil
+}
+
+// Patch writes the object of id, whether it exists or not
+func (s *S3) Patch(ctx context.Context, id string, token any) (bool, error) {
+	log := s.logger.Logger()
+	var tokenStr string
+	var b bool
+	if b, tokenStr = InterfaceIsString(token); !b {
+		log.Error().Msgf(ErrTokenTypeNotString)
+		return false, fmt.Errorf(ErrTokenTypeNotString)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.config.Prefix+id, nil, nil, []byte(tokenStr))
+	if err != nil {
+		log.Error().Msgf("error while patching key with id %s: %s\n", id, err.Error())
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Stats counts the objects under the prefix, and sums their sizes, from their listing
+func (s *S3) Stats(ctx context.Context) (*StoreStats, error) {
+	st := &StoreStats{Driver: DriverS3}
+	if err := s.listObjects(ctx, "", "", func(key string, size int64) bool {
+		st.Records++
+		st.Bytes += size
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Flush deletes every object under the prefix, or of the whole bucket without one
+func (s *S3) Flush(ctx context.Context) (bool, error) {
+	var keys []string
+	if err := s.list(ctx, "", "", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if _, err := s.Delete(ctx, key); err != nil {
+			return false, err
+		}
+	}
+	s.logger.Logger().Debug().Msgf("flushed %d objects from bucket %s", len(keys), s.config.Bucket)
+	return true, nil
+}
+
+// s3ListResult is the body of a ListObjectsV2 response
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		Size int64
+	}
+}
+
+// list calls fn with the keys under prefix, relative to the prefix of the store, in key order, from the key after
+// after if set. It stops when fn returns false. The keys are listed a page of ListObjectsV2 at a time.
+func (s *S3) list(ctx context.Context, prefix, after string, fn func(key string) bool) error {
+	return s.listObjects(ctx, prefix, after, func(key string, size int64) bool {
+		return fn(key)
+	})
+}
+
+// listObjects lists like list, calling fn with the size of every object too
+func (s *S3) listObjects(ctx context.Context, prefix, after string, fn func(key string, size int64) bool) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}, "encoding-type": {"url"}}
+	if len(after) > 0 {
+		query.Set("start-after", s.config.Prefix+after)
+	}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("%w: listing bucket %s: %s", ErrS3Request, s.config.Bucket, err)
+		}
+
+		for _, object := range result.Contents {
+			key, err := url.QueryUnescape(object.Key)
+			if err != nil {
+				return fmt.Errorf("%w: listing bucket %s: key %q: %s", ErrS3Request, s.config.Bucket, object.Key, err)
+			}
+			if !fn(strings.TrimPrefix(key, s.config.Prefix), object.Size) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// read reads the objects of keys, DefaultS3Concurrency at a time, as records in the order of keys. Objects deleted
+// since they were listed are left out.
+func (s *S3) read(ctx context.Context, keys []string) ([]Record, error) {
+	vals := make([]*string, len(keys))
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, DefaultS3Concurrency)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		i, key := i, key
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			val, err := s.Retrieve(ctx, key)
+			if err == nil {
+				vals[i] = &val
+			} else if !errors.Is(err, ErrNotFound) {
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(keys))
+	for i, val := range vals {
+		if val != nil {
+			records = append(records, Record{Key: keys[i], Value: *val})
+		}
+	}
+	return records, nil
+}
+
+// s3Error is the body of a failed S3 response
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends a signed request for the object key, or the bucket if key is empty, and returns the response if it
+// succeeded. Missing objects fail with ErrNotFound, and failed conditional writes with ErrKeyExists.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	payloadHash := s3EmptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signV4(req, s3Key{s.config.AccessKeyID, s.config.SecretAccessKey, s.config.SessionToken}, s.config.Region, payloadHash, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s %s: %w", ErrS3Request, method, s.config.Bucket+"/"+key, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" && len(key) > 0:
+		return nil, fmt.Errorf("object %s: %w", key, ErrNotFound)
+	case resp.StatusCode == http.StatusPreconditionFailed && method == http.MethodPut:
+		return nil, fmt.Errorf("object %s: %w", key, ErrKeyExists)
+	case resp.StatusCode == http.StatusConflict && method == http.MethodPut:
+		// a concurrent conditional write of the same key is in progress
+		return nil, fmt.Errorf("object %s: %w", key, ErrConflict)
+	}
+	return nil, fmt.Errorf("%w: %s %s: %s %s: %s", ErrS3Request, method, s.config.Bucket+"/"+key, resp.Status, e.Code, e.Message)
+}
+
+// url returns the url of the object key, or of the bucket if key is empty, with query in canonical order
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		base += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = base + "/" + key
+	u.RawPath = s3Escape(base, false) + "/" + s3Escape(key, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// signV4 signs req with AWS Signature Version 4, for the payload hashing to payloadHash. Every header set on req is
+// signed along with its host, so the query of its url must already be in canonical order.
+func signV4(req *http.Request, key s3Key, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := amzDate[:8] + "/" + region + "/" + s3Service + "/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(key.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", key.sessionToken)
+	}
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, vals := range req.Header {
+		if name = strings.ToLower(name); name == "authorization" || name == "user-agent" {
+			continue
+		}
+		trimmed := make([]string, len(vals))
+		for i, val := range vals {
+			trimmed[i] = strings.Join(strings.Fields(val), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+
+	signingKey := []byte("AWS4" + key.secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, s3Service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s3Algorithm, key.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name then value, as SigV4 signs it
+func canonicalQuery(query url.Values) string {
+	escaped := map[string][]string{}
+	names := make([]string, 0, len(query))
+	for name, vals := range query {
+		name = s3Escape(name, true)
+		names = append(names, name)
+		for _, val := range vals {
+			escaped[name] = append(escaped[name], s3Escape(val, true))
+		}
+		sort.Strings(escaped[name])
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, val := range escaped[name] {
+			pairs = append(pairs, name+"="+val)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes every byte of s but the unreserved characters, and the slashes of paths unless slash is set
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// firstNonEmpty returns the first of vals that isn't empty
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if len(val) > 0 {
+			return val
+		}
+	}
+	return ""
+}
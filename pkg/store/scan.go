@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrMatchInvalid = errors.New("invalid match pattern")
+)
+
+// ScanOptions selects and pages the records a Scan returns. Records are returned in key order.
+type ScanOptions struct {
+	// Prefix keeps the keys under this path prefix, as in HasPathPrefix
+	Prefix string
+	// Match keeps the keys matching this glob, as in path.Match. '*' doesn't cross a PathSeparator.
+	Match string
+	// After resumes a scan after this key, which is usually the Next of the previous page
+	After string
+	// Reverse scans in descending key order. After then resumes before the key.
+	Reverse bool
+	// Limit caps the number of records of a page. 0 returns every record left.
+	Limit int
+}
+
+// Record is a key value pair returned by Scan
+type Record struct {
+	Key   string
+	Value string
+}
+
+// ScanPage is a page of records. Next is the key to resume the scan after, or empty on the last page.
+type ScanPage struct {
+	Records []Record
+	Next    string
+}
+
+// Scanner is implemented by stores that can filter and page their records without loading all of them
+type Scanner interface {
+	// Scan returns the page of records selected by opts
+	Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error)
+}
+
+// Scan returns the page of records of s selected by opts. Stores that aren't Scanners are scanned through
+// RetrieveAll.
+func Scan(ctx context.Context, s Store, opts ScanOptions) (*ScanPage, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if sc, ok := s.(Scanner); ok {
+		return sc.Scan(ctx, opts)
+	}
+	all, err := s.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(all, opts), nil
+}
+
+// validate checks that the glob of opts is well-formed, so backends can match keys without failing midway
+func (opts ScanOptions) validate() error {
+	if len(opts.Match) == 0 {
+		return nil
+	}
+	if _, err := path.Match(opts.Match, ""); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrMatchInvalid, opts.Match, err)
+	}
+	return nil
+}
+
+// selects reports whether key is selected by the prefix and glob of opts, ignoring the cursor
+func (opts ScanOptions) selects(key string) bool {
+	if !HasPathPrefix(key, opts.Prefix) {
+		return false
+	}
+	if len(opts.Match) == 0 {
+		return true
+	}
+	ok, _ := path.Match(opts.Match, key)
+	return ok
+}
+
+// resumes reports whether key comes after the cursor of opts, in the order of the scan
+func (opts ScanOptions) resumes(key string) bool {
+	if len(opts.After) == 0 {
+		return true
+	}
+	if opts.Reverse {
+		return key < opts.After
+	}
+	return key > opts.After
+}
+
+// literalPrefix returns the longest raw key prefix every selected key starts with, to narrow backend range scans
+func (opts ScanOptions) literalPrefix() string {
+	prefix := CleanPath(opts.Prefix)
+	if i := strings.IndexAny(opts.Match, `*?[\`); i != 0 {
+		literal := opts.Match
+		if i > 0 {
+			literal = opts.Match[:i]
+		}
+		// the longer of the two constraints narrows the range the most, and one always extends the other
+		if len(literal) > len(prefix) && strings.HasPrefix(literal, prefix) {
+			prefix = literal
+		}
+	}
+	return prefix
+}
+
+// page cuts the records of a scan, already selected and in order, to the limit of opts
+func (opts ScanOptions) page(records []Record) *ScanPage {
+	if opts.Limit <= 0 || len(records) <= opts.Limit {
+		return &ScanPage{Records: records}
+	}
+	records = records[:opts.Limit]
+	return &ScanPage{Records: records, Next: records[len(records)-1].Key}
+}
+
+// scanRecords scans the records of all, for stores that can't do better than loading everything
+func scanRecords(all map[string]string, opts ScanOptions) *ScanPage {
+	keys := sortedKeys(all)
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	var records []Record
+	for _, key := range keys {
+		if opts.resumes(key) && opts.selects(key) {
+			records = append(records, Record{Key: key, Value: all[key]})
+		}
+	}
+	return opts.page(records)
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ScanTestSuite struct {
+	suite.Suite
+	dir     string
+	records map[string]string
+	log     *vlog.Logger
+}
+
+func (suite *ScanTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.dir = suite.T().TempDir()
+	suite.records = map[string]string{
+		"team/app/db/password": "token1",
+		"team/app/db/user":     "token2",
+		"team/app/api_key":     "token3",
+		"team/application/key": "token4",
+		"team/web/token":       "token5",
+		"solo":                 "token6",
+	}
+}
+
+// stores returns a fresh store of every kind that is scanned differently, filled with the records of the suite
+func (suite *ScanTestSuite) stores(ctx context.Context) map[string]Store {
+	gob, err := NewGob(ctx, filepath.Join(suite.dir, "scan.gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	file := NewFile(filepath.Join(suite.dir, "scan.env"), suite.log)
+	_, err = file.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	stores := map[string]Store{
+		"map":      NewSyncMap(ctx, suite.log),
+		"gob":      gob,
+		"file":     file,
+		"prefixed": NewPrefixed(NewSyncMap(ctx, suite.log), "_vault/ns/a/", 0, suite.log),
+	}
+	for name, s := range stores {
+		for k, v := range suite.records {
+			suite.Require().NoErrorf(s.Store(ctx, k, v), "%s: expected no errors storing %s\n", name, k)
+		}
+	}
+	return stores
+}
+
+func (suite *ScanTestSuite) TestFilter() {
+	ctx := context.Background()
+	table := []struct {
+		opts     ScanOptions
+		expected []string
+	}{
+		{ScanOptions{}, []string{"solo", "team/app/api_key", "team/app/db/password", "team/app/db/user", "team/application/key", "team/web/token"}},
+		{ScanOptions{Prefix: "team/app"}, []string{"team/app/api_key", "team/app/db/password", "team/app/db/user"}},
+		{ScanOptions{Prefix: "team/app/db/"}, []string{"team/app/db/password", "team/app/db/user"}},
+		{ScanOptions{Match: "team/*/token"}, []string{"team/web/token"}},
+		{ScanOptions{Match: "team/app*/*"}, []string{"team/app/api_key", "team/application/key"}},
+		{ScanOptions{Prefix: "team/app", Match: "*/*/db/p*"}, []string{"team/app/db/password"}},
+		{ScanOptions{Prefix: "team", Reverse: true}, []string{"team/web/token", "team/application/key", "team/app/db/user", "team/app/db/password", "team/app/api_key"}},
+		{ScanOptions{Prefix: "other"}, nil},
+	}
+	for name, s := range suite.stores(ctx) {
+		for _, tt := range table {
+			page, err := Scan(ctx, s, tt.opts)
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			suite.Require().Equalf(tt.expected, keysOf(page), "%s: unexpected keys for %+v\n", name, tt.opts)
+			suite.Require().Emptyf(page.Next, "%s: expected a single page for %+v\n", name, tt.opts)
+			for _, record := range page.Records {
+				suite.Require().Equal(suite.records[record.Key], record.Value)
+			}
+		}
+	}
+}
+
+func (suite *ScanTestSuite) TestPages() {
+	ctx := context.Background()
+	for name, s := range suite.stores(ctx) {
+		for _, reverse := range []bool{false, true} {
+			var keys []string
+			opts := ScanOptions{Limit: 2, Reverse: reverse}
+			for pages := 1; ; pages++ {
+				page, err := Scan(ctx, s, opts)
+				suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+				suite.Require().LessOrEqual(len(page.Records), 2)
+				keys = append(keys, keysOf(page)...)
+				if len(page.Next) == 0 {
+					suite.Require().Equalf(3, pages, "%s: expected 3 pages of 2 records\n", name)
+					break
+				}
+				opts.After = page.Next
+			}
+			all, err := Scan(ctx, s, ScanOptions{Reverse: reverse})
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			suite.Require().Equalf(keysOf(all), keys, "%s: expected the pages to add up to a full scan\n", name)
+		}
+	}
+}
+
+func (suite *ScanTestSuite) TestIndex() {
+	ctx := context.Background()
+	m := NewSyncMap(ctx, suite.log)
+	suite.Require().NoError(m.Store(ctx, "b", "1"))
+	suite.Require().NoError(m.Store(ctx, "a", "2"))
+	_, err := m.Patch(ctx, "c", "3")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = m.Delete(ctx, "b")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	page, err := m.Scan(ctx, ScanOptions{})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal([]string{"a", "c"}, keysOf(page), "expected the index to follow stores, patches and deletes")
+
+	_, err = m.Flush(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	page, err = m.Scan(ctx, ScanOptions{})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Empty(page.Records, "expected flush to empty the index")
+}
+
+func (suite *ScanTestSuite) TestInvalidMatch() {
+	ctx := context.Background()
+	_, err := Scan(ctx, NewSyncMap(ctx, suite.log), ScanOptions{Match: "team/[app"})
+	suite.Require().Error(err, "expected a malformed glob to be rejected")
+}
+
+func (suite *ScanTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func keysOf(page *ScanPage) []string {
+	var keys []string
+	for _, record := range page.Records {
+		keys = append(keys, record.Key)
+	}
+	return keys
+}
+
+// TestScanSuite tests filtering and paging the records of every kind of store
+func TestScanSuite(t *testing.T) {
+	suite.Run(t, new(ScanTestSuite))
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultVirtualNodes is how many points each shard gets on the hash ring. More points spread keys more evenly.
+	DefaultVirtualNodes = 128
+)
+
+var (
+	ErrShardsEmpty     = errors.New("a sharded store needs at least one shard")
+	ErrShardNameExists = errors.New("shard name is used twice")
+)
+
+// Shard is a store holding a part of the keys of a Sharded store. Keys are placed by the name of their shard, so a
+// shard must keep its name, and not its position, for its keys to stay where they are.
+type Shard struct {
+	Name  string
+	Store Store
+}
+
+// RebalanceOptions tunes a Rebalance run
+type RebalanceOptions struct {
+	// DryRun counts the keys to move without moving them
+	DryRun bool
+}
+
+// RebalanceReport counts the keys Rebalance moved off a shard
+type RebalanceReport struct {
+	Shard string `json:"shard"`
+	Keys  int    `json:"keys"`
+	Moved int    `json:"moved"`
+	// Retired is set on the shards removed from the ring, which are drained of all their keys
+	Retired bool `json:"retired,omitempty"`
+}
+
+// Sharded spreads keys across shards with consistent hashing, so adding or removing a shard only moves the keys of
+// its neighbours on the ring. Listings merge the keys of every shard.
+type Sharded struct {
+	shards []Shard
+	// ring holds the points of the shards on the hash ring, sorted, and owners the index of the shard of each point
+	ring   []uint64
+	owners []int
+	logger *vlog.Logger
+}
+
+func init() {
+	Register(DriverSharded, func(ctx context.Context, cfg Config) (Store, error) {
+		shards, err := OpenShards(ctx, cfg.Options[ParamShard], cfg.Logger)
+		if err != nil {
+			return nil, err
+		}
+		var vnodes int
+		if raw := cfg.Options.Get(ParamVirtualNodes); len(raw) > 0 {
+			if vnodes, err = strconv.Atoi(raw); err != nil {
+				return nil, fmt.Errorf("%w: %s must be a number", ErrURLInvalid, ParamVirtualNodes)
+			}
+		}
+		return NewSharded(shards, vnodes, cfg.Logger)
+	})
+}
+
+// NewSharded creates a store spreading keys across shards, with virtualNodes points per shard on the hash ring. Zero
+// virtualNodes defaults to DefaultVirtualNodes.
+func NewSharded(shards []Shard, virtualNodes int, logger *vlog.Logger) (*Sharded, error) {
+	if len(shards) == 0 {
+		return nil, ErrShardsEmpty
+	}
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	var points []point
+	names := map[string]bool{}
+	for i, shard := range shards {
+		if names[shard.Name] {
+			return nil, fmt.Errorf("%w: %s", ErrShardNameExists, shard.Name)
+		}
+		names[shard.Name] = true
+		for v := 0; v < virtualNodes; v++ {
+			points = append(points, point{hash: hashKey(shard.Name + "#" + strconv.Itoa(v)), owner: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	s := &Sharded{shards: shards, logger: logger}
+	for _, p := range points {
+		s.ring = append(s.ring, p.hash)
+		s.owners = append(s.owners, p.owner)
+	}
+	return s, nil
+}
+
+// ShardOf returns the name of the shard key is placed on
+func (s *Sharded) ShardOf(key string) string {
+	return s.shards[s.owner(key)].Name
+}
+
+// owner returns the index of the shard owning key: the shard of the first point of the ring at or after its hash
+func (s *Sharded) owner(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i] >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.owners[i]
+}
+
+func (s *Sharded) shard(key string) Store {
+	return s.shards[s.owner(key)].Store
+}
+
+// Connect connects every shard. A sharded store is only usable with all its shards.
+func (s *Sharded) Connect(ctx context.Context) (bool, error) {
+	for _, shard := range s.shards {
+		if b, err := shard.Store.Connect(ctx); err != nil || !b {
+			return false, fmt.Errorf("error connecting to shard %s: %v", shard.Name, err)
+		}
+	}
+	return true, nil
+}
+
+func (s *Sharded) Store(ctx context.Context, id string, token any) error {
+	return s.shard(id).Store(ctx, id, token)
+}
+
+func (s *Sharded) Retrieve(ctx context.Context, id string) (string, error) {
+	return s.shard(id).Retrieve(ctx, id)
+}
+
+// RetrieveAll merges the records of every shard
+func (s *Sharded) RetrieveAll(ctx context.Context) (map[string]string, error) {
+	all := map[string]string{}
+	for _, shard := range s.shards {
+		records, err := shard.Store.RetrieveAll(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading shard %s: %w", shard.Name, err)
+		}
+		for k, v := range records {
+			all[k] = v
+		}
+	}
+	return all, nil
+}
+
+// Scan scans every shard for a page, and merges them into the page of the whole store. A shard never holds more than
+// a page of the keys of the merged page, so the shards filter and page their keys themselves.
+func (s *Sharded) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	var records []Record
+	for _, shard := range s.shards {
+		page, err := Scan(ctx, shard.Store, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning shard %s: %w", shard.Name, err)
+		}
+		records = append(records, page.Records...)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if opts.Reverse {
+			return records[i].Key > records[j].Key
+		}
+		return records[i].Key < records[j].Key
+	})
+	return opts.page(records), nil
+}
+
+func (s *Sharded) Delete(ctx context.Context, id string) (bool, error) {
+	return s.shard(id).Delete(ctx, id)
+}
+
+func (s *Sharded) Patch(ctx context.Context, id string, token any) (bool, error) {
+	return s.shard(id).Patch(ctx, id, token)
+}
+
+// Batch applies ops as a single batch of their shard when they all live on the same one. A batch spanning shards is
+// applied op by op, and rolled back when one fails, as on stores that can't batch.
+func (s *Sharded) Batch(ctx context.Context, ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	owner := s.owner(ops[0].Key)
+	for _, op := range ops[1:] {
+		if s.owner(op.Key) != owner {
+			return batchEach(ctx, s, ops)
+		}
+	}
+	return Batch(ctx, s.shards[owner].Store, ops)
+}
+
+func (s *Sharded) Flush(ctx context.Context) (bool, error) {
+	for _, shard := range s.shards {
+		if b, err := shard.Store.Flush(ctx); err != nil || !b {
+			return false, fmt.Errorf("error flushing shard %s: %v", shard.Name, err)
+		}
+	}
+	return true, nil
+}
+
+// Watch merges the changes of every shard. It fails if one of them can't be watched.
+func (s *Sharded) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var streams []<-chan Event
+	for _, shard := range s.shards {
+		events, err := Watch(ctx, shard.Store, prefix)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("error watching shard %s: %w", shard.Name, err)
+		}
+		streams = append(streams, events)
+	}
+
+	merged := make(chan Event, DefaultWatchBuffer)
+	var wg sync.WaitGroup
+	for _, events := range streams {
+		wg.Add(1)
+		go func(events <-chan Event) {
+			defer wg.Done()
+			// a shard closing its stream closes the merged one, so the watcher resyncs instead of missing events
+			defer cancel()
+			for event := range events {
+				select {
+				case merged <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(events)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+// Stats describes every shard, and sums their records and bytes
+func (s *Sharded) Stats(ctx context.Context) (*StoreStats, error) {
+	st := &StoreStats{Driver: DriverSharded, Shards: make(map[string]*StoreStats, len(s.shards))}
+	for _, shard := range s.shards {
+		shardStats, err := Stats(ctx, shard.Store)
+		if err != nil {
+			return nil, fmt.Errorf("error reading shard %s: %w", shard.Name, err)
+		}
+		st.Records += shardStats.Records
+		st.Bytes += shardStats.Bytes
+		st.Shards[shard.Name] = shardStats
+	}
+	return st, nil
+}
+
+func (s *Sharded) Close(ctx context.Context) error {
+	var errs []error
+	for _, shard := range s.shards {
+		if err := shard.Store.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shard %s: %w", shard.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rebalance moves every key that isn't on the shard owning it to that shard, after shards were added to or removed
+// from the ring. The keys of the retired shards, removed from the ring, are all moved. Keys are copied before they
+// are deleted, so an interrupted run can be run again.
+func (s *Sharded) Rebalance(ctx context.Context, retired []Shard, opts RebalanceOptions) ([]*RebalanceReport, error) {
+	log := s.logger.Logger()
+
+	var reports []*RebalanceReport
+	sources := append(append([]Shard{}, s.shards...), retired...)
+	for i, source := range sources {
+		report := &RebalanceReport{Shard: source.Name, Retired: i >= len(s.shards)}
+		reports = append(reports, report)
+		records, err := source.Store.RetrieveAll(ctx)
+		if err != nil {
+			return reports, fmt.Errorf("error reading shard %s: %w", source.Name, err)
+		}
+		report.Keys = len(records)
+
+		for _, id := range sortedKeys(records) {
+			owner := s.owner(id)
+			if owner == i {
+				continue
+			}
+			report.Moved++
+			if opts.DryRun {
+				continue
+			}
+			if _, err = s.shards[owner].Store.Patch(ctx, id, records[id]); err != nil {
+				return reports, fmt.Errorf("error moving %s to shard %s: %w", id, s.shards[owner].Name, err)
+			}
+			if _, err = source.Store.Delete(ctx, id); err != nil {
+				return reports, fmt.Errorf("error deleting %s from shard %s: %w", id, source.Name, err)
+			}
+		}
+		log.Info().Msgf("moved %d of the %d keys of shard %s", report.Moved, report.Keys, source.Name)
+	}
+	return reports, nil
+}
+
+// hashKey places a key on the hash ring. FNV is mixed with the murmur3 finalizer, so keys differing only by their
+// last characters, like the points of a shard, still land far apart.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
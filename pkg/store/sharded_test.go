@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type ShardedTestSuite struct {
+	suite.Suite
+	shards []Shard
+	log    *vlog.Logger
+}
+
+func (suite *ShardedTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.shards = nil
+	for _, name := range []string{"a", "b", "c"} {
+		suite.shards = append(suite.shards, suite.shard(name))
+	}
+}
+
+func (suite *ShardedTestSuite) shard(name string) Shard {
+	return Shard{Name: name, Store: NewSyncMap(context.Background(), suite.log)}
+}
+
+// fill stores n keys through s, and returns them with their values
+func (suite *ShardedTestSuite) fill(s Store, n int) map[string]string {
+	records := map[string]string{}
+	for i := 0; i < n; i++ {
+		id, token := fmt.Sprintf("customer%03d/ssn", i), fmt.Sprintf("token%d", i)
+		suite.Require().NoError(s.Store(context.Background(), id, token))
+		records[id] = token
+	}
+	return records
+}
+
+func (suite *ShardedTestSuite) TestRouting() {
+	ctx := context.Background()
+	s, err := NewSharded(suite.shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	records := suite.fill(s, 300)
+
+	for _, shard := range suite.shards {
+		held, err := shard.Store.RetrieveAll(ctx)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Greaterf(len(held), 50, "expected keys spread evenly, but shard %s holds %d of 300", shard.Name, len(held))
+		for id := range held {
+			suite.Require().Equal(shard.Name, s.ShardOf(id), "expected %s on the shard owning it", id)
+		}
+	}
+
+	val, err := s.Retrieve(ctx, "customer042/ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token42", val)
+	all, err := s.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(records, all, "expected the records of every shard merged")
+}
+
+func (suite *ShardedTestSuite) TestScan() {
+	ctx := context.Background()
+	s, err := NewSharded(suite.shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	records := suite.fill(s, 100)
+
+	for _, reverse := range []bool{false, true} {
+		opts := ScanOptions{Match: "customer0[1-4]*/ssn", Limit: 7, Reverse: reverse}
+		want := scanRecords(records, ScanOptions{Match: opts.Match, Reverse: reverse}).Records
+		var got []Record
+		for {
+			page, err := s.Scan(ctx, opts)
+			suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+			got = append(got, page.Records...)
+			if len(page.Next) == 0 {
+				break
+			}
+			opts.After = page.Next
+		}
+		suite.Require().Equal(want, got, "expected the pages of the shards merged in order")
+	}
+}
+
+func (suite *ShardedTestSuite) TestRebalance() {
+	ctx := context.Background()
+	s, err := NewSharded(suite.shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	records := suite.fill(s, 400)
+
+	// adding a shard moves the keys it now owns, and only those
+	grown, err := NewSharded(append(suite.shards, suite.shard("d")), 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	reports, err := grown.Rebalance(ctx, nil, RebalanceOptions{DryRun: true})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	moved := 0
+	for _, report := range reports {
+		moved += report.Moved
+	}
+	suite.Require().Greater(moved, 0)
+	suite.Require().Less(moved, 200, "expected a new shard to take about a quarter of the keys")
+
+	_, err = grown.Rebalance(ctx, nil, RebalanceOptions{})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	for id, token := range records {
+		val, err := grown.Retrieve(ctx, id)
+		suite.Require().NoErrorf(err, "expected %s to be found after a rebalance, but got this %v\n", id, err)
+		suite.Require().Equal(token, val)
+	}
+
+	// retiring a shard drains it
+	shrunk, err := NewSharded([]Shard{grown.shards[0], grown.shards[2], grown.shards[3]}, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	reports, err = shrunk.Rebalance(ctx, []Shard{grown.shards[1]}, RebalanceOptions{})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(reports[3].Retired)
+	suite.Require().Equal(reports[3].Keys, reports[3].Moved, "expected every key of a retired shard moved")
+	held, _ := grown.shards[1].Store.RetrieveAll(ctx)
+	suite.Require().Empty(held)
+	all, err := shrunk.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(records, all)
+}
+
+func (suite *ShardedTestSuite) TestWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewSharded(suite.shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	events, err := s.Watch(ctx, "customer")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+
+	records := suite.fill(s, 10)
+	seen := map[string]bool{}
+	for len(seen) < len(records) {
+		select {
+		case event := <-events:
+			suite.Require().Equal(EventCreate, event.Type)
+			seen[event.Key] = true
+		case <-time.After(time.Second):
+			suite.FailNow("expected an event from every shard")
+		}
+	}
+}
+
+func (suite *ShardedTestSuite) TestOpenURL() {
+	ctx := context.Background()
+	s, err := OpenURL(ctx, "sharded:?shard=map://a&shard=map://b&vnodes=16", suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().IsType(&Sharded{}, s)
+	suite.Require().Equal([]string{"map:a", "map:b"}, []string{s.(*Sharded).shards[0].Name, s.(*Sharded).shards[1].Name})
+
+	_, err = OpenURL(ctx, "sharded:", suite.log)
+	suite.Require().Truef(errors.Is(err, ErrShardsEmpty), "expected a no shards error, but got %v\n", err)
+	_, err = OpenURL(ctx, "sharded:?shard=map:&shard=map:", suite.log)
+	suite.Require().Truef(errors.Is(err, ErrShardNameExists), "expected a duplicate name error, but got %v\n", err)
+}
+
+func (suite *ShardedTestSuite) TestInvalid() {
+	_, err := NewSharded(nil, 0, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrShardsEmpty), "expected a no shards error, but got %v\n", err)
+	_, err = NewSharded([]Shard{suite.shard("a"), suite.shard("a")}, 0, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrShardNameExists), "expected a duplicate name error, but got %v\n", err)
+}
+
+// TestShardedSuite tests spreading keys across shards with consistent hashing, and rebalancing them
+func TestShardedSuite(t *testing.T) {
+	suite.Run(t, new(ShardedTestSuite))
+}
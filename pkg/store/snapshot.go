@@ -0,0 +1,390 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/mitchellh/go-homedir"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSnapshotInterval is how often a map with a snapshot location is snapshotted while it changes, unless set
+	DefaultSnapshotInterval = time.Minute
+	// snapshotMagic starts every map snapshot, and names the version of its format
+	snapshotMagic = "VMAPSNP1"
+)
+
+var (
+	ErrMapConfigInvalid = errors.New("map config is invalid")
+	// labelSnapshotKey derives the key map snapshots are encrypted under from the store key
+	labelSnapshotKey = []byte("vault/store/snapshot")
+)
+
+// MapConfig configures a Map made by NewMap. The zero config makes a map like NewSyncMap: unbounded, and lost when the
+// process exits.
+type MapConfig struct {
+	// SnapshotLoc is the file the map is snapshotted to, periodically and on Close, and reloaded from on Connect.
+	// Empty keeps the map in memory only.
+	SnapshotLoc string
+	// SnapshotKey encrypts the snapshot. It must be StoreKeySize bytes long when SnapshotLoc is set.
+	SnapshotKey []byte
+	// SnapshotInterval is how often the map is snapshotted while it changes. Defaults to DefaultSnapshotInterval, and
+	// a negative interval only snapshots on Close.
+	SnapshotInterval time.Duration
+	// Truncate starts the map empty, ignoring the snapshot at SnapshotLoc
+	Truncate bool
+	// MaxEntries is the most entries the map keeps. Zero means no limit.
+	MaxEntries int
+	// MaxBytes is the most bytes of keys and values the map keeps. Zero means no limit.
+	MaxBytes int64
+}
+
+// limited tells whether the map evicts entries
+func (c MapConfig) limited() bool {
+	return c.MaxEntries > 0 || c.MaxBytes > 0
+}
+
+func init() {
+	Register(DriverMap, func(ctx context.Context, cfg Config) (Store, error) {
+		config, err := parseMapConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewMap(ctx, config, cfg.Logger)
+	})
+}
+
+// parseMapConfig parses the snapshot and memory settings of a map url
+func parseMapConfig(cfg Config) (MapConfig, error) {
+	config := MapConfig{Truncate: cfg.Truncate}
+	var err error
+	if raw := cfg.Options.Get(ParamSnapshotInterval); len(raw) > 0 {
+		if config.SnapshotInterval, err = time.ParseDuration(raw); err != nil {
+			return config, fmt.Errorf("%w: %s must be a duration", ErrURLInvalid, ParamSnapshotInterval)
+		}
+	}
+	if raw := cfg.Options.Get(ParamMaxEntries); len(raw) > 0 {
+		if config.MaxEntries, err = strconv.Atoi(raw); err != nil {
+			return config, fmt.Errorf("%w: %s must be a number", ErrURLInvalid, ParamMaxEntries)
+		}
+	}
+	if raw := cfg.Options.Get(ParamMaxBytes); len(raw) > 0 {
+		if config.MaxBytes, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return config, fmt.Errorf("%w: %s must be a number", ErrURLInvalid, ParamMaxBytes)
+		}
+	}
+
+	if config.SnapshotLoc, err = homedir.Expand(cfg.Options.Get(ParamSnapshot)); err != nil || len(config.SnapshotLoc) == 0 {
+		return config, err
+	}
+	keyLoc := config.SnapshotLoc + ".key"
+	if raw := cfg.Options.Get(ParamSnapshotKey); len(raw) > 0 {
+		if keyLoc, err = homedir.Expand(raw); err != nil {
+			return config, err
+		}
+	}
+	config.SnapshotKey, err = LoadStoreKey(keyLoc, cfg.Logger)
+	return config, err
+}
+
+// NewMap creates a map configured by config. A map with limits evicts its least recently used entries when it
+// outgrows them, for good, snapshot included: it suits a local cache tier in front of another store, not a store of
+// record.
+func NewMap(ctx context.Context, config MapConfig, logger *vlog.Logger) (*Map, error) {
+	if len(config.SnapshotLoc) > 0 && len(config.SnapshotKey) != StoreKeySize {
+		return nil, fmt.Errorf("%w: snapshot key: %w", ErrMapConfigInvalid, ErrStoreKeyInvalid)
+	}
+	if config.MaxEntries < 0 || config.MaxBytes < 0 {
+		return nil, fmt.Errorf("%w: limits can't be negative", ErrMapConfigInvalid)
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = DefaultSnapshotInterval
+	}
+
+	m := NewSyncMap(ctx, logger)
+	m.config = config
+	if config.limited() {
+		m.lru = newMapLRU()
+	}
+	return m, nil
+}
+
+// Snapshot writes the content of the map to its snapshot location, encrypted. It replaces the previous snapshot
+// atomically, so a crash while it runs leaves that one whole.
+func (m *Map) Snapshot(ctx context.Context) error {
+	log := m.logger.Logger()
+	if len(m.config.SnapshotLoc) == 0 {
+		return fmt.Errorf("%w: no snapshot location", ErrMapConfigInvalid)
+	}
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+
+	records, changes := m.snapshotRecords()
+	plain, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	sealed, err := m.sealSnapshot(plain)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(m.config.SnapshotLoc)
+	tmp, err := os.CreateTemp(dir, filepath.Base(m.config.SnapshotLoc)+".tmp*")
+	if err != nil {
+		log.Error().Msgf("error while creating snapshot in %s: %s\n", dir, err.Error())
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(sealed); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.config.SnapshotLoc)
+	}
+	if err != nil {
+		log.Error().Msgf("error while writing snapshot %s: %s\n", m.config.SnapshotLoc, err.Error())
+		return err
+	}
+
+	m.snapshotted, m.snapshotAt = changes, time.Now()
+	log.Debug().Msgf("snapshotted %d entries to %s", len(records), m.config.SnapshotLoc)
+	return nil
+}
+
+// snapshotRecords returns the entries of the map, from the least to the most recently used if it keeps that order,
+// with the count of changes they include
+func (m *Map) snapshotRecords() ([]Record, uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []string
+	if m.lru != nil {
+		keys = m.lru.keys()
+	} else {
+		m.index.scan("", "", false, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		if val, ok := m.scaffold.Load(key); ok {
+			records = append(records, Record{Key: key, Value: fmt.Sprint(val)})
+		}
+	}
+	return records, m.changes
+}
+
+// restore reloads the map from its snapshot, if there is one. Entries past the limits of the map are evicted, the
+// least recently used first.
+func (m *Map) restore(ctx context.Context) error {
+	log := m.logger.Logger()
+	sealed, err := os.ReadFile(m.config.SnapshotLoc)
+	if os.IsNotExist(err) {
+		log.Debug().Msgf("snapshot %s not found, starting empty", m.config.SnapshotLoc)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := m.openSnapshot(sealed)
+	if err != nil {
+		log.Error().Msgf("error while opening snapshot %s: %s\n", m.config.SnapshotLoc, err.Error())
+		return err
+	}
+	var records []Record
+	if err = json.Unmarshal(plain, &records); err != nil {
+		return fmt.Errorf("%w: snapshot %s: %s", ErrStoreCorrupted, m.config.SnapshotLoc, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range records {
+		m.scaffold.Store(r.Key, r.Value)
+		m.index.add(r.Key)
+		m.wrote(r.Key, r.Value)
+	}
+	m.evict()
+	m.snapshotted = m.changes
+	if info, err := os.Stat(m.config.SnapshotLoc); err == nil {
+		m.snapshotAt = info.ModTime()
+	}
+	log.Debug().Msgf("restored %d entries from %s", len(records), m.config.SnapshotLoc)
+	return nil
+}
+
+// snapshotLoop snapshots the map every interval while it changes, until ctx is done
+func (m *Map) snapshotLoop(ctx context.Context, interval time.Duration) {
+	defer close(m.snapshotsDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !m.dirty() {
+				continue
+			}
+			if err := m.Snapshot(ctx); err != nil {
+				m.logger.Logger().Error().Msgf("error while snapshotting map: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// dirty tells whether the map changed since it was last snapshotted
+func (m *Map) dirty() bool {
+	m.mu.RLock()
+	changes := m.changes
+	m.mu.RUnlock()
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+	return changes != m.snapshotted
+}
+
+// snapshotAEAD returns the cipher snapshots are sealed with
+func (m *Map) snapshotAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(m.config.SnapshotKey, labelSnapshotKey))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSnapshot encrypts plain under a random nonce, after the snapshot magic it authenticates
+func (m *Map) sealSnapshot(plain []byte) ([]byte, error) {
+	aead, err := m.snapshotAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(snapshotMagic), nonce...)
+	return aead.Seal(out, nonce, plain, []byte(snapshotMagic)), nil
+}
+
+// openSnapshot decrypts a snapshot sealed by sealSnapshot
+func (m *Map) openSnapshot(sealed []byte) ([]byte, error) {
+	aead, err := m.snapshotAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(sealed, []byte(snapshotMagic)) || len(sealed) < len(snapshotMagic)+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: snapshot %s isn't a map snapshot", ErrStoreCorrupted, m.config.SnapshotLoc)
+	}
+	sealed = sealed[len(snapshotMagic):]
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(snapshotMagic))
+	if err != nil {
+		return nil, fmt.Errorf("%w: snapshot %s", ErrStoreCorrupted, m.config.SnapshotLoc)
+	}
+	return plain, nil
+}
+
+// mapLRU orders the keys of a map from the most to the least recently used, and sums their sizes
+type mapLRU struct {
+	sync.Mutex
+	order *list.List
+	elems map[string]*list.Element
+	bytes int64
+}
+
+// lruEntry is a key of a mapLRU, with the bytes of its entry
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+func newMapLRU() *mapLRU {
+	return &mapLRU{order: list.New(), elems: map[string]*list.Element{}}
+}
+
+// put records that the entry of key was written with val
+func (l *mapLRU) put(key, val string) {
+	l.Lock()
+	defer l.Unlock()
+	size := int64(len(key) + len(val))
+	if el, ok := l.elems[key]; ok {
+		entry := el.Value.(*lruEntry)
+		l.bytes += size - entry.size
+		entry.size = size
+		l.order.MoveToFront(el)
+		return
+	}
+	l.elems[key] = l.order.PushFront(&lruEntry{key: key, size: size})
+	l.bytes += size
+}
+
+// touch records that the entry of key was read
+func (l *mapLRU) touch(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if el, ok := l.elems[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *mapLRU) remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if el, ok := l.elems[key]; ok {
+		l.bytes -= el.Value.(*lruEntry).size
+		l.order.Remove(el)
+		delete(l.elems, key)
+	}
+}
+
+func (l *mapLRU) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.order.Init()
+	l.elems = map[string]*list.Element{}
+	l.bytes = 0
+}
+
+// coldest returns the least recently used key, if it isn't the only one
+func (l *mapLRU) coldest() (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if l.order.Len() < 2 {
+		return "", false
+	}
+	return l.order.Back().Value.(*lruEntry).key, true
+}
+
+// over tells whether the entries outgrow the limits of config
+func (l *mapLRU) over(config MapConfig) bool {
+	l.Lock()
+	defer l.Unlock()
+	return (config.MaxEntries > 0 && l.order.Len() > config.MaxEntries) || (config.MaxBytes > 0 && l.bytes > config.MaxBytes)
+}
+
+// keys returns the keys from the least to the most recently used
+func (l *mapLRU) keys() []string {
+	l.Lock()
+	defer l.Unlock()
+	keys := make([]string, 0, l.order.Len())
+	for el := l.order.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(*lruEntry).key)
+	}
+	return keys
+}
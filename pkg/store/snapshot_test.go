@@ -0,0 +1,162 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type SnapshotTestSuite struct {
+	suite.Suite
+	loc string
+	key []byte
+	log *vlog.Logger
+}
+
+func (suite *SnapshotTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.loc = filepath.Join(suite.T().TempDir(), "map.snap")
+	var err error
+	suite.key, err = GenerateStoreKey()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+}
+
+// connected returns a connected map snapshotted to the suite location
+func (suite *SnapshotTestSuite) connected(config MapConfig) *Map {
+	config.SnapshotLoc, config.SnapshotKey = suite.loc, suite.key
+	m, err := NewMap(context.Background(), config, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := m.Connect(context.Background())
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	return m
+}
+
+func (suite *SnapshotTestSuite) TestRestore() {
+	ctx := context.Background()
+	m := suite.connected(MapConfig{SnapshotInterval: -1})
+	suite.Require().NoError(m.Store(ctx, "customer123/ssn", "token1"))
+	suite.Require().NoError(Batch(ctx, m, []Op{{Type: OpPatch, Key: "customer123/dob", Value: "token2"}}))
+	suite.Require().NoError(m.Close(ctx))
+
+	sealed, err := os.ReadFile(suite.loc)
+	suite.Require().NoErrorf(err, "expected the snapshot written on close, but got this %v\n", err)
+	suite.Require().False(bytes.Contains(sealed, []byte("customer123")), "expected the snapshot encrypted")
+
+	restored := suite.connected(MapConfig{})
+	all, err := restored.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123/ssn": "token1", "customer123/dob": "token2"}, all)
+	page, err := restored.Scan(ctx, ScanOptions{Prefix: "customer123/"})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Len(page.Records, 2, "expected the restored keys indexed")
+
+	truncated := suite.connected(MapConfig{Truncate: true})
+	all, _ = truncated.RetrieveAll(ctx)
+	suite.Require().Empty(all)
+}
+
+func (suite *SnapshotTestSuite) TestTampered() {
+	ctx := context.Background()
+	m := suite.connected(MapConfig{})
+	suite.Require().NoError(m.Store(ctx, "customer123/ssn", "token1"))
+	suite.Require().NoError(m.Close(ctx))
+
+	other, err := GenerateStoreKey()
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	wrongKey, err := NewMap(ctx, MapConfig{SnapshotLoc: suite.loc, SnapshotKey: other}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = wrongKey.Connect(ctx)
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected a corrupted store error, but got %v\n", err)
+
+	sealed, _ := os.ReadFile(suite.loc)
+	sealed[len(sealed)-1] ^= 1
+	suite.Require().NoError(os.WriteFile(suite.loc, sealed, 0600))
+	edited, err := NewMap(ctx, MapConfig{SnapshotLoc: suite.loc, SnapshotKey: suite.key}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = edited.Connect(ctx)
+	suite.Require().Truef(errors.Is(err, ErrStoreCorrupted), "expected a corrupted store error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestInterval() {
+	ctx := context.Background()
+	m := suite.connected(MapConfig{SnapshotInterval: 10 * time.Millisecond})
+	defer m.Close(ctx)
+	suite.Require().NoError(m.Store(ctx, "customer123/ssn", "token1"))
+
+	suite.Require().Eventually(func() bool {
+		_, err := os.Stat(suite.loc)
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "expected a periodic snapshot of the changed map")
+}
+
+func (suite *SnapshotTestSuite) TestEviction() {
+	ctx := context.Background()
+	m, err := NewMap(ctx, MapConfig{MaxEntries: 3}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(m.Store(ctx, fmt.Sprintf("customer%03d/ssn", i), "token"))
+	}
+	// reading the oldest entry keeps it warm, so the next one is evicted instead
+	_, err = m.Retrieve(ctx, "customer000/ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(m.Store(ctx, "customer003/ssn", "token"))
+	all, _ := m.RetrieveAll(ctx)
+	suite.Require().Len(all, 3)
+	suite.Require().NotContains(all, "customer001/ssn", "expected the least recently used entry evicted")
+	page, _ := m.Scan(ctx, ScanOptions{})
+	suite.Require().Len(page.Records, 3, "expected the evicted entry dropped from the index")
+
+	bounded, err := NewMap(ctx, MapConfig{MaxBytes: 45}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(bounded.Store(ctx, "customer000/ssn", "token1"))
+	suite.Require().NoError(bounded.Store(ctx, "customer001/ssn", "token2"))
+	suite.Require().NoError(bounded.Store(ctx, "customer002/ssn", "token3"))
+	all, _ = bounded.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"customer001/ssn": "token2", "customer002/ssn": "token3"}, all)
+
+	_, err = NewMap(ctx, MapConfig{MaxEntries: -1}, suite.log)
+	suite.Require().Truef(errors.Is(err, ErrMapConfigInvalid), "expected an invalid config error, but got %v\n", err)
+}
+
+func (suite *SnapshotTestSuite) TestEvictionRestore() {
+	ctx := context.Background()
+	m := suite.connected(MapConfig{MaxEntries: 3})
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(m.Store(ctx, fmt.Sprintf("customer%03d/ssn", i), "token"))
+	}
+	_, err := m.Retrieve(ctx, "customer000/ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NoError(m.Close(ctx))
+
+	// the snapshot keeps the order of use, so a smaller map keeps the most recently used entries
+	smaller := suite.connected(MapConfig{MaxEntries: 2})
+	all, _ := smaller.RetrieveAll(ctx)
+	suite.Require().Equal(map[string]string{"customer000/ssn": "token", "customer002/ssn": "token"}, all)
+}
+
+func (suite *SnapshotTestSuite) TestOpenURL() {
+	ctx := context.Background()
+	s, err := OpenURL(ctx, "map:?snapshot="+suite.loc+"&snapshot_interval=1h&max_entries=2", suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	m := s.(*Map)
+	suite.Require().Equal(2, m.config.MaxEntries)
+	suite.Require().Equal(time.Hour, m.config.SnapshotInterval)
+	_, err = os.Stat(suite.loc + ".key")
+	suite.Require().NoErrorf(err, "expected the snapshot key generated next to the snapshot, but got this %v\n", err)
+
+	_, err = OpenURL(ctx, "map:?max_bytes=lots", suite.log)
+	suite.Require().Truef(errors.Is(err, ErrURLInvalid), "expected an invalid url error, but got %v\n", err)
+}
+
+// TestSnapshotSuite tests snapshotting maps to disk, and evicting their least recently used entries
+func TestSnapshotSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotTestSuite))
+}
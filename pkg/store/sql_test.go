@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type SQLTestSuite struct {
+	suite.Suite
+	loc string
+	log *vlog.Logger
+}
+
+func (suite *SQLTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.loc = filepath.Join(suite.T().TempDir(), "vault.db")
+}
+
+// connected returns a SQL store connected to the suite SQLite database
+func (suite *SQLTestSuite) connected() *SQL {
+	s, err := OpenURL(context.Background(), "sqlite://"+suite.loc, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := s.Connect(context.Background())
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b, "expected true but got false")
+	return s.(*SQL)
+}
+
+func (suite *SQLTestSuite) TestStore() {
+	ctx := context.Background()
+	s := suite.connected()
+
+	suite.Require().NoError(s.Store(ctx, "customer123/ssn", "token1"))
+	err := s.Store(ctx, "customer123/ssn", "token2")
+	suite.Require().Truef(errors.Is(err, ErrKeyExists), "expected the unique constraint to fail the store, but got %v\n", err)
+	// keys are compared byte by byte
+	suite.Require().NoError(s.Store(ctx, "Customer123/ssn", "token3"))
+	suite.Require().NoError(s.Store(ctx, "customer123/ssn ", "token4"))
+
+	b, err := s.Patch(ctx, "customer123/ssn", "token5")
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err = s.Patch(ctx, "customer123/dob", "token6")
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected a patch to create a missing key, but got this %v\n", err)
+	val, err := s.Retrieve(ctx, "customer123/ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token5", val)
+
+	b, err = s.Delete(ctx, "customer123/ssn")
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = s.Retrieve(ctx, "customer123/ssn")
+	suite.Require().Truef(errors.Is(err, ErrNotFound), "expected a not found error, but got %v\n", err)
+
+	all, err := s.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"Customer123/ssn": "token3", "customer123/ssn ": "token4", "customer123/dob": "token6"}, all)
+	suite.Require().NoError(s.Close(ctx))
+
+	// reconnecting keeps the rows, and doesn't migrate again
+	s = suite.connected()
+	all, _ = s.RetrieveAll(ctx)
+	suite.Require().Len(all, 3)
+	b, err = s.Flush(ctx)
+	suite.Require().True(b)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	all, _ = s.RetrieveAll(ctx)
+	suite.Require().Empty(all)
+}
+
+func (suite *SQLTestSuite) TestConcurrentStore() {
+	ctx := context.Background()
+	s := suite.connected()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Store(ctx, "customer123/ssn", fmt.Sprintf("token%d", i))
+		}()
+	}
+	wg.Wait()
+	var stored int
+	for _, err := range errs {
+		if err == nil {
+			stored++
+			continue
+		}
+		suite.Require().Truef(errors.Is(err, ErrKeyExists), "expected a key exists error, but got %v\n", err)
+	}
+	suite.Require().Equal(1, stored, "expected a single concurrent store to create the key")
+}
+
+func (suite *SQLTestSuite) TestScan() {
+	ctx := context.Background()
+	s := suite.connected()
+	for _, key := range []string{"team/app/db/password", "team/app/db/user", "team/app/api", "team/application/db", "team/web/db/password", "other"} {
+		suite.Require().NoError(s.Store(ctx, key, "token:"+key))
+	}
+
+	page, err := s.Scan(ctx, ScanOptions{Prefix: "team/app", Limit: 2})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(&ScanPage{Records: []Record{{Key: "team/app/api", Value: "token:team/app/api"},
+		{Key: "team/app/db/password", Value: "token:team/app/db/password"}}, Next: "team/app/db/password"}, page)
+	page, err = Scan(ctx, s, ScanOptions{Prefix: "team/app", After: page.Next})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(&ScanPage{Records: []Record{{Key: "team/app/db/user", Value: "token:team/app/db/user"}}}, page)
+
+	page, err = s.Scan(ctx, ScanOptions{Match: "team/*/db/password", Reverse: true})
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal([]Record{{Key: "team/web/db/password", Value: "token:team/web/db/password"},
+		{Key: "team/app/db/password", Value: "token:team/app/db/password"}}, page.Records)
+}
+
+func (suite *SQLTestSuite) TestMigrate() {
+	ctx := context.Background()
+	s := suite.connected()
+	suite.Require().NoError(s.Close(ctx))
+
+	db, err := sql.Open("sqlite", suite.loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer db.Close()
+	var version int
+	suite.Require().NoError(db.QueryRow("SELECT version FROM " + DefaultSQLTable + sqlSchemaSuffix).Scan(&version))
+	suite.Require().Equal(len(sqlMigrations), version, "expected the schema version recorded")
+
+	// a table migrated by a newer vault is refused rather than written to
+	_, err = db.Exec("UPDATE "+DefaultSQLTable+sqlSchemaSuffix+" SET version = ?", len(sqlMigrations)+1)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	s, err = NewSQL(SQLConfig{Dialect: DriverSQLite, DSN: suite.loc}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = s.Connect(ctx)
+	suite.Require().Truef(errors.Is(err, ErrSQLSchemaNewer), "expected a newer schema error, but got %v\n", err)
+}
+
+func (suite *SQLTestSuite) TestParseURL() {
+	for _, tc := range []struct {
+		raw, dsn, table string
+	}{
+		{raw: "postgres://vault:secret@db:5432/vault?sslmode=disable&table=secrets&truncate=false",
+			dsn: "postgres://vault:secret@db:5432/vault?sslmode=disable", table: "secrets"},
+		{raw: "mysql://vault:secret@db:3306/vault?parseTime=true", dsn: "vault:secret@tcp(db:3306)/vault?parseTime=true"},
+		{raw: "sqlite://" + suite.loc + "?table=secrets", dsn: "file:" + suite.loc + "?_pragma=busy_timeout%285000%29", table: "secrets"},
+	} {
+		driver, cfg, err := ParseURL(tc.raw)
+		suite.Require().NoErrorf(err, "expected no errors parsing %s, but got this %v\n", tc.raw, err)
+		cfg.Logger = suite.log
+		config, err := parseSQLConfig(driver, cfg)
+		suite.Require().NoErrorf(err, "expected no errors parsing %s, but got this %v\n", tc.raw, err)
+		suite.Require().Equal(tc.dsn, config.DSN, tc.raw)
+		suite.Require().Equal(tc.table, config.Table, tc.raw)
+	}
+
+	_, err := OpenURL(context.Background(), "sqlite://"+suite.loc+"?table=vault-records", suite.log)
+	suite.Require().Truef(errors.Is(err, ErrSQLTableInvalid), "expected an invalid table error, but got %v\n", err)
+}
+
+// TestSQLSuite tests the SQL store against SQLite
+func TestSQLSuite(t *testing.T) {
+	suite.Run(t, new(SQLTestSuite))
+}
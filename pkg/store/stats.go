@@ -0,0 +1,112 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoreStats describes the records of a store, and the backend keeping them
+type StoreStats struct {
+	// Driver is the driver of the store, or empty for stores described from their records alone
+	Driver string `json:"driver,omitempty"`
+	// Records counts the records of the store, the ones the vault keeps for itself under ReservedPrefix included
+	Records int64 `json:"records"`
+	// Bytes is the size of the records on disk or in memory. Stores that can't tell count the bytes of their keys and
+	// values.
+	Bytes int64 `json:"bytes"`
+	// LastCompaction is when the backend last rewrote its records whole, reclaiming the space of the old ones. It is
+	// nil for backends that don't compact, or haven't yet.
+	LastCompaction *time.Time `json:"last_compaction,omitempty"`
+	// Pool describes the connections of stores talking to a server
+	Pool *PoolStats `json:"pool,omitempty"`
+	// Cache and Replication are the counters of the Cached and Replicated stores wrapping the backend
+	Cache       *CacheStats   `json:"cache,omitempty"`
+	Replication *ReplicaStats `json:"replication,omitempty"`
+	// Shards describes every shard of a Sharded store, by name
+	Shards map[string]*StoreStats `json:"shards,omitempty"`
+}
+
+// PoolStats describes the connection pool of a store
+type PoolStats struct {
+	// MaxOpen caps the connections open at once. Zero means no limit.
+	MaxOpen int `json:"max_open"`
+	Open    int `json:"open"`
+	Idle    int `json:"idle"`
+	InUse   int `json:"in_use"`
+	// Hits and Misses count the times a free connection was found in the pool, or a new one had to be opened
+	Hits   uint64 `json:"hits,omitempty"`
+	Misses uint64 `json:"misses,omitempty"`
+	// Timeouts counts the times no connection freed up in time
+	Timeouts uint64 `json:"timeouts,omitempty"`
+	// Waits counts the times a connection was waited for, and WaitTime sums how long
+	Waits    int64         `json:"waits,omitempty"`
+	WaitTime time.Duration `json:"wait_time,omitempty"`
+}
+
+// Statser is implemented by stores that can describe themselves without reading all of their records
+type Statser interface {
+	// Stats returns the statistics of the store
+	Stats(ctx context.Context) (*StoreStats, error)
+}
+
+// Stats returns the statistics of s. Stores that aren't Statsers are described from the records RetrieveAll returns.
+func Stats(ctx context.Context, s Store) (*StoreStats, error) {
+	if st, ok := s.(Statser); ok {
+		return st.Stats(ctx)
+	}
+	all, err := s.RetrieveAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return recordStats(all), nil
+}
+
+// recordStats counts records, and the bytes of their keys and values
+func recordStats(records map[string]string) *StoreStats {
+	st := &StoreStats{Records: int64(len(records))}
+	for k, v := range records {
+		st.Bytes += int64(len(k) + len(v))
+	}
+	return st
+}
+
+// fileStats describes the records of a store kept in the file at loc. Stores rewrite their file whole on every
+// write, so it was last compacted when it last changed.
+func fileStats(driver, loc string, records int) (*StoreStats, error) {
+	info, err := os.Stat(loc)
+	if err != nil {
+		return nil, err
+	}
+	modified := info.ModTime()
+	return &StoreStats{Driver: driver, Records: int64(records), Bytes: info.Size(), LastCompaction: &modified}, nil
+}
+
+// parseRedisInfo reads the fields of the reply to a redis INFO command
+func parseRedisInfo(info string) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// unixTime returns the time of a count of seconds since the epoch, or nil if secs isn't a positive count
+func unixTime(secs string) *time.Time {
+	n, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	t := time.Unix(n, 0)
+	return &t
+}
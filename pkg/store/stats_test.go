@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type StatsTestSuite struct {
+	suite.Suite
+	dir string
+	log *vlog.Logger
+}
+
+func (suite *StatsTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+	suite.dir = suite.T().TempDir()
+}
+
+// fill stores the records of varTableStoreMapRetrieve in s, and returns the bytes of their keys and values
+func (suite *StatsTestSuite) fill(s Store) int64 {
+	var bytes int64
+	for k, v := range varTableStoreMapRetrieve {
+		suite.Require().NoError(s.Store(context.Background(), k, v))
+		bytes += int64(len(k) + len(v))
+	}
+	return bytes
+}
+
+func (suite *StatsTestSuite) TestMap() {
+	ctx := context.Background()
+	m, err := NewMap(ctx, MapConfig{SnapshotLoc: filepath.Join(suite.dir, "map.snap"), SnapshotKey: make([]byte, StoreKeySize), SnapshotInterval: -1}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	_, err = m.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	bytes := suite.fill(m)
+
+	st, err := Stats(ctx, m)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(&StoreStats{Driver: DriverMap, Records: int64(len(varTableStoreMapRetrieve)), Bytes: bytes}, st)
+
+	// snapshots compact the map
+	suite.Require().NoError(m.Snapshot(ctx))
+	st, err = Stats(ctx, m)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().NotNil(st.LastCompaction, "expected the snapshot to be reported as the last compaction")
+	suite.Require().WithinDuration(time.Now(), *st.LastCompaction, time.Minute)
+}
+
+func (suite *StatsTestSuite) TestFile() {
+	ctx := context.Background()
+	loc := filepath.Join(suite.dir, ".store")
+	f := NewFile(loc, suite.log)
+	_, err := f.Connect(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer f.Close(ctx)
+	suite.fill(f)
+
+	g, err := NewGob(ctx, filepath.Join(suite.dir, ".gob"), suite.log, true)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	defer g.Close(ctx)
+	suite.fill(g)
+
+	for _, s := range []Store{f, g} {
+		st, err := Stats(ctx, s)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+		suite.Require().Equal(int64(len(varTableStoreMapRetrieve)), st.Records)
+		suite.Require().NotNil(st.LastCompaction, "expected the last write to be reported as the last compaction")
+	}
+	info, err := os.Stat(loc)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	st, err := f.Stats(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(info.Size(), st.Bytes, "expected the size of the file")
+}
+
+func (suite *StatsTestSuite) TestWrapped() {
+	ctx := context.Background()
+	shards := []Shard{
+		{Name: "a", Store: NewSyncMap(ctx, suite.log)},
+		{Name: "b", Store: NewSyncMap(ctx, suite.log)},
+	}
+	sharded, err := NewSharded(shards, 0, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	cached, err := NewCached(sharded, CacheConfig{Size: 16, TTL: time.Minute}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	bytes := suite.fill(cached)
+	for k := range varTableStoreMapRetrieve {
+		_, err = cached.Retrieve(ctx, k)
+		suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	}
+
+	st, err := Stats(ctx, cached)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(DriverSharded, st.Driver)
+	suite.Require().Equal(int64(len(varTableStoreMapRetrieve)), st.Records)
+	suite.Require().Equal(bytes, st.Bytes)
+	suite.Require().Equal(st.Records, st.Shards["a"].Records+st.Shards["b"].Records, "expected the records of the shards to add up")
+	suite.Require().NotNil(st.Cache, "expected the cache counters")
+	suite.Require().Equal(cached.CacheStats(), *st.Cache)
+
+	// views are described from their records
+	view := NewPrefixed(sharded, "ijbnijdelkfiue", 0, suite.log)
+	st, err = Stats(ctx, view)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Empty(st.Driver)
+	suite.Require().Equal(int64(len(varTableStoreMapRetrieve)), st.Records)
+	suite.Require().Nil(st.Shards)
+}
+
+func (suite *StatsTestSuite) TestRedisInfo() {
+	fields := parseRedisInfo("# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\n\r\n# Persistence\r\nrdb_last_save_time:1700000000\r\n")
+	suite.Require().Equal("1048576", fields["used_memory"])
+	suite.Require().Equal(time.Unix(1700000000, 0), *unixTime(fields["rdb_last_save_time"]))
+	suite.Require().Nil(unixTime(fields["aof_last_rewrite_time"]), "expected no time for a missing field")
+}
+
+// TestStatsSuite tests the statistics of stores
+func TestStatsSuite(t *testing.T) {
+	suite.Run(t, new(StatsTestSuite))
+}
@@ -1,6 +1,12 @@
 package store
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned, possibly wrapped, by Retrieve when no record exists for the requested id
+var ErrNotFound = errors.New("key doesn't exist")
 
 type Store interface {
 	Connect(ctx context.Context) (bool, error)
@@ -6,11 +6,30 @@ import (
 	"fmt"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"sync"
+	"time"
 )
 
 type Map struct {
 	scaffold *sync.Map
 	logger   *vlog.Logger
+	watchers *hub
+	// index keeps the keys of scaffold in order for Scan
+	index *keyIndex
+	// mu makes batches atomic: writes hold it exclusively, and reads shared, so no read sees a batch half applied
+	mu sync.RWMutex
+	// config holds the snapshot and memory settings of a map made by NewMap
+	config MapConfig
+	// lru orders the keys by use when the memory of the map is limited, and is nil otherwise
+	lru *mapLRU
+	// changes counts the writes to the map, and snapshotted the count its last snapshot includes, taken at snapshotAt
+	changes     uint64
+	snapshotted uint64
+	snapshotAt  time.Time
+	// snapMu serializes snapshots
+	snapMu sync.Mutex
+	// stopSnapshots stops the periodic snapshots started by Connect, which close snapshotsDone once stopped
+	stopSnapshots context.CancelFunc
+	snapshotsDone chan struct{}
 }
 
 //func NewSyncMap() *sync.Map {
@@ -19,22 +38,47 @@ type Map struct {
 
 func NewSyncMap(ctx context.Context, logger *vlog.Logger) *Map {
 	return &Map{
-		&sync.Map{},
-		logger,
+		scaffold: &sync.Map{},
+		logger:   logger,
+		watchers: newHub(),
+		index:    newKeyIndex(),
 	}
 }
 
+// Connect reloads a map with a snapshot location from its snapshot, and starts snapshotting it periodically
 func (m *Map) Connect(ctx context.Context) (bool, error) {
+	if len(m.config.SnapshotLoc) == 0 || m.stopSnapshots != nil {
+		return true, nil
+	}
+	if err := IsValidFile(m.config.SnapshotLoc, m.logger.Logger()); err != nil {
+		return false, err
+	}
+	if !m.config.Truncate {
+		if err := m.restore(ctx); err != nil {
+			return false, err
+		}
+	}
+	// snapshots outlive the context of Connect, until Close
+	var snapshotCtx context.Context
+	snapshotCtx, m.stopSnapshots = context.WithCancel(context.Background())
+	m.snapshotsDone = make(chan struct{})
+	if m.config.SnapshotInterval > 0 {
+		go m.snapshotLoop(snapshotCtx, m.config.SnapshotInterval)
+	} else {
+		close(m.snapshotsDone)
+	}
 	return true, nil
 }
 
 func (m *Map) Store(ctx context.Context, id string, token any) error {
 	log := m.logger.Logger()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// check if key exists
 	if m.IsExist(id) {
 		log.Error().Msgf("key %s already exists, aborting\n", id)
-		return fmt.Errorf("key %s already exists, aborting\n", id)
+		return fmt.Errorf("key %s: %w", id, ErrKeyExists)
 	}
 
 	// ensure that token underlying type is a string
@@ -47,23 +91,32 @@ func (m *Map) Store(ctx context.Context, id string, token any) error {
 
 	// now store key value pair
 	m.scaffold.Store(id, tokenStr)
+	m.index.add(id)
+	m.wrote(id, tokenStr)
+	m.evict()
 
 	// confirm that key value pair is correctly inserted
 	if _, ok := m.scaffold.Load(id); !ok {
 		log.Debug().Msgf("error occurred while confirming insertion")
 		return fmt.Errorf("error occurred while confirming insertion")
 	}
+	m.watchers.publish(EventCreate, id)
 	return nil
 }
 
 func (m *Map) Retrieve(ctx context.Context, id string) (string, error) {
 	log := m.logger.Logger()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	// first check if key already exists
 	val, ok := m.scaffold.Load(id)
 	if !ok {
 		log.Debug().Msgf("error occurred while retrieving value from store using key id: %s: key doesn't exist\n", id)
-		return "", fmt.Errorf("error occured while retrieving value from store using key id: %s: key doesn't exist\n", id)
+		return "", fmt.Errorf("error occured while retrieving value from store using key id: %s: %w\n", id, ErrNotFound)
+	}
+	if m.lru != nil {
+		m.lru.touch(id)
 	}
 
 	// ensyre that returned value is string
@@ -79,6 +132,8 @@ func (m *Map) Retrieve(ctx context.Context, id string) (string, error) {
 
 func (m *Map) RetrieveAll(ctx context.Context) (map[string]string, error) {
 	log := m.logger.Logger()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	// create a bucket for all the tokens
 	var allTokenMap = map[string]string{}
@@ -94,9 +149,12 @@ func (m *Map) RetrieveAll(ctx context.Context) (map[string]string, error) {
 
 func (m *Map) Delete(ctx context.Context, id string) (bool, error) {
 	log := m.logger.Logger()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// delete key from map
-	m.scaffold.Delete(id)
+	_, existed := m.scaffold.LoadAndDelete(id)
+	m.index.remove(id)
 
 	// check if key still exists
 	if m.IsExist(id) {
@@ -105,16 +163,24 @@ func (m *Map) Delete(ctx context.Context, id string) (bool, error) {
 	}
 
 	log.Debug().Msgf("successfully deleted key with id: %s\n", id)
+	if existed {
+		m.dropped(id)
+		m.watchers.publish(EventDelete, id)
+	}
 
 	return true, nil
 }
 
 func (m *Map) Patch(ctx context.Context, id string, token any) (bool, error) {
 	log := m.logger.Logger()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// check if key exists
+	event := EventCreate
 	if m.IsExist(id) {
 		log.Error().Msgf("key with id %v exists, patching", id)
+		event = EventUpdate
 	}
 
 	// ensyre that returned value passed in is string
@@ -127,26 +193,186 @@ func (m *Map) Patch(ctx context.Context, id string, token any) (bool, error) {
 
 	// patch key in map
 	m.scaffold.Store(id, tokenStr)
+	m.index.add(id)
+	m.wrote(id, tokenStr)
+	m.evict()
 	log.Debug().Msgf("successfully updated key with id: %s\n", id)
+	m.watchers.publish(event, id)
 
 	return true, nil
 }
 
 func (m *Map) Flush(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// simulate flushing by assigning a new instance of sync.Map to scaffold
+	flushed := m.scaffold
 	m.scaffold = &sync.Map{}
+	m.index.reset(nil)
+	m.changes++
+	if m.lru != nil {
+		m.lru.reset()
+	}
+
+	if m.watchers.active() {
+		flushed.Range(func(id, value interface{}) bool {
+			m.watchers.publish(EventDelete, fmt.Sprint(id))
+			return true
+		})
+	}
 
 	return true, nil
 }
 
+// Scan returns the page of records selected by opts, ranging over the ordered keys of the map instead of all of them
+func (m *Map) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []Record
+	m.index.scan(opts.literalPrefix(), opts.After, opts.Reverse, func(key string) bool {
+		if !opts.selects(key) {
+			return true
+		}
+		val, ok := m.scaffold.Load(key)
+		if !ok {
+			// deleted since the scan started
+			return true
+		}
+		records = append(records, Record{Key: key, Value: fmt.Sprint(val)})
+		// one record past the limit tells whether there is a next page
+		return opts.Limit <= 0 || len(records) <= opts.Limit
+	})
+	return opts.page(records), nil
+}
+
+// Batch applies ops atomically. They are all checked before any is applied, and no read sees them half applied.
+func (m *Map) Batch(ctx context.Context, ops []Op) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := checkOps(ops, func(key string) (string, bool) {
+		val, ok := m.scaffold.Load(key)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprint(val), true
+	}); err != nil {
+		return err
+	}
+
+	var events []Event
+	for _, op := range writes(ops) {
+		if op.Type == OpDelete {
+			if _, existed := m.scaffold.LoadAndDelete(op.Key); existed {
+				m.index.remove(op.Key)
+				m.dropped(op.Key)
+				events = append(events, Event{Type: EventDelete, Key: op.Key})
+			}
+			continue
+		}
+		event := EventCreate
+		if m.IsExist(op.Key) {
+			event = EventUpdate
+		}
+		m.scaffold.Store(op.Key, op.Value)
+		m.index.add(op.Key)
+		m.wrote(op.Key, op.Value)
+		events = append(events, Event{Type: event, Key: op.Key})
+	}
+	m.evict()
+
+	// watchers hear of the batch once it is whole
+	for _, event := range events {
+		m.watchers.publish(event.Type, event.Key)
+	}
+	return nil
+}
+
+// load replaces the content of the map with records, without notifying watchers
+func (m *Map) load(records map[string]string) {
+	for k, v := range records {
+		m.scaffold.Store(k, v)
+	}
+	m.index.reset(sortedKeys(records))
+}
+
+// Stats counts the entries of the map and the bytes of their keys and values. A map with a snapshot location was
+// last compacted when it was last snapshotted, as snapshots rewrite it whole.
+func (m *Map) Stats(ctx context.Context) (*StoreStats, error) {
+	st := &StoreStats{Driver: DriverMap}
+	m.mu.RLock()
+	m.scaffold.Range(func(key, val any) bool {
+		st.Records++
+		st.Bytes += int64(len(key.(string)) + len(fmt.Sprint(val)))
+		return true
+	})
+	m.mu.RUnlock()
+
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+	if !m.snapshotAt.IsZero() {
+		at := m.snapshotAt
+		st.LastCompaction = &at
+	}
+	return st, nil
+}
+
+// Watch streams the changes made to keys starting with prefix through this map, until ctx is done
+func (m *Map) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return m.watchers.subscribe(ctx, prefix), nil
+}
+
+// Close takes a last snapshot of a map with a snapshot location, then empties the map
 func (m *Map) Close(ctx context.Context) error {
+	if m.stopSnapshots != nil {
+		m.stopSnapshots()
+		<-m.snapshotsDone
+		m.stopSnapshots = nil
+		if err := m.Snapshot(ctx); err != nil {
+			return err
+		}
+	}
 	if b, err := m.Flush(ctx); !b || err != nil {
 		return err
 	}
 	return nil
 }
 
+// wrote records a write of val under key, with the write lock held
+func (m *Map) wrote(key, val string) {
+	m.changes++
+	if m.lru != nil {
+		m.lru.put(key, val)
+	}
+}
+
+// dropped records the deletion of key, with the write lock held
+func (m *Map) dropped(key string) {
+	m.changes++
+	if m.lru != nil {
+		m.lru.remove(key)
+	}
+}
+
+// evict drops the least recently used entries while the map outgrows its limits, with the write lock held. The most
+// recently used entry is kept even if it outgrows them alone.
+func (m *Map) evict() {
+	if m.lru == nil {
+		return
+	}
+	for m.lru.over(m.config) {
+		key, ok := m.lru.coldest()
+		if !ok {
+			return
+		}
+		m.scaffold.Delete(key)
+		m.index.remove(key)
+		m.lru.remove(key)
+		m.changes++
+		m.logger.Logger().Debug().Msgf("evicted %s from the map", key)
+	}
+}
+
 // IsExist checks whether a key exists in a sync map
 func (m *Map) IsExist(key string) bool {
 	_, ok := m.scaffold.Load(key)
@@ -37,7 +37,7 @@ func Redact(s string) string {
 
 // IsValidFile checks if a given file address is valid
 func IsValidFile(loc string, log *zerolog.Logger) error {
-	var abs string
+	var abs = loc
 	var err error
 	// some sanity check
 	if loc[0] != '/' {
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change an Event reports
+type EventType string
+
+const (
+	EventCreate EventType = "create"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+
+	// DefaultWatchBuffer is the number of events buffered for a watcher. A watcher that falls further behind is
+	// disconnected, so it can resync instead of silently missing events.
+	DefaultWatchBuffer = 64
+	// fileWatchDebounce coalesces the bursts of writes a single file store operation makes
+	fileWatchDebounce = 50 * time.Millisecond
+)
+
+var (
+	ErrWatchUnsupported = errors.New("store does not support watching for changes")
+)
+
+// Event reports a change to a key in a store. It never carries the stored value.
+type Event struct {
+	Type EventType `json:"type"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// Watcher is implemented by stores that can notify of changes to their keys
+type Watcher interface {
+	// Watch streams the changes to keys starting with prefix until ctx is done, and then closes the channel. The
+	// channel is closed early if the watcher falls behind or the underlying notification source fails.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+// Watch streams the changes to keys of s starting with prefix, if s supports watching
+func Watch(ctx context.Context, s Store, prefix string) (<-chan Event, error) {
+	w, ok := s.(Watcher)
+	if !ok {
+		return nil, ErrWatchUnsupported
+	}
+	return w.Watch(ctx, prefix)
+}
+
+// hub fans events out to in-process watchers
+type hub struct {
+	subs map[*subscriber]struct{}
+	sync.Mutex
+}
+
+type subscriber struct {
+	prefix string
+	events chan Event
+}
+
+func newHub() *hub {
+	return &hub{subs: map[*subscriber]struct{}{}}
+}
+
+// subscribe registers a watcher for keys starting with prefix, until ctx is done
+func (h *hub) subscribe(ctx context.Context, prefix string) <-chan Event {
+	sub := &subscriber{prefix: prefix, events: make(chan Event, DefaultWatchBuffer)}
+	h.Lock()
+	h.subs[sub] = struct{}{}
+	h.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.remove(sub)
+	}()
+	return sub.events
+}
+
+// active reports whether anyone is watching, so publishers can skip work nobody would see
+func (h *hub) active() bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subs) > 0
+}
+
+func (h *hub) publish(t EventType, key string) {
+	event := Event{Type: t, Key: key, Time: time.Now().UTC()}
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subs {
+		if !strings.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// the watcher fell behind
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+func (h *hub) remove(sub *subscriber) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// diffRecords returns the events that turn before into after, for keys starting with prefix, sorted by key
+func diffRecords(before, after map[string]string, prefix string) []Event {
+	now := time.Now().UTC()
+	events := []Event{}
+	for k, v := range after {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if old, ok := before[k]; !ok {
+			events = append(events, Event{Type: EventCreate, Key: k, Time: now})
+		} else if old != v {
+			events = append(events, Event{Type: EventUpdate, Key: k, Time: now})
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok && strings.HasPrefix(k, prefix) {
+			events = append(events, Event{Type: EventDelete, Key: k, Time: now})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Key < events[j].Key })
+	return events
+}
+
+// watchFile watches the file at loc, and diffs the records read by load whenever it changes. The parent directory
+// is watched rather than the file, so changes are still seen when the file is replaced.
+func watchFile(ctx context.Context, loc, prefix string, load func() (map[string]string, error), logger *vlog.Logger) (<-chan Event, error) {
+	log := logger.Logger()
+
+	abs, err := filepath.Abs(loc)
+	if err != nil {
+		return nil, err
+	}
+	before, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = fw.Add(filepath.Dir(abs)); err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	events := make(chan Event, DefaultWatchBuffer)
+	go func() {
+		defer close(events)
+		defer fw.Close()
+
+		debounce := time.NewTimer(fileWatchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case fe, ok := <-fw.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(fe.Name) == abs {
+					debounce.Reset(fileWatchDebounce)
+				}
+			case err, ok := <-fw.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Msgf("error while watching %s: %s\n", loc, err.Error())
+				return
+			case <-debounce.C:
+				after, err := load()
+				if err != nil {
+					// most likely a read in the middle of a write. the end of the write triggers another read
+					log.Debug().Msgf("error while reading %s after a change: %s\n", loc, err.Error())
+					continue
+				}
+				for _, event := range diffRecords(before, after, prefix) {
+					select {
+					case events <- event:
+					default:
+						log.Error().Msgf("watcher on %s fell behind, disconnecting it", loc)
+						return
+					}
+				}
+				before = after
+			}
+		}
+	}()
+	return events, nil
+}
+
+// readFileRecords reads the file at loc with read, treating a missing or empty file as an empty store
+func readFileRecords(loc string, read func(content []byte) (map[string]string, error)) (map[string]string, error) {
+	content, err := os.ReadFile(loc)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(content) == 0) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return read(content)
+}
+
+// forward relays the events of in that fn keeps, as rewritten by fn, until in is closed or ctx is done
+func forward(ctx context.Context, in <-chan Event, fn func(Event) (Event, bool)) <-chan Event {
+	out := make(chan Event, DefaultWatchBuffer)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-in:
+				if !ok {
+					return
+				}
+				if event, ok = fn(event); !ok {
+					continue
+				}
+				select {
+				case out <- event:
+				default:
+					// the watcher fell behind
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// every backend and decorator can be watched
+var (
+	_ Watcher = (*Map)(nil)
+	_ Watcher = (*File)(nil)
+	_ Watcher = (*Gob)(nil)
+	_ Watcher = (*Redis)(nil)
+	_ Watcher = (*Encrypted)(nil)
+	_ Watcher = (*Cached)(nil)
+)
+
+// unwatched hides every method of the store it embeds but those of Store
+type unwatched struct{ storeOnly }
+
+type storeOnly = Store
+
+type WatchTestSuite struct {
+	suite.Suite
+	log *vlog.Logger
+}
+
+func (suite *WatchTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+}
+
+func (suite *WatchTestSuite) TestMap() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewSyncMap(ctx, suite.log)
+	events, err := m.Watch(ctx, "customer123__")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(m.Store(ctx, "customer123__ssn", "token1"))
+	suite.Require().NoError(m.Store(ctx, "customer456__ssn", "token2"))
+	_, err = m.Patch(ctx, "customer123__ssn", "token3")
+	suite.Require().NoError(err)
+	_, err = m.Delete(ctx, "customer123__ssn")
+	suite.Require().NoError(err)
+
+	suite.expect(events, EventCreate, "customer123__ssn")
+	suite.expect(events, EventUpdate, "customer123__ssn")
+	suite.expect(events, EventDelete, "customer123__ssn")
+
+	cancel()
+	suite.Eventually(func() bool {
+		_, ok := <-events
+		return !ok
+	}, time.Second, 10*time.Millisecond, "expected events to be closed once the context is done")
+}
+
+func (suite *WatchTestSuite) TestFile() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loc := filepath.Join(suite.T().TempDir(), ".store")
+
+	writer := NewFile(loc, suite.log)
+	_, err := writer.Connect(ctx)
+	suite.Require().NoError(err)
+	defer writer.Close(ctx)
+
+	// a separate instance stands in for another process watching the same file
+	events, err := NewFile(loc, suite.log).Watch(ctx, "")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(writer.Store(ctx, "customer123__ssn", "token1"))
+	suite.expect(events, EventCreate, "customer123__ssn")
+	_, err = writer.Patch(ctx, "customer123__ssn", "token2")
+	suite.Require().NoError(err)
+	suite.expect(events, EventUpdate, "customer123__ssn")
+}
+
+func (suite *WatchTestSuite) TestDecorators() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key, err := GenerateStoreKey()
+	suite.Require().NoError(err)
+
+	inner := &countingStore{Map: NewSyncMap(ctx, suite.log)}
+	encrypted, err := NewEncrypted(inner, key, suite.log)
+	suite.Require().NoError(err)
+	cached, err := NewCached(encrypted, CacheConfig{Size: 16, TTL: time.Minute}, suite.log)
+	suite.Require().NoError(err)
+
+	events, err := Watch(ctx, cached, "customer123__")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(cached.Store(ctx, "customer456__ssn", "token1"))
+	suite.Require().NoError(cached.Store(ctx, "customer123__ssn", "token1"))
+	suite.expect(events, EventCreate, "customer123__ssn")
+
+	// a change made beneath the cache invalidates the cached entry
+	_, err = encrypted.Patch(ctx, "customer123__ssn", "token2")
+	suite.Require().NoError(err)
+	suite.expect(events, EventUpdate, "customer123__ssn")
+	val, err := cached.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoError(err)
+	suite.Require().Equal("token2", val)
+
+	_, err = Watch(ctx, unwatched{inner}, "")
+	suite.Require().Truef(errors.Is(err, ErrWatchUnsupported), "expected unsupported error, but got %v\n", err)
+}
+
+func (suite *WatchTestSuite) expect(events <-chan Event, t EventType, key string) {
+	select {
+	case event, ok := <-events:
+		suite.Require().True(ok, "expected events to still be open")
+		suite.Require().Equal(t, event.Type)
+		suite.Require().Equal(key, event.Key)
+	case <-time.After(2 * time.Second):
+		suite.FailNowf("timed out", "waiting for %s event on %s", t, key)
+	}
+}
+
+func (suite *WatchTestSuite) TearDownTest() {}
+
+// TestWatchSuite tests change notifications of stores and store decorators
+func TestWatchSuite(t *testing.T) {
+	suite.Run(t, new(WatchTestSuite))
+}
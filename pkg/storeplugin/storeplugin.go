@@ -0,0 +1,143 @@
+// Package storeplugin serves a store.Store to the vault as an external storage plugin, so the vault can be backed by
+// a datastore it doesn't ship a driver for.
+//
+// A plugin is an executable whose main hands its store to Serve:
+//
+//	func main() {
+//		if err := storeplugin.Serve(mystore.New()); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+//
+// and is selected with a plugin store url, as in `vault init --store plugin:///usr/local/bin/vault-mystore`. The vault
+// launches the executable, shakes hands with it, health checks it and restarts it when it exits. Stdout carries the
+// plugin protocol, so importing this package redirects os.Stdout to os.Stderr, which the vault logs.
+package storeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	ErrNotLaunched = errors.New("store plugins are launched by the vault, with a plugin store url")
+)
+
+// stdout carries the plugin protocol. Anything else printed goes to stderr.
+var stdout = os.Stdout
+
+func init() {
+	os.Stdout = os.Stderr
+}
+
+// Serve serves s to the vault that launched this executable, until the vault closes the connection
+func Serve(s store.Store) error {
+	if os.Getenv(store.PluginCookieEnv) != store.PluginCookie {
+		return ErrNotLaunched
+	}
+
+	sock := os.Getenv(store.PluginSocketEnv)
+	if len(sock) == 0 {
+		return ServeConn(context.Background(), s, os.Stdin, stdout)
+	}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return ServeConn(context.Background(), s, conn, conn)
+}
+
+// ServeConn serves s over the plugin protocol, reading requests from r and writing responses to w, until r ends or the
+// vault closes the store. Requests are handled concurrently.
+func ServeConn(ctx context.Context, s store.Store, r io.Reader, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var req store.PluginRequest
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("error decoding plugin request: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := handle(ctx, s, req)
+			wmu.Lock()
+			defer wmu.Unlock()
+			if err := enc.Encode(resp); err != nil {
+				cancel()
+			}
+		}()
+		if req.Method == store.PluginClose {
+			return nil
+		}
+	}
+}
+
+// handle calls the method of s requested by req
+func handle(ctx context.Context, s store.Store, req store.PluginRequest) *store.PluginResponse {
+	resp := &store.PluginResponse{ID: req.ID}
+	var err error
+	switch req.Method {
+	case store.PluginHandshake:
+		if req.Version != store.PluginProtocolVersion {
+			err = fmt.Errorf("plugin speaks version %d, vault speaks version %d", store.PluginProtocolVersion, req.Version)
+		}
+		resp.Version = store.PluginProtocolVersion
+	case store.PluginHealth:
+		resp.OK = true
+	case store.PluginConnect:
+		resp.OK, err = s.Connect(ctx)
+	case store.PluginStore:
+		if err = s.Store(ctx, req.Key, req.Value); err == nil {
+			resp.OK = true
+		}
+	case store.PluginRetrieve:
+		resp.Value, err = s.Retrieve(ctx, req.Key)
+	case store.PluginRetrieveAll:
+		resp.Records, err = s.RetrieveAll(ctx)
+	case store.PluginDelete:
+		resp.OK, err = s.Delete(ctx, req.Key)
+	case store.PluginPatch:
+		resp.OK, err = s.Patch(ctx, req.Key, req.Value)
+	case store.PluginFlush:
+		resp.OK, err = s.Flush(ctx)
+	case store.PluginClose:
+		if err = s.Close(ctx); err == nil {
+			resp.OK = true
+		}
+	default:
+		err = fmt.Errorf("unknown plugin method %q", req.Method)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+		if errors.Is(err, store.ErrNotFound) {
+			resp.Code = store.PluginCodeNotFound
+		}
+	}
+	return resp
+}
@@ -0,0 +1,122 @@
+package storeplugin
+
+import (
+	"context"
+	"errors"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"testing"
+	"time"
+)
+
+// crashKey makes the test plugin exit as if it crashed
+const crashKey = "crash"
+
+// crashing is a store that exits the process when crashKey is stored
+type crashing struct {
+	*store.Map
+}
+
+func (c crashing) Store(ctx context.Context, id string, token any) error {
+	if id == crashKey {
+		os.Exit(3)
+	}
+	return c.Map.Store(ctx, id, token)
+}
+
+// TestMain runs the test binary as the plugin when the vault launches it
+func TestMain(m *testing.M) {
+	if os.Getenv(store.PluginCookieEnv) == store.PluginCookie {
+		if err := Serve(crashing{store.NewSyncMap(context.Background(), vlog.New(false))}); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type PluginTestSuite struct {
+	suite.Suite
+	log *vlog.Logger
+}
+
+func (suite *PluginTestSuite) SetupTest() {
+	suite.log = vlog.New(true)
+}
+
+func (suite *PluginTestSuite) plugin(socket bool) *store.Plugin {
+	p, err := store.NewPlugin(store.PluginConfig{Path: os.Args[0], Socket: socket, HealthInterval: 50 * time.Millisecond}, suite.log)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	b, err := p.Connect(context.Background())
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b)
+	return p
+}
+
+func (suite *PluginTestSuite) crud(p *store.Plugin) {
+	ctx := context.Background()
+	suite.Require().NoError(p.Store(ctx, "customer123__ssn", "token1"))
+	suite.Require().Error(p.Store(ctx, "customer123__ssn", "token2"), "expected storing an existing key to fail")
+
+	val, err := p.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token1", val)
+	_, err = p.Retrieve(ctx, "customer123__dob")
+	suite.Require().Truef(errors.Is(err, store.ErrNotFound), "expected a not found error, but got %v\n", err)
+
+	b, err := p.Patch(ctx, "customer123__ssn", "token2")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b)
+	all, err := p.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal(map[string]string{"customer123__ssn": "token2"}, all)
+
+	b, err = p.Delete(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().True(b)
+	all, err = p.RetrieveAll(ctx)
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Empty(all)
+}
+
+func (suite *PluginTestSuite) TestStdio() {
+	p := suite.plugin(false)
+	suite.crud(p)
+	suite.Require().NoError(p.Close(context.Background()))
+	_, err := p.Retrieve(context.Background(), "customer123__ssn")
+	suite.Require().Truef(errors.Is(err, store.ErrPluginClosed), "expected a closed plugin error, but got %v\n", err)
+}
+
+func (suite *PluginTestSuite) TestSocket() {
+	p := suite.plugin(true)
+	suite.crud(p)
+	suite.Require().NoError(p.Close(context.Background()))
+}
+
+func (suite *PluginTestSuite) TestRestart() {
+	ctx := context.Background()
+	p := suite.plugin(false)
+	defer p.Close(ctx)
+
+	err := p.Store(ctx, crashKey, "token1")
+	suite.Require().Truef(errors.Is(err, store.ErrPluginUnavailable), "expected the crashed call to fail, but got %v\n", err)
+
+	// the health check restarts the plugin in the background
+	suite.Require().Eventually(func() bool { return p.Restarts() == 1 }, 5*time.Second, 10*time.Millisecond)
+	suite.Require().NoError(p.Store(ctx, "customer123__ssn", "token1"))
+	val, err := p.Retrieve(ctx, "customer123__ssn")
+	suite.Require().NoErrorf(err, "expected no errors, but got this %v\n", err)
+	suite.Require().Equal("token1", val)
+}
+
+func (suite *PluginTestSuite) TestNotLaunched() {
+	err := Serve(store.NewSyncMap(context.Background(), suite.log))
+	suite.Require().Truef(errors.Is(err, ErrNotLaunched), "expected serving outside the vault to fail, but got %v\n", err)
+}
+
+// TestPluginSuite tests a store served by a plugin process, over stdio and a unix socket
+func TestPluginSuite(t *testing.T) {
+	suite.Run(t, new(PluginTestSuite))
+}
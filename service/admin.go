@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/snapshot"
+	"net/http"
+	"strconv"
+)
+
+var (
+	AdminBackup  = "/admin/backup"
+	AdminRestore = "/admin/restore"
+)
+
+var (
+	HeaderBackupPassphrase = "X-Vault-Backup-Passphrase"
+	HeaderBackupRecipient  = "X-Vault-Backup-Recipient"
+	HeaderBackupIdentity   = "X-Vault-Backup-Identity"
+	ParamReplace           = "replace"
+	ParamAcceptTampered    = "accept_tampered"
+)
+
+var (
+	ErrBackupKeyMissing  = errors.New("one of the headers " + HeaderBackupPassphrase + " or " + HeaderBackupRecipient + " must be set")
+	ErrRestoreKeyMissing = errors.New("one of the headers " + HeaderBackupPassphrase + " or " + HeaderBackupIdentity + " must be set")
+)
+
+// BackupHandlerFunc streams an encrypted snapshot of the whole vault back to the caller
+func BackupHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", AdminBackup))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodPost {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		keyer, err := backupKeyer(r)
+		if err != nil {
+			writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+
+		// buffer the snapshot, so a failure can still be reported as json
+		var buf bytes.Buffer
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		manifest, err := manager.Backup(ctx, &buf, keyer, srv.storeStr)
+		if err != nil {
+			writeNamespaceError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"vault-%d%s\"", manifest.CreatedAt.Unix(), snapshot.Extension))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	}
+}
+
+// RestoreHandlerFunc restores the encrypted snapshot in the request body into the store of the service
+func RestoreHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", AdminRestore))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodPost {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+
+		keyer, err := restoreKeyer(r)
+		if err != nil {
+			writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+
+		var opts tokenize.RestoreOptions
+		if replace := r.URL.Query().Get(ParamReplace); len(replace) > 0 {
+			if opts.Replace, err = strconv.ParseBool(replace); err != nil {
+				writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s: %s", ErrInvalidRequestParameter, ParamReplace))
+				return
+			}
+		}
+		if accept := r.URL.Query().Get(ParamAcceptTampered); len(accept) > 0 {
+			if opts.AcceptTampered, err = strconv.ParseBool(accept); err != nil {
+				writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s: %s", ErrInvalidRequestParameter, ParamAcceptTampered))
+				return
+			}
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		report, err := manager.Restore(ctx, r.Body, keyer, opts)
+		if err != nil {
+			status, code := http.StatusInternalServerError, CodeInternalServerError
+			if errors.Is(err, snapshot.ErrNotSnapshot) || errors.Is(err, snapshot.ErrDecrypt) || errors.Is(err, snapshot.ErrChecksum) ||
+				errors.Is(err, snapshot.ErrModeMismatch) || errors.Is(err, snapshot.ErrWrongIdentity) {
+				status, code = http.StatusBadRequest, CodeInvalidRequest
+			} else if errors.Is(err, tokenize.ErrNamespaceScoped) {
+				status, code = http.StatusBadRequest, CodeInvalidRequest
+			} else if errors.Is(err, tokenize.ErrRestoreKeyringConflict) || errors.Is(err, tokenize.ErrRestoreTampered) {
+				status, code = http.StatusConflict, CodeInvalidRequest
+			}
+			writeError(w, &resp, status, code, err.Error())
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+
+		resp.Resp = report
+		resp.Code = CodeSuccess
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// backupKeyer resolves the key a backup is sealed with from the request headers
+func backupKeyer(r *http.Request) (snapshot.Keyer, error) {
+	if passphrase := r.Header.Get(HeaderBackupPassphrase); len(passphrase) > 0 {
+		return snapshot.Passphrase(passphrase), nil
+	}
+	if recipient := r.Header.Get(HeaderBackupRecipient); len(recipient) > 0 {
+		return snapshot.ParseRecipient(recipient)
+	}
+	return nil, ErrBackupKeyMissing
+}
+
+// restoreKeyer resolves the key a snapshot is opened with from the request headers
+func restoreKeyer(r *http.Request) (snapshot.Keyer, error) {
+	if passphrase := r.Header.Get(HeaderBackupPassphrase); len(passphrase) > 0 {
+		return snapshot.Passphrase(passphrase), nil
+	}
+	if identity := r.Header.Get(HeaderBackupIdentity); len(identity) > 0 {
+		return snapshot.ParseIdentity(identity)
+	}
+	return nil, ErrRestoreKeyMissing
+}
+
+// writeError writes a json error response with the given status
+func writeError(w http.ResponseWriter, resp *model.Response, status, code int, msg string) {
+	resp.Error = append(resp.Error, msg)
+	resp.Code = code
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -3,10 +3,13 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dark-enstein/vault/internal/model"
 	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/store"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -16,13 +19,38 @@ const (
 	CodeInvalidRequest
 	CodeMethodNotAllowed
 	CodeRequestTimeout
+	// CodePartialFailure answers a partial multi-key request some keys of which failed
+	CodePartialFailure
+	// CodePreconditionFailed answers a conditional request on a secret that isn't at the revision it expects
+	CodePreconditionFailed
+	// CodeConflict answers a request on secrets that kept being changed concurrently while it was applied
+	CodeConflict
 )
 
 var (
-	KeyDelimiter = tokenize.KeyDelimiter
-	ParamVarID   = "id"
+	KeyDelimiter   = tokenize.KeyDelimiter
+	ParamVarID     = "id"
+	ParamMatch     = "match"
+	ParamLabel     = "label"
+	ParamSort      = "sort"
+	ParamLimit     = "limit"
+	ParamPageToken = "page_token"
+	// ParamPartial opts a multi-key request out of atomicity: the keys that can be written are, and the others fail
+	ParamPartial = "partial"
 )
 
+// HeaderIdentity names who a request is made by, which is recorded in the metadata of the secrets it changes
+const HeaderIdentity = "X-Vault-Identity"
+
+// requestContext returns the context the store calls of a request are made with, carrying its HeaderIdentity
+func requestContext(r *http.Request) context.Context {
+	ctx := context.Background()
+	if identity := r.Header.Get(HeaderIdentity); len(identity) > 0 {
+		ctx = tokenize.ContextWithIdentity(ctx, identity)
+	}
+	return ctx
+}
+
 var (
 	Tokenize      = "/tokenize"
 	Detokenize    = "/detokenize"
@@ -50,6 +78,20 @@ func NewVaultHandler(ctx context.Context, srv *Service) *VaultHandler {
 	vh[GetTokensByID] = GetTokenByIDParamHandler(srv)
 	vh[DeleteToken] = DeleteTokenByIDParamHandler(srv)
 	vh[PatchToken] = PatchTokenByIDParamHandler(srv)
+	vh[AdminBackup] = BackupHandlerFunc(srv)
+	vh[AdminRestore] = RestoreHandlerFunc(srv)
+	vh[Watch] = WatchHandlerFunc(srv)
+	vh[Undelete] = UndeleteHandlerFunc(srv)
+	vh[Trash] = TrashHandlerFunc(srv)
+	vh[Purge] = PurgeHandlerFunc(srv)
+	vh[NamespacePath] = NamespaceRouterFunc(srv)
+	vh[AdminNamespaces] = NamespacesHandlerFunc(srv)
+	vh[AdminNamespaces+"/"] = NamespaceHandlerFunc(srv)
+	vh[RaftStatus] = RaftStatusHandlerFunc(srv)
+	vh[RaftJoin] = RaftJoinHandlerFunc(srv)
+	vh[RaftRemove] = RaftRemoveHandlerFunc(srv)
+	vh[AdminVerify] = VerifyHandlerFunc(srv)
+	vh[SysStats] = StatsHandlerFunc(srv)
 	//vh[Introduction] = newVaultHandleFunc
 	return &vh
 }
@@ -67,7 +109,7 @@ func GetTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *http.
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Detokenize))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var err error
 
@@ -87,7 +129,12 @@ func GetTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *http.
 		w.Header().Set("Content-Type", "application/json")
 		query := r.URL.Query().Get(IDQueryKey)
 
-		token, err := srv.manager.GetTokenByID(ctx, query)
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		token, err := manager.GetTokenByID(ctx, query)
 		if err != nil {
 			resp.Error = append(resp.Error, err.Error())
 			log.Logger().Error().Msg(err.Error())
@@ -98,6 +145,9 @@ func GetTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *http.
 			return
 		}
 
+		if len(token.Data) == 1 && token.Data[0].Metadata != nil {
+			setETag(w, token.Data[0].Metadata.Revision)
+		}
 		resp.Resp = &model.TokenizeResponse{
 			ID:   token.ID,
 			Data: token.Data,
@@ -116,7 +166,7 @@ func DeleteTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *ht
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Detokenize))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var err error
 
@@ -134,27 +184,34 @@ func DeleteTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *ht
 		//reqCtx := context.Background()
 
 		w.Header().Set("Content-Type", "application/json")
-		query := r.URL.Query().Get(IDQueryKey)
-
-		b, err := srv.manager.DeleteTokenByID(ctx, query)
-		if err != nil || !b {
-			resp.Error = append(resp.Error, err.Error())
-			log.Logger().Error().Msg(err.Error())
-			resp.Code = CodeInternalServerError
-			// return 400 status codes
-			w.WriteHeader(http.StatusInternalServerError)
+		// the id may be repeated to delete several tokens at once
+		ids := r.URL.Query()[IDQueryKey]
+		if len(ids) == 0 {
+			resp.Error = append(resp.Error, fmt.Sprintf(ErrParameterizedVariableNotPassedF, IDQueryKey))
+			log.Logger().Error().Msg(resp.Error[0])
+			resp.Code = CodeInvalidRequest
+			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
-		resp.Resp = &model.TokenizeResponse{}
-		resp.Error = nil
-		resp.Code = CodeSuccess
+		opts, ok := conditionalBatchOptions(w, srv, r, &resp, len(ids))
+		if !ok {
+			return
+		}
 
-		// set header and return
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(resp)
-		return
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		// all tokens are deleted, or none unless the request is partial
+		token := &model.Tokenize{}
+		for _, id := range ids {
+			token.Data = append(token.Data, model.Child{Key: id})
+		}
+		results, err := manager.DeleteMany(ctx, ids, hardDelete(r), opts)
+		writeBatchResponse(w, srv, &resp, token, results, err)
 	}
 }
 
@@ -162,7 +219,7 @@ func PatchTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *htt
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Detokenize))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var token model.Tokenize
 		var err error
@@ -192,11 +249,11 @@ func PatchTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *htt
 			return
 		}
 
-		var tokenStr string
-		var children []model.Child
-
 		// tokenize logic
-		manager := srv.manager
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
 
 		// ensure user request parameter is correct and valid
 		validationResp, ok := manager.Validate(ctx, &token, true)
@@ -215,37 +272,14 @@ func PatchTokenByIDParamHandler(srv *Service) func(w http.ResponseWriter, r *htt
 
 		w.Header().Set("Content-Type", "application/json")
 
-		// user request valid, not proceed to process
-		parentKey := token.ID
-		for i := 0; i < len(token.Data); i++ {
-			childKey := token.Data[i].Key
-			combinedKeyName := tokenize.GetCombinedKey(parentKey, childKey)
-			tokenStr, err = manager.PatchTokenByID(ctx, combinedKeyName, token.Data[i].Value)
-			if err != nil {
-				resp.Error = append(resp.Error, fmt.Sprintf("error with key %s.%s: %s", parentKey, childKey, err.Error()))
-				log.Logger().Error().Msg(fmt.Sprintf("error with key %s.%s: %s", parentKey, childKey, err.Error()))
-				resp.Code = CodeInternalServerError
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(resp)
-				return
-			}
-			children = append(children, model.Child{
-				Key:   childKey,
-				Value: tokenStr,
-			})
-		}
-
-		// generate response
-		tokenStruct := &model.TokenizeResponse{
-			ID:   token.ID,
-			Data: children,
+		opts, ok := conditionalBatchOptions(w, srv, r, &resp, len(token.Data))
+		if !ok {
+			return
 		}
-		resp.Resp = tokenStruct
-		resp.Code = CodeSuccess
 
-		// set header and return
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(resp)
+		// user request valid, not proceed to process. all keys are patched, or none unless the request is partial
+		results, err := manager.PatchMany(ctx, keyValues(&token), opts)
+		writeBatchResponse(w, srv, &resp, &token, results, err)
 	}
 }
 
@@ -253,7 +287,7 @@ func GetTokensByIDHandler(srv *Service) func(w http.ResponseWriter, r *http.Requ
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		var resp model.Response
-		var ctx context.Context
+		ctx := requestContext(r)
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", GetTokensByID))
 
 		if r.Method != http.MethodGet {
@@ -288,7 +322,10 @@ func GetTokensByIDHandler(srv *Service) func(w http.ResponseWriter, r *http.Requ
 		var err error
 
 		// tokenize logic
-		manager := srv.manager
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
 
 		token, err := manager.GetTokenByID(ctx, id)
 		if err != nil {
@@ -319,7 +356,7 @@ func DeleteTokenByIDHandler(srv *Service) func(w http.ResponseWriter, r *http.Re
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		var resp model.Response
-		var ctx context.Context
+		ctx := requestContext(r)
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", GetTokensByID))
 
 		if r.Method != http.MethodDelete {
@@ -353,24 +390,17 @@ func DeleteTokenByIDHandler(srv *Service) func(w http.ResponseWriter, r *http.Re
 		log.Logger().Debug().Msg(fmt.Sprintf("id after after path: %s", id))
 		var err error
 
-		b, err := srv.manager.DeleteTokenByID(ctx, id)
-		if err != nil || !b {
-			resp.Error = append(resp.Error, err.Error())
-			log.Logger().Error().Msg(err.Error())
-			resp.Code = CodeInternalServerError
-			// return 400 status codes
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(resp)
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
 			return
 		}
 
-		resp.Resp = model.TokenizeResponse{}
-		resp.Code = CodeSuccess
-
-		// set header and return
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(resp)
-		return
+		opts, ok := conditionalBatchOptions(w, srv, r, &resp, 1)
+		if !ok {
+			return
+		}
+		results, err := manager.DeleteMany(ctx, []string{id}, hardDelete(r), opts)
+		writeBatchResponse(w, srv, &resp, &model.Tokenize{Data: []model.Child{{Key: id}}}, results, err)
 
 	}
 }
@@ -379,7 +409,7 @@ func GetTokensHandler(srv *Service) func(w http.ResponseWriter, r *http.Request)
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", GetTokens))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var err error
 
@@ -395,24 +425,31 @@ func GetTokensHandler(srv *Service) func(w http.ResponseWriter, r *http.Request)
 		//reqCtx := context.Background()
 
 		// tokenize logic
-		manager := srv.manager
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
 
-		// user request valid, not proceed to process
-		tokens, err := manager.GetAllTokens(ctx)
+		// user request valid, not proceed to process. the query selects, sorts and pages the tokens listed.
+		opts, err := listOptions(r)
 		if err != nil {
-			resp.Error = append(resp.Error, err.Error())
+			writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		tokenStruct, err := manager.ListPage(ctx, opts)
+		if err != nil {
+			status, code := http.StatusInternalServerError, CodeInternalServerError
+			if errors.Is(err, tokenize.ErrSortInvalid) || errors.Is(err, tokenize.ErrLimitInvalid) ||
+				errors.Is(err, tokenize.ErrPageTokenInvalid) || errors.Is(err, store.ErrMatchInvalid) {
+				status, code = http.StatusBadRequest, CodeInvalidRequest
+			}
+			writeError(w, &resp, status, code, err.Error())
 			log.Logger().Error().Msg(err.Error())
-			resp.Code = CodeInternalServerError
-			// return 400 status codes
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(resp)
 			return
 		}
 
 		// generate response
-		tokenStruct := &model.All{
-			tokens,
-		}
 		resp.Resp = tokenStruct
 		resp.Code = CodeSuccess
 
@@ -427,7 +464,7 @@ func DetokenizeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Req
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Detokenize))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var detoken model.Detokenize
 		var err error
@@ -463,7 +500,10 @@ func DetokenizeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Req
 		var children []*model.ChildReceipt
 
 		// tokenize logic
-		manager := srv.manager
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
 
 		// user request valid, not proceed to process
 		parentKey := detoken.ID
@@ -508,7 +548,7 @@ func TokenizeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Reque
 	log := srv.log
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Tokenize))
-		ctx := context.Background()
+		ctx := requestContext(r)
 		var resp model.Response
 		var token model.Tokenize
 		var err error
@@ -540,15 +580,16 @@ func TokenizeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
-		var tokenStr string
-		var children []model.Child
-
 		// tokenize logic
-		manager := srv.manager
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
 
-		// ensure user request parameter is correct and valid
+		// ensure user request parameter is correct and valid. a partial request reports invalid keys with the others
+		opts := batchOptions(r)
 		validationResp, ok := manager.Validate(ctx, &token, false)
-		if !ok {
+		if !ok && !opts.Partial {
 			for i := 0; i < len(validationResp); i++ {
 				resp.Error = append(resp.Error, fmt.Sprintf("error with key %s: %s", validationResp[i].Key, validationResp[i].Err))
 				log.Logger().Error().Msg(fmt.Sprintf("error with key %s: %s", validationResp[i].Key, validationResp[i].Err))
@@ -559,37 +600,134 @@ func TokenizeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
-		// user request valid, not proceed to process
-		parentKey := token.ID
-		for i := 0; i < len(token.Data); i++ {
-			childKey := token.Data[i].Key
-			combinedKeyName := tokenize.GetCombinedKey(parentKey, childKey)
-			tokenStr, err = manager.Tokenize(ctx, combinedKeyName, token.Data[i].Value)
-			if err != nil {
-				resp.Error = append(resp.Error, fmt.Sprintf("error with key %s.%s: %s", parentKey, childKey, err.Error()))
-				log.Logger().Error().Msg(fmt.Sprintf("error with key %s.%s: %s", parentKey, childKey, err.Error()))
-				resp.Code = CodeInternalServerError
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(resp)
-				return
-			}
-			children = append(children, model.Child{
-				Key:   childKey,
-				Value: tokenStr,
-			})
+		// user request valid, not proceed to process. all keys are stored, or none unless the request is partial
+		results, err := manager.TokenizeMany(ctx, keyValues(&token), opts)
+		writeBatchResponse(w, srv, &resp, &token, results, err)
+	}
+}
+
+// keyValues returns the keys of the children of token, with their values
+func keyValues(token *model.Tokenize) []tokenize.KeyValue {
+	kvs := make([]tokenize.KeyValue, 0, len(token.Data))
+	for i := 0; i < len(token.Data); i++ {
+		kvs = append(kvs, tokenize.KeyValue{Key: tokenize.GetCombinedKey(token.ID, token.Data[i].Key), Value: token.Data[i].Value})
+	}
+	return kvs
+}
+
+// batchOptions parses the options of a multi-key request from the query of r
+func batchOptions(r *http.Request) tokenize.BatchOptions {
+	partial, _ := strconv.ParseBool(r.URL.Query().Get(ParamPartial))
+	return tokenize.BatchOptions{Partial: partial}
+}
+
+// conditionalBatchOptions parses the options of a patch or delete of keys keys, from the query and HeaderIfMatch of r.
+// It answers the request itself when they are invalid, and reports whether it didn't.
+func conditionalBatchOptions(w http.ResponseWriter, srv *Service, r *http.Request, resp *model.Response, keys int) (tokenize.BatchOptions, bool) {
+	opts := batchOptions(r)
+	revision, err := ifRevision(r, keys)
+	if err != nil {
+		resp.Error = append(resp.Error, err.Error())
+		srv.log.Logger().Error().Msg(err.Error())
+		resp.Code = CodeInvalidRequest
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return opts, false
+	}
+	opts.IfRevision = revision
+	return opts, true
+}
+
+// writeBatchResponse answers a multi-key request on the children of token with the children written. A failed atomic
+// request wrote none, and is answered with the error of the key that failed. A partial request some keys of which
+// failed is answered with 207 Multi-Status, the children written and the errors of the others.
+func writeBatchResponse(w http.ResponseWriter, srv *Service, resp *model.Response, token *model.Tokenize, results []*tokenize.BatchResult, err error) {
+	log := srv.log
+	if err != nil {
+		resp.Error = append(resp.Error, err.Error())
+		log.Logger().Error().Msg(err.Error())
+		switch {
+		case errors.Is(err, store.ErrQuotaExceeded):
+			resp.Code = CodeInvalidRequest
+			w.WriteHeader(http.StatusInsufficientStorage)
+		case errors.Is(err, store.ErrKeyExists), errors.Is(err, tokenize.ErrKeyReserved):
+			resp.Code = CodeInvalidRequest
+			w.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, tokenize.ErrRevisionMismatch):
+			resp.Code = CodePreconditionFailed
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case errors.Is(err, store.ErrConflict):
+			resp.Code = CodeConflict
+			w.WriteHeader(http.StatusConflict)
+		default:
+			resp.Code = CodeInternalServerError
+			w.WriteHeader(http.StatusInternalServerError)
 		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 
-		// generate response
-		tokenStruct := &model.TokenizeResponse{
-			ID:   token.ID,
-			Data: children,
+	children := []model.Child{}
+	for i, result := range results {
+		childKey := token.Data[i].Key
+		if result.Err != nil {
+			name := childKey
+			if len(token.ID) > 0 {
+				name = token.ID + "." + childKey
+			}
+			resp.Error = append(resp.Error, fmt.Sprintf("error with key %s: %s", name, result.Err.Error()))
+			continue
 		}
-		resp.Resp = tokenStruct
-		resp.Code = CodeSuccess
+		children = append(children, model.Child{Key: childKey, Value: result.Token})
+	}
 
-		// set header and return
-		w.WriteHeader(http.StatusOK)
+	// generate response
+	resp.Resp = &model.TokenizeResponse{
+		ID:   token.ID,
+		Data: children,
+	}
+	if len(resp.Error) > 0 {
+		resp.Code = CodePartialFailure
+		w.WriteHeader(http.StatusMultiStatus)
 		json.NewEncoder(w).Encode(resp)
 		return
 	}
+	if len(results) == 1 {
+		setETag(w, results[0].Revision)
+	}
+	resp.Code = CodeSuccess
+
+	// set header and return
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listOptions parses the listing options of the query of r. Labels are given as label=key=value, or label=key to
+// match any value.
+func listOptions(r *http.Request) (tokenize.ListOptions, error) {
+	query := r.URL.Query()
+	opts := tokenize.ListOptions{
+		Prefix:    query.Get(ParamPrefix),
+		Match:     query.Get(ParamMatch),
+		Sort:      query.Get(ParamSort),
+		PageToken: query.Get(ParamPageToken),
+	}
+	if limit := query.Get(ParamLimit); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be a number: %s", ParamLimit, limit)
+		}
+		opts.Limit = n
+	}
+	for _, label := range query[ParamLabel] {
+		k, v, _ := strings.Cut(label, "=")
+		if len(k) == 0 {
+			return opts, tokenize.ErrLabelKeyEmpty
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[k] = v
+	}
+	return opts, nil
 }
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/store"
+	"net/http"
+	"strings"
+)
+
+var (
+	// NamespacePath prefixes every route to scope it to a namespace, as in /ns/<namespace>/tokenize
+	NamespacePath   = "/ns/"
+	AdminNamespaces = "/admin/namespaces"
+	HeaderNamespace = "X-Vault-Namespace"
+)
+
+// namespaceKey is the context key of the namespace selected through NamespacePath
+type namespaceKey struct{}
+
+// NamespaceRouterFunc serves NamespacePath by stripping the namespace segment off the path, and dispatching the request
+// to the route that follows it, scoped to the namespace
+func NamespaceRouterFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resp model.Response
+		name, route, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, NamespacePath), "/")
+		route = "/" + route
+		if len(name) == 0 || strings.HasPrefix(route, NamespacePath) {
+			writeError(w, &resp, http.StatusNotFound, CodeInvalidRequest, Err404)
+			log.Logger().Error().Msgf("%s: %s", r.URL.Path, Err404)
+			return
+		}
+		log.Logger().Debug().Msgf("routing %s to %s in namespace %s", r.URL.Path, route, name)
+
+		scoped := r.Clone(context.WithValue(r.Context(), namespaceKey{}, name))
+		scoped.URL.Path = route
+		scoped.URL.RawPath = ""
+		srv.mux.ServeHTTP(w, scoped)
+	}
+}
+
+// namespace returns the name of the namespace a request is scoped to, from its path or its HeaderNamespace header
+func namespace(r *http.Request) string {
+	if name, ok := r.Context().Value(namespaceKey{}).(string); ok {
+		return name
+	}
+	return r.Header.Get(HeaderNamespace)
+}
+
+// scopedManager resolves the manager of the namespace a request is scoped to. If that fails, it writes the error
+// response and returns false.
+func (s *Service) scopedManager(ctx context.Context, w http.ResponseWriter, r *http.Request, resp *model.Response) (*tokenize.Manager, bool) {
+	manager, err := s.manager.InNamespace(ctx, namespace(r))
+	if err != nil {
+		writeNamespaceError(w, resp, err)
+		s.log.Logger().Error().Msg(err.Error())
+		return nil, false
+	}
+	return manager, true
+}
+
+// NamespacesHandlerFunc lists namespaces on GET, and creates one on POST from a json body with a name and a quota
+func NamespacesHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", AdminNamespaces))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			namespaces, err := manager.ListNamespaces(ctx)
+			if err != nil {
+				writeNamespaceError(w, &resp, err)
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+			writeResponse(w, &resp, http.StatusOK, namespaces)
+		case http.MethodPost:
+			var req model.NamespaceRequest
+			jsonDecoder := json.NewDecoder(r.Body)
+			jsonDecoder.DisallowUnknownFields()
+			defer r.Body.Close()
+			if err := jsonDecoder.Decode(&req); err != nil {
+				writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+
+			ns, err := manager.CreateNamespace(ctx, req.Name, req.Quota)
+			if err != nil {
+				writeNamespaceError(w, &resp, err)
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+			writeResponse(w, &resp, http.StatusCreated, ns)
+		default:
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+		}
+	}
+}
+
+// NamespaceHandlerFunc describes the namespace named in the path on GET, changes its quota on PATCH, and deletes it
+// with all its keys on DELETE
+func NamespaceHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", AdminNamespaces+"/"))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		name := strings.TrimPrefix(r.URL.Path, AdminNamespaces+"/")
+		if len(name) == 0 || strings.Contains(name, "/") {
+			writeError(w, &resp, http.StatusNotFound, CodeInvalidRequest, Err404)
+			log.Logger().Error().Msgf("%s: %s", r.URL.Path, Err404)
+			return
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		var result any
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			result, err = manager.GetNamespace(ctx, name)
+		case http.MethodPatch:
+			var req model.NamespaceRequest
+			jsonDecoder := json.NewDecoder(r.Body)
+			jsonDecoder.DisallowUnknownFields()
+			defer r.Body.Close()
+			if err = jsonDecoder.Decode(&req); err != nil {
+				writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+			result, err = manager.SetNamespaceQuota(ctx, name, req.Quota)
+		case http.MethodDelete:
+			var deleted int
+			deleted, err = manager.DeleteNamespace(ctx, name)
+			result = &model.NamespaceDeleted{Name: name, Deleted: deleted}
+		default:
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			writeNamespaceError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, result)
+	}
+}
+
+// writeNamespaceError writes the json error response matching a namespace error
+func writeNamespaceError(w http.ResponseWriter, resp *model.Response, err error) {
+	status, code := http.StatusInternalServerError, CodeInternalServerError
+	switch {
+	case errors.Is(err, tokenize.ErrNamespaceNotFound):
+		status, code = http.StatusNotFound, CodeInvalidRequest
+	case errors.Is(err, tokenize.ErrNamespaceExists):
+		status, code = http.StatusConflict, CodeInvalidRequest
+	case errors.Is(err, tokenize.ErrNamespaceInvalid), errors.Is(err, tokenize.ErrNamespaceScoped),
+		errors.Is(err, tokenize.ErrQuotaInvalid):
+		status, code = http.StatusBadRequest, CodeInvalidRequest
+	case errors.Is(err, store.ErrQuotaExceeded):
+		status, code = http.StatusInsufficientStorage, CodeInvalidRequest
+	}
+	writeError(w, resp, status, code, err.Error())
+}
+
+// writeResponse writes a successful json response with the given status
+func writeResponse(w http.ResponseWriter, resp *model.Response, status int, result any) {
+	resp.Resp = result
+	resp.Code = CodeSuccess
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
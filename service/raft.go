@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"net/http"
+)
+
+var (
+	RaftStatus = "/v1/sys/raft"
+	RaftJoin   = "/v1/sys/raft/join"
+	RaftRemove = "/v1/sys/raft/remove"
+)
+
+var (
+	ErrRaftDisabled = errors.New("the service doesn't replicate its store with raft. start it with --raft-node-id")
+)
+
+// RaftStatusHandlerFunc describes the raft node of the service, and its cluster
+func RaftStatusHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", RaftStatus))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodGet {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+		if !srv.raftEnabled(w, &resp) {
+			return
+		}
+
+		status, err := srv.raft.Status(ctx)
+		if err != nil {
+			writeRaftError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, status)
+	}
+}
+
+// RaftJoinHandlerFunc joins the raft node of the service to the cluster of the node at the address in the json body
+func RaftJoinHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", RaftJoin))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		var req model.RaftJoinRequest
+		if !decodeRaftRequest(w, r, &resp, &req) || !srv.raftEnabled(w, &resp) {
+			return
+		}
+		if len(req.Address) == 0 {
+			writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf(ErrParameterizedVariableNotPassedF, "address"))
+			return
+		}
+
+		if err := srv.raft.Join(ctx, req.Address); err != nil {
+			writeRaftError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		log.Logger().Info().Msgf("raft node %s joined the cluster of %s", srv.raft.ID(), req.Address)
+		writeResponse(w, &resp, http.StatusOK, store.RaftPeer{ID: srv.raft.ID(), Address: srv.raft.Addr(), Voter: true})
+	}
+}
+
+// RaftRemoveHandlerFunc removes the node named in the json body from the raft cluster of the service
+func RaftRemoveHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", RaftRemove))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		var req model.RaftRemoveRequest
+		if !decodeRaftRequest(w, r, &resp, &req) || !srv.raftEnabled(w, &resp) {
+			return
+		}
+		if len(req.NodeID) == 0 {
+			writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf(ErrParameterizedVariableNotPassedF, "node_id"))
+			return
+		}
+
+		if err := srv.raft.Remove(ctx, req.NodeID); err != nil {
+			writeRaftError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		log.Logger().Info().Msgf("raft node %s removed from the cluster", req.NodeID)
+		writeResponse(w, &resp, http.StatusOK, req)
+	}
+}
+
+// raftEnabled writes an error response and returns false if the service has no raft node
+func (s *Service) raftEnabled(w http.ResponseWriter, resp *model.Response) bool {
+	if s.raft == nil {
+		writeError(w, resp, http.StatusBadRequest, CodeInvalidRequest, ErrRaftDisabled.Error())
+		s.log.Logger().Error().Msg(ErrRaftDisabled.Error())
+		return false
+	}
+	return true
+}
+
+// decodeRaftRequest decodes the json body of a POST request into req. If that fails, it writes the error response and
+// returns false.
+func decodeRaftRequest(w http.ResponseWriter, r *http.Request, resp *model.Response, req any) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+		return false
+	}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.DisallowUnknownFields()
+	defer r.Body.Close()
+	if err := jsonDecoder.Decode(req); err != nil {
+		writeError(w, resp, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// writeRaftError writes the json error response matching a raft error
+func writeRaftError(w http.ResponseWriter, resp *model.Response, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, store.ErrRaftNoLeader) || errors.Is(err, store.ErrRaftNotConnected) {
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, resp, status, CodeInternalServerError, err.Error())
+}
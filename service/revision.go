@@ -0,0 +1,48 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HeaderETag carries the revision of the secret a single-key request read or wrote, as a quoted number
+	HeaderETag = "ETag"
+	// HeaderIfMatch makes a patch or delete of a single key conditional on its secret being at the revision of an ETag
+	HeaderIfMatch = "If-Match"
+)
+
+var (
+	ErrIfMatchInvalid   = errors.New(HeaderIfMatch + " must be a single ETag, as in \"3\"")
+	ErrIfMatchSingleKey = errors.New(HeaderIfMatch + " is only accepted on requests on a single key")
+)
+
+// ifRevision parses the revision the HeaderIfMatch of r makes a request on keys keys conditional on, or returns nil
+// if there is none. Secrets stored before revisions were kept are matched by revision 0.
+func ifRevision(r *http.Request, keys int) (*int64, error) {
+	header := strings.TrimSpace(r.Header.Get(HeaderIfMatch))
+	if len(header) == 0 {
+		return nil, nil
+	}
+	if keys != 1 {
+		return nil, ErrIfMatchSingleKey
+	}
+	// a bare number is accepted as well as the quoted ETag
+	if unquoted, err := strconv.Unquote(header); err == nil {
+		header = unquoted
+	}
+	revision, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || revision < 0 {
+		return nil, ErrIfMatchInvalid
+	}
+	return &revision, nil
+}
+
+// setETag sets the HeaderETag of w to revision. Secrets stored before revisions were kept have none.
+func setETag(w http.ResponseWriter, revision int64) {
+	if revision > 0 {
+		w.Header().Set(HeaderETag, strconv.Quote(strconv.FormatInt(revision, 10)))
+	}
+}
@@ -8,15 +8,21 @@ import (
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/pkg/errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 const (
+	// DefaultShutdownTimeout is how long a graceful shutdown waits for the requests in flight
+	DefaultShutdownTimeout = 10 * time.Second
+
 	port        = "8080"
-	STORE_REDIS = "redis"
-	STORE_GOB   = "gob"
-	STORE_FILE  = "file"
-	STORE_MAP   = "map"
+	STORE_REDIS = store.DriverRedis
+	STORE_GOB   = store.DriverGob
+	STORE_FILE  = store.DriverFile
+	STORE_MAP   = store.DriverMap
 )
 
 var (
@@ -24,27 +30,38 @@ var (
 )
 
 type Service struct {
-	sc         *StartConfig
-	manager    *tokenize.Manager
-	srv        *http.Server
-	mux        *http.ServeMux
-	log        *vlog.Logger
-	storeStr   string
-	fileConfig struct {
-		loc string
+	sc      *StartConfig
+	manager *tokenize.Manager
+	srv     *http.Server
+	mux     *http.ServeMux
+	log     *vlog.Logger
+	// storeStr names the driver of the store, as registered with store.Register
+	storeStr      string
+	storeURL      string
+	storeConfig   store.Config
+	replicaConfig struct {
+		urls   []string
+		config store.ReplicatedConfig
 	}
-	gobConfig struct {
-		loc   string
-		trunc bool
+	encryptConfig struct {
+		enabled bool
+		keyLoc  string
 	}
-	redisConfig struct {
-		connectionString string
+	cacheConfig *store.CacheConfig
+	raftConfig  *store.RaftConfig
+	// raft is the node replicating the store when raftConfig is set
+	raft        *store.Raft
+	trashConfig struct {
+		retention     time.Duration
+		purgeInterval time.Duration
 	}
-	syncMapConfig struct{}
+	// accessResolution is how long the recorded access time of a secret is kept when it is read again
+	accessResolution time.Duration
 }
 
 func New(ctx context.Context, log *vlog.Logger, opts ...Options) (*Service, error) {
 	srv := &Service{sc: &StartConfig{port: port}, mux: http.NewServeMux(), log: log}
+	srv.trashConfig.purgeInterval = DefaultPurgeInterval
 
 	// fill in the gaps in the struct
 	for i := 0; i < len(opts); i++ {
@@ -61,13 +78,13 @@ func New(ctx context.Context, log *vlog.Logger, opts ...Options) (*Service, erro
 		return nil, err
 	}
 
-	srv.manager = tokenize.NewManager(ctx, srv.log, tokenize.WithStore(store))
+	srv.manager = tokenize.NewManager(ctx, srv.log, tokenize.WithStore(store), tokenize.WithTrashRetention(srv.trashConfig.retention), tokenize.WithAccessResolution(srv.accessResolution))
 
 	log.Logger().Debug().Msg("generating service config")
 	readTimeout := 10 * time.Second
 	writeTimeout := 10 * time.Second
 	srv.srv = &http.Server{
-		Addr:                         ":" + port,
+		Addr:                         ":" + srv.sc.port,
 		Handler:                      nil,
 		DisableGeneralOptionsHandler: false,
 		TLSConfig:                    nil,
@@ -83,7 +100,7 @@ func New(ctx context.Context, log *vlog.Logger, opts ...Options) (*Service, erro
 		ConnContext:                  nil,
 	}
 
-	log.Logger().Debug().Msgf("initialized service with settings:\n\taddress: %v\n\tread timeout: %v\n\twrite timeout: %v\n", ":"+port, readTimeout, writeTimeout)
+	log.Logger().Debug().Msgf("initialized service with settings:\n\taddress: %v\n\tread timeout: %v\n\twrite timeout: %v\n", ":"+srv.sc.port, readTimeout, writeTimeout)
 	return srv, nil
 }
 
@@ -101,70 +118,181 @@ func (s *Service) LoadHandlers(ctx context.Context) {
 	}
 }
 
+// Run serves until the server fails, or the process is interrupted or terminated, which shuts the service down
+// gracefully
 func (s *Service) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// load handlers into mux
 	s.LoadHandlers(ctx)
 	// set mux into server
 	s.srv.Handler = s.mux
+	// purge the trash in the background while serving
+	if s.trashConfig.purgeInterval > 0 {
+		go s.purgeLoop(ctx, s.trashConfig.purgeInterval)
+	}
 	// start server
-	return s.srv.ListenAndServe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	s.log.Logger().Info().Msg("shutting down")
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown waits for the requests in flight, then closes the store, so stores keeping records in memory, like maps
+// with a snapshot location, persist them
+func (s *Service) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultShutdownTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.manager.Close(ctx)
 }
 
 // isInvalidStore resolves the underlying store struct based on the passed in info
 func (s *Service) isInvalidStore(ctx context.Context) (store.Store, error) {
 	// no-op
-	if len(s.storeStr) == 0 {
+	if len(s.storeStr) == 0 && len(s.storeURL) == 0 {
 		return nil, nil
 	}
 
-	var val store.Store
-	var err error
-	switch s.storeStr {
-	case STORE_REDIS:
-		val, err = store.NewRedis(s.redisConfig.connectionString, s.log)
-	case STORE_FILE:
-		val = store.NewFile(s.fileConfig.loc, s.log)
-	case STORE_GOB:
-		val, err = store.NewGob(ctx, s.gobConfig.loc, s.log, s.gobConfig.trunc)
-	case STORE_MAP:
-		val = store.NewSyncMap(ctx, s.log)
-	default:
-		return nil, fmt.Errorf("%w: input store invalid", ErrInvalidRequestParameter)
+	// a store url overrides the driver and location options
+	if len(s.storeURL) > 0 {
+		var err error
+		if s.storeStr, s.storeConfig, err = store.ParseURL(s.storeURL); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRequestParameter, err)
+		}
+	}
+	s.storeConfig.Logger = s.log
+	val, err := store.Open(ctx, s.storeStr, s.storeConfig)
+	if errors.Is(err, store.ErrDriverUnknown) {
+		return nil, fmt.Errorf("%w: input store invalid: %w", ErrInvalidRequestParameter, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// replicate the store across a raft cluster, connecting it here so a node that can't start fails the service
+	if s.raftConfig != nil {
+		if s.raft, err = store.NewRaft(val, *s.raftConfig, s.log); err != nil {
+			return nil, err
+		}
+		if _, err = s.raft.Connect(ctx); err != nil {
+			return nil, err
+		}
+		val = s.raft
+	}
+
+	// mirror the store to its replicas, below encryption so they hold the same ciphertext
+	if len(s.replicaConfig.urls) > 0 {
+		var secondaries []store.Store
+		for _, raw := range s.replicaConfig.urls {
+			secondary, err := store.OpenURL(ctx, raw, s.log)
+			if err != nil {
+				return nil, fmt.Errorf("error while creating replica: %w", err)
+			}
+			secondaries = append(secondaries, secondary)
+		}
+		if val, err = store.NewReplicated(val, secondaries, s.replicaConfig.config, s.log); err != nil {
+			return nil, err
+		}
+	}
+
+	// wrap the resolved store with encryption at rest
+	if s.encryptConfig.enabled {
+		key, err := store.LoadStoreKey(s.encryptConfig.keyLoc, s.log)
+		if err != nil {
+			return nil, err
+		}
+		if val, err = store.NewEncrypted(val, key, s.log); err != nil {
+			return nil, err
+		}
+	}
+
+	// cache in front of everything else, so hits skip decryption too
+	if s.cacheConfig != nil {
+		return store.NewCached(val, *s.cacheConfig, s.log)
 	}
-	return val, err
+	return val, nil
 }
 
 func (s *Service) SetDefaults() {
 	if len(s.storeStr) == 0 {
 		s.storeStr = STORE_GOB
-		s.gobConfig.loc = ".gob"
-		s.gobConfig.trunc = true
+		s.storeConfig.Loc = ".gob"
+		s.storeConfig.Truncate = true
 	}
 }
 
 type Options func(*Service)
 
-func WithFileLoc(loc string) Options {
+// WithStoreLoc sets where the store keeps its records: a path for file and gob stores, a connection string for redis
+func WithStoreLoc(loc string) Options {
 	return func(s *Service) {
-		s.fileConfig.loc = loc
+		s.storeConfig.Loc = loc
 	}
 }
 
+func WithFileLoc(loc string) Options {
+	return WithStoreLoc(loc)
+}
+
 func WithGobLoc(loc string) Options {
-	return func(s *Service) {
-		s.gobConfig.loc = loc
-	}
+	return WithStoreLoc(loc)
 }
 
 func WithGobTrunc() Options {
 	return func(s *Service) {
-		s.gobConfig.trunc = true
+		s.storeConfig.Truncate = true
 	}
 }
 
 func WithRedisConnString(connStr string) Options {
+	return WithStoreLoc(connStr)
+}
+
+// WithReplicas mirrors the store to the stores addressed by the store urls, as configured by config
+func WithReplicas(urls []string, config store.ReplicatedConfig) Options {
+	return func(s *Service) {
+		s.replicaConfig.urls = urls
+		s.replicaConfig.config = config
+	}
+}
+
+// WithPort sets the port the service listens on
+func WithPort(port string) Options {
+	return func(s *Service) {
+		s.sc.port = port
+	}
+}
+
+// WithRaft replicates the store across the nodes of a raft cluster, this node being configured by config
+func WithRaft(config store.RaftConfig) Options {
 	return func(s *Service) {
-		s.redisConfig.connectionString = connStr
+		s.raftConfig = &config
+	}
+}
+
+// WithStoreEncryption encrypts and authenticates every record at rest, using the store key persisted at keyLoc
+func WithStoreEncryption(keyLoc string) Options {
+	return func(s *Service) {
+		s.encryptConfig.enabled = true
+		s.encryptConfig.keyLoc = keyLoc
+	}
+}
+
+// WithCache puts a read-through LRU cache configured by config in front of the store
+func WithCache(config store.CacheConfig) Options {
+	return func(s *Service) {
+		s.cacheConfig = &config
 	}
 }
 
@@ -173,3 +301,33 @@ func WithStoreStr(storeStr string) Options {
 		s.storeStr = storeStr
 	}
 }
+
+// WithStoreURL opens the store addressed by raw, as in gob:///path/to/.gob or redis://localhost:6379. See
+// store.ParseURL.
+func WithStoreURL(raw string) Options {
+	return func(s *Service) {
+		s.storeURL = raw
+	}
+}
+
+// WithTrashRetention sets how long deleted tokens are kept in the trash before they are purged
+func WithTrashRetention(retention time.Duration) Options {
+	return func(s *Service) {
+		s.trashConfig.retention = retention
+	}
+}
+
+// WithAccessResolution sets how long the recorded access time of a secret is kept when it is read again. Negative
+// resolutions don't record access times, as suits read-only stores. See tokenize.WithAccessResolution.
+func WithAccessResolution(resolution time.Duration) Options {
+	return func(s *Service) {
+		s.accessResolution = resolution
+	}
+}
+
+// WithPurgeInterval sets how often the trash is purged of the tokens past their retention. 0 disables purging.
+func WithPurgeInterval(interval time.Duration) Options {
+	return func(s *Service) {
+		s.trashConfig.purgeInterval = interval
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"net/http"
+)
+
+var (
+	SysStats = "/v1/sys/stats"
+)
+
+// StatsHandlerFunc describes the store of the vault, and counts the operations it served with their latencies. In
+// a namespace, only the keys of the namespace are counted in the store.
+func StatsHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", SysStats))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodGet {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+		stats, err := manager.Stats(ctx)
+		if err != nil {
+			writeNamespaceError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultPurgeInterval is how often the service purges the tokens past their retention from the trash
+const DefaultPurgeInterval = time.Hour
+
+var (
+	Undelete = "/undelete"
+	Trash    = "/trash"
+	Purge    = "/purge"
+
+	// ParamHard deletes a token for good on /delete, instead of moving it to the trash
+	ParamHard = "hard"
+	// ParamAll empties the trash on /purge
+	ParamAll = "all"
+)
+
+// UndeleteHandlerFunc moves the token identified by the id query parameter back from the trash on POST
+func UndeleteHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Undelete))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodPost {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		id := r.URL.Query().Get(ParamVarID)
+		if err := manager.UndeleteTokenByID(ctx, id); err != nil {
+			writeTrashError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, model.TokenizeResponse{ID: id})
+	}
+}
+
+// TrashHandlerFunc lists the tokens in the trash on GET
+func TrashHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Trash))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodGet {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		trashed, err := manager.ListTrash(ctx)
+		if err != nil {
+			writeTrashError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, trashed)
+	}
+}
+
+// PurgeHandlerFunc deletes trashed tokens for good on POST: the one identified by the id query parameter, all of them
+// with all=true, or else those past their retention
+func PurgeHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Purge))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodPost {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		opts := tokenize.PurgeOptions{ID: r.URL.Query().Get(ParamVarID)}
+		if all := r.URL.Query().Get(ParamAll); len(all) > 0 {
+			var err error
+			if opts.All, err = strconv.ParseBool(all); err != nil {
+				writeError(w, &resp, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s must be true or false: %s", ParamAll, all))
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		purged, err := manager.Purge(ctx, opts)
+		if err != nil {
+			writeTrashError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		writeResponse(w, &resp, http.StatusOK, model.Purged{Purged: purged})
+	}
+}
+
+// hardDelete reports whether a /delete request asks to delete for good
+func hardDelete(r *http.Request) bool {
+	hard, _ := strconv.ParseBool(r.URL.Query().Get(ParamHard))
+	return hard
+}
+
+// purgeLoop purges the tokens past their retention from the trash every interval, until ctx is done
+func (s *Service) purgeLoop(ctx context.Context, interval time.Duration) {
+	log := s.log.Logger()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.manager.PurgeExpired(ctx)
+			if err != nil {
+				log.Error().Msgf("error while purging the trash: %s\n", err.Error())
+			}
+			if purged > 0 {
+				log.Info().Msgf("purged %d tokens past their retention from the trash", purged)
+			}
+		}
+	}
+}
+
+// writeTrashError writes the json error response matching a trash error
+func writeTrashError(w http.ResponseWriter, resp *model.Response, err error) {
+	status, code := http.StatusInternalServerError, CodeInternalServerError
+	switch {
+	case errors.Is(err, tokenize.ErrNotInTrash):
+		status, code = http.StatusNotFound, CodeInvalidRequest
+	case errors.Is(err, tokenize.ErrTrashConflict):
+		status, code = http.StatusConflict, CodeInvalidRequest
+	case errors.Is(err, tokenize.ErrKeyReserved):
+		status, code = http.StatusBadRequest, CodeInvalidRequest
+	}
+	writeError(w, resp, status, code, err.Error())
+}
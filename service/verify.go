@@ -0,0 +1,59 @@
+package service
+
+import (
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"net/http"
+)
+
+var (
+	AdminVerify = "/admin/verify"
+)
+
+// VerifyHandlerFunc checks the tokens of the vault against the MACs it keeps of them on GET, and reports the keys
+// changed outside of it. On POST, the tokens are resealed as they are stored first, accepting them.
+func VerifyHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", AdminVerify))
+		ctx := requestContext(r)
+		var resp model.Response
+
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		manager, ok := srv.scopedManager(ctx, w, r, &resp)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if err := manager.Reseal(ctx); err != nil {
+				writeNamespaceError(w, &resp, err)
+				log.Logger().Error().Msg(err.Error())
+				return
+			}
+			log.Logger().Info().Msg("resealed the tokens of the vault")
+		}
+
+		reports, err := manager.Verify(ctx)
+		if err != nil {
+			writeNamespaceError(w, &resp, err)
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+		for _, report := range reports {
+			if report.Tampered {
+				log.Logger().Error().Msgf("tokens of namespace %q were changed outside the vault: %d added, %d removed, %d modified, root valid: %t",
+					report.Namespace, len(report.Added), len(report.Removed), len(report.Modified), report.RootValid)
+			}
+			if report.Detected != nil {
+				log.Logger().Error().Msgf("a write detected tampering in namespace %q at %s: %s", report.Namespace, report.Detected.DetectedAt, report.Detected.Reason)
+			}
+		}
+		writeResponse(w, &resp, http.StatusOK, reports)
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"net/http"
+	"time"
+)
+
+var (
+	Watch       = "/v1/watch"
+	ParamPrefix = "prefix"
+)
+
+// WatchHeartbeat is how often an idle watch stream sends a comment, so proxies don't close it
+var WatchHeartbeat = 15 * time.Second
+
+// WatchHandlerFunc streams the changes to keys starting with the prefix query parameter as Server-Sent Events. Each
+// event is named after its type, and carries the store.Event as json. The stream ends when the client goes away, or
+// when the client falls behind, in which case it should reconnect and resync.
+func WatchHandlerFunc(srv *Service) func(w http.ResponseWriter, r *http.Request) {
+	log := srv.log
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Logger().Info().Msg(fmt.Sprintf("received a request on %s", Watch))
+		var resp model.Response
+
+		if r.Method != http.MethodGet {
+			writeError(w, &resp, http.StatusMethodNotAllowed, CodeMethodNotAllowed, ErrMethodNotAllowed+": "+r.Method)
+			log.Logger().Error().Msg(ErrMethodNotAllowed)
+			return
+		}
+
+		manager, ok := srv.scopedManager(r.Context(), w, r, &resp)
+		if !ok {
+			return
+		}
+
+		prefix := r.URL.Query().Get(ParamPrefix)
+		events, err := manager.Watch(r.Context(), prefix)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrWatchUnsupported) {
+				status = http.StatusNotImplemented
+			}
+			writeError(w, &resp, status, CodeInternalServerError, err.Error())
+			log.Logger().Error().Msg(err.Error())
+			return
+		}
+
+		// the stream outlives the write timeout of the server
+		rc := http.NewResponseController(w)
+		if err = rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Logger().Debug().Msgf("could not lift write deadline of watch stream: %s", err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, ": watching %q\n\n", prefix)
+		rc.Flush()
+
+		heartbeat := time.NewTicker(WatchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case event, ok := <-events:
+				if !ok {
+					log.Logger().Info().Msgf("watch stream on %q ended", prefix)
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Logger().Error().Msgf("error marshalling watch event: %s", err)
+					return
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			if err = rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/snapshot"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+const (
+	FlagOutput         = "output"
+	FlagPassphraseFile = "passphrase-file"
+	FlagRecipient      = "recipient"
+	FlagIdentity       = "identity"
+
+	// EnvPassphrase holds the backup passphrase when no passphrase file is given
+	EnvPassphrase = "VAULT_BACKUP_PASSPHRASE"
+)
+
+var (
+	ErrKeyMissing = errors.New("a backup key is required: set --" + FlagPassphraseFile + ", --" + FlagRecipient + " or " + EnvPassphrase)
+)
+
+type BackupOptions struct {
+	output         string
+	passphraseFile string
+	recipient      string
+}
+
+type KeygenOptions struct {
+	identity string
+}
+
+// NewBackupCmd represents the CLI command for writing an encrypted snapshot of the vault
+func NewBackupCmd() *cobra.Command {
+
+	bop := &BackupOptions{}
+
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Writes an encrypted snapshot of the whole vault",
+		Long: `The 'backup' command writes every stored record, together with the keyring the tokens were generated with, into a single encrypted snapshot file.
+The snapshot carries a manifest with the record count and checksums, and can be restored into any storage backend with 'vault restore'.
+
+The snapshot is encrypted under either:
+- a backup passphrase, read from --passphrase-file or the ` + EnvPassphrase + ` environment variable
+- a recipient key, generated with 'vault backup keygen'. Only the holder of the matching identity file can restore it.
+
+Examples:
+  VAULT_BACKUP_PASSPHRASE=... vault backup -o snapshot.vbk
+  vault backup -o snapshot.vbk --recipient <recipient key>`,
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, err := cmd.Flags().GetBool("debug")
+			if err != nil {
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+			}
+
+			ctx := context.Background()
+			logger := vlog.New(debug)
+
+			bytes, err := bop.Run(ctx, logger)
+			if len(bytes) > 0 {
+				fmt.Println(string(bytes))
+			}
+			if err != nil {
+				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
+					fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
+				} else {
+					fmt.Println("Backup failed:", err)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	backupCmd.Flags().StringVarP(&bop.output, FlagOutput, "o", "", "specify the file the snapshot is written to, e.g. snapshot"+snapshot.Extension)
+	backupCmd.Flags().StringVar(&bop.passphraseFile, FlagPassphraseFile, "", "specify a file holding the backup passphrase")
+	backupCmd.Flags().StringVar(&bop.recipient, FlagRecipient, "", "specify the recipient key the snapshot is sealed to")
+	backupCmd.MarkFlagRequired(FlagOutput)
+	backupCmd.MarkFlagsMutuallyExclusive(FlagPassphraseFile, FlagRecipient)
+
+	backupCmd.AddCommand(newKeygenCmd())
+
+	return backupCmd
+}
+
+func newKeygenCmd() *cobra.Command {
+
+	kop := &KeygenOptions{}
+
+	keygenCmd := &cobra.Command{
+		Use:   "keygen",
+		Short: "Generates an identity file and prints its recipient key",
+		Long: `The 'keygen' command generates a new identity, writes it to the identity file, and prints the matching recipient key.
+Snapshots sealed to the recipient key with 'vault backup --recipient' can only be restored with the identity file.
+
+Example:
+  vault backup keygen --identity ~/.vault/backup.key`,
+		Run: func(cmd *cobra.Command, args []string) {
+			recipient, err := kop.Run()
+			if err != nil {
+				fmt.Println("Key generation failed:", err)
+				os.Exit(1)
+			}
+			fmt.Println("Recipient key:", recipient)
+		},
+	}
+
+	keygenCmd.Flags().StringVar(&kop.identity, FlagIdentity, "", "specify the file the identity is written to")
+	keygenCmd.MarkFlagRequired(FlagIdentity)
+
+	return keygenCmd
+}
+
+func (bop *BackupOptions) Run(ctx context.Context, logger *vlog.Logger) ([]byte, error) {
+	keyer, err := bop.keyer()
+	if err != nil {
+		return nil, err
+	}
+
+	ic := helper.NewInstanceConfig()
+	if err = ic.JsonDecode(); err != nil {
+		return nil, err
+	}
+
+	manager, err := ic.Manager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// write to a temporary file first, so a failed backup never clobbers a previous snapshot
+	tmp := bop.output + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := manager.Backup(ctx, f, keyer, ic.StoreType)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err = os.Rename(tmp, bop.output); err != nil {
+		return nil, err
+	}
+	logger.Logger().Info().Msgf("Wrote snapshot to %s", bop.output)
+
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+func (bop *BackupOptions) keyer() (snapshot.Keyer, error) {
+	if len(bop.recipient) > 0 {
+		return snapshot.ParseRecipient(bop.recipient)
+	}
+	return Passphrase(bop.passphraseFile)
+}
+
+func (kop *KeygenOptions) Run() (string, error) {
+	if _, err := os.Stat(kop.identity); err == nil {
+		return "", fmt.Errorf("identity file %s already exists", kop.identity)
+	}
+	identity, err := snapshot.GenerateIdentity()
+	if err != nil {
+		return "", err
+	}
+	if err = store.IsValidFile(kop.identity, &log.Logger); err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(kop.identity, []byte(identity.String()+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return identity.Recipient().String(), nil
+}
+
+// Passphrase reads the backup passphrase from the file at loc, falling back to the EnvPassphrase environment
+// variable when loc is empty
+func Passphrase(loc string) (snapshot.Passphrase, error) {
+	if len(loc) == 0 {
+		if passphrase, ok := os.LookupEnv(EnvPassphrase); ok && len(passphrase) > 0 {
+			return snapshot.Passphrase(passphrase), nil
+		}
+		return "", ErrKeyMissing
+	}
+	content, err := os.ReadFile(loc)
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(content), "\r\n")
+	if len(passphrase) == 0 {
+		return "", snapshot.ErrPassphraseEmpty
+	}
+	return snapshot.Passphrase(passphrase), nil
+}
@@ -6,16 +6,27 @@ package del
 import (
 	"context"
 	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/dark-enstein/vault/vaught/cmd/helper"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"os"
+	"strings"
+)
+
+const (
+	FlagHard    = "hard"
+	FlagPartial = "partial"
 )
 
 type DeleteOptions struct {
-	id string
+	ids     []string
+	hard    bool
+	partial bool
+	// failed counts the tokens a partial deletion couldn't delete
+	failed int
 }
 
 // NewDeleteCmd represents the cli command
@@ -26,7 +37,8 @@ func NewDeleteCmd() *cobra.Command {
 	deleteCmd := &cobra.Command{
 		Use:   "delete",
 		Short: "Deletes a specific token from the vault",
-		Long: `The 'delete' command removes a specified token from the vault's storage, identified by its unique ID. This action is irreversible, emphasizing the need for caution.
+		Long: `The 'delete' command removes a specified token from the vault's storage, identified by its unique ID. Deleted tokens are moved to the trash,
+where 'vault undelete' can bring them back until they are purged. Pass --hard to delete a token for good instead. This action is irreversible, emphasizing the need for caution.
 
 Supported deletion operation:
 
@@ -36,14 +48,23 @@ Examples:
 Delete a token by its ID:
   vault delete --id <token-id>
 
+Delete a token for good, bypassing the trash:
+  vault delete --id <token-id> --hard
+
+Delete several tokens at once. Either all of them are deleted, or none is:
+  vault delete --id <token-id> --id <token-id>
+
+Delete every token that can be, reporting those that can't:
+  vault delete --id <token-id> --id <token-id> --partial
+
 Ensure the correct token ID is specified to prevent unintended data loss. This command is designed for precise operation, allowing for the secure management and cleanup of stored tokens.
 
 Each deletion operation requires the token ID to be specified, ensuring targeted and secure removal of sensitive information.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println("Deleting record with id:", do.id)
+			fmt.Println("Deleting record with id:", strings.Join(do.ids, ", "))
 			debug, err := cmd.Flags().GetBool("debug")
 			if err != nil {
-				log.Error().Msgf("error retrieving persistent flag: %s: %w", "debug", err)
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
 			}
 
 			ctx := context.Background()
@@ -53,14 +74,29 @@ Each deletion operation requires the token ID to be specified, ensuring targeted
 			if err != nil {
 				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
 					fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
-					os.Exit(1)
+				} else {
+					fmt.Println("Delete failed:", err)
+				}
+				os.Exit(1)
+			}
+			if do.failed > 0 {
+				fmt.Printf("Delete failed for %d of %d tokens\n", do.failed, len(do.ids))
+				os.Exit(1)
+			}
+			if do.hard {
+				fmt.Println("Deleted successfully")
+			} else {
+				fmt.Println("Moved to the trash. Undo with:")
+				for _, id := range do.ids {
+					fmt.Println("  vault undelete --id " + id)
 				}
 			}
-			fmt.Println("Deleted successfully")
 		},
 	}
 
-	deleteCmd.Flags().StringVarP(&do.id, "id", "i", "", "specify token ID to be deleted.")
+	deleteCmd.Flags().StringArrayVarP(&do.ids, "id", "i", nil, "specify token ID to be deleted. may be repeated to delete several tokens at once.")
+	deleteCmd.Flags().BoolVar(&do.partial, FlagPartial, false, "delete every token that can be when some can't, instead of none.")
+	deleteCmd.Flags().BoolVar(&do.hard, FlagHard, false, "delete the token for good, instead of moving it to the trash.")
 	return deleteCmd
 }
 
@@ -80,7 +116,15 @@ func (do *DeleteOptions) Run(ctx context.Context, logger *vlog.Logger) error {
 		return err
 	}
 
-	_, err = manager.DeleteTokenByID(ctx, do.id)
-	// ignore error, since delete op
+	results, err := manager.DeleteMany(ctx, do.ids, do.hard, tokenize.BatchOptions{Partial: do.partial})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("error with key %s: %s\n", result.Key, result.Err.Error())
+			do.failed++
+		}
+	}
 	return nil
 }
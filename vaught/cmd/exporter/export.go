@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/parser"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+const (
+	FlagOutput    = "output"
+	FlagFormat    = "format"
+	FlagPlaintext = "plaintext"
+)
+
+type ExportOptions struct {
+	output    string
+	format    string
+	plaintext bool
+}
+
+// NewExportCmd represents the CLI command for writing all secrets to a file
+func NewExportCmd() *cobra.Command {
+
+	eop := &ExportOptions{}
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Writes all secrets to a JSON, CSV or dotenv file",
+		Long: `The 'export' command writes every secret in the vault to a file, or to stdout if no file is given.
+Only tokens are exported by default. Set --plaintext to export the decrypted secrets instead, e.g. to feed them back into 'vault import'.
+
+Supported formats, inferred from the file extension unless --format is set:
+- json: an array of {"id": ..., "data": [{"key": ..., "value": ...}]} objects
+- csv: rows of id,key,value, after an id,key,value header
+- dotenv: variables named <id>__<key>, with the slashes of ids replaced by __, as in team__app__db__password
+
+Examples:
+  vault export -o tokens.json
+  vault export --plaintext -o .env`,
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, err := cmd.Flags().GetBool("debug")
+			if err != nil {
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+			}
+
+			ctx := context.Background()
+			logger := vlog.New(debug)
+
+			if err = eop.Run(ctx, logger); err != nil {
+				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
+					fmt.Fprintln(os.Stderr, "config empty run `vault init` first. see more by running `vault init --help`")
+				} else {
+					fmt.Fprintln(os.Stderr, "Export failed:", err)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	exportCmd.Flags().StringVarP(&eop.output, FlagOutput, "o", "", "specify the file secrets are written to. Defaults to stdout")
+	exportCmd.Flags().StringVar(&eop.format, FlagFormat, "", "specify the file format. Options: json, csv, dotenv. Inferred from the file extension if not set")
+	exportCmd.Flags().BoolVar(&eop.plaintext, FlagPlaintext, false, "export decrypted secrets instead of tokens")
+
+	return exportCmd
+}
+
+func (eop *ExportOptions) Run(ctx context.Context, logger *vlog.Logger) error {
+	var err error
+	format := parser.FormatFromPath(eop.output)
+	if len(eop.format) > 0 {
+		if format, err = parser.ParseFormat(eop.format); err != nil {
+			return err
+		}
+	}
+
+	ic := helper.NewInstanceConfig()
+	if err = ic.JsonDecode(); err != nil {
+		return err
+	}
+
+	manager, err := ic.Manager(ctx)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := manager.Export(ctx, eop.plaintext)
+	if err != nil {
+		return err
+	}
+
+	if len(eop.output) == 0 {
+		return parser.Encode(os.Stdout, format, tokens)
+	}
+
+	// plaintext exports hold secrets, so keep them private to the user
+	f, err := os.OpenFile(eop.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = parser.Encode(f, format, tokens); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	logger.Logger().Info().Msgf("Exported secrets to %s", eop.output)
+	return nil
+}
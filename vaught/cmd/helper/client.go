@@ -0,0 +1,77 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/service"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds a request to the service, which may wait for its cluster to elect a leader
+const requestTimeout = 30 * time.Second
+
+// RunWithService runs fn with a client of the service at address. Failures are printed after failed, and exit the
+// process.
+func RunWithService(address, failed string, fn func(ctx context.Context, c *Client) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := fn(ctx, &Client{address: strings.TrimSuffix(address, "/")}); err != nil {
+		fmt.Println(failed, err)
+		os.Exit(1)
+	}
+}
+
+// Client calls the api of a vault service, scoped to the namespace of the command
+type Client struct {
+	address string
+}
+
+// Call sends body as json to the route of the service, and decodes the result of its response into result
+func (c *Client) Call(ctx context.Context, method, route string, body, result any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.address+route, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(Namespace) > 0 {
+		req.Header.Set(service.HeaderNamespace, Namespace)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resp := model.Response{Resp: result}
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("unexpected response from %s: %s: %w", c.address, res.Status, err)
+	}
+	if len(resp.Error) > 0 {
+		return errors.New(strings.Join(resp.Error, "; "))
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected response from %s: %s", c.address, res.Status)
+	}
+	return nil
+}
+
+// EnvOr returns the value of the environment variable key, or def if it is unset
+func EnvOr(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return def
+}
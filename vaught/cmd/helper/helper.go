@@ -9,8 +9,11 @@ import (
 	"github.com/dark-enstein/vault/pkg/store"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/dark-enstein/vault/service"
+	"github.com/mitchellh/go-homedir"
 	"os"
+	"os/user"
 	"path/filepath"
+	"time"
 )
 
 var (
@@ -25,53 +28,204 @@ var (
 	DefaultCipherLoc  = filepath.Join(DefaultRootConfig, ".cipher")
 	DefaultStoreLoc   = filepath.Join(DefaultRootConfig, ".store")
 	DefaultGobLoc     = filepath.Join(DefaultRootConfig, ".gob")
+	DefaultStoreKey   = filepath.Join(DefaultRootConfig, ".store.key")
 )
 
 var logger = vlog.New(true)
 
+// EnvNamespace selects the namespace commands are scoped to when --namespace isn't passed
+const EnvNamespace = "VAULT_NAMESPACE"
+
+// EnvAddress is the address of the vault service commands talking to it reach, when --address isn't passed
+const EnvAddress = "VAULT_ADDR"
+
+// DefaultAddress is the address of a vault service run locally with the default port
+const DefaultAddress = "http://127.0.0.1:8080"
+
+// Namespace is the namespace commands are scoped to, set by the --namespace flag of the root command. Empty selects
+// the default namespace.
+var Namespace string
+
 type InstanceConfig struct {
 	ID          string `json:"id"`
 	CipherLoc   string `json:"cipher_loc"`
 	StoreLoc    string `json:"store_loc"`
 	RedisString string `json:"redis_string"`
 	StoreType   string `json:"store_type"`
-	Debug       bool   `json:"debug"`
-	LastUse     int64  `json:"last_login"`
+	// StoreURL addresses the storage backend, as in plugin:///path/to/plugin?socket=true. It takes precedence over
+	// StoreLoc and RedisString.
+	StoreURL string `json:"store_url,omitempty"`
+	// Replicas are the store urls of secondaries the store is mirrored to
+	Replicas    []string `json:"replicas,omitempty"`
+	ReplicaMode string   `json:"replica_mode,omitempty"`
+	// ReadOrder is the order replicas are read from, 0 being the primary. See store.ReplicatedConfig.
+	ReadOrder   []int  `json:"read_order,omitempty"`
+	Encrypt     bool   `json:"encrypt"`
+	StoreKeyLoc string `json:"store_key_loc"`
+	// CacheSize enables a read-through cache of at most CacheSize entries in front of the store when positive
+	CacheSize        int    `json:"cache_size"`
+	CacheTTL         string `json:"cache_ttl"`
+	CachePolicy      string `json:"cache_policy"`
+	CacheNegativeTTL string `json:"cache_negative_ttl"`
+	// TrashRetention is how long deleted tokens are kept in the trash. Empty keeps the default.
+	TrashRetention string `json:"trash_retention,omitempty"`
+	Debug          bool   `json:"debug"`
+	LastUse        int64  `json:"last_login"`
 }
 
 func NewInstanceConfig() *InstanceConfig {
 	return &InstanceConfig{}
 }
 
-func (ic *InstanceConfig) Manager(ctx context.Context) (*tokenize.Manager, error) {
-	if len(ic.StoreLoc) == 0 {
-		return nil, ErrStoreTypeEmpty
+// StoreConfig returns the driver and config of the storage backend of the instance config. Locations left empty
+// default to the ones under DefaultRootConfig.
+func (ic *InstanceConfig) StoreConfig() (string, store.Config, error) {
+	if len(ic.StoreURL) > 0 {
+		driver, config, err := store.ParseURL(ic.StoreURL)
+		config.Logger = logger
+		return driver, config, err
+	}
+	if len(ic.StoreType) == 0 {
+		return "", store.Config{}, ErrStoreTypeEmpty
+	}
+	loc := ic.StoreLoc
+	if ic.StoreType == service.STORE_REDIS {
+		loc = ic.RedisString
+	}
+	if len(loc) == 0 {
+		loc = defaultLocs[ic.StoreType]
 	}
+	loc, err := homedir.Expand(loc)
+	if err != nil {
+		return "", store.Config{}, err
+	}
+	return ic.StoreType, store.Config{Loc: loc, Logger: logger}, nil
+}
+
+// defaultLocs holds the default location of each built-in driver that takes one
+var defaultLocs = map[string]string{
+	service.STORE_FILE:  DefaultStoreLoc,
+	service.STORE_GOB:   DefaultGobLoc,
+	service.STORE_REDIS: store.DefaultRedisConnectionString,
+}
+
+// Store opens the storage backend of the instance config, mirrored to its replicas if it has any. It is neither
+// encrypted nor cached.
+func (ic *InstanceConfig) Store(ctx context.Context) (store.Store, error) {
 	log := logger.Logger()
-	switch ic.StoreLoc {
-	case service.STORE_FILE:
-		log.Info().Msg("Using File storage")
-		return tokenize.NewManager(ctx, logger, tokenize.WithStore(store.NewFile(ic.StoreLoc, logger))), nil
-	case service.STORE_GOB:
-		log.Info().Msg("Using Gob storage")
-		gob, err := store.NewGob(ctx, ic.StoreLoc, logger, false)
+	driver, config, err := ic.StoreConfig()
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Using %s storage", driver)
+	s, err := store.Open(ctx, driver, config)
+	if errors.Is(err, store.ErrDriverUnknown) {
+		return nil, fmt.Errorf("%w: %w", ErrStoreTypeInvalid, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while creating storage backend: %w", err)
+	}
+	if len(ic.Replicas) == 0 {
+		return s, nil
+	}
+
+	log.Info().Msgf("Mirroring storage to %d replicas", len(ic.Replicas))
+	var secondaries []store.Store
+	for _, raw := range ic.Replicas {
+		secondary, err := store.OpenURL(ctx, raw, logger)
 		if err != nil {
-			log.Fatal().Msgf("error while creating storage backend: %s", err)
+			return nil, fmt.Errorf("error while creating replica %s: %w", raw, err)
 		}
-		return tokenize.NewManager(ctx, logger, tokenize.WithStore(gob)), nil
-	case service.STORE_REDIS:
-		log.Info().Msg("Using Redis storage")
-		r, err := store.NewRedis(ic.RedisString, logger)
+		secondaries = append(secondaries, secondary)
+	}
+	return store.NewReplicated(s, secondaries, store.ReplicatedConfig{Mode: store.ReplicaMode(ic.ReplicaMode), ReadOrder: ic.ReadOrder}, logger)
+}
+
+func (ic *InstanceConfig) Manager(ctx context.Context) (*tokenize.Manager, error) {
+	log := logger.Logger()
+	s, err := ic.Store(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ic.Encrypt {
+		log.Info().Msg("Encrypting storage at rest")
+		s, err = ic.encrypted(s)
 		if err != nil {
-			log.Fatal().Msgf("error while creating storage backend: %s", err)
+			return nil, err
 		}
-		return tokenize.NewManager(ctx, logger, tokenize.WithStore(r)), nil
-	case service.STORE_MAP:
-		log.Info().Msg("Using In-memory map storage")
-		return tokenize.NewManager(ctx, logger, tokenize.WithStore(store.NewSyncMap(ctx, logger))), nil
-	default:
-		return nil, ErrStoreTypeInvalid
 	}
+
+	if ic.CacheSize > 0 {
+		log.Info().Msg("Caching storage reads")
+		s, err = ic.cached(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var retention time.Duration
+	if len(ic.TrashRetention) > 0 {
+		if retention, err = time.ParseDuration(ic.TrashRetention); err != nil {
+			return nil, fmt.Errorf("trash retention invalid: %w", err)
+		}
+	}
+	manager := tokenize.NewManager(ctx, logger, tokenize.WithStore(s), tokenize.WithIdentity(identity()), tokenize.WithTrashRetention(retention))
+	return manager.InNamespace(ctx, Namespace)
+}
+
+// identity returns the name of the user running the CLI, which is recorded in the metadata of the secrets it changes
+func identity() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// CacheConfig parses the cache settings of the instance config
+func (ic *InstanceConfig) CacheConfig() (store.CacheConfig, error) {
+	config := store.CacheConfig{
+		Size:   ic.CacheSize,
+		Policy: store.CachePolicy(ic.CachePolicy),
+	}
+	var err error
+	if len(ic.CacheTTL) > 0 {
+		if config.TTL, err = time.ParseDuration(ic.CacheTTL); err != nil {
+			return config, fmt.Errorf("cache ttl invalid: %w", err)
+		}
+	}
+	if len(ic.CacheNegativeTTL) > 0 {
+		if config.NegativeTTL, err = time.ParseDuration(ic.CacheNegativeTTL); err != nil {
+			return config, fmt.Errorf("cache negative ttl invalid: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// cached wraps s with a read-through cache using the configured cache settings
+func (ic *InstanceConfig) cached(s store.Store) (store.Store, error) {
+	config, err := ic.CacheConfig()
+	if err != nil {
+		return nil, err
+	}
+	return store.NewCached(s, config, logger)
+}
+
+// encrypted wraps s with authenticated encryption under the configured store key
+func (ic *InstanceConfig) encrypted(s store.Store) (store.Store, error) {
+	keyLoc := ic.StoreKeyLoc
+	if len(keyLoc) == 0 {
+		keyLoc = DefaultStoreKey
+	}
+	keyLoc, err := homedir.Expand(keyLoc)
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.LoadStoreKey(keyLoc, logger)
+	if err != nil {
+		return nil, err
+	}
+	return store.NewEncrypted(s, key, logger)
 }
 
 func (ic *InstanceConfig) JsonEncode(path string) error {
@@ -126,9 +280,9 @@ func (ic *InstanceConfig) jsonDecode(path string) error {
 	}
 
 	// reset instance config
-	ic = &InstanceConfig{}
+	*ic = InstanceConfig{}
 
-	err = json.Unmarshal(fileBytes, &ic)
+	err = json.Unmarshal(fileBytes, ic)
 	if err != nil {
 		log.Error().Msgf("json config invalid: %s", err)
 		return err
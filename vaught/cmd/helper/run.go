@@ -0,0 +1,74 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// RunWithManager resolves the manager of the configured store, and runs fn with it. Failures are printed after
+// failed, and exit the process.
+func RunWithManager(cmd *cobra.Command, failed string, fn func(ctx context.Context, manager *tokenize.Manager) error) {
+	run(cmd, failed, func(ctx context.Context, ic *InstanceConfig) error {
+		manager, err := ic.Manager(ctx)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, manager)
+	})
+}
+
+// RunWithStore connects to the configured storage backend, and runs fn with it before closing it. The store is
+// neither encrypted nor cached, for commands working on the stored records as they are. Failures are printed after
+// failed, and exit the process.
+func RunWithStore(cmd *cobra.Command, failed string, fn func(ctx context.Context, s store.Store) error) {
+	run(cmd, failed, func(ctx context.Context, ic *InstanceConfig) error {
+		s, err := ic.Store(ctx)
+		if err != nil {
+			return err
+		}
+		if b, err := s.Connect(ctx); err != nil || !b {
+			return fmt.Errorf("could not connect to the store: %v", err)
+		}
+		defer s.Close(ctx)
+		return fn(ctx, s)
+	})
+}
+
+// RunWithConfig loads the instance config, and runs fn with it, for commands that don't connect to the store.
+// Failures are printed after failed, and exit the process.
+func RunWithConfig(cmd *cobra.Command, failed string, fn func(ctx context.Context, ic *InstanceConfig) error) {
+	run(cmd, failed, fn)
+}
+
+// run loads the instance config, and runs fn with it
+func run(cmd *cobra.Command, failed string, fn func(ctx context.Context, ic *InstanceConfig) error) {
+	debug, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+	}
+
+	ctx := context.Background()
+	logger := vlog.New(debug)
+	logger.Logger().Debug().Msgf("running %s command", cmd.Name())
+
+	ic := NewInstanceConfig()
+	if err = ic.JsonDecode(); err == nil {
+		err = fn(ctx, ic)
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrConfigEmpty) || errors.Is(err, ErrStoreTypeEmpty) {
+			fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
+		} else {
+			fmt.Println(failed, err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/parser"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+const (
+	FlagFormat     = "format"
+	FlagOnConflict = "on-conflict"
+)
+
+type ImportOptions struct {
+	file       string
+	format     string
+	onConflict string
+}
+
+// NewImportCmd represents the CLI command for storing many secrets at once from a file
+func NewImportCmd() *cobra.Command {
+
+	iop := &ImportOptions{}
+
+	importCmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Tokenizes and stores all secrets in a JSON, CSV or dotenv file",
+		Long: `The 'import' command reads plaintext secrets from a file, tokenizes them, and stores the tokens in the vault in one go.
+Pass '-' to read from stdin.
+
+Supported formats, inferred from the file extension unless --format is set:
+- json: an array of {"id": ..., "data": [{"key": ..., "value": ...}]} objects
+- csv: rows of id,key,value, after an id,key,value header
+- dotenv: variables named <id>__<key>, with the slashes of ids replaced by __, as in team__app__db__password
+
+Every key is validated before anything is written. Keys that already exist in the vault are handled according to --on-conflict:
+- skip: keep the existing token
+- overwrite: replace the existing token
+- fail: abort the import without writing anything
+
+Examples:
+  vault import secrets.json
+  vault import .env --on-conflict overwrite
+  cat secrets.csv | vault import - --format csv`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, err := cmd.Flags().GetBool("debug")
+			if err != nil {
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+			}
+
+			ctx := context.Background()
+			logger := vlog.New(debug)
+			iop.file = args[0]
+
+			bytes, err := iop.Run(ctx, logger)
+			if len(bytes) > 0 {
+				fmt.Println(string(bytes))
+			}
+			if err != nil {
+				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
+					fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
+				} else {
+					fmt.Println("Import failed:", err)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	importCmd.Flags().StringVar(&iop.format, FlagFormat, "", "specify the file format. Options: json, csv, dotenv. Inferred from the file extension if not set")
+	importCmd.Flags().StringVar(&iop.onConflict, FlagOnConflict, string(tokenize.ConflictFail), "specify what to do with keys that already exist. Options: skip, overwrite, fail")
+
+	return importCmd
+}
+
+func (iop *ImportOptions) Run(ctx context.Context, logger *vlog.Logger) ([]byte, error) {
+	policy, err := tokenize.ParseConflictPolicy(iop.onConflict)
+	if err != nil {
+		return nil, err
+	}
+	format := parser.FormatFromPath(iop.file)
+	if len(iop.format) > 0 {
+		if format, err = parser.ParseFormat(iop.format); err != nil {
+			return nil, err
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	if iop.file != "-" {
+		f, err := os.Open(iop.file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	tokens, err := parser.Decode(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	ic := helper.NewInstanceConfig()
+	if err = ic.JsonDecode(); err != nil {
+		return nil, err
+	}
+
+	manager, err := ic.Manager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := manager.Import(ctx, tokens, policy)
+	jsonBytes, jsonErr := json.MarshalIndent(report, "", "  ")
+	if jsonErr != nil {
+		logger.Logger().Error().Msgf("error marshalling import report into json: %s", jsonErr)
+	}
+	return jsonBytes, err
+}
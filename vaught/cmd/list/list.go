@@ -8,14 +8,34 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
 	"github.com/dark-enstein/vault/pkg/vlog"
 	"github.com/dark-enstein/vault/vaught/cmd/helper"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"os"
+	"strings"
+)
+
+const (
+	FlagTree      = "tree"
+	FlagMatch     = "match"
+	FlagLabel     = "label"
+	FlagSort      = "sort"
+	FlagLimit     = "limit"
+	FlagPageToken = "page-token"
 )
 
 type ListOptions struct {
+	prefix    string
+	tree      bool
+	match     string
+	labels    []string
+	sort      string
+	limit     int
+	pageToken string
+	// next is the page token of the page after the one listed
+	next string
 }
 
 // NewListCmd represents the CLI command for listing all stored tokens
@@ -24,21 +44,36 @@ func NewListCmd() *cobra.Command {
 	lop := ListOptions{}
 
 	listCmd := &cobra.Command{
-		Use:   "list",
+		Use:   "list [path prefix]",
 		Short: "Lists all stored tokens in the vault",
 		Long: `The 'list' command retrieves and displays all tokens currently stored in the vault. 
 This command is useful for getting an overview of all the secrets managed by the vault system. 
 
 Usage:
 
-  vault list
+  vault list [path prefix] [--tree] [--match <glob>] [--label key=value]... [--sort id|created|updated] [--limit <n>] [--page-token <token>]
+
+This will output all the tokens stored, formatted as JSON for easy reading and integration with other tools. Ensure you have the appropriate permissions and the vault is correctly configured before running this command.
+Secrets are stored under slash-separated paths, like team/app/db/password. Pass a path prefix to only list the secrets under it, and --tree to print the paths as a directory tree instead.
+Narrow the listing down with a --match glob, where '*' matches within a path segment, and with --label, which keeps the secrets carrying the label. A label without a value matches any value.
+Secrets are listed by path. --sort created or updated lists them by time instead, and a leading '-' reverses the order.
+Pass --limit to list a page at a time. Every page but the last ends with the page token to pass as --page-token for the next one.
 
-This will output all the tokens stored, formatted as JSON for easy reading and integration with other tools. Ensure you have the appropriate permissions and the vault is correctly configured before running this command.`,
+Examples:
+  vault list
+  vault list team/app/
+  vault list team --tree
+  vault list --match 'team/*/db/*' --label env=prod
+  vault list team --sort -updated --limit 50`,
+		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				lop.prefix = args[0]
+			}
 			fmt.Println("Listing records in vault")
 			debug, err := cmd.Flags().GetBool("debug")
 			if err != nil {
-				log.Error().Msgf("error retrieving persistent flag: %s: %w", "debug", err)
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
 			}
 
 			ctx := context.Background()
@@ -48,15 +83,31 @@ This will output all the tokens stored, formatted as JSON for easy reading and i
 			if err != nil {
 				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
 					fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
-					os.Exit(1)
+				} else {
+					fmt.Println("List failed:", err)
 				}
+				os.Exit(1)
 			}
 
-			fmt.Println("All Tokens:")
+			if len(lop.prefix) > 0 {
+				fmt.Printf("Tokens under %s:\n", lop.prefix)
+			} else {
+				fmt.Println("All Tokens:")
+			}
 			fmt.Println(string(bytes))
+			if len(lop.next) > 0 {
+				fmt.Printf("More tokens left. Continue with --%s %s\n", FlagPageToken, lop.next)
+			}
 		},
 	}
 
+	listCmd.Flags().BoolVar(&lop.tree, FlagTree, false, "print the paths of the secrets as a directory tree")
+	listCmd.Flags().StringVar(&lop.match, FlagMatch, "", "only list the secrets whose path matches this glob, as in team/*/db/*")
+	listCmd.Flags().StringArrayVarP(&lop.labels, FlagLabel, "l", nil, "only list the secrets carrying this label, as key=value or key. Can be repeated")
+	listCmd.Flags().StringVar(&lop.sort, FlagSort, "", "sort by id, created or updated. Start with '-' to reverse the order")
+	listCmd.Flags().IntVar(&lop.limit, FlagLimit, 0, "list at most this many secrets. 0 lists them all")
+	listCmd.Flags().StringVar(&lop.pageToken, FlagPageToken, "", "continue a listing from the page token printed after its previous page")
+
 	return listCmd
 
 }
@@ -78,11 +129,35 @@ func (lop *ListOptions) Run(ctx context.Context, logger *vlog.Logger) ([]byte, e
 		return nil, err
 	}
 
-	tokens, err := manager.GetAllTokens(ctx)
+	opts := tokenize.ListOptions{
+		Prefix:    lop.prefix,
+		Match:     lop.match,
+		Sort:      lop.sort,
+		Limit:     lop.limit,
+		PageToken: lop.pageToken,
+	}
+	for _, label := range lop.labels {
+		k, v, _ := strings.Cut(label, "=")
+		if len(k) == 0 {
+			return nil, tokenize.ErrLabelKeyEmpty
+		}
+		if opts.Labels == nil {
+			opts.Labels = map[string]string{}
+		}
+		opts.Labels[k] = v
+	}
+
+	page, err := manager.ListPage(ctx, opts)
 	if err != nil {
 		logger.Logger().Error().Msgf("error retrieving tokens from store: %s", err)
 		return nil, err
 	}
+	tokens := page.Tokens
+	lop.next = page.NextPageToken
+
+	if lop.tree {
+		return []byte(Tree(tokens)), nil
+	}
 
 	bytesResult, err := json.Marshal(&tokens)
 	if err != nil {
@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package list
+
+import (
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"sort"
+	"strings"
+)
+
+// node is a segment of the path of a secret. A segment can hold a secret, other segments, or both.
+type node struct {
+	secret   bool
+	children map[string]*node
+}
+
+func (n *node) child(name string) *node {
+	if n.children == nil {
+		n.children = map[string]*node{}
+	}
+	if _, ok := n.children[name]; !ok {
+		n.children[name] = &node{}
+	}
+	return n.children[name]
+}
+
+// Tree renders the paths of tokens as a directory tree. Segments holding other segments end with a slash.
+func Tree(tokens []*model.Tokenize) string {
+	root := &node{}
+	for _, token := range tokens {
+		parent := root
+		if id := store.CleanPath(token.ID); len(id) > 0 {
+			for _, segment := range strings.Split(id, store.PathSeparator) {
+				parent = parent.child(segment)
+			}
+		}
+		for _, child := range token.Data {
+			parent.child(child.Key).secret = true
+		}
+	}
+
+	var b strings.Builder
+	root.render(&b, "")
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (n *node) render(b *strings.Builder, indent string) {
+	// a segment holding both a secret and other segments is listed twice, once as each
+	type entry struct {
+		label string
+		dir   *node
+	}
+	entries := []entry{}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := n.children[name]
+		if child.secret {
+			entries = append(entries, entry{label: name})
+		}
+		if len(child.children) > 0 {
+			entries = append(entries, entry{label: name + store.PathSeparator, dir: child})
+		}
+	}
+
+	for i, e := range entries {
+		branch, next := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, next = "└── ", "    "
+		}
+		b.WriteString(indent + branch + e.label + "\n")
+		if e.dir != nil {
+			e.dir.render(b, indent+next)
+		}
+	}
+}
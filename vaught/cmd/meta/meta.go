@@ -0,0 +1,154 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+const (
+	FlagID          = "id"
+	FlagDescription = "description"
+	FlagLabel       = "label"
+	FlagRemoveLabel = "remove-label"
+)
+
+type SetOptions struct {
+	id           string
+	description  string
+	labels       []string
+	removeLabels []string
+}
+
+// NewMetaCmd represents the CLI command for viewing and editing the metadata of secrets
+func NewMetaCmd() *cobra.Command {
+
+	metaCmd := &cobra.Command{
+		Use:   "meta",
+		Short: "Shows and edits the metadata of a secret",
+		Long: `The 'meta' command shows and edits the metadata the vault keeps for every secret: when it was created, last updated and last accessed,
+who created and last updated it, and a free-form description and labels.
+
+Timestamps and owners are maintained by the vault. The CLI records changes as made by the user running it.
+
+Examples:
+  vault meta get --id customer123/ssn
+  vault meta set --id customer123/ssn --description "Social security number" --label team=payments --label env=prod
+  vault meta set --id customer123/ssn --remove-label env`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	metaCmd.AddCommand(newGetCmd())
+	metaCmd.AddCommand(newSetCmd())
+
+	return metaCmd
+}
+
+func newGetCmd() *cobra.Command {
+	var id string
+
+	getCmd := &cobra.Command{
+		Use:   "get",
+		Short: "Shows the metadata of a secret",
+		Long: `The 'get' command prints the metadata of a secret as JSON, without reading the secret itself.
+
+Example:
+  vault meta get --id customer123/ssn`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Metadata retrieval failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				meta, err := manager.GetMetadata(ctx, id)
+				if err != nil {
+					return err
+				}
+				return printMeta(meta)
+			})
+		},
+	}
+
+	getCmd.Flags().StringVarP(&id, FlagID, "i", "", "specify the ID of the secret")
+	getCmd.MarkFlagRequired(FlagID)
+
+	return getCmd
+}
+
+func newSetCmd() *cobra.Command {
+
+	sop := &SetOptions{}
+
+	setCmd := &cobra.Command{
+		Use:   "set",
+		Short: "Sets the description and labels of a secret",
+		Long: `The 'set' command edits the description and labels of a secret, and prints its updated metadata.
+Labels are given as key=value, and replace existing labels with the same key. Flags that aren't passed are left as they are.
+
+Example:
+  vault meta set --id customer123/ssn --description "Social security number" --label team=payments --remove-label env`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Metadata update failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				update, err := sop.update(cmd)
+				if err != nil {
+					return err
+				}
+				meta, err := manager.UpdateMetadata(ctx, sop.id, update)
+				if err != nil {
+					return err
+				}
+				return printMeta(meta)
+			})
+		},
+	}
+
+	setCmd.Flags().StringVarP(&sop.id, FlagID, "i", "", "specify the ID of the secret")
+	setCmd.Flags().StringVar(&sop.description, FlagDescription, "", "set the description of the secret")
+	setCmd.Flags().StringArrayVarP(&sop.labels, FlagLabel, "l", nil, "add or replace a label, as key=value. Can be repeated")
+	setCmd.Flags().StringArrayVar(&sop.removeLabels, FlagRemoveLabel, nil, "remove the label with this key. Can be repeated")
+	setCmd.MarkFlagRequired(FlagID)
+
+	return setCmd
+}
+
+// update builds the metadata update the flags of cmd ask for
+func (sop *SetOptions) update(cmd *cobra.Command) (tokenize.MetadataUpdate, error) {
+	var update tokenize.MetadataUpdate
+	if cmd.Flags().Changed(FlagDescription) {
+		update.Description = &sop.description
+	}
+	for _, label := range sop.labels {
+		k, v, ok := strings.Cut(label, "=")
+		if !ok {
+			return update, fmt.Errorf("label %q must be given as key=value", label)
+		}
+		if update.Labels == nil {
+			update.Labels = map[string]string{}
+		}
+		update.Labels[k] = v
+	}
+	update.RemoveLabels = sop.removeLabels
+	return update, nil
+}
+
+// printMeta writes meta to stdout as indented json
+func printMeta(meta *model.Metadata) error {
+	if meta == nil {
+		fmt.Println("No metadata recorded")
+		return nil
+	}
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
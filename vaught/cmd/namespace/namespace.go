@@ -0,0 +1,171 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	FlagQuota = "quota"
+)
+
+type CreateOptions struct {
+	quota int
+}
+
+// NewNamespaceCmd represents the CLI command for managing namespaces
+func NewNamespaceCmd() *cobra.Command {
+
+	namespaceCmd := &cobra.Command{
+		Use:   "namespace",
+		Short: "Creates, lists, deletes and sets quotas on namespaces",
+		Long: `The 'namespace' command manages namespaces. Every namespace is an isolated keyspace of the vault, with its own storage prefix and its own encryption keys,
+so the secrets of one namespace can't be listed, read or detokenized from another.
+
+Select the namespace other commands work in with the global --namespace flag, or the ` + helper.EnvNamespace + ` environment variable.
+Without either, commands work in the default namespace.
+
+Examples:
+  vault namespace create payments --quota 1000
+  vault namespace list
+  vault --namespace payments store --id customer123 --secret 1234
+  vault namespace quota payments 0
+  vault namespace delete payments`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	namespaceCmd.AddCommand(newCreateCmd())
+	namespaceCmd.AddCommand(newListCmd())
+	namespaceCmd.AddCommand(newQuotaCmd())
+	namespaceCmd.AddCommand(newDeleteCmd())
+
+	return namespaceCmd
+}
+
+func newCreateCmd() *cobra.Command {
+
+	cop := &CreateOptions{}
+
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Creates a namespace",
+		Long: `The 'create' command creates a namespace. Names are 1 to 63 lowercase letters, digits, '-' or '_', starting with a letter or digit.
+A positive --quota caps the number of keys the namespace can hold.
+
+Example:
+  vault namespace create payments --quota 1000`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Namespace creation failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				ns, err := manager.CreateNamespace(ctx, args[0], cop.quota)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Created namespace %s with %s\n", ns.Name, quota(ns.Quota))
+				return nil
+			})
+		},
+	}
+
+	createCmd.Flags().IntVar(&cop.quota, FlagQuota, 0, "cap the number of keys in the namespace. 0 means unlimited")
+
+	return createCmd
+}
+
+func newListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Lists namespaces",
+		Long: `The 'list' command lists every namespace, with the number of keys it holds and its quota.
+
+Example:
+  vault namespace list`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Namespace listing failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				namespaces, err := manager.ListNamespaces(ctx)
+				if err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "NAME\tKEYS\tQUOTA\tCREATED")
+				for _, ns := range namespaces {
+					limit := "none"
+					if ns.Quota > 0 {
+						limit = strconv.Itoa(ns.Quota)
+					}
+					fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", ns.Name, ns.Keys, limit, ns.CreatedAt.Format(time.RFC3339))
+				}
+				return tw.Flush()
+			})
+		},
+	}
+}
+
+func newQuotaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "quota <name> <keys>",
+		Short: "Sets the quota of a namespace",
+		Long: `The 'quota' command caps the number of keys a namespace can hold, or lifts the cap when set to 0.
+Keys over a lowered quota are kept, but no new key is accepted until the namespace is back under it.
+
+Example:
+  vault namespace quota payments 500`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Namespace quota update failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				keys, err := strconv.Atoi(args[1])
+				if err != nil {
+					return fmt.Errorf("quota must be a number of keys: %w", err)
+				}
+				ns, err := manager.SetNamespaceQuota(ctx, args[0], keys)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Namespace %s now holds %d keys with %s\n", ns.Name, ns.Keys, quota(ns.Quota))
+				return nil
+			})
+		},
+	}
+}
+
+func newDeleteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Deletes a namespace and all its secrets",
+		Long: `The 'delete' command deletes every secret of a namespace, and then the namespace itself. This can't be undone.
+
+Example:
+  vault namespace delete payments`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Namespace deletion failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				deleted, err := manager.DeleteNamespace(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Deleted namespace %s and its %d keys\n", args[0], deleted)
+				return nil
+			})
+		},
+	}
+}
+
+func quota(keys int) string {
+	if keys == 0 {
+		return "no quota"
+	}
+	return fmt.Sprintf("a quota of %d keys", keys)
+}
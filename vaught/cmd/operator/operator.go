@@ -0,0 +1,38 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package operator
+
+import (
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FlagAddress = "address"
+)
+
+// NewOperatorCmd represents the CLI command for operating running vault services
+func NewOperatorCmd() *cobra.Command {
+
+	var address string
+
+	operatorCmd := &cobra.Command{
+		Use:   "operator",
+		Short: "Operates running vault services",
+		Long: `The 'operator' command operates vault services through their api, rather than the configured store.
+
+The service is reached at --address, or the address in the ` + helper.EnvAddress + ` environment variable.
+
+Examples:
+  vault operator raft peers --address http://127.0.0.1:8080`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	operatorCmd.PersistentFlags().StringVar(&address, FlagAddress, helper.EnvOr(helper.EnvAddress, helper.DefaultAddress), "address of the vault service to operate, as in "+helper.DefaultAddress)
+	operatorCmd.AddCommand(newRaftCmd(&address))
+
+	return operatorCmd
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package operator
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/model"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/service"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+func newRaftCmd(address *string) *cobra.Command {
+
+	raftCmd := &cobra.Command{
+		Use:   "raft",
+		Short: "Manages the members of the raft cluster of a vault service",
+		Long: `The 'raft' command manages the raft cluster a vault service replicates its store across, when run with --raft-node-id.
+
+A cluster starts as the single node run with --raft-bootstrap. Every other node is run without it, and joined to the
+cluster once with 'vault operator raft join'. Nodes keep their membership across restarts. A node leaving the cluster
+for good is removed with 'vault operator raft remove', so the cluster stops counting on its vote.
+
+Examples:
+  vault operator raft join 127.0.0.1:8201 --address http://127.0.0.1:8081
+  vault operator raft peers
+  vault operator raft remove n3`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	raftCmd.AddCommand(newJoinCmd(address))
+	raftCmd.AddCommand(newRemoveCmd(address))
+	raftCmd.AddCommand(newPeersCmd(address))
+
+	return raftCmd
+}
+
+func newJoinCmd(address *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "join <raft address>",
+		Short: "Joins the node of a vault service to a raft cluster",
+		Long: `The 'join' command joins the raft node of the service at --address to the cluster of the node listening at the raft address, as passed to its --raft-addr.
+Any node of the cluster can be joined through, as the request is forwarded to the leader. The joining node must start with an empty store,
+which the cluster then replicates its records to.
+
+Example:
+  vault operator raft join 127.0.0.1:8201 --address http://127.0.0.1:8081`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithService(*address, "Raft join failed:", func(ctx context.Context, c *helper.Client) error {
+				var peer store.RaftPeer
+				if err := c.Call(ctx, http.MethodPost, service.RaftJoin, model.RaftJoinRequest{Address: args[0]}, &peer); err != nil {
+					return err
+				}
+				fmt.Printf("Joined node %s at %s to the cluster of %s\n", peer.ID, peer.Address, args[0])
+				return nil
+			})
+		},
+	}
+}
+
+func newRemoveCmd(address *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <node id>",
+		Short: "Removes a node from a raft cluster",
+		Long: `The 'remove' command removes the node of the given id from the raft cluster of the service at --address. A removed node stops
+replicating, and its vote no longer counts towards the majority the cluster needs to commit writes.
+
+Example:
+  vault operator raft remove n3`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithService(*address, "Raft remove failed:", func(ctx context.Context, c *helper.Client) error {
+				if err := c.Call(ctx, http.MethodPost, service.RaftRemove, model.RaftRemoveRequest{NodeID: args[0]}, nil); err != nil {
+					return err
+				}
+				fmt.Printf("Removed node %s from the cluster\n", args[0])
+				return nil
+			})
+		},
+	}
+}
+
+func newPeersCmd(address *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "peers",
+		Short: "Lists the nodes of a raft cluster",
+		Long: `The 'peers' command lists the nodes of the raft cluster of the service at --address, and which of them leads it.
+
+Example:
+  vault operator raft peers`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithService(*address, "Raft peers listing failed:", func(ctx context.Context, c *helper.Client) error {
+				var status store.RaftStatus
+				if err := c.Call(ctx, http.MethodGet, service.RaftStatus, nil, &status); err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "NODE\tADDRESS\tSTATE\tVOTER")
+				for _, peer := range status.Peers {
+					state := "follower"
+					if peer.Leader {
+						state = "leader"
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", peer.ID, peer.Address, state, peer.Voter)
+				}
+				return tw.Flush()
+			})
+		},
+	}
+}
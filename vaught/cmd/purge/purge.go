@@ -0,0 +1,52 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package purge
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FlagAll = "all"
+)
+
+// NewPurgeCmd represents the CLI command for deleting trashed tokens for good
+func NewPurgeCmd() *cobra.Command {
+	opts := tokenize.PurgeOptions{}
+
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Deletes trashed tokens for good",
+		Long: `The 'purge' command deletes the tokens in the trash whose retention ran out, so they can't be undeleted anymore.
+Pass --id to purge a single token whatever its age, or --all to empty the trash. This can't be undone.
+
+The retention is set with 'vault init --trash-retention', and defaults to 30 days.
+
+Examples:
+  vault purge
+  vault purge --id customer123/ssn
+  vault purge --all`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Purge failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				purged, err := manager.Purge(ctx, opts)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Purged %d tokens from the trash\n", purged)
+				return nil
+			})
+		},
+	}
+
+	purgeCmd.Flags().StringVarP(&opts.ID, "id", "i", "", "purge the token with this ID, whatever its age")
+	purgeCmd.Flags().BoolVar(&opts.All, FlagAll, false, "empty the trash")
+	purgeCmd.MarkFlagsMutuallyExclusive("id", FlagAll)
+
+	return purgeCmd
+}
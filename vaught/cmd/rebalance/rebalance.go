@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package rebalance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FlagRetire = "retire"
+	FlagDryRun = "dry-run"
+)
+
+var (
+	ErrNotSharded = errors.New("the store isn't sharded. set one up with `vault init --store \"sharded:?shard=<url>&shard=<url>\"`")
+)
+
+// NewRebalanceCmd represents the CLI command for moving keys to their shard after shards were added or removed
+func NewRebalanceCmd() *cobra.Command {
+	opts := store.RebalanceOptions{}
+	var retire []string
+
+	rebalanceCmd := &cobra.Command{
+		Use:   "rebalance",
+		Short: "Moves keys to their shard after shards were added to or removed from a sharded store",
+		Long: `The 'rebalance' command moves every key of a sharded store that isn't on the shard owning it to that shard.
+
+Keys are placed on shards by consistent hashing, so adding a shard only moves the keys it takes over from the others.
+Add a shard to the store url with 'vault init', then run a rebalance to move its keys over. To remove a shard, drop it
+from the store url, and pass it to --retire so all its keys are moved to the remaining shards.
+
+Keys are copied before they are deleted from their old shard, so an interrupted rebalance can be run again.
+
+Examples:
+Count the keys to move without moving them:
+  vault rebalance --dry-run
+
+Move keys after adding a shard:
+  vault init --store "sharded:?shard=redis://a:6379&shard=redis://b:6379&shard=redis://c:6379"
+  vault rebalance
+
+Drain a removed shard:
+  vault init --store "sharded:?shard=redis://a:6379&shard=redis://b:6379"
+  vault rebalance --retire redis://c:6379`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithStore(cmd, "Rebalance failed:", func(ctx context.Context, s store.Store) error {
+				sharded, ok := s.(*store.Sharded)
+				if !ok {
+					return ErrNotSharded
+				}
+				retired, err := helper.OpenShards(ctx, retire)
+				if err != nil {
+					return err
+				}
+				for _, shard := range retired {
+					if b, err := shard.Store.Connect(ctx); err != nil || !b {
+						return fmt.Errorf("could not connect to retired shard %s: %v", shard.Name, err)
+					}
+					defer shard.Store.Close(ctx)
+				}
+
+				reports, err := sharded.Rebalance(ctx, retired, opts)
+				if len(reports) > 0 {
+					jsonBytes, jsonErr := json.MarshalIndent(reports, "", "  ")
+					if jsonErr == nil {
+						fmt.Println(string(jsonBytes))
+					}
+				}
+				return err
+			})
+		},
+	}
+
+	rebalanceCmd.Flags().StringArrayVar(&retire, FlagRetire, nil, "url of a shard removed from the store, to move all its keys off. may be repeated")
+	rebalanceCmd.Flags().BoolVar(&opts.DryRun, FlagDryRun, false, "count the keys to move without moving them")
+
+	return rebalanceCmd
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+)
+
+const (
+	FlagDryRun = "dry-run"
+)
+
+var (
+	ErrNoReplicas = errors.New("the store has no replicas. add some with `vault init --replica`")
+)
+
+// NewReconcileCmd represents the CLI command for repairing the drift between the store and its replicas
+func NewReconcileCmd() *cobra.Command {
+	opts := store.ReconcileOptions{}
+
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Repairs the drift between the store and its replicas",
+		Long: `The 'reconcile' command compares every replica set up with 'vault init --replica' with the store, and repairs it so it holds exactly the records of the store:
+records missing from the replica or holding another value are copied over, and records the store doesn't have are deleted.
+
+Replicas drift when writes can't be mirrored to them, for instance while they are unreachable or when their queue overflows in async mode.
+
+Examples:
+Report the drift without repairing it:
+  vault reconcile --dry-run
+
+Repair every replica:
+  vault reconcile`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithStore(cmd, "Reconcile failed:", func(ctx context.Context, s store.Store) error {
+				replicated, ok := s.(*store.Replicated)
+				if !ok {
+					return ErrNoReplicas
+				}
+				reports, err := replicated.Reconcile(ctx, opts)
+				if len(reports) > 0 {
+					jsonBytes, jsonErr := json.MarshalIndent(reports, "", "  ")
+					if jsonErr == nil {
+						fmt.Println(string(jsonBytes))
+					}
+				}
+				return err
+			})
+		},
+	}
+
+	reconcileCmd.Flags().BoolVar(&opts.DryRun, FlagDryRun, false, "report the drift of every replica without repairing it")
+
+	return reconcileCmd
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/snapshot"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/dark-enstein/vault/vaught/cmd/backup"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+const (
+	FlagPassphraseFile = backup.FlagPassphraseFile
+	FlagIdentity       = backup.FlagIdentity
+	FlagReplace        = "replace"
+	FlagAcceptTampered = "accept-tampered"
+	FlagTo             = "to"
+)
+
+type RestoreOptions struct {
+	snapshot       string
+	passphraseFile string
+	identity       string
+	replace        bool
+	acceptTampered bool
+	to             string
+}
+
+// NewRestoreCmd represents the CLI command for restoring the vault from an encrypted snapshot
+func NewRestoreCmd() *cobra.Command {
+
+	rop := &RestoreOptions{}
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <snapshot>",
+		Short: "Restores the vault from an encrypted snapshot",
+		Long: `The 'restore' command decrypts a snapshot written by 'vault backup', verifies its checksums, and restores its records and keyring.
+Records are restored into the storage backend of the CLI config, or into the backend given with --to, whatever the backend the snapshot was taken from.
+
+A snapshot sealed with a passphrase is opened with --passphrase-file or the ` + backup.EnvPassphrase + ` environment variable.
+A snapshot sealed to a recipient key is opened with the matching --identity file.
+
+Restoring into a store that already holds tokens generated with a different keyring is refused, unless --replace is set.
+--replace replaces every record of the destination store with those of the snapshot, in a single batch.
+
+The records of the snapshot are verified before they are restored, and so are those of the destination store they are
+merged into without --replace. Tokens changed outside the vault fail the restore: run 'vault verify' to review them,
+and --accept-tampered to restore them anyway.
+
+Examples:
+  VAULT_BACKUP_PASSPHRASE=... vault restore snapshot.vbk
+  vault restore snapshot.vbk --identity ~/.vault/backup.key --to redis://localhost:6379 --replace`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, err := cmd.Flags().GetBool("debug")
+			if err != nil {
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+			}
+
+			ctx := context.Background()
+			logger := vlog.New(debug)
+			rop.snapshot = args[0]
+
+			bytes, err := rop.Run(ctx, logger)
+			if len(bytes) > 0 {
+				fmt.Println(string(bytes))
+			}
+			if err != nil {
+				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
+					fmt.Println("config empty run `vault init` first, or restore into a store given with --to. see more by running `vault restore --help`")
+				} else {
+					fmt.Println("Restore failed:", err)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	restoreCmd.Flags().StringVar(&rop.passphraseFile, FlagPassphraseFile, "", "specify a file holding the backup passphrase")
+	restoreCmd.Flags().StringVar(&rop.identity, FlagIdentity, "", "specify the identity file matching the recipient key the snapshot was sealed to")
+	restoreCmd.Flags().BoolVar(&rop.replace, FlagReplace, false, "replace the records and keyring of the destination store")
+	restoreCmd.Flags().BoolVar(&rop.acceptTampered, FlagAcceptTampered, false, "restore the records even if they were changed outside the vault, resealing them as they are")
+	restoreCmd.Flags().StringVar(&rop.to, FlagTo, "", "specify the destination storage backend, e.g. redis://localhost:6379. defaults to the store of the CLI config")
+	restoreCmd.MarkFlagsMutuallyExclusive(FlagPassphraseFile, FlagIdentity)
+
+	return restoreCmd
+}
+
+func (rop *RestoreOptions) Run(ctx context.Context, logger *vlog.Logger) ([]byte, error) {
+	keyer, err := rop.keyer()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(rop.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manager, err := rop.manager(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := manager.Restore(ctx, f, keyer, tokenize.RestoreOptions{Replace: rop.replace, AcceptTampered: rop.acceptTampered})
+	if err != nil {
+		return nil, err
+	}
+	logger.Logger().Info().Msgf("Restored snapshot %s", rop.snapshot)
+
+	return json.MarshalIndent(report, "", "  ")
+}
+
+func (rop *RestoreOptions) keyer() (snapshot.Keyer, error) {
+	if len(rop.identity) > 0 {
+		return snapshot.LoadIdentity(rop.identity)
+	}
+	return backup.Passphrase(rop.passphraseFile)
+}
+
+// manager returns a token manager over the destination store
+func (rop *RestoreOptions) manager(ctx context.Context, logger *vlog.Logger) (*tokenize.Manager, error) {
+	if len(rop.to) == 0 {
+		ic := helper.NewInstanceConfig()
+		if err := ic.JsonDecode(); err != nil {
+			return nil, err
+		}
+		return ic.Manager(ctx)
+	}
+
+	su, err := helper.ParseStoreURL(rop.to)
+	if err != nil {
+		return nil, err
+	}
+	s, err := su.Store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tokenize.NewManager(ctx, logger, tokenize.WithStore(s)), nil
+}
@@ -5,20 +5,39 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/dark-enstein/vault/vaught/cmd/backup"
 	del "github.com/dark-enstein/vault/vaught/cmd/delete"
+	"github.com/dark-enstein/vault/vaught/cmd/exporter"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/dark-enstein/vault/vaught/cmd/importer"
 	"github.com/dark-enstein/vault/vaught/cmd/initer"
 	"github.com/dark-enstein/vault/vaught/cmd/list"
+	"github.com/dark-enstein/vault/vaught/cmd/meta"
+	"github.com/dark-enstein/vault/vaught/cmd/migrate"
+	"github.com/dark-enstein/vault/vaught/cmd/namespace"
+	"github.com/dark-enstein/vault/vaught/cmd/operator"
 	"github.com/dark-enstein/vault/vaught/cmd/peek"
 	"github.com/dark-enstein/vault/vaught/cmd/peel"
+	"github.com/dark-enstein/vault/vaught/cmd/purge"
+	"github.com/dark-enstein/vault/vaught/cmd/rebalance"
+	"github.com/dark-enstein/vault/vaught/cmd/reconcile"
+	"github.com/dark-enstein/vault/vaught/cmd/restore"
 	"github.com/dark-enstein/vault/vaught/cmd/service"
+	"github.com/dark-enstein/vault/vaught/cmd/status"
 	"github.com/dark-enstein/vault/vaught/cmd/store"
+	"github.com/dark-enstein/vault/vaught/cmd/storeinfo"
+	"github.com/dark-enstein/vault/vaught/cmd/trash"
+	"github.com/dark-enstein/vault/vaught/cmd/undelete"
+	"github.com/dark-enstein/vault/vaught/cmd/verify"
+	"github.com/dark-enstein/vault/vaught/cmd/watch"
 	"os"
 
 	"github.com/spf13/cobra"
 )
 
 const (
-	FlagDebug = "debug"
+	FlagDebug     = "debug"
+	FlagNamespace = "namespace"
 )
 
 type RootOptions struct {
@@ -59,6 +78,34 @@ Examples:
   - List all stored tokens:
     vault list
 
+  - Move all stored tokens to another storage backend:
+    vault migrate --from gob:/path/to/.gob --to redis://localhost:6379 --switch
+
+  - Back up the whole vault into an encrypted snapshot, and restore it:
+    vault backup -o snapshot.vbk
+    vault restore snapshot.vbk
+
+  - Import secrets from a JSON, CSV or dotenv file, and export them again:
+    vault import secrets.json --on-conflict skip
+    vault export --plaintext -o secrets.csv
+
+  - Follow changes to stored tokens as they happen:
+    vault watch --prefix "myTokenID"
+
+  - Keep the secrets of a team apart from everyone else's:
+    vault namespace create payments --quota 1000
+    vault --namespace payments store --id "myTokenID" --secret <sensitive value>
+
+  - Detect tokens changed in the store outside the vault:
+    vault verify
+
+  - See how big the store of a service is, and how fast it serves:
+    vault status
+
+  - Replicate the store of services across a raft cluster, and manage its members:
+    vault service run --raft-node-id n2 --raft-addr 127.0.0.1:8202 --port 8081
+    vault operator raft join 127.0.0.1:8201 --address http://127.0.0.1:8081
+
   To run vault as a service:
     vault service run [--port <port>]
 
@@ -75,7 +122,25 @@ Use "vault [command] --help" for more information about a command.`,
 	rootCmd.AddCommand(list.NewListCmd())
 	rootCmd.AddCommand(del.NewDeleteCmd())
 	rootCmd.AddCommand(initer.NewInitCmd())
+	rootCmd.AddCommand(migrate.NewMigrateCmd())
+	rootCmd.AddCommand(backup.NewBackupCmd())
+	rootCmd.AddCommand(restore.NewRestoreCmd())
+	rootCmd.AddCommand(importer.NewImportCmd())
+	rootCmd.AddCommand(exporter.NewExportCmd())
+	rootCmd.AddCommand(watch.NewWatchCmd())
+	rootCmd.AddCommand(namespace.NewNamespaceCmd())
+	rootCmd.AddCommand(meta.NewMetaCmd())
+	rootCmd.AddCommand(undelete.NewUndeleteCmd())
+	rootCmd.AddCommand(trash.NewTrashCmd())
+	rootCmd.AddCommand(purge.NewPurgeCmd())
+	rootCmd.AddCommand(reconcile.NewReconcileCmd())
+	rootCmd.AddCommand(rebalance.NewRebalanceCmd())
+	rootCmd.AddCommand(operator.NewOperatorCmd())
+	rootCmd.AddCommand(storeinfo.NewStoreInfoCmd())
+	rootCmd.AddCommand(verify.NewVerifyCmd())
+	rootCmd.AddCommand(status.NewStatusCmd())
 	rootCmd.PersistentFlags().BoolVarP(&rop.debug, FlagDebug, "d", false, "Enable or disable debug mode.")
+	rootCmd.PersistentFlags().StringVarP(&helper.Namespace, FlagNamespace, "n", os.Getenv(helper.EnvNamespace), "Scope the command to a namespace. Defaults to $"+helper.EnvNamespace+", or the default namespace.")
 
 	return rootCmd
 }
@@ -0,0 +1,184 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/service"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	FlagAddress = "address"
+	FlagLocal   = "local"
+	FlagJSON    = "json"
+)
+
+type StatusOptions struct {
+	address string
+	local   bool
+	json    bool
+}
+
+// NewStatusCmd represents the CLI command for describing the store of a vault and the operations it served
+func NewStatusCmd() *cobra.Command {
+
+	sop := &StatusOptions{}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Describes the store of a vault service and the operations it served",
+		Long: `The 'status' command describes the store of the vault service at --address, or the address in the ` + helper.EnvAddress + ` environment
+variable: how many records it holds, the space they take, when the backend last compacted them, and the connection pool of
+stores talking to a server. The operations the service served since it started are listed with their counts, errors and
+latencies.
+
+--local describes the configured store instead, without a running service. Operations are counted by the service serving
+them, so none are listed.
+
+In a namespace, only the records of the namespace are counted.
+
+Examples:
+  vault status
+  vault status --address http://127.0.0.1:8081 --json
+  vault status --local`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if sop.local {
+				helper.RunWithManager(cmd, "Status failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+					stats, err := manager.Stats(ctx)
+					if err != nil {
+						return err
+					}
+					return sop.print(stats)
+				})
+				return
+			}
+			helper.RunWithService(sop.address, "Status failed:", func(ctx context.Context, c *helper.Client) error {
+				var stats tokenize.Stats
+				if err := c.Call(ctx, http.MethodGet, service.SysStats, nil, &stats); err != nil {
+					return err
+				}
+				return sop.print(&stats)
+			})
+		},
+	}
+
+	statusCmd.Flags().StringVar(&sop.address, FlagAddress, helper.EnvOr(helper.EnvAddress, helper.DefaultAddress), "address of the vault service to describe, as in "+helper.DefaultAddress)
+	statusCmd.Flags().BoolVar(&sop.local, FlagLocal, false, "describe the configured store instead of a running service")
+	statusCmd.Flags().BoolVar(&sop.json, FlagJSON, false, "print the stats as json")
+
+	return statusCmd
+}
+
+// print prints stats as json, or as tables
+func (sop *StatusOptions) print(stats *tokenize.Stats) error {
+	if sop.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(stats.Namespace) > 0 {
+		fmt.Fprintf(tw, "Namespace\t%s\n", stats.Namespace)
+	}
+	printStore(tw, "", stats.Store)
+	if stats.Tampered != nil {
+		fmt.Fprintf(tw, "Tampered\t%s, detected %s. run `vault verify`\n", stats.Tampered.Reason, stats.Tampered.DetectedAt.Format(time.RFC3339))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if sop.local {
+		return nil
+	}
+
+	fmt.Printf("\nOperations since %s\n", stats.Since.Format(time.RFC3339))
+	ops := make([]string, 0, len(stats.Operations))
+	for op := range stats.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Fprintln(tw, "OPERATION\tCOUNT\tERRORS\tMEAN\tMAX")
+	for _, op := range ops {
+		st := stats.Operations[op]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", op, st.Count, st.Errors, latency(st.Mean), latency(st.Max))
+	}
+	return tw.Flush()
+}
+
+// printStore prints the lines describing the store st, each name starting with indent
+func printStore(w io.Writer, indent string, st *store.StoreStats) {
+	if len(st.Driver) > 0 {
+		fmt.Fprintf(w, "%sDriver\t%s\n", indent, st.Driver)
+	}
+	fmt.Fprintf(w, "%sRecords\t%d\n", indent, st.Records)
+	fmt.Fprintf(w, "%sSize\t%s\n", indent, size(st.Bytes))
+	if st.LastCompaction != nil {
+		fmt.Fprintf(w, "%sLast compaction\t%s\n", indent, st.LastCompaction.Format(time.RFC3339))
+	}
+	if pool := st.Pool; pool != nil {
+		limit := "unlimited"
+		if pool.MaxOpen > 0 {
+			limit = fmt.Sprintf("max %d", pool.MaxOpen)
+		}
+		fmt.Fprintf(w, "%sConnections\t%d open, %d idle, %d in use, %s\n", indent, pool.Open, pool.Idle, pool.InUse, limit)
+		if pool.Hits+pool.Misses > 0 {
+			fmt.Fprintf(w, "%sPool\t%d hits, %d misses, %d timeouts\n", indent, pool.Hits, pool.Misses, pool.Timeouts)
+		}
+		if pool.Waits > 0 {
+			fmt.Fprintf(w, "%sPool waits\t%d, %s in total\n", indent, pool.Waits, pool.WaitTime)
+		}
+	}
+	if cache := st.Cache; cache != nil {
+		fmt.Fprintf(w, "%sCache\t%d entries, %.1f%% hits, %d evictions\n", indent, cache.Entries, cache.HitRate()*100, cache.Evictions)
+	}
+	if rs := st.Replication; rs != nil {
+		fmt.Fprintf(w, "%sReplication\t%d mirrored, %d failed, %d failovers\n", indent, rs.Mirrored, rs.Failed, rs.Failovers)
+	}
+
+	names := make([]string, 0, len(st.Shards))
+	for name := range st.Shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%sShard %s\t\n", indent, name)
+		printStore(w, indent+"  ", st.Shards[name])
+	}
+}
+
+// size formats a count of bytes in binary units
+func size(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// latency rounds d for display
+func latency(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(100 * time.Microsecond).String()
+}
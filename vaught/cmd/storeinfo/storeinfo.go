@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package storeinfo
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/store"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// formatKinds maps the drivers keeping their records in a versioned file to the kind of that file
+var formatKinds = map[string]string{
+	store.DriverFile: store.FormatFile,
+	store.DriverGob:  store.FormatGob,
+}
+
+// NewStoreInfoCmd represents the CLI command for describing the configured store and its on-disk format
+func NewStoreInfoCmd() *cobra.Command {
+
+	storeInfoCmd := &cobra.Command{
+		Use:   "store-info",
+		Short: "Describes the configured store and the format of its files",
+		Long: `The 'store-info' command prints the driver and location of the configured store and of its replicas, and for the file and gob
+stores, the format version their file is written in. Files are not opened as stores, so files written in an older format are
+reported as they are. They are upgraded the next time vault opens them, after a copy of them is kept as <file>.v<version>.bak.
+
+Example:
+  vault store-info`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithConfig(cmd, "Store info failed:", func(ctx context.Context, ic *helper.InstanceConfig) error {
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "STORE\tDRIVER\tLOCATION\tFORMAT\tBACKUPS")
+
+				driver, config, err := ic.StoreConfig()
+				if err != nil {
+					return err
+				}
+				if err = describe(tw, "primary", driver, config); err != nil {
+					return err
+				}
+				for i, raw := range ic.Replicas {
+					driver, config, err = store.ParseURL(raw)
+					if err != nil {
+						return fmt.Errorf("replica %s: %w", raw, err)
+					}
+					if err = describe(tw, fmt.Sprintf("replica %d", i+1), driver, config); err != nil {
+						return err
+					}
+				}
+				return tw.Flush()
+			})
+		},
+	}
+
+	return storeInfoCmd
+}
+
+// describe prints a line describing the store of driver and config, named name
+func describe(tw *tabwriter.Writer, name, driver string, config store.Config) error {
+	kind, ok := formatKinds[driver]
+	if !ok {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\n", name, driver, location(config.Loc))
+		return nil
+	}
+	info, err := store.ReadFormat(kind, config.Loc)
+	if err != nil {
+		return fmt.Errorf("error while reading the format of %s: %w", config.Loc, err)
+	}
+	format := fmt.Sprintf("v%d", info.Version)
+	if info.Version < info.Current {
+		format += fmt.Sprintf(" (upgraded to v%d on next use)", info.Current)
+	}
+	backups := "-"
+	if len(info.Backups) > 0 {
+		backups = strings.Join(info.Backups, ", ")
+	}
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, driver, info.Path, format, backups)
+	return nil
+}
+
+// location returns loc with any password redacted. Locations that aren't urls may hold credentials elsewhere, as
+// connection strings do, and aren't printed.
+func location(loc string) string {
+	u, err := url.Parse(loc)
+	if err != nil || len(u.Scheme) == 0 {
+		return "-"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package trash
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// NewTrashCmd represents the CLI command for inspecting the trash
+func NewTrashCmd() *cobra.Command {
+
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Inspects the deleted tokens kept in the trash",
+		Long: `The 'trash' command inspects the trash. Deleted tokens are kept there until their retention runs out and they are purged,
+and can be restored with 'vault undelete' in the meantime.
+
+Examples:
+  vault trash list
+  vault undelete --id customer123/ssn
+  vault purge --id customer123/ssn`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	trashCmd.AddCommand(newListCmd())
+
+	return trashCmd
+}
+
+func newListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Lists the tokens in the trash",
+		Long: `The 'list' command lists the tokens in the trash, with when and by whom they were deleted, and when they are due to be purged.
+
+Example:
+  vault trash list`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Trash listing failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				trashed, err := manager.ListTrash(ctx)
+				if err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "ID\tDELETED\tDELETED BY\tPURGE AFTER")
+				for _, t := range trashed {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.DeletedAt.Format(time.RFC3339), t.DeletedBy, t.PurgeAt.Format(time.RFC3339))
+				}
+				return tw.Flush()
+			})
+		},
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package undelete
+
+import (
+	"context"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+)
+
+// NewUndeleteCmd represents the CLI command for restoring a deleted token from the trash
+func NewUndeleteCmd() *cobra.Command {
+	var id string
+
+	undeleteCmd := &cobra.Command{
+		Use:   "undelete",
+		Short: "Restores a deleted token from the trash",
+		Long: `The 'undelete' command moves a deleted token back from the trash, with its metadata, as long as it hasn't been purged.
+It fails if a token with the same ID was stored since; delete that one first.
+
+Example:
+  vault undelete --id customer123/ssn`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Undelete failed:", func(ctx context.Context, manager *tokenize.Manager) error {
+				if err := manager.UndeleteTokenByID(ctx, id); err != nil {
+					return err
+				}
+				fmt.Println("Restored", id, "from the trash")
+				return nil
+			})
+		},
+	}
+
+	undeleteCmd.Flags().StringVarP(&id, "id", "i", "", "specify the ID of the token to restore")
+	undeleteCmd.MarkFlagRequired("id")
+
+	return undeleteCmd
+}
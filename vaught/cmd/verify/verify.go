@@ -0,0 +1,136 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/internal/tokenize"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+const (
+	FlagReseal = "reseal"
+	FlagJSON   = "json"
+)
+
+var (
+	ErrTampered = errors.New("tokens were changed outside the vault")
+)
+
+type VerifyOptions struct {
+	reseal bool
+	json   bool
+}
+
+// NewVerifyCmd represents the CLI command for detecting tokens changed outside the vault
+func NewVerifyCmd() *cobra.Command {
+
+	vop := &VerifyOptions{}
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Detects tokens changed outside the vault",
+		Long: `The 'verify' command checks every token against the MAC the vault keeps of it, and the Merkle tree of the MACs against its
+root, signed with a key derived from the cipher. Every write made through the vault updates both. Tokens stored, deleted or changed in the store
+directly, as anyone with access to a Redis server can, are listed as added, removed or modified, and the command fails.
+
+A token deleted along with its MAC, or rolled back to an older version along with it, only shows as a root that doesn't
+match: the vault knows the store was tampered with, but not which keys were. A write finding the root tampered with
+records it, and the vault keeps writing without sealing its writes until it is resealed.
+
+Tokens stored before the vault kept MACs are sealed as they are the first time the vault starts over the store. Once
+the changes are reviewed, --reseal accepts the store as it is.
+The default namespace is verified with every namespace, unless --namespace is passed.
+
+Examples:
+  vault verify
+  vault verify --json
+  vault verify --reseal`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			helper.RunWithManager(cmd, "Verify failed:", vop.Run)
+		},
+	}
+
+	verifyCmd.Flags().BoolVar(&vop.reseal, FlagReseal, false, "accept the tokens as they are stored, sealing them again before verifying")
+	verifyCmd.Flags().BoolVar(&vop.json, FlagJSON, false, "print the reports as json")
+
+	return verifyCmd
+}
+
+func (vop *VerifyOptions) Run(ctx context.Context, manager *tokenize.Manager) error {
+	if vop.reseal {
+		if err := manager.Reseal(ctx); err != nil {
+			return err
+		}
+		fmt.Println("Resealed the tokens as they are stored")
+	}
+
+	reports, err := manager.Verify(ctx)
+	if err != nil {
+		return err
+	}
+
+	tampered := false
+	for _, report := range reports {
+		tampered = tampered || report.Tampered
+	}
+	if vop.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, report := range reports {
+			printReport(report)
+		}
+	}
+
+	if tampered {
+		return ErrTampered
+	}
+	return nil
+}
+
+// printReport prints the outcome of verifying a keyspace
+func printReport(report *tokenize.VerifyReport) {
+	name := report.Namespace
+	if len(name) == 0 {
+		name = tokenize.DefaultNamespace
+	}
+	sealed := "never sealed"
+	if report.Sealed {
+		sealed = "sealed " + report.SealedAt.Format(time.RFC3339)
+	}
+	status := "ok"
+	if report.Tampered {
+		status = "TAMPERED"
+	}
+	fmt.Printf("%s: %s, %d tokens checked, %s\n", name, status, report.Checked, sealed)
+	for _, key := range report.Added {
+		fmt.Printf("  added     %s\n", key)
+	}
+	for _, key := range report.Removed {
+		fmt.Printf("  removed   %s\n", key)
+	}
+	for _, key := range report.Modified {
+		fmt.Printf("  modified  %s\n", key)
+	}
+	if !report.RootValid {
+		fmt.Println("  root      doesn't match the MACs: tokens were deleted or rolled back along with their MAC")
+	}
+	if report.Detected != nil {
+		fmt.Printf("  detected  %s, %s. writes since aren't sealed\n", report.Detected.DetectedAt.Format(time.RFC3339), report.Detected.Reason)
+	}
+	if !report.Sealed && len(report.Added) > 0 {
+		fmt.Println("  the tokens were stored before the vault sealed them. review them, and run `vault verify --reseal` to accept them")
+	}
+}
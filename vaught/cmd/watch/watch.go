@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Ayobami Bamigboye <ayo@greystein.com>
+*/
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dark-enstein/vault/pkg/vlog"
+	"github.com/dark-enstein/vault/vaught/cmd/helper"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	FlagPrefix = "prefix"
+)
+
+type WatchOptions struct {
+	prefix string
+}
+
+// NewWatchCmd represents the CLI command for following changes to stored tokens
+func NewWatchCmd() *cobra.Command {
+
+	wop := &WatchOptions{}
+
+	watchCmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Prints changes to stored tokens as they happen",
+		Long: `The 'watch' command follows the configured store, and prints a json line for every token that is created, updated or deleted, until interrupted.
+Only keys are printed, never token values. Changes made by other processes are seen for the file, gob and redis stores.
+
+Redis stores rely on keyspace notifications, which 'vault watch' tries to enable. If the server refuses, set notify-keyspace-events to include Kg$xe.
+
+Examples:
+  vault watch
+  vault watch --prefix customer123`,
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, err := cmd.Flags().GetBool("debug")
+			if err != nil {
+				log.Error().Msgf("error retrieving persistent flag: %s: %s", "debug", err)
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			logger := vlog.New(debug)
+
+			if err = wop.Run(ctx, logger); err != nil {
+				if errors.Is(err, helper.ErrConfigEmpty) || errors.Is(err, helper.ErrStoreTypeEmpty) {
+					fmt.Println("config empty run `vault init` first. see more by running `vault init --help`")
+				} else {
+					fmt.Println("Watch failed:", err)
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	watchCmd.Flags().StringVarP(&wop.prefix, FlagPrefix, "p", "", "only print changes to keys starting with this prefix")
+
+	return watchCmd
+}
+
+func (wop *WatchOptions) Run(ctx context.Context, logger *vlog.Logger) error {
+	ic := helper.NewInstanceConfig()
+	if err := ic.JsonDecode(); err != nil {
+		return err
+	}
+
+	manager, err := ic.Manager(ctx)
+	if err != nil {
+		return err
+	}
+
+	events, err := manager.Watch(ctx, wop.prefix)
+	if err != nil {
+		return err
+	}
+	logger.Logger().Info().Msgf("Watching for changes to keys starting with %q", wop.prefix)
+
+	enc := json.NewEncoder(os.Stdout)
+	for event := range events {
+		if err = enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	// the stream only ends on its own when the watch failed or fell behind
+	if ctx.Err() == nil {
+		return errors.New("watch stream ended unexpectedly")
+	}
+	return nil
+}